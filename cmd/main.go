@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
 	"github.com/aemakeye/circuit_calculator/internal/config"
+	"github.com/aemakeye/circuit_calculator/internal/handlers/archive"
+	"github.com/aemakeye/circuit_calculator/internal/handlers/diff"
+	"github.com/aemakeye/circuit_calculator/internal/handlers/export"
+	"github.com/aemakeye/circuit_calculator/internal/handlers/graph"
+	"github.com/aemakeye/circuit_calculator/internal/handlers/netlist"
+	"github.com/aemakeye/circuit_calculator/internal/handlers/render"
 	"github.com/aemakeye/circuit_calculator/internal/handlers/storage"
+	"github.com/aemakeye/circuit_calculator/internal/neo4j"
 	"github.com/aemakeye/circuit_calculator/internal/shutdown"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -38,19 +47,130 @@ func main() {
 		)
 	}
 
+	// "migrate" command applies graph schema migrations and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(logger, newNeo4j(logger, cfg))
+		return
+	}
+
+	gstorage := cfg.Graph
+	if gstorage == nil {
+		ctrl := newNeo4j(logger, cfg)
+		if cfg.Neo4j.Migrate {
+			migrate(logger, ctrl)
+		}
+		gstorage = ctrl
+	}
+
+	calc, err := calculator.NewCalculator(logger, cfg.DiagramSvc, gstorage, cfg.Storage)
+	if err != nil {
+		logger.Fatal("error instantiating calculator",
+			zap.Error(err),
+		)
+	}
+
+	calc.Validation = cfg.Validation
+
+	go purgeTrash(logger, calc, cfg.TrashRetention)
+
 	router := chi.NewRouter()
 	router.Use(middleware.Logger)
 
 	storageHandler := storage.Handler{
+		Logger:        logger,
+		Storage:       cfg.Storage,
+		Calculator:    calc,
+		MaxUploadSize: cfg.MaxUploadSize,
+		PresignExpiry: cfg.PresignExpiry,
+		PresignSecret: []byte(cfg.PresignSecret),
+	}
+
+	renderHandler := render.Handler{
 		Logger:  logger,
 		Storage: cfg.Storage,
 	}
 
-	storageHandler.Register(router)
+	exportHandler := export.Handler{
+		Logger:     logger,
+		Calculator: calc,
+	}
+
+	netlistHandler := netlist.Handler{
+		Logger:     logger,
+		Calculator: calc,
+	}
+
+	graphHandler := graph.Handler{
+		Logger:     logger,
+		Calculator: calc,
+	}
+
+	// archived documents are bound like uploaded ones
+	maxFileSize := cfg.MaxUploadSize
+	if maxFileSize == 0 {
+		maxFileSize = storage.DefaultMaxUploadSize
+	}
+	archiveHandler := archive.Handler{
+		Logger:      logger,
+		Calculator:  calc,
+		MaxFileSize: maxFileSize,
+	}
+
+	diffHandler := diff.Handler{
+		Logger:     logger,
+		Calculator: calc,
+	}
+
+	// every handler brings its own middlewares, keep them in separate groups
+	router.Group(storageHandler.Register)
+	router.Group(renderHandler.Register)
+	router.Group(exportHandler.Register)
+	router.Group(netlistHandler.Register)
+	router.Group(graphHandler.Register)
+	router.Group(diffHandler.Register)
+	router.Group(archiveHandler.Register)
 
 	start(router, logger, cfg)
 }
 
+func newNeo4j(logger *zap.Logger, cfg *config.CConfig) *neo4j.Controller {
+	ctrl, err := neo4j.NewController(logger, cfg.Neo4j.Endpoint, cfg.Neo4j.User, cfg.Neo4j.Password)
+	if err != nil {
+		logger.Fatal("error instantiating neo4j controller",
+			zap.Error(err),
+		)
+	}
+	ctrl.BatchSize = cfg.Neo4j.BatchSize
+	return ctrl
+}
+
+func migrate(logger *zap.Logger, ctrl *neo4j.Controller) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	applied, err := ctrl.Migrate(ctx, logger)
+	if err != nil {
+		logger.Fatal("could not migrate graph schema",
+			zap.Int("applied", len(applied)),
+			zap.Error(err),
+		)
+	}
+}
+
+// purgeTrash removes diagrams which stayed in trash longer than retention, trash is checked every hour
+func purgeTrash(logger *zap.Logger, calc *calculator.Calculator, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		if _, err := calc.PurgeTrash(ctx, time.Now().Add(-retention)); err != nil {
+			logger.Error("could not purge trash",
+				zap.Error(err),
+			)
+		}
+		cancel()
+	}
+}
+
 func start(router chi.Router, logger *zap.Logger, cfg *config.CConfig) {
 	var server *http.Server
 	var listener net.Listener
@@ -68,10 +188,12 @@ func start(router chi.Router, logger *zap.Logger, cfg *config.CConfig) {
 	}
 
 	server = &http.Server{
-		Addr:         cfg.Listen.String(),
-		Handler:      router,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+		Addr:    cfg.Listen.String(),
+		Handler: router,
+		// headers are read quickly, bodies of uploads and archives may take minutes
+		ReadHeaderTimeout: 15 * time.Second,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
 	}
 
 	go shutdown.Graceful(logger,
@@ -0,0 +1,352 @@
+package calculator
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
+	"go.uber.org/zap"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Archive layout: manifest.json describes the project, latest versions of documents are kept
+// as files/<path>, all their versions as versions/<path>/<version> and netlists as netlists/<path>.json
+const (
+	ManifestName    = "manifest.json"
+	archiveFiles    = "files/"
+	archiveVersions = "versions/"
+	archiveNetlists = "netlists/"
+)
+
+// Import statuses of archived documents
+const (
+	ImportCreated  = "created"
+	ImportConflict = "conflict"
+	ImportFailed   = "failed"
+)
+
+// ArchiveOptions select content of the project archive
+type ArchiveOptions struct {
+	// History adds every version of documents, only the latest versions are added otherwise
+	History bool
+	// Netlists adds netlists built from the latest versions of diagrams
+	Netlists bool
+}
+
+// Manifest describes the project archive
+type Manifest struct {
+	Project  string         `json:"project"`
+	Created  time.Time      `json:"created"`
+	History  bool           `json:"history"`
+	Netlists bool           `json:"netlists"`
+	Files    []ArchivedFile `json:"files"`
+}
+
+// ArchivedFile is a document of the archived project
+type ArchivedFile struct {
+	Path string `json:"path"`
+	// Versions are the latest version only, or all versions with ArchiveOptions.History, the latest first
+	Versions []FileInfo `json:"versions"`
+	// Netlist is the archive entry of the netlist, NetlistError is set when the document is not a diagram
+	Netlist      string `json:"netlist,omitempty"`
+	NetlistError string `json:"netlistError,omitempty"`
+}
+
+// ImportOptions describe import of the project archive
+type ImportOptions struct {
+	// Project the documents are imported to, project of the archive when empty
+	Project string
+	// Overwrite uploads documents existing in the project as their new versions, they are conflicts otherwise
+	Overwrite bool
+	// MaxFileSize bounds uncompressed size of archived documents, 0 means no limit
+	MaxFileSize int64
+}
+
+// ImportReport tells what happened to every archived document
+type ImportReport struct {
+	Project string         `json:"project"`
+	Files   []ImportedFile `json:"files"`
+}
+
+// ImportedFile is the import result of a single document. Current is the existing version of a conflicting
+// document, UUID and DiagramVersion tell where the imported diagram was ingested to.
+type ImportedFile struct {
+	Path           string    `json:"path"`
+	Status         string    `json:"status"`
+	Version        string    `json:"version,omitempty"`
+	Current        *FileInfo `json:"current,omitempty"`
+	UUID           string    `json:"uuid,omitempty"`
+	DiagramVersion int       `json:"diagramVersion,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	IngestError    string    `json:"ingestError,omitempty"`
+}
+
+// ExportProject writes zip archive of the project documents to w, ErrNotFound is returned before anything
+// is written when the project has no documents
+func (c *Calculator) ExportProject(ctx context.Context, w io.Writer, project string, opts ArchiveOptions) (*Manifest, error) {
+	paths, err := c.documents(ctx, project+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("project %s: %w", project, ErrNotFound)
+	}
+
+	manifest := &Manifest{
+		Project:  project,
+		Created:  time.Now().UTC(),
+		History:  opts.History,
+		Netlists: opts.Netlists,
+		Files:    []ArchivedFile{},
+	}
+	zw := zip.NewWriter(w)
+	for _, p := range paths {
+		file, err := c.archiveFile(ctx, zw, p, opts)
+		if errors.Is(err, ErrNotFound) {
+			// deleted while archiving
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, *file)
+	}
+
+	entry, err := zw.Create(ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(entry)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(manifest); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	c.Logger.Info("project exported",
+		zap.String("project", project),
+		zap.Int("files", len(manifest.Files)),
+		zap.Bool("history", opts.History),
+	)
+	return manifest, nil
+}
+
+// archiveFile adds the document to the archive
+func (c *Calculator) archiveFile(ctx context.Context, zw *zip.Writer, p string, opts ArchiveOptions) (*ArchivedFile, error) {
+	latest, err := c.TextStorage.StatFile(ctx, c.Logger, p, "")
+	if err != nil {
+		return nil, err
+	}
+	file := &ArchivedFile{Path: p, Versions: []FileInfo{*latest}}
+	if err = c.archiveVersion(ctx, zw, archiveFiles+p, latest); err != nil {
+		return nil, err
+	}
+
+	if opts.History {
+		ids, err := c.TextStorage.LsVersions(ctx, p, c.Logger)
+		if err != nil {
+			return nil, err
+		}
+		file.Versions = file.Versions[:0]
+		for id := range ids {
+			info, err := c.TextStorage.StatFile(ctx, c.Logger, p, id)
+			if err != nil {
+				return nil, err
+			}
+			if err = c.archiveVersion(ctx, zw, archiveVersions+p+"/"+id, info); err != nil {
+				return nil, err
+			}
+			file.Versions = append(file.Versions, *info)
+		}
+	}
+
+	if opts.Netlists {
+		n, err := c.fileNetlist(ctx, p, latest.Version)
+		if err != nil {
+			file.NetlistError = err.Error()
+			return file, nil
+		}
+		file.Netlist = archiveNetlists + p + ".json"
+		entry, err := zw.Create(file.Netlist)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.NewEncoder(entry).Encode(n); err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// archiveVersion copies content of the document version to the archive entry
+func (c *Calculator) archiveVersion(ctx context.Context, zw *zip.Writer, name string, info *FileInfo) error {
+	r, err := c.TextStorage.LoadFileByName(ctx, c.Logger, info.Path, info.Version)
+	if err != nil {
+		return err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.LastModified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, r)
+	return err
+}
+
+func (c *Calculator) fileNetlist(ctx context.Context, p string, version string) (*netlist.Netlist, error) {
+	r, err := c.TextStorage.LoadFileByName(ctx, c.Logger, p, version)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	uuid, items, err := c.ParseItems(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return netlist.FromItems(uuid, items), nil
+}
+
+// ImportProject uploads documents of the archive, with their history when it is archived, and ingests
+// the latest versions to graph storage. Documents existing in the project are conflicts unless
+// opts.Overwrite is set. Failures of single documents are reported, an error is returned when the archive
+// could not be read.
+func (c *Calculator) ImportProject(ctx context.Context, archive *zip.Reader, opts ImportOptions) (*ImportReport, error) {
+	entries := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		entries[f.Name] = f
+	}
+	mf, ok := entries[ManifestName]
+	if !ok {
+		return nil, fmt.Errorf("archive has no %s", ManifestName)
+	}
+	rc, err := mf.Open()
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	err = json.NewDecoder(rc).Decode(&manifest)
+	_ = rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: %w", ManifestName, err)
+	}
+	if !validArchivePath(manifest.Project) || strings.Contains(manifest.Project, "/") {
+		return nil, fmt.Errorf("bad project %q in %s", manifest.Project, ManifestName)
+	}
+
+	project := opts.Project
+	if project == "" {
+		project = manifest.Project
+	}
+	report := &ImportReport{Project: project, Files: []ImportedFile{}}
+	for _, file := range manifest.Files {
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Files = append(report.Files, c.importFile(ctx, entries, manifest, file, project, opts))
+	}
+	c.Logger.Info("project imported",
+		zap.String("project", project),
+		zap.Int("files", len(report.Files)),
+	)
+	return report, nil
+}
+
+// importFile uploads versions of the archived document oldest first and ingests the latest one
+func (c *Calculator) importFile(ctx context.Context, entries map[string]*zip.File, manifest Manifest, file ArchivedFile,
+	project string, opts ImportOptions) ImportedFile {
+	rel := strings.TrimPrefix(file.Path, manifest.Project+"/")
+	result := ImportedFile{Path: project + "/" + rel}
+	fail := func(err error) ImportedFile {
+		result.Status = ImportFailed
+		result.Error = err.Error()
+		return result
+	}
+	if rel == file.Path || !validArchivePath(rel) || len(file.Versions) == 0 {
+		return fail(fmt.Errorf("bad archived path %q", file.Path))
+	}
+
+	// entries are checked before anything is uploaded, so a document is not imported partially
+	var versions []*zip.File
+	var infos []FileInfo
+	if manifest.History {
+		for i := len(file.Versions) - 1; i >= 0; i-- {
+			versions = append(versions, entries[archiveVersions+file.Path+"/"+file.Versions[i].Version])
+			infos = append(infos, file.Versions[i])
+		}
+	} else {
+		versions = append(versions, entries[archiveFiles+file.Path])
+		infos = append(infos, file.Versions[0])
+	}
+	for i, entry := range versions {
+		if entry == nil {
+			return fail(fmt.Errorf("version %s is not in the archive", infos[i].Version))
+		}
+		if opts.MaxFileSize > 0 && entry.UncompressedSize64 > uint64(opts.MaxFileSize) {
+			return fail(fmt.Errorf("version %s is larger than %d bytes", infos[i].Version, opts.MaxFileSize))
+		}
+	}
+
+	for i, entry := range versions {
+		upload := UploadOptions{
+			Uploader:    infos[i].Uploader,
+			Checksum:    infos[i].Checksum,
+			IfNoneMatch: i == 0 && !opts.Overwrite,
+		}
+		if infos[i].Metadata != nil {
+			upload.Metadata = *infos[i].Metadata
+		}
+		info, err := c.importVersion(ctx, entry, result.Path, upload)
+		var perr *PreconditionError
+		if errors.As(err, &perr) {
+			result.Status = ImportConflict
+			result.Current = perr.Current
+			return result
+		}
+		if err != nil {
+			return fail(err)
+		}
+		result.Version = info.Version
+	}
+	result.Status = ImportCreated
+
+	uuid, summary, err := c.IngestFile(ctx, result.Path, result.Version)
+	if err != nil {
+		result.IngestError = err.Error()
+		return result
+	}
+	result.UUID = uuid
+	result.DiagramVersion = summary.Versions[uuid]
+	return result
+}
+
+func (c *Calculator) importVersion(ctx context.Context, entry *zip.File, p string, opts UploadOptions) (*FileInfo, error) {
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return c.TextStorage.UploadFile(ctx, c.Logger, rc, p, opts)
+}
+
+// validArchivePath tells whether the path from the archive stays inside the project
+func validArchivePath(p string) bool {
+	if p == "" || strings.HasPrefix(p, "/") || path.Clean(p) != p {
+		return false
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." || part == "." {
+			return false
+		}
+	}
+	return true
+}
@@ -1,33 +1,129 @@
 package calculator
 
 import (
-	"github.com/aemakeye/circuit_calculator/internal/config"
+	"bytes"
+	"context"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
 	"go.uber.org/zap"
+	"io"
 	"sync"
 )
 
 type Calculator struct {
 	Logger      *zap.Logger
-	Config      *config.CConfig
 	Gstorage    GraphStorage
 	TextStorage ObjectStorage
 	DiagramSvc  DiagramProcessor
+	// Validation is the policy of uploaded documents, see Inspector
+	Validation Validation
 }
 
 var instance *Calculator
 var once sync.Once
 
-func NewCalculator(logger *zap.Logger, config *config.CConfig, gs GraphStorage, os ObjectStorage) (*Calculator, error) {
+func NewCalculator(logger *zap.Logger, dp DiagramProcessor, gs GraphStorage, os ObjectStorage) (*Calculator, error) {
 	once.Do(func() {
 		logger.Info("creating Calculator instance")
 		instance = &Calculator{
 			Logger:      logger,
-			Config:      config,
 			Gstorage:    gs,
 			TextStorage: os,
-			DiagramSvc:  config.DiagramSvc,
+			DiagramSvc:  dp,
 		}
 	})
 
 	return instance, nil
 }
+
+// ParseItems reads diagram document and collects its items
+func (c *Calculator) ParseItems(ctx context.Context, r io.Reader) (uuid string, items []drawio.Item, err error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ch := make(chan drawio.Item)
+	done := make(chan struct{})
+	go func() {
+		for item := range ch {
+			items = append(items, item)
+		}
+		close(done)
+	}()
+
+	uuid, err = c.DiagramSvc.XmlToItems(ctx, c.Logger, bytes.NewReader(body), ch)
+	close(ch)
+	<-done
+	if err != nil {
+		return "", nil, err
+	}
+	return uuid, items, nil
+}
+
+// StoreItems pushes items to graph storage, storage stops when ctx is cancelled
+func (c *Calculator) StoreItems(ctx context.Context, opts PushOptions, items []drawio.Item) (PushSummary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan drawio.Item)
+	go func() {
+		defer close(ch)
+		for _, item := range items {
+			select {
+			case ch <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c.Gstorage.PushItems(ctx, c.Logger, opts, ch)
+}
+
+// LoadCircuit builds circuit model of a diagram version stored in graph storage, 0 is the latest version,
+// so it can be computed without uploading the document again
+func (c *Calculator) LoadCircuit(ctx context.Context, uuid string, version int) (*netlist.Netlist, error) {
+	items, err := c.Gstorage.LoadItems(ctx, c.Logger, uuid, version)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrNotFound
+	}
+	return netlist.FromItems(uuid, items), nil
+}
+
+// FindComponents searches elements of the latest diagram versions, min and max bound element values when set.
+// Elements with values which could not be parsed or are in other units than the bounds are skipped then.
+func (c *Calculator) FindComponents(ctx context.Context, q ElementQuery, min, max *netlist.Value) ([]ElementMatch, error) {
+	if min == nil && max == nil {
+		return c.Gstorage.FindElements(ctx, c.Logger, q)
+	}
+
+	// limit applies after filtering by value
+	limit := q.Limit
+	q.Limit = 0
+	matches, err := c.Gstorage.FindElements(ctx, c.Logger, q)
+	if err != nil {
+		return nil, err
+	}
+	var found []ElementMatch
+	for _, m := range matches {
+		v, err := netlist.ParseValue(m.Item.Value, netlist.ClassUnit[m.Item.Class])
+		if err != nil {
+			continue
+		}
+		if min != nil && (v.Unit != min.Unit || v.Magnitude < min.Magnitude) {
+			continue
+		}
+		if max != nil && (v.Unit != max.Unit || v.Magnitude > max.Magnitude) {
+			continue
+		}
+		found = append(found, m)
+		if limit > 0 && len(found) == limit {
+			break
+		}
+	}
+	return found, nil
+}
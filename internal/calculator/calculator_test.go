@@ -3,6 +3,13 @@ package calculator
 //go:generate mockgen -source=calculator.go -destination=../mock/calculator.go
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"go.uber.org/zap"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -77,3 +84,163 @@ func TestCalculator_ReadInDiagram(t *testing.T) {
 	//_ =  calc
 	//_ = diagramReader
 }
+
+func TestUploadOptions_Check(t *testing.T) {
+	current := &FileInfo{Path: "test/diagram.xml", Version: "v2", ETag: "abc"}
+	for _, tc := range []struct {
+		name    string
+		opts    UploadOptions
+		current *FileInfo
+		fail    bool
+	}{
+		{name: "unconditional", opts: UploadOptions{}, current: current},
+		{name: "unconditional create", opts: UploadOptions{}},
+		{name: "match version", opts: UploadOptions{IfMatch: []string{"v1", "v2"}}, current: current},
+		{name: "match etag", opts: UploadOptions{IfMatch: []string{"abc"}}, current: current},
+		{name: "match any", opts: UploadOptions{IfMatch: []string{"*"}}, current: current},
+		{name: "stale version", opts: UploadOptions{IfMatch: []string{"v1"}}, current: current, fail: true},
+		{name: "match missing file", opts: UploadOptions{IfMatch: []string{"*"}}, fail: true},
+		{name: "create", opts: UploadOptions{IfNoneMatch: true}},
+		{name: "create existing", opts: UploadOptions{IfNoneMatch: true}, current: current, fail: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.opts.Check(tc.current)
+			if !tc.fail {
+				if err != nil {
+					t.Errorf("unexpected error %s", err)
+				}
+				return
+			}
+			var perr *PreconditionError
+			if !errors.As(err, &perr) || !errors.Is(err, ErrPrecondition) {
+				t.Fatalf("PreconditionError expected, got %v", err)
+			}
+			if perr.Current != tc.current {
+				t.Errorf("current version %v expected, got %v", tc.current, perr.Current)
+			}
+		})
+	}
+}
+
+func TestNewFileMetadata(t *testing.T) {
+	meta, err := NewFileMetadata(" alice ", "", []string{"power", " Power", "", "draft "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Author != "alice" || len(meta.Tags) != 2 || meta.Tags[0] != "power" || meta.Tags[1] != "draft" {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+	if !meta.HasTags("DRAFT", "power") || meta.HasTags("power", "missing") {
+		t.Errorf("tags %v are not matched", meta.Tags)
+	}
+	if !meta.Equal(&FileMetadata{Author: "alice", Tags: []string{"power", "draft"}}) || meta.Equal(nil) {
+		t.Errorf("metadata %+v is not compared", meta)
+	}
+	if !(*FileMetadata)(nil).Equal(&FileMetadata{}) {
+		t.Errorf("nil metadata is not equal to empty one")
+	}
+
+	tags := make([]string, MaxTags+1)
+	for i := range tags {
+		tags[i] = strings.Repeat("t", i+1)
+	}
+	for _, tc := range []struct {
+		description string
+		tags        []string
+	}{
+		{description: strings.Repeat("x", MaxDescriptionLength+1)},
+		{tags: []string{strings.Repeat("x", MaxTagLength+1)}},
+		{tags: tags},
+	} {
+		if _, err := NewFileMetadata("", tc.description, tc.tags); err == nil {
+			t.Errorf("metadata over the limits is accepted")
+		}
+	}
+}
+
+func TestCalculator_InspectDocument(t *testing.T) {
+	logger := zap.NewNop()
+	c := &Calculator{Logger: logger, DiagramSvc: drawio.NewController(logger)}
+	for _, tc := range []struct {
+		name     string
+		document string
+		policy   ValidationPolicy
+		reason   string
+		line     int
+		uuid     string
+	}{
+		{name: "diagram", document: string(diagram), policy: ValidationPolicy{Level: ValidationStrict}, uuid: "uweCVhkyVy6MirBnUyNJ"},
+		{name: "text", document: "notes", policy: ValidationPolicy{Level: ValidationLenient}},
+		{name: "text strict", document: "notes", policy: ValidationPolicy{Level: ValidationStrict}, reason: ReasonUnsupported},
+		{name: "svg", document: "<svg/>", policy: ValidationPolicy{Level: ValidationLenient}},
+		{name: "svg strict", document: "<svg/>", policy: ValidationPolicy{Level: ValidationStrict}, reason: ReasonUnsupported},
+		{name: "malformed", document: "<mxfile>\n<diagram>\n</mxfile>", policy: ValidationPolicy{Level: ValidationLenient},
+			reason: ReasonMalformed, line: 3},
+		{name: "malformed unchecked", document: "<mxfile>\n<diagram>\n</mxfile>", policy: ValidationPolicy{Level: ValidationNone}},
+		{name: "entities", document: "<?xml version=\"1.0\"?>\n<!DOCTYPE mxfile [<!ENTITY x SYSTEM \"file:///etc/passwd\">]>\n<mxfile>&x;</mxfile>",
+			policy: ValidationPolicy{Level: ValidationLenient}, reason: ReasonDTD, line: 2},
+		{name: "no diagram id", document: "<mxfile><diagram/></mxfile>", policy: ValidationPolicy{Level: ValidationLenient},
+			reason: ReasonNotDiagram},
+		{name: "too large", document: string(diagram), policy: ValidationPolicy{Level: ValidationNone, MaxSize: 100},
+			reason: ReasonTooLarge},
+		{name: "too many elements", document: string(diagram), policy: ValidationPolicy{Level: ValidationLenient, MaxElements: 6},
+			reason: ReasonTooManyElements},
+		{name: "elements limit", document: string(diagram), policy: ValidationPolicy{Level: ValidationLenient, MaxElements: 7},
+			uuid: "uweCVhkyVy6MirBnUyNJ"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var meta FileMetadata
+			err := c.InspectDocument(context.Background(), strings.NewReader(tc.document), tc.policy, &meta)
+			if tc.reason == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %s", err)
+				}
+				if meta.DiagramUUID != tc.uuid {
+					t.Errorf("diagram uuid %q expected, got %q", tc.uuid, meta.DiagramUUID)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) || !errors.Is(err, ErrValidation) {
+				t.Fatalf("ValidationError expected, got %v", err)
+			}
+			if verr.Reason != tc.reason || verr.Line != tc.line {
+				t.Errorf("%s at line %d expected, got %s at line %d: %s", tc.reason, tc.line, verr.Reason, verr.Line, verr.Detail)
+			}
+		})
+	}
+
+	// the document is not read past the limit
+	endless := io.MultiReader(strings.NewReader("<mxfile>"), infiniteReader{})
+	for _, level := range []string{ValidationNone, ValidationLenient} {
+		var verr *ValidationError
+		err := c.InspectDocument(context.Background(), endless, ValidationPolicy{Level: level, MaxSize: 1 << 20}, &FileMetadata{})
+		if !errors.As(err, &verr) || verr.Reason != ReasonTooLarge {
+			t.Errorf("%s: too large document expected, got %v", level, err)
+		}
+	}
+
+	var meta FileMetadata
+	if err := c.InspectDocument(context.Background(), bytes.NewReader(diagram), ValidationPolicy{}, &meta); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"resistors": 1, "inductors": 1, "capacitors": 1}
+	if meta.Editor != "65bd71144e" || len(meta.Components) != len(want) {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+	for class, n := range want {
+		if meta.Components[class] != n {
+			t.Errorf("%d %s expected, got %d", n, class, meta.Components[class])
+		}
+	}
+}
+
+// infiniteReader reads spaces forever
+type infiniteReader struct{}
+
+func (infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
@@ -0,0 +1,72 @@
+package calculator
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+)
+
+// IngestFile parses the stored document version, empty for the latest one, and pushes it to graph storage
+// as a new version of the diagram. The first segment of the path is the project, the document version
+// is kept with the diagram version.
+func (c *Calculator) IngestFile(ctx context.Context, path string, version string) (uuid string, summary PushSummary, err error) {
+	info, err := c.TextStorage.StatFile(ctx, c.Logger, path, version)
+	if err != nil {
+		return "", PushSummary{}, err
+	}
+	r, err := c.TextStorage.LoadFileByName(ctx, c.Logger, path, info.Version)
+	if err != nil {
+		return "", PushSummary{}, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	uuid, items, err := c.ParseItems(ctx, r)
+	if err != nil {
+		return "", PushSummary{}, err
+	}
+	project, _, _ := strings.Cut(path, "/")
+	summary, err = c.StoreItems(ctx, PushOptions{Project: project, Source: path, SourceVersion: info.Version}, items)
+	if err != nil {
+		return uuid, summary, err
+	}
+	c.Logger.Info("document ingested",
+		zap.String("path", path),
+		zap.String("VersionID", info.Version),
+		zap.String("uuid", uuid),
+		zap.Int("version", summary.Versions[uuid]),
+	)
+	return uuid, summary, nil
+}
+
+// RestoreFileVersion uploads the version of the document as the latest one, so history is kept
+// and the restored content gets a new version. Metadata of the version is restored too unless opts has some.
+func (c *Calculator) RestoreFileVersion(ctx context.Context, path string, version string, opts UploadOptions) (*FileInfo, error) {
+	restored, err := c.TextStorage.StatFile(ctx, c.Logger, path, version)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Metadata.IsZero() && restored.Metadata != nil {
+		opts.Metadata = *restored.Metadata
+	}
+	r, err := c.TextStorage.LoadFileByName(ctx, c.Logger, path, version)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	info, err := c.TextStorage.UploadFile(ctx, c.Logger, r, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.Logger.Info("document version restored",
+		zap.String("path", path),
+		zap.String("from", version),
+		zap.String("version", info.Version),
+	)
+	return info, nil
+}
@@ -3,25 +3,406 @@ package calculator
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/aemakeye/circuit_calculator/internal/drawio"
 	"go.uber.org/zap"
 	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 )
 
 type ObjectStorage interface {
 	ConfigDump(ctx context.Context, logger *zap.Logger) map[string]string
+	// DeleteFile hides the file, it is brought back by RestoreFile until PurgeFile removes it for good
 	DeleteFile(ctx context.Context, logger *zap.Logger, path string) error
+	// RestoreFile brings back deleted file, ErrNotFound is returned when there is nothing to restore
+	RestoreFile(ctx context.Context, logger *zap.Logger, path string) error
+	// PurgeFile removes the file with all its versions
+	PurgeFile(ctx context.Context, logger *zap.Logger, path string) error
+	// DeleteVersion hides a single version of the file, it is brought back by RestoreVersion until PurgeVersion
+	// removes it for good. The newest version left becomes the latest one, the file is deleted when none is left.
+	DeleteVersion(ctx context.Context, logger *zap.Logger, path string, version string) error
+	// RestoreVersion brings back deleted version, it is the latest one again when no newer version was uploaded.
+	// ErrNotFound is returned when the version is not deleted.
+	RestoreVersion(ctx context.Context, logger *zap.Logger, path string, version string) error
+	// PurgeVersion removes deleted version for good, ErrNotFound is returned when the version is not deleted
+	PurgeVersion(ctx context.Context, logger *zap.Logger, path string, version string) error
+	// UploadTextFile is UploadFile with no options
 	UploadTextFile(ctx context.Context, logger *zap.Logger, r io.Reader, path string) error
+	// UploadFile stores the content as a new version of the file and returns metadata of the version.
+	// PreconditionError is returned when the latest version does not meet opts. Content equal to the latest
+	// version is not stored again, the latest version is returned then.
+	UploadFile(ctx context.Context, logger *zap.Logger, r io.Reader, path string, opts UploadOptions) (*FileInfo, error)
 	LoadFileByName(ctx context.Context, logger *zap.Logger, path string, version string) (io.Reader, error)
+	// StatFile returns metadata of the latest version of the file for empty version, the given version otherwise.
+	// ErrNotFound is returned when there is no such file or version
+	StatFile(ctx context.Context, logger *zap.Logger, path string, version string) (*FileInfo, error)
 	IsVersioned(ctx context.Context) bool
-	Ls(ctx context.Context, path string) <-chan string
+	// Ls lists files and directories right under path ordered by path, directories end with a slash and have
+	// no metadata, size and time. A listing error is the last entry, its Err is set. Cancel ctx to stop
+	// listing early.
+	Ls(ctx context.Context, path string, opts LsOptions) <-chan ObjectInfo
 	LsVersions(ctx context.Context, path string, logger *zap.Logger) (<-chan string, error)
 }
 
+// Presigner is implemented by object storages clients load and upload files from directly, by short-lived URLs
+type Presigner interface {
+	// PresignGet returns URL downloading the version of the file
+	PresignGet(ctx context.Context, logger *zap.Logger, path string, version string, expiry time.Duration) (*url.URL, error)
+	// PresignPut returns URL uploading to a new staging key, the upload is stored by CommitUpload
+	PresignPut(ctx context.Context, logger *zap.Logger, expiry time.Duration) (key string, u *url.URL, err error)
+	// CommitUpload stores the content uploaded to the staging key as UploadFile does and removes the staging
+	// object. ErrNotFound is returned when nothing was uploaded to the key.
+	CommitUpload(ctx context.Context, logger *zap.Logger, key string, path string, opts UploadOptions) (*FileInfo, error)
+}
+
+// FileInfo is metadata of a stored file version
+type FileInfo struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	// ETag is unquoted entity tag of the version content
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+	ContentType  string    `json:"contentType,omitempty"`
+	// Uploader and Checksum are empty for versions uploaded without them
+	Uploader string `json:"uploader,omitempty"`
+	// Checksum is hex encoded SHA-256 of the content
+	Checksum string        `json:"checksum,omitempty"`
+	Metadata *FileMetadata `json:"metadata,omitempty"`
+}
+
+// ObjectInfo is an entry of object storage listing
+type ObjectInfo struct {
+	Path         string        `json:"path"`
+	Size         int64         `json:"size,omitempty"`
+	LastModified *time.Time    `json:"lastModified,omitempty"`
+	Metadata     *FileMetadata `json:"metadata,omitempty"`
+	// Err is set when listing failed, it is the last entry then
+	Err error `json:"-"`
+}
+
+// IsDir tells whether the entry is a directory
+func (o ObjectInfo) IsDir() bool {
+	return strings.HasSuffix(o.Path, "/")
+}
+
+// LsOptions select entries of ObjectStorage.Ls
+type LsOptions struct {
+	// Recursive lists every file under the path, directories are not listed then
+	Recursive bool
+	// StartAfter lists entries with paths greater than it only
+	StartAfter string
+}
+
+// Limits of user provided metadata, it is kept in object headers by some storages
+const (
+	MaxTags              = 16
+	MaxTagLength         = 64
+	MaxDescriptionLength = 512
+)
+
+// FileMetadata describes the document version. Author, Description and Tags are given by the uploader,
+// Editor, DiagramUUID and Components are read from the diagram.
+type FileMetadata struct {
+	Author      string   `json:"author,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Editor is the application the diagram was saved with, host attribute of mxfile
+	Editor      string `json:"editor,omitempty"`
+	DiagramUUID string `json:"diagramUuid,omitempty"`
+	// Components are numbers of diagram elements by class, connections are not counted
+	Components map[string]int `json:"components,omitempty"`
+}
+
+// NewFileMetadata returns metadata given by the uploader, tags are trimmed and repeated tags are dropped.
+// An error is returned when the metadata is over the limits.
+func NewFileMetadata(author string, description string, tags []string) (FileMetadata, error) {
+	meta := FileMetadata{Author: strings.TrimSpace(author), Description: strings.TrimSpace(description)}
+	if len(meta.Description) > MaxDescriptionLength {
+		return meta, fmt.Errorf("description is longer than %d bytes", MaxDescriptionLength)
+	}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || meta.HasTags(tag) {
+			continue
+		}
+		if len(tag) > MaxTagLength {
+			return meta, fmt.Errorf("tag %q is longer than %d bytes", tag, MaxTagLength)
+		}
+		meta.Tags = append(meta.Tags, tag)
+	}
+	if len(meta.Tags) > MaxTags {
+		return meta, fmt.Errorf("more than %d tags", MaxTags)
+	}
+	return meta, nil
+}
+
+// HasTags tells whether the metadata has every one of tags, case is ignored
+func (m *FileMetadata) HasTags(tags ...string) bool {
+	for _, tag := range tags {
+		found := false
+		if m != nil {
+			for _, t := range m.Tags {
+				if strings.EqualFold(t, tag) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// IsZero tells whether nothing is known about the document
+func (m *FileMetadata) IsZero() bool {
+	return m == nil || m.Author == "" && m.Description == "" && len(m.Tags) == 0 &&
+		m.Editor == "" && m.DiagramUUID == "" && len(m.Components) == 0
+}
+
+// Equal tells whether the metadata are the same, nil is equal to empty metadata
+func (m *FileMetadata) Equal(o *FileMetadata) bool {
+	if m.IsZero() || o.IsZero() {
+		return m.IsZero() && o.IsZero()
+	}
+	if m.Author != o.Author || m.Description != o.Description || m.Editor != o.Editor || m.DiagramUUID != o.DiagramUUID ||
+		len(m.Tags) != len(o.Tags) || len(m.Components) != len(o.Components) {
+		return false
+	}
+	for i := range m.Tags {
+		if m.Tags[i] != o.Tags[i] {
+			return false
+		}
+	}
+	for class, n := range m.Components {
+		if o.Components[class] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// UploadOptions describe the uploaded file version
+type UploadOptions struct {
+	// Uploader is the name of the user uploading the file, empty when unknown
+	Uploader string
+	// IfMatch are versions or ETags, one of them must be the latest version of the file, "*" matches any version
+	IfMatch []string
+	// IfNoneMatch allows creating the file only
+	IfNoneMatch bool
+	// Checksum is expected hex encoded SHA-256 of the content, ErrChecksum is returned when the content differs
+	Checksum string
+	// Metadata is kept with the version
+	Metadata FileMetadata
+	// Inspect reads the received content before it is stored and completes metadata of the version,
+	// an error fails the upload
+	Inspect func(ctx context.Context, r io.Reader, meta *FileMetadata) error
+}
+
+// Describe returns metadata of the uploaded version, Metadata completed by Inspect with the content
+// opened by open. Nil is returned when there is no metadata.
+func (o UploadOptions) Describe(ctx context.Context, open func() (io.ReadCloser, error)) (*FileMetadata, error) {
+	meta := o.Metadata
+	meta.Tags = append([]string(nil), o.Metadata.Tags...)
+	meta.Components = nil
+	for class, n := range o.Metadata.Components {
+		if meta.Components == nil {
+			meta.Components = make(map[string]int)
+		}
+		meta.Components[class] = n
+	}
+	if o.Inspect != nil {
+		r, err := open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if err = o.Inspect(ctx, r, &meta); err != nil {
+			return nil, err
+		}
+	}
+	if meta.IsZero() {
+		return nil, nil
+	}
+	return &meta, nil
+}
+
+// Conditional tells whether the upload depends on the latest version of the file
+func (o UploadOptions) Conditional() bool {
+	return o.IfNoneMatch || len(o.IfMatch) > 0
+}
+
+// Check returns PreconditionError when the latest version of the file, nil if there is none,
+// does not meet IfMatch and IfNoneMatch
+func (o UploadOptions) Check(current *FileInfo) error {
+	if o.IfNoneMatch && current != nil {
+		return &PreconditionError{Current: current}
+	}
+	if len(o.IfMatch) == 0 {
+		return nil
+	}
+	if current != nil {
+		for _, tag := range o.IfMatch {
+			if tag == "*" || tag == current.Version || tag == current.ETag {
+				return nil
+			}
+		}
+	}
+	return &PreconditionError{Current: current}
+}
+
+// PreconditionError is returned by UploadFile when the file was changed since the uploader has seen it
+type PreconditionError struct {
+	// Current is the latest version of the file, nil when there is none
+	Current *FileInfo
+}
+
+func (e *PreconditionError) Error() string {
+	if e.Current == nil {
+		return "upload precondition failed: file does not exist"
+	}
+	return fmt.Sprintf("upload precondition failed: latest version of %s is %s", e.Current.Path, e.Current.Version)
+}
+
+func (e *PreconditionError) Unwrap() error {
+	return ErrPrecondition
+}
+
+// drawio generates 20 characters ids of letters, digits, "-" and "_", some more room is left for ids of imported documents
+var uuidRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidateUUID checks diagram id before it gets to graph storage, every GraphStorage accepts the same ids
+func ValidateUUID(uuid string) error {
+	if !uuidRe.MatchString(uuid) {
+		return fmt.Errorf("invalid diagram uuid %q", uuid)
+	}
+	return nil
+}
+
+// ErrNoRelationEndpoint is set to relation items whose source or target element is not in the diagram
+var ErrNoRelationEndpoint = errors.New("relation source or target element not found")
+
+// ErrNotFound is returned by read operations when nothing is stored under the requested id
+var ErrNotFound = errors.New("not found")
+
+// ErrChecksum is returned by UploadFile when the content does not match UploadOptions.Checksum
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ErrPrecondition is wrapped by PreconditionError
+var ErrPrecondition = errors.New("precondition failed")
+
+// ErrValidation is wrapped by ValidationError
+var ErrValidation = errors.New("validation failed")
+
+// MaxPathLength bounds PathQuery.MaxLength, number of paths grows fast with their length
+const MaxPathLength = 16
+
+// PushOptions describes diagram version stored by PushItems
+type PushOptions struct {
+	// Project and Source are kept with the version, e.g. project and path of the document in object storage
+	Project string
+	Source  string
+	// SourceVersion is the version of the source document the diagram was read from, empty when unknown
+	SourceVersion string
+	// Replace overwrites the latest version, its elements and relations missing in the pushed items are removed.
+	// A new version is created otherwise.
+	Replace bool
+}
+
+// PushSummary is aggregated result of a single PushItems call
+type PushSummary struct {
+	Nodes     int
+	Relations int
+	// Versions are diagram versions written, by diagram uuid
+	Versions map[string]int
+	// Failed are items not stored, each one with Error set
+	Failed []drawio.Item
+}
+
+// DiagramVersion is a single upload of the diagram, versions are numbered from 1
+type DiagramVersion struct {
+	UUID    string `json:"uuid"`
+	Version int    `json:"version"`
+	Project string `json:"project,omitempty"`
+	Source  string `json:"source,omitempty"`
+	// SourceVersion is the version of the source document, it is trashed and restored along with the diagram version
+	SourceVersion string    `json:"sourceVersion,omitempty"`
+	Created       time.Time `json:"created"`
+	Elements      int       `json:"elements"`
+	// Deleted is the time version was moved to trash
+	Deleted *time.Time `json:"deleted,omitempty"`
+}
+
+// Element is a stored element with its relations and elements on the other side of them
+type Element struct {
+	Item       drawio.Item
+	Relations  []drawio.Item
+	Neighbours []drawio.Item
+}
+
+// ElementQuery selects elements of the latest version of every diagram, empty fields match anything
+type ElementQuery struct {
+	Project  string
+	Class    string
+	SubClass string
+	// Label matches elements with the label containing it, case is ignored
+	Label string
+	// Limit is the maximum number of matches, 0 means no limit
+	Limit int
+}
+
+// ElementMatch is an element found in graph storage along with the diagram version it belongs to
+type ElementMatch struct {
+	Item    drawio.Item
+	Version int
+	Project string
+}
+
+// PathQuery selects simple paths between two elements of a diagram version
+type PathQuery struct {
+	UUID     string
+	Version  int
+	From, To int
+	// MaxLength is the maximum number of connections in a path, up to MaxPathLength
+	MaxLength int
+	// Limit is the maximum number of paths, 0 means no limit
+	Limit int
+}
+
+// GraphStorage reads items until the channel is closed. Cancelling ctx stops writing,
+// the returned error is set when nothing from the diagram was stored.
+// Read operations take diagram version, 0 means the latest one. Versions in trash are hidden from reads
+// until restored or purged, their numbers are never given to new versions.
 type GraphStorage interface {
-	// TODO: decom PushItem
-	//PushItem(logger *zap.Logger, item storage.Item) (uuid string, id string, err error)
-	PushItems(logger *zap.Logger, items <-chan drawio.Item, pr chan drawio.Item, noMoreItems chan struct{})
+	PushItems(ctx context.Context, logger *zap.Logger, opts PushOptions, items <-chan drawio.Item) (PushSummary, error)
+	// LoadItems returns nodes and relations of the diagram, nothing when diagram is not stored
+	LoadItems(ctx context.Context, logger *zap.Logger, uuid string, version int) ([]drawio.Item, error)
+	// ListDiagrams returns sorted uuids of stored diagrams
+	ListDiagrams(ctx context.Context, logger *zap.Logger) ([]string, error)
+	// ListVersions returns versions of the diagram ordered by number
+	ListVersions(ctx context.Context, logger *zap.Logger, uuid string) ([]DiagramVersion, error)
+	// LoadElement returns ErrNotFound when there is no such element in the diagram
+	LoadElement(ctx context.Context, logger *zap.Logger, uuid string, version int, eid int) (*Element, error)
+	// FindElements returns matches ordered by diagram uuid and element id
+	FindElements(ctx context.Context, logger *zap.Logger, q ElementQuery) ([]ElementMatch, error)
+	// FindPaths returns paths as alternating elements and connections, starting and ending with an element,
+	// shorter paths first. ErrNotFound is returned when either element is not in the diagram
+	FindPaths(ctx context.Context, logger *zap.Logger, q PathQuery) ([][]drawio.Item, error)
+	// DeleteDiagram moves the version, or all versions for 0, to trash, ErrNotFound is returned when nothing was moved
+	DeleteDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error
+	// RestoreDiagram brings back the trashed version, or all trashed versions for 0, ErrNotFound is returned
+	// when nothing was restored
+	RestoreDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error
+	// PurgeDiagram removes the trashed version, or all trashed versions for 0, for good
+	PurgeDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error
+	// ListTrash returns trashed versions ordered by diagram uuid and version
+	ListTrash(ctx context.Context, logger *zap.Logger) ([]DiagramVersion, error)
 }
 
 type DiagramProcessor interface {
@@ -0,0 +1,352 @@
+package calculator
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Consistency is the report of diagrams and documents found in one storage only
+type Consistency struct {
+	// Orphaned are latest versions of diagrams which source document is not in object storage
+	Orphaned []DiagramVersion `json:"orphaned"`
+	// Unindexed are documents in object storage which are not a source of any diagram
+	Unindexed []string `json:"unindexed"`
+}
+
+// DeleteDiagram moves the diagram version to trash along with the document version it was read from,
+// unless another diagram version not in trash was read from it too. Version 0 moves the whole diagram
+// along with its source documents, unless a document is the source of another diagram too. Versions moved
+// by the call are restored when a document could not be deleted, versions trashed before stay in trash.
+func (c *Calculator) DeleteDiagram(ctx context.Context, uuid string, version int) error {
+	if version != 0 {
+		return c.deleteVersion(ctx, uuid, version)
+	}
+	live, err := c.Gstorage.ListVersions(ctx, c.Logger, uuid)
+	if err != nil {
+		return err
+	}
+	sources, err := c.sources(ctx)
+	if err != nil {
+		return err
+	}
+	var documents []string
+	for source, uuids := range sources {
+		if len(uuids) == 1 && uuids[0] == uuid {
+			documents = append(documents, source)
+		}
+	}
+	sort.Strings(documents)
+
+	if err = c.Gstorage.DeleteDiagram(ctx, c.Logger, uuid, version); err != nil {
+		return err
+	}
+	for i, path := range documents {
+		err := c.TextStorage.DeleteFile(ctx, c.Logger, path)
+		if err == nil || errors.Is(err, ErrNotFound) {
+			continue
+		}
+		c.Logger.Error("could not delete diagram document, restoring diagram",
+			zap.String("uuid", uuid),
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		for _, deleted := range documents[:i] {
+			if err := c.TextStorage.RestoreFile(ctx, c.Logger, deleted); err != nil {
+				c.Logger.Error("could not restore diagram document",
+					zap.String("path", deleted),
+					zap.Error(err),
+				)
+			}
+		}
+		for _, v := range live {
+			c.restoreVersion(ctx, v)
+		}
+		return err
+	}
+	return nil
+}
+
+// deleteVersion moves a single diagram version to trash along with its document version, the diagram version
+// is restored when the document version could not be deleted
+func (c *Calculator) deleteVersion(ctx context.Context, uuid string, version int) error {
+	live, err := c.live(ctx)
+	if err != nil {
+		return err
+	}
+	var deleted *DiagramVersion
+	for i, v := range live {
+		if v.UUID == uuid && v.Version == version {
+			deleted = &live[i]
+		}
+	}
+	shared := false
+	for _, v := range live {
+		other := v.UUID != uuid || v.Version != version
+		if deleted != nil && other && documentVersion(v) == documentVersion(*deleted) {
+			shared = true
+		}
+	}
+
+	if err = c.Gstorage.DeleteDiagram(ctx, c.Logger, uuid, version); err != nil {
+		return err
+	}
+	if deleted == nil || shared || !hasDocumentVersion(*deleted) {
+		return nil
+	}
+	err = c.TextStorage.DeleteVersion(ctx, c.Logger, deleted.Source, deleted.SourceVersion)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	c.Logger.Error("could not delete diagram document version, restoring diagram version",
+		zap.String("uuid", uuid),
+		zap.Int("version", version),
+		zap.String("path", deleted.Source),
+		zap.String("VersionID", deleted.SourceVersion),
+		zap.Error(err),
+	)
+	c.restoreVersion(ctx, *deleted)
+	return err
+}
+
+// restoreVersion brings back the diagram version trashed by a failed call
+func (c *Calculator) restoreVersion(ctx context.Context, v DiagramVersion) {
+	if err := c.Gstorage.RestoreDiagram(ctx, c.Logger, v.UUID, v.Version); err != nil {
+		c.Logger.Error("could not restore diagram version",
+			zap.String("uuid", v.UUID),
+			zap.Int("version", v.Version),
+			zap.Error(err),
+		)
+	}
+}
+
+// RestoreDiagram brings back the trashed version along with its document version, or all trashed versions
+// for 0 along with their source documents
+func (c *Calculator) RestoreDiagram(ctx context.Context, uuid string, version int) error {
+	trash, err := c.Gstorage.ListTrash(ctx, c.Logger)
+	if err != nil {
+		return err
+	}
+	var documents []string
+	var restored []DiagramVersion
+	seen := make(map[string]bool)
+	for _, v := range trash {
+		if v.UUID != uuid || (version != 0 && v.Version != version) {
+			continue
+		}
+		restored = append(restored, v)
+		if version == 0 && isDocument(v.Source) && !seen[v.Source] {
+			seen[v.Source] = true
+			documents = append(documents, v.Source)
+		}
+	}
+
+	if err = c.Gstorage.RestoreDiagram(ctx, c.Logger, uuid, version); err != nil {
+		return err
+	}
+	for _, path := range documents {
+		// document was kept when it was shared by another diagram
+		if err := c.TextStorage.RestoreFile(ctx, c.Logger, path); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	for _, v := range restored {
+		if !hasDocumentVersion(v) {
+			continue
+		}
+		// document version was kept when another diagram version was read from it
+		err := c.TextStorage.RestoreVersion(ctx, c.Logger, v.Source, v.SourceVersion)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeTrash removes versions trashed before the given time for good, along with their document versions
+// and source documents no other version refers to. Purged versions are returned.
+func (c *Calculator) PurgeTrash(ctx context.Context, before time.Time) ([]DiagramVersion, error) {
+	trash, err := c.Gstorage.ListTrash(ctx, c.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []DiagramVersion
+	// kept are sources and document versions of versions staying in trash
+	kept := make(map[string]bool)
+	for _, v := range trash {
+		if v.Deleted == nil || !v.Deleted.Before(before) {
+			kept[v.Source] = true
+			kept[documentVersion(v)] = true
+			continue
+		}
+		if err = c.Gstorage.PurgeDiagram(ctx, c.Logger, v.UUID, v.Version); err != nil && !errors.Is(err, ErrNotFound) {
+			return purged, err
+		}
+		purged = append(purged, v)
+	}
+
+	live, err := c.live(ctx)
+	if err != nil {
+		return purged, err
+	}
+	sources := make(map[string]bool)
+	for _, v := range live {
+		sources[v.Source] = true
+		sources[documentVersion(v)] = true
+	}
+	done := make(map[string]bool)
+	for _, v := range purged {
+		key := documentVersion(v)
+		if !hasDocumentVersion(v) || kept[key] || done[key] || sources[key] {
+			continue
+		}
+		done[key] = true
+		// document version is not deleted when another diagram version was read from it
+		err = c.TextStorage.PurgeVersion(ctx, c.Logger, v.Source, v.SourceVersion)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return purged, err
+		}
+	}
+	for _, v := range purged {
+		path := v.Source
+		if !isDocument(path) || kept[path] || done[path] || sources[path] {
+			continue
+		}
+		done[path] = true
+		// document uploaded again after the diagram was deleted stays
+		if c.exists(ctx, path) {
+			continue
+		}
+		if err = c.TextStorage.PurgeFile(ctx, c.Logger, path); err != nil && !errors.Is(err, ErrNotFound) {
+			return purged, err
+		}
+	}
+	if len(purged) > 0 {
+		c.Logger.Info("trash purged",
+			zap.Time("before", before),
+			zap.Int("versions", len(purged)),
+		)
+	}
+	return purged, nil
+}
+
+// CheckConsistency compares diagrams in graph storage with documents in object storage
+func (c *Calculator) CheckConsistency(ctx context.Context) (*Consistency, error) {
+	report := &Consistency{Orphaned: []DiagramVersion{}, Unindexed: []string{}}
+
+	uuids, err := c.Gstorage.ListDiagrams(ctx, c.Logger)
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[string]bool)
+	for _, uuid := range uuids {
+		versions, err := c.Gstorage.ListVersions(ctx, c.Logger, uuid)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			sources[v.Source] = true
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		latest := versions[len(versions)-1]
+		if isDocument(latest.Source) && !c.exists(ctx, latest.Source) {
+			report.Orphaned = append(report.Orphaned, latest)
+		}
+	}
+
+	documents, err := c.documents(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range documents {
+		if !sources[path] {
+			report.Unindexed = append(report.Unindexed, path)
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// sources returns uuids of diagrams by their source documents, versions in trash are not taken into account
+func (c *Calculator) sources(ctx context.Context) (map[string][]string, error) {
+	live, err := c.live(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[string][]string)
+	for _, v := range live {
+		uuids := sources[v.Source]
+		if isDocument(v.Source) && (len(uuids) == 0 || uuids[len(uuids)-1] != v.UUID) {
+			sources[v.Source] = append(uuids, v.UUID)
+		}
+	}
+	return sources, nil
+}
+
+// live returns versions of every diagram which are not in trash, ordered by diagram
+func (c *Calculator) live(ctx context.Context) ([]DiagramVersion, error) {
+	uuids, err := c.Gstorage.ListDiagrams(ctx, c.Logger)
+	if err != nil {
+		return nil, err
+	}
+	var live []DiagramVersion
+	for _, uuid := range uuids {
+		versions, err := c.Gstorage.ListVersions(ctx, c.Logger, uuid)
+		if err != nil {
+			return nil, err
+		}
+		live = append(live, versions...)
+	}
+	return live, nil
+}
+
+// documents lists files under the path recursively, folder marker objects are skipped
+func (c *Calculator) documents(ctx context.Context, path string) ([]string, error) {
+	var documents []string
+	for obj := range c.TextStorage.Ls(ctx, path, LsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if obj.IsDir() {
+			continue
+		}
+		documents = append(documents, obj.Path)
+	}
+	return documents, nil
+}
+
+func (c *Calculator) exists(ctx context.Context, path string) bool {
+	r, err := c.TextStorage.LoadFileByName(ctx, c.Logger, path, "")
+	if err != nil {
+		return false
+	}
+	if closer, ok := r.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	return true
+}
+
+// hasDocumentVersion tells whether the version records the document version it was read from
+func hasDocumentVersion(v DiagramVersion) bool {
+	return isDocument(v.Source) && v.SourceVersion != ""
+}
+
+// documentVersion is the key of the document version of the diagram version
+func documentVersion(v DiagramVersion) string {
+	return v.Source + "@" + v.SourceVersion
+}
+
+// isDocument tells whether version source is a path of document in object storage, documents are kept
+// as project/name, other sources like "netlist" tell how the diagram was imported
+func isDocument(source string) bool {
+	return strings.Contains(source, "/")
+}
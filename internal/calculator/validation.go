@@ -0,0 +1,307 @@
+package calculator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Validation levels of uploaded documents
+const (
+	// ValidationNone accepts any content
+	ValidationNone = "none"
+	// ValidationLenient accepts any content, but XML documents have to be well-formed without DTD
+	// and diagrams have to have an id
+	ValidationLenient = "lenient"
+	// ValidationStrict accepts diagrams only
+	ValidationStrict = "strict"
+)
+
+// Reasons of ValidationError
+const (
+	ReasonUnsupported     = "unsupported-format"
+	ReasonTooLarge        = "too-large"
+	ReasonMalformed       = "malformed"
+	ReasonDTD             = "dtd"
+	ReasonNotDiagram      = "not-diagram"
+	ReasonTooManyElements = "too-many-elements"
+)
+
+// ValidationPolicy tells which uploaded documents are accepted
+type ValidationPolicy struct {
+	// Level is one of validation levels, empty means ValidationLenient
+	Level string `yaml:"level" json:"level"`
+	// MaxSize is the maximum size of the document in bytes, 0 means no limit
+	MaxSize int64 `yaml:"maxSize" json:"maxSize"`
+	// MaxElements is the maximum number of elements and connections of a diagram, 0 means no limit
+	MaxElements int `yaml:"maxElements" json:"maxElements"`
+}
+
+// Check returns an error for unknown level
+func (p ValidationPolicy) Check() error {
+	switch p.Level {
+	case "", ValidationNone, ValidationLenient, ValidationStrict:
+		return nil
+	}
+	return fmt.Errorf("unknown validation level %q, one of %s, %s or %s expected",
+		p.Level, ValidationNone, ValidationLenient, ValidationStrict)
+}
+
+// Validation is the policy of uploads with overrides for single projects
+type Validation struct {
+	Default ValidationPolicy
+	// Projects override non zero fields of Default, project names are matched ignoring case
+	Projects map[string]ValidationPolicy
+}
+
+// Policy returns the policy of the project
+func (v Validation) Policy(project string) ValidationPolicy {
+	policy := v.Default
+	for name, override := range v.Projects {
+		if !strings.EqualFold(name, project) {
+			continue
+		}
+		if override.Level != "" {
+			policy.Level = override.Level
+		}
+		if override.MaxSize != 0 {
+			policy.MaxSize = override.MaxSize
+		}
+		if override.MaxElements != 0 {
+			policy.MaxElements = override.MaxElements
+		}
+	}
+	if policy.Level == "" {
+		policy.Level = ValidationLenient
+	}
+	return policy
+}
+
+// ValidationError tells why the uploaded document is rejected
+type ValidationError struct {
+	// Reason is one of Reason constants
+	Reason string `json:"reason"`
+	Detail string `json:"detail"`
+	// Line is the line of the document the problem is found at, 0 when unknown
+	Line int `json:"line,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("document rejected: %s at line %d", e.Detail, e.Line)
+	}
+	return "document rejected: " + e.Detail
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+// Inspector returns UploadOptions.Inspect of uploads to the path, the document is validated by the policy
+// of its project, the first segment of the path. Documents are not read past maxSize, when it is not zero.
+func (c *Calculator) Inspector(path string, maxSize int64) func(ctx context.Context, r io.Reader, meta *FileMetadata) error {
+	project, _, _ := strings.Cut(path, "/")
+	policy := c.Validation.Policy(project)
+	if maxSize > 0 && (policy.MaxSize == 0 || policy.MaxSize > maxSize) {
+		policy.MaxSize = maxSize
+	}
+	return func(ctx context.Context, r io.Reader, meta *FileMetadata) error {
+		return c.InspectDocument(ctx, r, policy, meta)
+	}
+}
+
+// InspectDocument validates the uploaded document by the policy and completes its metadata with the editor,
+// diagram uuid and numbers of components when it is a diagram. ValidationError is returned for rejected
+// documents. Documents accepted by the policy other than diagrams are kept without these fields, as well as
+// any document at ValidationNone. The document is streamed, it is not kept in memory.
+func (c *Calculator) InspectDocument(ctx context.Context, r io.Reader, policy ValidationPolicy, meta *FileMetadata) error {
+	if policy.MaxSize > 0 {
+		r = &sizeLimiter{r: r, left: policy.MaxSize, max: policy.MaxSize}
+	}
+	br := bufio.NewReader(r)
+	head, err := br.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	strict := policy.Level == ValidationStrict
+	switch {
+	case policy.Level == ValidationNone:
+		return drain(br)
+	case !isXML(head):
+		if strict {
+			return &ValidationError{Reason: ReasonUnsupported,
+				Detail: http.DetectContentType(head) + " document is not a diagram"}
+		}
+		return drain(br)
+	}
+
+	doc, err := scanXML(br)
+	if err != nil {
+		return err
+	}
+	if doc.root != "mxfile" {
+		if strict {
+			return &ValidationError{Reason: ReasonUnsupported, Detail: fmt.Sprintf("root element <%s> is not mxfile", doc.root)}
+		}
+		return nil
+	}
+	if doc.uuid == "" {
+		return &ValidationError{Reason: ReasonNotDiagram, Detail: "no diagram id in document"}
+	}
+	if policy.MaxElements > 0 && doc.elements > policy.MaxElements {
+		return &ValidationError{Reason: ReasonTooManyElements,
+			Detail: fmt.Sprintf("diagram has %d elements and connections, at most %d allowed", doc.elements, policy.MaxElements)}
+	}
+	meta.Editor = doc.host
+	meta.DiagramUUID = doc.uuid
+	meta.Components = doc.components
+	return nil
+}
+
+// sizeLimiter reads at most max bytes, ValidationError is returned when the document is larger
+type sizeLimiter struct {
+	r    io.Reader
+	left int64
+	max  int64
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// a byte past the limit tells the document is larger
+		var b [1]byte
+		if n, _ := l.r.Read(b[:]); n > 0 {
+			return 0, &ValidationError{Reason: ReasonTooLarge, Detail: fmt.Sprintf("document is larger than %d bytes", l.max)}
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// drain reads the rest of the document, so its size is checked
+func drain(r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// xmlDocument is what scanXML reads of the document
+type xmlDocument struct {
+	// root and host are the name and host attribute of the root element
+	root string
+	host string
+	// uuid is the id of the first diagram of mxfile
+	uuid string
+	// elements are cells of diagrams with style, components are elements other than lines by their class
+	elements   int
+	components map[string]int
+}
+
+// mxCellPath is the path of diagram cells read by DiagramProcessor
+var mxCellPath = []string{"mxfile", "diagram", "mxGraphModel", "root", "mxCell"}
+
+// scanXML reads the whole document token by token. ValidationError is returned for malformed documents and
+// documents with DTD, entities are declared there.
+func scanXML(r io.Reader) (*xmlDocument, error) {
+	doc := &xmlDocument{}
+	dec := xml.NewDecoder(r)
+	var path []string
+	for {
+		token, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, malformed(err)
+		}
+		switch t := token.(type) {
+		case xml.Directive:
+			line, _ := dec.InputPos()
+			return nil, &ValidationError{Reason: ReasonDTD, Detail: "document type declarations are not allowed", Line: line}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			switch {
+			case len(path) == 1:
+				doc.root = t.Name.Local
+				doc.host = attr(t, "host")
+			case len(path) == 2 && doc.root == "mxfile" && t.Name.Local == "diagram" && doc.uuid == "":
+				doc.uuid = attr(t, "id")
+			case doc.root == "mxfile" && equalPath(path, mxCellPath):
+				var cell drawio.MxCell
+				if err = dec.DecodeElement(&cell, &t); err != nil {
+					return nil, malformed(err)
+				}
+				path = path[:len(path)-1]
+				if !cell.HasStyle() {
+					continue
+				}
+				doc.elements++
+				item := drawio.NewItem(&cell, doc.uuid)
+				if item.Class == "" || item.Class == drawio.ItemClassLines {
+					continue
+				}
+				if doc.components == nil {
+					doc.components = make(map[string]int)
+				}
+				doc.components[item.Class]++
+			}
+		}
+	}
+	if doc.root == "" {
+		return nil, &ValidationError{Reason: ReasonMalformed, Detail: "no root element"}
+	}
+	return doc, nil
+}
+
+// malformed converts decoding error to ValidationError, errors of reading the document are kept
+func malformed(err error) error {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		return err
+	}
+	var serr *xml.SyntaxError
+	if errors.As(err, &serr) {
+		return &ValidationError{Reason: ReasonMalformed, Detail: serr.Msg, Line: serr.Line}
+	}
+	return &ValidationError{Reason: ReasonMalformed, Detail: err.Error()}
+}
+
+func attr(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func equalPath(path []string, want []string) bool {
+	if len(path) != len(want) {
+		return false
+	}
+	for i := range path {
+		if path[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isXML tells whether the document starts with markup, byte order mark and spaces are skipped
+func isXML(body []byte) bool {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	return bytes.HasPrefix(bytes.TrimLeft(body, " \t\r\n"), []byte("<"))
+}
@@ -5,14 +5,23 @@ import (
 	"fmt"
 	"github.com/aemakeye/circuit_calculator/internal/calculator"
 	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/filegraph"
+	"github.com/aemakeye/circuit_calculator/internal/filestore"
+	"github.com/aemakeye/circuit_calculator/internal/memgraph"
 	"github.com/aemakeye/circuit_calculator/internal/minio"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"net/netip"
+	"time"
 )
 
 const (
 	defaultApiListen = "127.0.0.1:8099"
+	// defaultTrashRetention is the time deleted diagrams are kept in trash
+	defaultTrashRetention = 30 * 24 * time.Hour
+	// defaultServerTimeout bounds reading and writing of a request, it is longer than archive handler
+	// deadline and leaves a slow client minutes to transfer an upload of the default size
+	defaultServerTimeout = 10 * time.Minute
 )
 
 // CConfig internal structure
@@ -22,8 +31,23 @@ type CConfig struct {
 	Logger     *zap.Logger
 	Loglevel   string
 	Neo4j      *neo4j
-	Storage    calculator.ObjectStorage
-	Filename   string
+	// Graph is set when graph storage other than neo4j is configured, see FileConfig.GraphStorage
+	Graph    calculator.GraphStorage
+	Storage  calculator.ObjectStorage
+	Filename string
+	// TrashRetention is the time deleted diagrams and documents are kept before they are purged
+	TrashRetention time.Duration
+	// MaxUploadSize is the maximum size of uploaded documents in bytes, 0 means handler default
+	MaxUploadSize int64
+	// Validation is the policy of uploaded documents
+	Validation calculator.Validation
+	// PresignExpiry is the lifetime of presigned URLs, 0 means handler default
+	PresignExpiry time.Duration
+	// PresignSecret signs upload tokens of presigned URLs, empty means a random one
+	PresignSecret string
+	// ReadTimeout and WriteTimeout of the API server, they bound transfers of documents and archives
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
 }
 
 // neo4j internal structure
@@ -31,6 +55,10 @@ type neo4j struct {
 	User     string
 	Password string
 	Endpoint string
+	// BatchSize is the number of rows in a single UNWIND statement
+	BatchSize int
+	// Migrate applies graph schema migrations on start
+	Migrate bool
 	//play with this and Neo4j structure
 	//Timeout  time.Duration
 }
@@ -42,6 +70,10 @@ type Neo4j struct {
 	Host     string
 	Port     string
 	Schema   string
+	// BatchSize is the number of rows in a single UNWIND statement, 0 means default
+	BatchSize int `yaml:"batchSize" json:"batchSize"`
+	// Migrate applies graph schema migrations on start, they may be applied with "migrate" command otherwise
+	Migrate bool `yaml:"migrate" json:"migrate"`
 	// TODO play with this
 	//Timeout  time.Duration `yaml:"timeout" json:"timeout"`
 
@@ -54,6 +86,16 @@ type Minio struct {
 	Host     string `yaml:"Host" json:"host"`
 	Secure   bool   `yaml:"Secure" json:"secure"`
 	Bucket   string `yaml:"Bucket" json:"bucket"`
+	// PublicHost is the endpoint presigned URLs point to, e.g. the ingress browsers reach, Host by default
+	PublicHost   string `yaml:"PublicHost" json:"publicHost"`
+	PublicSecure bool   `yaml:"PublicSecure" json:"publicSecure"`
+	// Region signs presigned URLs for PublicHost, us-east-1 by default
+	Region string `yaml:"Region" json:"region"`
+}
+
+// Embedded structure to unmarshal CConfig file
+type Embedded struct {
+	Path string `yaml:"path" json:"path"`
 }
 
 // FileConfig structure to unmarshal CConfig from file
@@ -63,8 +105,44 @@ type FileConfig struct {
 	Neo4j         Neo4j  `yaml:"neo4j" json:"Neo4J"`
 	ObjectStorage struct {
 		Minio *Minio `json:"minio,omitempty"`
-		//	maybe another type of storage here
+		// Filesystem keeps documents and their versions in a local directory
+		Filesystem *Embedded `json:"filesystem,omitempty"`
+		// MaxUploadSize is the maximum size of uploaded documents in bytes
+		MaxUploadSize int64 `yaml:"maxUploadSize" json:"maxUploadSize"`
 	} `json:"objectStorage"`
+	GraphStorage struct {
+		// Neo4j replaces top level neo4j section
+		Neo4j *Neo4j `json:"neo4j,omitempty"`
+		// Embedded keeps diagrams in files of a local directory
+		Embedded *Embedded `json:"embedded,omitempty"`
+		// Memory keeps diagrams in memory of the process, neo4j is used when nothing is set
+		Memory *struct{} `json:"memory,omitempty"`
+	} `json:"graphStorage"`
+	Trash struct {
+		// Retention is a duration like "720h", 0 means default
+		Retention time.Duration `yaml:"retention" json:"retention"`
+	} `json:"trash"`
+	// Validation of uploaded documents, policy of projects not listed in Projects
+	Validation struct {
+		Level       string `yaml:"level" json:"level"`
+		MaxSize     int64  `yaml:"maxSize" json:"maxSize"`
+		MaxElements int    `yaml:"maxElements" json:"maxElements"`
+		// Projects override non zero fields of the policy for single projects
+		Projects map[string]calculator.ValidationPolicy `yaml:"projects" json:"projects"`
+	} `json:"validation"`
+	// Presign of URLs the editor loads and saves documents with directly
+	Presign struct {
+		// Expiry is a duration like "15m", 0 means default
+		Expiry time.Duration `yaml:"expiry" json:"expiry"`
+		// Secret signs upload tokens, they are not valid after restart when it is empty
+		Secret string `yaml:"secret" json:"secret"`
+	} `json:"presign"`
+	// Server timeouts are durations like "10m", 0 means default. They have to fit the largest upload
+	// and archive at the slowest client speed.
+	Server struct {
+		ReadTimeout  time.Duration `yaml:"readTimeout" json:"readTimeout"`
+		WriteTimeout time.Duration `yaml:"writeTimeout" json:"writeTimeout"`
+	} `json:"server"`
 }
 
 // NewConfig function to create CConfig object with viper from file or reader.
@@ -120,11 +198,65 @@ func NewConfig(logger *zap.Logger, reader *bytes.Reader) (cfg *CConfig, err erro
 		cfg.Listen, _ = netip.ParseAddrPort(defaultApiListen)
 	}
 
+	cfg.ReadTimeout, cfg.WriteTimeout = fc.Server.ReadTimeout, fc.Server.WriteTimeout
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = defaultServerTimeout
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = defaultServerTimeout
+	}
+
+	cfg.MaxUploadSize = fc.ObjectStorage.MaxUploadSize
+	cfg.PresignExpiry = fc.Presign.Expiry
+	cfg.PresignSecret = fc.Presign.Secret
+
+	cfg.Validation = calculator.Validation{
+		Default: calculator.ValidationPolicy{
+			Level:       fc.Validation.Level,
+			MaxSize:     fc.Validation.MaxSize,
+			MaxElements: fc.Validation.MaxElements,
+		},
+		Projects: fc.Validation.Projects,
+	}
+	if err = cfg.Validation.Default.Check(); err != nil {
+		return nil, fmt.Errorf("bad validation config: %w", err)
+	}
+	for project, policy := range cfg.Validation.Projects {
+		if err = policy.Check(); err != nil {
+			return nil, fmt.Errorf("bad validation config of project %s: %w", project, err)
+		}
+	}
+
+	cfg.TrashRetention = fc.Trash.Retention
+	if cfg.TrashRetention <= 0 {
+		cfg.TrashRetention = defaultTrashRetention
+	}
+
+	if fc.GraphStorage.Neo4j != nil {
+		fc.Neo4j = *fc.GraphStorage.Neo4j
+	}
 	cfg.Neo4j = &neo4j{
-		User:     fc.Neo4j.User,
-		Password: fc.Neo4j.Password,
-		Endpoint: fc.Neo4j.Host + ":" + fc.Neo4j.Port,
+		User:      fc.Neo4j.User,
+		Password:  fc.Neo4j.Password,
+		Endpoint:  fc.Neo4j.Host + ":" + fc.Neo4j.Port,
+		BatchSize: fc.Neo4j.BatchSize,
+		Migrate:   fc.Neo4j.Migrate,
+	}
+	switch {
+	case fc.GraphStorage.Memory != nil:
+		logger.Info("using in-memory graph storage")
+		cfg.Graph = memgraph.NewStorage()
+	case fc.GraphStorage.Embedded != nil:
+		graph, err := filegraph.NewStorage(logger, fc.GraphStorage.Embedded.Path)
+		if err != nil {
+			logger.Error("could not initialize embedded graph storage",
+				zap.Error(err),
+			)
+			return nil, err
+		}
+		cfg.Graph = graph
 	}
+
 	switch {
 	case fc.ObjectStorage.Minio != nil:
 		strg, err := minio.NewMinioStorage(
@@ -141,6 +273,28 @@ func NewConfig(logger *zap.Logger, reader *bytes.Reader) (cfg *CConfig, err erro
 			)
 			return nil, err
 		}
+		if strg != nil && fc.ObjectStorage.Minio.PublicHost != "" {
+			err = strg.SetPublicEndpoint(
+				fc.ObjectStorage.Minio.PublicHost,
+				fc.ObjectStorage.Minio.PublicSecure,
+				fc.ObjectStorage.Minio.Region,
+			)
+			if err != nil {
+				logger.Error("could not initialize minio public endpoint",
+					zap.Error(err),
+				)
+				return nil, err
+			}
+		}
+		cfg.Storage = strg
+	case fc.ObjectStorage.Filesystem != nil:
+		strg, err := filestore.NewStorage(logger, fc.ObjectStorage.Filesystem.Path)
+		if err != nil {
+			logger.Error("could not initialize filesystem object storage",
+				zap.Error(err),
+			)
+			return nil, err
+		}
 		cfg.Storage = strg
 	default:
 		logger.Fatal("no object storage defined")
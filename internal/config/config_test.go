@@ -3,10 +3,15 @@ package config
 import (
 	"bytes"
 	"context"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/filegraph"
+	"github.com/aemakeye/circuit_calculator/internal/filestore"
+	"github.com/aemakeye/circuit_calculator/internal/memgraph"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
@@ -71,4 +76,79 @@ func TestConfig(t *testing.T) {
 
 		t.Logf("netip.Addr string: %s", cfg.Listen.String())
 	})
+	t.Run("in-memory graph storage", func(t *testing.T) {
+		logger := zap.NewNop()
+		cfg, err := NewConfig(logger, bytes.NewReader(bytes.Replace(input,
+			[]byte(`"ObjectStorage":`), []byte(`"GraphStorage": {"memory": {}}, "ObjectStorage":`), 1)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.IsType(t, &memgraph.Storage{}, cfg.Graph)
+
+		cfg, err = NewConfig(logger, bytes.NewReader(input))
+		assert.NoError(t, err)
+		assert.Nil(t, cfg.Graph)
+	})
+	t.Run("embedded graph storage", func(t *testing.T) {
+		logger := zap.NewNop()
+		cfg, err := NewConfig(logger, bytes.NewReader(bytes.Replace(input,
+			[]byte(`"ObjectStorage":`), []byte(`"GraphStorage": {"embedded": {"path": "`+t.TempDir()+`"}}, "ObjectStorage":`), 1)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.IsType(t, &filegraph.Storage{}, cfg.Graph)
+	})
+	t.Run("filesystem object storage", func(t *testing.T) {
+		logger := zap.NewNop()
+		dir := t.TempDir()
+		cfg, err := NewConfig(logger, bytes.NewReader([]byte(`{
+			"Listen": "0.0.0.0:8099",
+			"GraphStorage": {"memory": {}},
+			"ObjectStorage": {"filesystem": {"path": "`+dir+`"}, "maxUploadSize": 1024}
+		}`)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.IsType(t, &filestore.Storage{}, cfg.Storage)
+		assert.Equal(t, dir, cfg.Storage.ConfigDump(context.Background(), logger)["path"])
+		assert.Equal(t, int64(1024), cfg.MaxUploadSize)
+		assert.Equal(t, defaultServerTimeout, cfg.ReadTimeout)
+		assert.Equal(t, defaultServerTimeout, cfg.WriteTimeout)
+	})
+	t.Run("server timeouts", func(t *testing.T) {
+		cfg, err := NewConfig(zap.NewNop(), bytes.NewReader([]byte(`{
+			"Listen": "0.0.0.0:8099",
+			"Server": {"readTimeout": "30m", "writeTimeout": "1h"},
+			"GraphStorage": {"memory": {}},
+			"ObjectStorage": {"filesystem": {"path": "`+t.TempDir()+`"}}
+		}`)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 30*time.Minute, cfg.ReadTimeout)
+		assert.Equal(t, time.Hour, cfg.WriteTimeout)
+	})
+	t.Run("validation", func(t *testing.T) {
+		logger := zap.NewNop()
+		config := func(validation string) []byte {
+			return []byte(`{
+				"Listen": "0.0.0.0:8099",
+				"GraphStorage": {"memory": {}},
+				"ObjectStorage": {"filesystem": {"path": "` + t.TempDir() + `"}},
+				"Validation": ` + validation + `
+			}`)
+		}
+		cfg, err := NewConfig(logger, bytes.NewReader(config(`{"maxSize": 2048,
+			"projects": {"Production": {"level": "strict", "maxElements": 100}, "sandbox": {"level": "none"}}}`)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, calculator.ValidationPolicy{Level: calculator.ValidationLenient, MaxSize: 2048}, cfg.Validation.Policy("other"))
+		assert.Equal(t, calculator.ValidationPolicy{Level: calculator.ValidationStrict, MaxSize: 2048, MaxElements: 100},
+			cfg.Validation.Policy("production"))
+		assert.Equal(t, calculator.ValidationNone, cfg.Validation.Policy("sandbox").Level)
+
+		_, err = NewConfig(logger, bytes.NewReader(config(`{"projects": {"sandbox": {"level": "off"}}}`)))
+		assert.Error(t, err)
+	})
 }
@@ -0,0 +1,230 @@
+package diff
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	ContentTypeDrawio = "application/vnd.jgraph.mxfile"
+
+	addedColor    = "#2ec27e"
+	removedColor  = "#e01b24"
+	modifiedColor = "#e5a50a"
+	rewiredColor  = "#1a5fb4"
+	strokeWidth   = "3"
+)
+
+// status of a cell in the annotated document, the first one found is shown
+type status int
+
+const (
+	statusNone status = iota
+	statusAdded
+	statusModified
+	statusRewired
+	statusRemoved
+)
+
+var statusStyle = map[status]map[string]string{
+	statusAdded:    {"strokeColor": addedColor, "fontColor": addedColor, "strokeWidth": strokeWidth},
+	statusModified: {"strokeColor": modifiedColor, "fontColor": modifiedColor, "strokeWidth": strokeWidth},
+	statusRewired:  {"strokeColor": rewiredColor, "strokeWidth": strokeWidth},
+	statusRemoved:  {"strokeColor": removedColor, "fontColor": removedColor, "dashed": "1", "opacity": "50"},
+}
+
+// Annotate writes the to document with changed cells highlighted: added components are green,
+// modified ones and ones with changed value are orange, rewired components and wires of changed nets are blue.
+// Removed components are copied from the from document, red and dashed, with ids above ids of the to document.
+// Everything else in the document is kept as is.
+func Annotate(w io.Writer, from io.Reader, to io.Reader, d *Diff) error {
+	cells := make(map[int]status)
+	mark := func(id int, s status) {
+		if cells[id] == statusNone {
+			cells[id] = s
+		}
+	}
+	for _, c := range d.Added {
+		mark(c.ID, statusAdded)
+	}
+	for _, c := range d.Modified {
+		mark(c.ID, statusModified)
+	}
+	for _, c := range d.Values {
+		mark(c.ID, statusModified)
+	}
+	for _, r := range d.Rewired {
+		mark(r.Pin.Component, statusRewired)
+	}
+	for _, n := range d.Nets {
+		for _, wire := range n.Wires {
+			mark(wire, statusRewired)
+		}
+	}
+
+	removed := make(map[int]struct{})
+	for _, c := range d.Removed {
+		removed[c.ID] = struct{}{}
+	}
+	ghosts, err := copyCells(from, removed)
+	if err != nil {
+		return fmt.Errorf("can not read previous version: %w", err)
+	}
+
+	tokens, err := readTokens(to)
+	if err != nil {
+		return fmt.Errorf("can not read document: %w", err)
+	}
+	nextID := 0
+	for _, t := range tokens {
+		if start, ok := t.(xml.StartElement); ok && start.Name.Local == "mxCell" {
+			if id, err := strconv.Atoi(attr(start, "id")); err == nil && id >= nextID {
+				nextID = id + 1
+			}
+		}
+	}
+
+	enc := xml.NewEncoder(w)
+	for i, t := range tokens {
+		switch tt := t.(type) {
+		case xml.CharData:
+			// xml declaration must be the first thing written
+			if i == 0 && len(strings.TrimSpace(string(tt))) == 0 {
+				continue
+			}
+		case xml.StartElement:
+			if tt.Name.Local == "mxCell" {
+				if id, err := strconv.Atoi(attr(tt, "id")); err == nil && cells[id] != statusNone {
+					t = restyle(tt, cells[id])
+				}
+			}
+		case xml.EndElement:
+			if tt.Name.Local == "root" {
+				for _, ghost := range ghosts {
+					ghost[0] = restyle(setAttr(ghost[0].(xml.StartElement), "id", strconv.Itoa(nextID)), statusRemoved)
+					nextID++
+					for _, gt := range ghost {
+						if err := enc.EncodeToken(gt); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+		if err := enc.EncodeToken(t); err != nil {
+			return err
+		}
+	}
+	return enc.Flush()
+}
+
+// readTokens reads the whole document, tokens are copied as decoder reuses its buffers
+func readTokens(r io.Reader) ([]xml.Token, error) {
+	dec := xml.NewDecoder(r)
+	var tokens []xml.Token
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return tokens, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, xml.CopyToken(t))
+	}
+}
+
+// copyCells returns tokens of every mxCell with one of ids, from its start to its end element
+func copyCells(r io.Reader, ids map[int]struct{}) ([][]xml.Token, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	tokens, err := readTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	var cells [][]xml.Token
+	for i := 0; i < len(tokens); i++ {
+		start, ok := tokens[i].(xml.StartElement)
+		if !ok || start.Name.Local != "mxCell" {
+			continue
+		}
+		id, err := strconv.Atoi(attr(start, "id"))
+		if err != nil {
+			continue
+		}
+		if _, ok := ids[id]; !ok {
+			continue
+		}
+		depth := 0
+		for j := i; j < len(tokens); j++ {
+			switch tokens[j].(type) {
+			case xml.StartElement:
+				depth++
+			case xml.EndElement:
+				depth--
+			}
+			if depth == 0 {
+				cells = append(cells, tokens[i:j+1])
+				i = j
+				break
+			}
+		}
+	}
+	return cells, nil
+}
+
+func restyle(start xml.StartElement, s status) xml.StartElement {
+	return setAttr(start, "style", setStyle(attr(start, "style"), statusStyle[s]))
+}
+
+// setStyle replaces values of existing style keys and appends missing ones, order of keys is kept
+func setStyle(style string, values map[string]string) string {
+	var parts []string
+	seen := make(map[string]struct{})
+	for _, part := range strings.Split(style, ";") {
+		if part == "" {
+			continue
+		}
+		if k, _, ok := strings.Cut(part, "="); ok {
+			if v, set := values[k]; set {
+				part = k + "=" + v
+				seen[k] = struct{}{}
+			}
+		}
+		parts = append(parts, part)
+	}
+	for _, k := range []string{"strokeColor", "fontColor", "strokeWidth", "dashed", "opacity"} {
+		if v, set := values[k]; set {
+			if _, ok := seen[k]; !ok {
+				parts = append(parts, k+"="+v)
+			}
+		}
+	}
+	return strings.Join(parts, ";") + ";"
+}
+
+func attr(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// setAttr returns start with attribute set, attributes of start are not changed
+func setAttr(start xml.StartElement, name string, value string) xml.StartElement {
+	start = start.Copy()
+	for i := range start.Attr {
+		if start.Attr[i].Name.Local == name {
+			start.Attr[i].Value = value
+			return start
+		}
+	}
+	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+	return start
+}
@@ -0,0 +1,263 @@
+// Package diff compares two versions of a circuit. Components are matched by mxCell id and
+// connections are compared by pins they join, so moving elements or rerouting a wire without
+// changing what it connects is not a change.
+package diff
+
+import (
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
+	"sort"
+)
+
+const (
+	FieldClass    = "class"
+	FieldSubClass = "subClass"
+)
+
+// Diff is the component level difference between two versions of the circuit
+type Diff struct {
+	UUID    string              `json:"uuid"`
+	Added   []netlist.Component `json:"added"`
+	Removed []netlist.Component `json:"removed"`
+	// Modified are components with changed class or subclass, i.e. symbol replaced in place
+	Modified []Change `json:"modified"`
+	// Values are components with changed label or parsed value
+	Values  []ValueChange `json:"values"`
+	Rewired []Rewire      `json:"rewired"`
+	Nets    []NetChange   `json:"nets"`
+}
+
+type Change struct {
+	ID     int               `json:"id"`
+	Fields []string          `json:"fields"`
+	From   netlist.Component `json:"from"`
+	To     netlist.Component `json:"to"`
+}
+
+type ValueChange struct {
+	ID        int            `json:"id"`
+	FromLabel string         `json:"fromLabel,omitempty"`
+	ToLabel   string         `json:"toLabel,omitempty"`
+	From      *netlist.Value `json:"from,omitempty"`
+	To        *netlist.Value `json:"to,omitempty"`
+}
+
+// Rewire is a pin of a component present in both versions connected to another set of pins
+type Rewire struct {
+	Pin  netlist.PinRef   `json:"pin"`
+	From []netlist.PinRef `json:"from"`
+	To   []netlist.PinRef `json:"to"`
+}
+
+// NetChange is a net which pins differ between versions. Nets are matched by shared pins,
+// From is empty for a new net and To is empty for a net that disappeared.
+type NetChange struct {
+	From    string           `json:"from,omitempty"`
+	To      string           `json:"to,omitempty"`
+	Added   []netlist.PinRef `json:"added"`
+	Removed []netlist.PinRef `json:"removed"`
+	// Wires are mxCell ids of lines of the net in the new version
+	Wires []int `json:"wires,omitempty"`
+}
+
+// Empty reports whether versions are the same circuit
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0 && len(d.Values) == 0 &&
+		len(d.Rewired) == 0 && len(d.Nets) == 0
+}
+
+// Compare returns difference of to against from, both netlists are expected to be of the same diagram
+func Compare(from *netlist.Netlist, to *netlist.Netlist) *Diff {
+	d := &Diff{
+		UUID:     to.UUID,
+		Added:    []netlist.Component{},
+		Removed:  []netlist.Component{},
+		Modified: []Change{},
+		Values:   []ValueChange{},
+		Rewired:  []Rewire{},
+		Nets:     []NetChange{},
+	}
+
+	old := make(map[int]netlist.Component)
+	for _, c := range from.Components {
+		old[c.ID] = c
+	}
+	both := make(map[int]struct{})
+	for _, c := range to.Components {
+		o, ok := old[c.ID]
+		if !ok {
+			d.Added = append(d.Added, c)
+			continue
+		}
+		both[c.ID] = struct{}{}
+
+		var fields []string
+		if o.Class != c.Class {
+			fields = append(fields, FieldClass)
+		}
+		if o.SubClass != c.SubClass {
+			fields = append(fields, FieldSubClass)
+		}
+		if fields != nil {
+			d.Modified = append(d.Modified, Change{ID: c.ID, Fields: fields, From: o, To: c})
+		}
+		if o.Label != c.Label || !sameValue(o.Value, c.Value) {
+			d.Values = append(d.Values, ValueChange{ID: c.ID, FromLabel: o.Label, ToLabel: c.Label, From: o.Value, To: c.Value})
+		}
+	}
+	for _, c := range from.Components {
+		if _, ok := both[c.ID]; !ok {
+			d.Removed = append(d.Removed, c)
+		}
+	}
+
+	oldPeers, newPeers := peers(from), peers(to)
+	for _, c := range to.Components {
+		if _, ok := both[c.ID]; !ok {
+			continue
+		}
+		for _, p := range c.Pins {
+			ref := netlist.PinRef{Component: c.ID, Pin: p}
+			if !samePins(oldPeers[ref], newPeers[ref]) {
+				d.Rewired = append(d.Rewired, Rewire{Pin: ref, From: pinsOrEmpty(oldPeers[ref]), To: pinsOrEmpty(newPeers[ref])})
+			}
+		}
+	}
+
+	d.Nets = compareNets(from.Nets, to.Nets)
+	return d
+}
+
+// peers maps every connected pin to other pins of its net
+func peers(n *netlist.Netlist) map[netlist.PinRef][]netlist.PinRef {
+	res := make(map[netlist.PinRef][]netlist.PinRef)
+	for _, net := range n.Nets {
+		for _, p := range net.Pins {
+			for _, q := range net.Pins {
+				if p != q {
+					res[p] = append(res[p], q)
+				}
+			}
+		}
+	}
+	for p := range res {
+		sortPins(res[p])
+	}
+	return res
+}
+
+// compareNets pairs nets sharing most pins, each net is paired once
+func compareNets(from []netlist.Net, to []netlist.Net) []NetChange {
+	type pair struct {
+		from, to, shared int
+	}
+	var pairs []pair
+	for i := range from {
+		set := pinSet(from[i].Pins)
+		for j := range to {
+			shared := 0
+			for _, p := range to[j].Pins {
+				if _, ok := set[p]; ok {
+					shared++
+				}
+			}
+			if shared > 0 {
+				pairs = append(pairs, pair{i, j, shared})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(a, b int) bool { return pairs[a].shared > pairs[b].shared })
+
+	matchedFrom := make(map[int]int)
+	matchedTo := make(map[int]struct{})
+	for _, p := range pairs {
+		if _, ok := matchedFrom[p.from]; ok {
+			continue
+		}
+		if _, ok := matchedTo[p.to]; ok {
+			continue
+		}
+		matchedFrom[p.from] = p.to
+		matchedTo[p.to] = struct{}{}
+	}
+
+	changes := []NetChange{}
+	toFrom := make(map[int]int)
+	for i, j := range matchedFrom {
+		toFrom[j] = i
+	}
+	for j, net := range to {
+		i, ok := toFrom[j]
+		if !ok {
+			changes = append(changes, NetChange{To: net.Name, Added: pinsOrEmpty(net.Pins), Removed: []netlist.PinRef{},
+				Wires: net.Wires})
+			continue
+		}
+		added, removed := subtract(net.Pins, from[i].Pins), subtract(from[i].Pins, net.Pins)
+		if len(added) > 0 || len(removed) > 0 {
+			changes = append(changes, NetChange{From: from[i].Name, To: net.Name, Added: added, Removed: removed,
+				Wires: net.Wires})
+		}
+	}
+	for i, net := range from {
+		if _, ok := matchedFrom[i]; !ok {
+			changes = append(changes, NetChange{From: net.Name, Added: []netlist.PinRef{}, Removed: pinsOrEmpty(net.Pins)})
+		}
+	}
+	return changes
+}
+
+func pinSet(pins []netlist.PinRef) map[netlist.PinRef]struct{} {
+	set := make(map[netlist.PinRef]struct{}, len(pins))
+	for _, p := range pins {
+		set[p] = struct{}{}
+	}
+	return set
+}
+
+// subtract returns pins of a missing in b
+func subtract(a []netlist.PinRef, b []netlist.PinRef) []netlist.PinRef {
+	set := pinSet(b)
+	res := []netlist.PinRef{}
+	for _, p := range a {
+		if _, ok := set[p]; !ok {
+			res = append(res, p)
+		}
+	}
+	sortPins(res)
+	return res
+}
+
+func samePins(a []netlist.PinRef, b []netlist.PinRef) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameValue(a *netlist.Value, b *netlist.Value) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func pinsOrEmpty(pins []netlist.PinRef) []netlist.PinRef {
+	if pins == nil {
+		return []netlist.PinRef{}
+	}
+	return pins
+}
+
+func sortPins(pins []netlist.PinRef) {
+	sort.Slice(pins, func(i, j int) bool {
+		if pins[i].Component != pins[j].Component {
+			return pins[i].Component < pins[j].Component
+		}
+		return pins[i].Pin < pins[j].Pin
+	})
+}
@@ -0,0 +1,137 @@
+package diff
+
+import (
+	"bytes"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const uuid = "uweCVhkyVy6MirBnUyNJ"
+
+var base = []drawio.Item{
+	{UUID: uuid, EID: 3, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "10k"},
+	{UUID: uuid, EID: 4, Class: drawio.ItemClassInductors, SubClass: "inductor_3"},
+	{UUID: uuid, EID: 6, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1"},
+	{UUID: uuid, EID: 7, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 6, ExitX: 1, EntryX: 0},
+	{UUID: uuid, EID: 8, Class: drawio.ItemClassLines, SourceId: 6, TargetId: 4, ExitX: 1, EntryX: 0},
+}
+
+func TestCompare(t *testing.T) {
+	t.Run("layout only", func(t *testing.T) {
+		moved := append([]drawio.Item{}, base...)
+		// wire rerouted to the same pin, exit point moved along the pin
+		moved[3].ExitX, moved[3].ExitY = 0.9, 0.2
+		// same connection drawn with a new line
+		moved[4].EID = 12
+		d := Compare(netlist.FromItems(uuid, base), netlist.FromItems(uuid, moved))
+		assert.True(t, d.Empty())
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		edited := []drawio.Item{
+			{UUID: uuid, EID: 3, Class: drawio.ItemClassResistors, SubClass: "resistor_2", Value: "22k"},
+			{UUID: uuid, EID: 6, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1"},
+			{UUID: uuid, EID: 9, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "1k"},
+			{UUID: uuid, EID: 7, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 6, ExitX: 1, EntryX: 0},
+			{UUID: uuid, EID: 10, Class: drawio.ItemClassLines, SourceId: 6, TargetId: 9, ExitX: 1, EntryX: 0},
+		}
+		d := Compare(netlist.FromItems(uuid, base), netlist.FromItems(uuid, edited))
+		assert.False(t, d.Empty())
+		assert.Equal(t, uuid, d.UUID)
+
+		assert.Len(t, d.Added, 1)
+		assert.Equal(t, 9, d.Added[0].ID)
+		assert.Len(t, d.Removed, 1)
+		assert.Equal(t, 4, d.Removed[0].ID)
+
+		assert.Len(t, d.Modified, 1)
+		assert.Equal(t, []string{FieldSubClass}, d.Modified[0].Fields)
+		assert.Len(t, d.Values, 1)
+		assert.Equal(t, "10k", d.Values[0].FromLabel)
+		assert.Equal(t, 22000.0, d.Values[0].To.Magnitude)
+
+		// capacitor pin 2 moved from inductor to the new resistor
+		assert.Equal(t, []Rewire{{
+			Pin:  netlist.PinRef{Component: 6, Pin: netlist.PinSecond},
+			From: []netlist.PinRef{{Component: 4, Pin: netlist.PinFirst}},
+			To:   []netlist.PinRef{{Component: 9, Pin: netlist.PinFirst}},
+		}}, d.Rewired)
+
+		assert.Len(t, d.Nets, 1)
+		assert.Equal(t, []netlist.PinRef{{Component: 9, Pin: netlist.PinFirst}}, d.Nets[0].Added)
+		assert.Equal(t, []netlist.PinRef{{Component: 4, Pin: netlist.PinFirst}}, d.Nets[0].Removed)
+		assert.Equal(t, []int{10}, d.Nets[0].Wires)
+	})
+
+	t.Run("nets appear and disappear", func(t *testing.T) {
+		d := Compare(netlist.FromItems(uuid, base[:4]), netlist.FromItems(uuid, append(base[:3:3], base[4])))
+		assert.Len(t, d.Nets, 2)
+		assert.Empty(t, d.Nets[0].From)
+		assert.Len(t, d.Nets[0].Added, 2)
+		assert.Empty(t, d.Nets[1].To)
+		assert.Len(t, d.Nets[1].Removed, 2)
+	})
+}
+
+const fromDoc = `<mxfile><diagram id="uweCVhkyVy6MirBnUyNJ"><mxGraphModel><root>
+<mxCell id="0"/><mxCell id="1" parent="0"/>
+<mxCell id="3" value="10k" style="shape=mxgraph.electrical.resistors.resistor_1;strokeColor=#000000;" vertex="1" parent="1"><mxGeometry x="110" y="140" width="100" height="20" as="geometry"/></mxCell>
+<mxCell id="4" value="" style="shape=mxgraph.electrical.inductors.inductor_3;" vertex="1" parent="1"><mxGeometry x="260" y="120" width="100" height="10" as="geometry"/></mxCell>
+</root></mxGraphModel></diagram></mxfile>`
+
+const toDoc = `<?xml version="1.0" encoding="UTF-8"?>
+<mxfile><diagram id="uweCVhkyVy6MirBnUyNJ"><mxGraphModel><root>
+<mxCell id="0"/><mxCell id="1" parent="0"/>
+<mxCell id="3" value="22k" style="shape=mxgraph.electrical.resistors.resistor_1;strokeColor=#000000;" vertex="1" parent="1"><mxGeometry x="110" y="140" width="100" height="20" as="geometry"/></mxCell>
+<mxCell id="9" value="1k" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1"><mxGeometry x="300" y="140" width="100" height="20" as="geometry"/></mxCell>
+</root></mxGraphModel></diagram></mxfile>`
+
+func TestAnnotate(t *testing.T) {
+	parse := func(doc string) *netlist.Netlist {
+		m, err := drawio.ReadMxfile(strings.NewReader(doc))
+		assert.NoError(t, err)
+		var items []drawio.Item
+		for i := range m.Diagram.MxGraphModel.Root.MxCells {
+			cell := &m.Diagram.MxGraphModel.Root.MxCells[i]
+			if cell.HasStyle() {
+				items = append(items, drawio.NewItem(cell, uuid))
+			}
+		}
+		return netlist.FromItems(uuid, items)
+	}
+	d := Compare(parse(fromDoc), parse(toDoc))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, Annotate(buf, strings.NewReader(fromDoc), strings.NewReader(toDoc), d))
+
+	annotated, err := drawio.ReadMxfile(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	cells := annotated.Diagram.MxGraphModel.Root.MxCells
+	assert.Len(t, cells, 5)
+
+	color := func(i int) string {
+		v, _ := cells[i].Attr("strokeColor")
+		return v
+	}
+	assert.Equal(t, 3, cells[2].Id)
+	assert.Equal(t, modifiedColor, color(2))
+	assert.Equal(t, 9, cells[3].Id)
+	assert.Equal(t, addedColor, color(3))
+
+	// removed inductor is taken from the previous version with a new id and its geometry
+	assert.Equal(t, 10, cells[4].Id)
+	assert.Equal(t, removedColor, color(4))
+	assert.Equal(t, 260.0, cells[4].Geometry.X)
+	shape, _ := cells[4].Attr("shape")
+	assert.Equal(t, "mxgraph.electrical.inductors.inductor_3", shape)
+	assert.True(t, strings.HasPrefix(buf.String(), "<?xml"))
+}
+
+func TestSetStyle(t *testing.T) {
+	assert.Equal(t, "ellipse;strokeColor=#2ec27e;html=1;strokeWidth=3;",
+		setStyle("ellipse;strokeColor=#000000;html=1", map[string]string{"strokeColor": addedColor, "strokeWidth": "3"}))
+	assert.Equal(t, "dashed=1;", setStyle("", map[string]string{"dashed": "1"}))
+}
@@ -71,15 +71,55 @@ type Mxfile struct {
 }
 
 type MxCell struct {
-	Id     int     `xml:"id,attr"`
-	Style  style   `xml:"style,attr"`
-	Value  string  `xml:"value,attr"`
-	Source int     `xml:"source,attr,omitempty"`
-	Target int     `xml:"target,attr,omitempty"`
-	ExitX  float32 `xml:"exitX,attr,omitempty"`
-	ExitY  float32 `xml:"exitY,attr,omitempty"`
-	EntryX float32 `xml:"entryX,attr,omitempty"`
-	EntryY float32 `xml:"entryY,attr,omitempty"`
+	Id       int        `xml:"id,attr"`
+	Style    style      `xml:"style,attr"`
+	Value    string     `xml:"value,attr"`
+	Source   int        `xml:"source,attr,omitempty"`
+	Target   int        `xml:"target,attr,omitempty"`
+	ExitX    float32    `xml:"exitX,attr,omitempty"`
+	ExitY    float32    `xml:"exitY,attr,omitempty"`
+	EntryX   float32    `xml:"entryX,attr,omitempty"`
+	EntryY   float32    `xml:"entryY,attr,omitempty"`
+	Geometry MxGeometry `xml:"mxGeometry"`
+}
+
+// MxGeometry keeps position and size of a vertex, for edges it keeps
+// loose end points and waypoints of the line.
+type MxGeometry struct {
+	X         float64   `xml:"x,attr"`
+	Y         float64   `xml:"y,attr"`
+	Width     float64   `xml:"width,attr"`
+	Height    float64   `xml:"height,attr"`
+	Points    []MxPoint `xml:"mxPoint"`
+	Waypoints []MxPoint `xml:"Array>mxPoint"`
+}
+
+type MxPoint struct {
+	X  float64 `xml:"x,attr"`
+	Y  float64 `xml:"y,attr"`
+	As string  `xml:"as,attr"`
+}
+
+// Point returns geometry point by its "as" attribute, i.e. sourcePoint or targetPoint
+func (g *MxGeometry) Point(as string) (MxPoint, bool) {
+	for _, p := range g.Points {
+		if p.As == as {
+			return p, true
+		}
+	}
+	return MxPoint{}, false
+}
+
+// Attr returns style attribute of the cell
+func (mx *MxCell) Attr(name string) (string, bool) {
+	v, ok := mx.Style.attrs[name]
+	return v, ok
+}
+
+// HasStyle reports whether cell has any style attributes, cells without style are
+// the service cells of the document (root and default layer)
+func (mx *MxCell) HasStyle() bool {
+	return mx.Style.attrs != nil
 }
 
 type style struct {
@@ -106,10 +146,11 @@ func (sh *style) UnmarshalXMLAttr(attr xml.Attr) error {
 	return nil
 }
 
-func NewItemDTO(mx *MxCell, uuid string) ItemDTO {
-	item := ItemDTO{
+// NewItem converts the cell of the diagram to Item
+func NewItem(mx *MxCell, uuid string) Item {
+	item := Item{
 		UUID:  uuid,
-		ID:    mx.Id,
+		EID:   mx.Id,
 		Value: mx.Value,
 	}
 
@@ -139,20 +180,26 @@ func NewItemDTO(mx *MxCell, uuid string) ItemDTO {
 	return item
 }
 
-// ReadInDiagram converts incoming document from xml to a channel of diagram.Item  objects
-func (c *Controller) XmlToItems(ctx context.Context, logger *zap.Logger, xmldoc *bytes.Reader, ch chan Item) (uuid string, err error) {
-	logger.Info("processing new document")
+// ReadMxfile reads and unmarshals drawio document, empty document is not an error here
+func ReadMxfile(r io.Reader) (*Mxfile, error) {
 	D := &Mxfile{}
-	xmlbytes, err := io.ReadAll(xmldoc)
+	xmlbytes, err := io.ReadAll(r)
 	if err != nil {
-		logger.Error("could not read in the document",
-			zap.Error(err),
-		)
-		return uuid, err
+		return nil, err
 	}
 
 	err = xml.Unmarshal(xmlbytes, D)
 	if err != nil && err.Error() != "EOF" {
+		return nil, err
+	}
+	return D, nil
+}
+
+// ReadInDiagram converts incoming document from xml to a channel of diagram.Item  objects
+func (c *Controller) XmlToItems(ctx context.Context, logger *zap.Logger, xmldoc *bytes.Reader, ch chan Item) (uuid string, err error) {
+	logger.Info("processing new document")
+	D, err := ReadMxfile(xmldoc)
+	if err != nil {
 		logger.Error("can not unmarshal document",
 			zap.Error(err),
 		)
@@ -170,25 +217,8 @@ func (c *Controller) XmlToItems(ctx context.Context, logger *zap.Logger, xmldoc
 			)
 			continue
 		}
-		di := NewItemDTO(&item, uuid)
-		ch <- ItemsAdapter(di)
+		ch <- NewItem(&item, uuid)
 	}
 
 	return uuid, err
 }
-
-func ItemsAdapter(item ItemDTO) Item {
-	return Item{
-		UUID:     item.UUID,
-		EID:      item.ID,
-		Value:    item.Value,
-		Class:    item.Class,
-		SubClass: item.SubClass,
-		SourceId: item.SourceId,
-		TargetId: item.TargetId,
-		ExitX:    item.ExitX,
-		ExitY:    item.ExitY,
-		EntryX:   item.EntryY,
-		EntryY:   item.EntryY,
-	}
-}
@@ -79,7 +79,7 @@ func TestXMLBasic(t *testing.T) {
 	})
 }
 
-func TestNewItemDTO(t *testing.T) {
+func TestNewItem(t *testing.T) {
 	tests := []struct {
 		name           string
 		xmlin          []byte
@@ -180,8 +180,8 @@ func TestNewItemDTO(t *testing.T) {
 			_ = xml.Unmarshal(test.xmlin, D)
 			var elem MxCell
 			elem = D.Diagram.MxGraphModel.Root.MxCells[2]
-			dto := NewItemDTO(&elem, "ijifjvifjv")
-			assert.Equal(t, dto.Class, test.expectedResult[0])
+			item := NewItem(&elem, "ijifjvifjv")
+			assert.Equal(t, item.Class, test.expectedResult[0])
 		})
 	}
 }
@@ -0,0 +1,172 @@
+package export
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatDot     = "dot"
+	FormatGraphML = "graphml"
+
+	graphMLNamespace = "http://graphml.graphdrawing.org/xmlns"
+)
+
+var ContentType = map[string]string{
+	FormatDot:     "text/vnd.graphviz",
+	FormatGraphML: "application/graphml+xml",
+}
+
+// split sorts items into elements and connections, connections with missing endpoint are dropped
+// as both formats require existing nodes on both ends of an edge
+func split(items []drawio.Item) (nodes []drawio.Item, edges []drawio.Item) {
+	known := make(map[int]struct{})
+	for _, item := range items {
+		if item.Class != drawio.ItemClassLines {
+			nodes = append(nodes, item)
+			known[item.EID] = struct{}{}
+		}
+	}
+	for _, item := range items {
+		if item.Class != drawio.ItemClassLines {
+			continue
+		}
+		_, sok := known[item.SourceId]
+		_, tok := known[item.TargetId]
+		if sok && tok {
+			edges = append(edges, item)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].EID < nodes[j].EID })
+	sort.Slice(edges, func(i, j int) bool { return edges[i].EID < edges[j].EID })
+	return nodes, edges
+}
+
+// Dot writes undirected graphviz graph of the diagram
+func Dot(w io.Writer, uuid string, items []drawio.Item) error {
+	nodes, edges := split(items)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "graph %s {\n", dotQuote(uuid))
+	for _, n := range nodes {
+		fmt.Fprintf(bw, "\t%d [class=%s, subclass=%s, value=%s, label=%s];\n",
+			n.EID, dotQuote(n.Class), dotQuote(n.SubClass), dotQuote(n.Value), dotQuote(label(n)))
+	}
+	for _, e := range edges {
+		fmt.Fprintf(bw, "\t%d -- %d [eid=%d, exitX=%s, exitY=%s, entryX=%s, entryY=%s];\n",
+			e.SourceId, e.TargetId, e.EID, pin(e.ExitX), pin(e.ExitY), pin(e.EntryX), pin(e.EntryY))
+	}
+	fmt.Fprint(bw, "}\n")
+	return bw.Flush()
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	ID     string        `xml:"id,attr"`
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// GraphML writes diagram graph as GraphML document, node ids are "n<mxCell id>", edge ids are "e<mxCell id>"
+func GraphML(w io.Writer, uuid string, items []drawio.Item) error {
+	nodes, edges := split(items)
+	doc := graphML{
+		Xmlns: graphMLNamespace,
+		Keys: []graphMLKey{
+			{ID: "class", For: "node", Name: "class", Type: "string"},
+			{ID: "subclass", For: "node", Name: "subclass", Type: "string"},
+			{ID: "value", For: "node", Name: "value", Type: "string"},
+			{ID: "exitX", For: "edge", Name: "exitX", Type: "float"},
+			{ID: "exitY", For: "edge", Name: "exitY", Type: "float"},
+			{ID: "entryX", For: "edge", Name: "entryX", Type: "float"},
+			{ID: "entryY", For: "edge", Name: "entryY", Type: "float"},
+		},
+		Graph: graphMLGraph{ID: uuid, EdgeDefault: "undirected"},
+	}
+	for _, n := range nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{
+			ID: "n" + strconv.Itoa(n.EID),
+			Data: []graphMLData{
+				{Key: "class", Value: n.Class},
+				{Key: "subclass", Value: n.SubClass},
+				{Key: "value", Value: n.Value},
+			},
+		})
+	}
+	for _, e := range edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			ID:     "e" + strconv.Itoa(e.EID),
+			Source: "n" + strconv.Itoa(e.SourceId),
+			Target: "n" + strconv.Itoa(e.TargetId),
+			Data: []graphMLData{
+				{Key: "exitX", Value: pin(e.ExitX)},
+				{Key: "exitY", Value: pin(e.ExitY)},
+				{Key: "entryX", Value: pin(e.EntryX)},
+				{Key: "entryY", Value: pin(e.EntryY)},
+			},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// label is what graphviz shows on the node: value of the element if set, class and id otherwise
+func label(item drawio.Item) string {
+	if item.Value != "" {
+		return item.Value
+	}
+	return item.SubClass + " #" + strconv.Itoa(item.EID)
+}
+
+func pin(f float32) string {
+	return strconv.FormatFloat(float64(f), 'g', -1, 32)
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,56 @@
+package export
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var items = []drawio.Item{
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 6, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: `C1 "10u"`},
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 3, Class: drawio.ItemClassResistors, SubClass: "resistor_1"},
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 7, Class: drawio.ItemClassLines, SubClass: "line",
+		SourceId: 3, TargetId: 6, ExitX: 0.993, ExitY: 0.5, EntryX: 0.004, EntryY: 0.5},
+	// dangling line, target is not set
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 9, Class: drawio.ItemClassLines, SubClass: "line", SourceId: 3},
+}
+
+func TestDot(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := Dot(buf, "uweCVhkyVy6MirBnUyNJ", items)
+	assert.NoError(t, err)
+	assert.Equal(t, `graph "uweCVhkyVy6MirBnUyNJ" {
+	3 [class="resistors", subclass="resistor_1", value="", label="resistor_1 #3"];
+	6 [class="capacitors", subclass="capacitor_1", value="C1 \"10u\"", label="C1 \"10u\""];
+	3 -- 6 [eid=7, exitX=0.993, exitY=0.5, entryX=0.004, entryY=0.5];
+}
+`, buf.String())
+}
+
+func TestGraphML(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := GraphML(buf, "uweCVhkyVy6MirBnUyNJ", items)
+	assert.NoError(t, err)
+
+	var doc graphML
+	err = xml.Unmarshal(buf.Bytes(), &doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "uweCVhkyVy6MirBnUyNJ", doc.Graph.ID)
+	assert.Len(t, doc.Graph.Nodes, 2)
+	assert.Equal(t, "n3", doc.Graph.Nodes[0].ID)
+	assert.Equal(t, graphMLData{Key: "value", Value: `C1 "10u"`}, doc.Graph.Nodes[1].Data[2])
+	assert.Len(t, doc.Graph.Edges, 1)
+	assert.Equal(t, graphMLEdge{
+		ID:     "e7",
+		Source: "n3",
+		Target: "n6",
+		Data: []graphMLData{
+			{Key: "exitX", Value: "0.993"},
+			{Key: "exitY", Value: "0.5"},
+			{Key: "entryX", Value: "0.004"},
+			{Key: "entryY", Value: "0.5"},
+		},
+	}, doc.Graph.Edges[0])
+}
@@ -0,0 +1,349 @@
+// Package filegraph is an embedded graph storage for single node deployments.
+// Diagrams are kept in memory with memgraph semantics and every pushed diagram
+// is written to its own JSON file, files are read back on start.
+package filegraph
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/memgraph"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileVersion = 1
+	fileExt     = ".json"
+)
+
+type Storage struct {
+	Path string
+	mem  *memgraph.Storage
+	// mu serializes file writes
+	mu sync.Mutex
+}
+
+// document is the file content of a single diagram with all its versions
+type document struct {
+	Version  int       `json:"version"`
+	UUID     string    `json:"uuid"`
+	Versions []version `json:"versions"`
+}
+
+// version is a diagram version, trashed versions have Deleted set and purged ones keep the number only
+type version struct {
+	Version       int        `json:"version"`
+	Project       string     `json:"project,omitempty"`
+	Source        string     `json:"source,omitempty"`
+	SourceVersion string     `json:"sourceVersion,omitempty"`
+	Created       time.Time  `json:"created"`
+	Deleted       *time.Time `json:"deleted,omitempty"`
+	Purged        bool       `json:"purged,omitempty"`
+	Items         []record   `json:"items"`
+}
+
+type record struct {
+	ID       int     `json:"id"`
+	Value    string  `json:"value,omitempty"`
+	Class    string  `json:"class"`
+	SubClass string  `json:"subClass,omitempty"`
+	Source   int     `json:"source,omitempty"`
+	Target   int     `json:"target,omitempty"`
+	ExitX    float32 `json:"exitX,omitempty"`
+	ExitY    float32 `json:"exitY,omitempty"`
+	EntryX   float32 `json:"entryX,omitempty"`
+	EntryY   float32 `json:"entryY,omitempty"`
+}
+
+// NewStorage creates directory if needed and loads all diagrams stored in it
+func NewStorage(logger *zap.Logger, path string) (*Storage, error) {
+	if err := os.MkdirAll(path, 0o750); err != nil {
+		return nil, fmt.Errorf("could not create graph storage directory: %w", err)
+	}
+	s := &Storage{
+		Path: path,
+		mem:  memgraph.NewStorage(),
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*"+fileExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		doc, err := readDocument(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", file, err)
+		}
+		for _, v := range doc.Versions {
+			items := make([]drawio.Item, 0, len(v.Items))
+			for _, r := range v.Items {
+				items = append(items, r.item(doc.UUID))
+			}
+			meta := calculator.DiagramVersion{
+				UUID:          doc.UUID,
+				Version:       v.Version,
+				Project:       v.Project,
+				Source:        v.Source,
+				SourceVersion: v.SourceVersion,
+				Created:       v.Created,
+				Deleted:       v.Deleted,
+			}
+			if err = s.mem.PutVersion(memgraph.Version{Meta: meta, Items: items, Purged: v.Purged}); err != nil {
+				return nil, fmt.Errorf("could not read %s: %w", file, err)
+			}
+		}
+	}
+	logger.Info("embedded graph storage loaded",
+		zap.String("path", path),
+		zap.Int("diagrams", len(files)),
+	)
+	return s, nil
+}
+
+// PushItems stores items in memory and writes every changed diagram to its file, the diagrams are reset
+// when a file could not be written. Items are read before the files are locked, so a slow producer does
+// not hold writes of other diagrams.
+func (s *Storage) PushItems(ctx context.Context, logger *zap.Logger, opts calculator.PushOptions, items <-chan drawio.Item) (calculator.PushSummary, error) {
+	var read []drawio.Item
+OuterLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			return calculator.PushSummary{}, ctx.Err()
+		case item, ok := <-items:
+			if !ok {
+				break OuterLoop
+			}
+			read = append(read, item)
+		}
+	}
+	buffered := make(chan drawio.Item, len(read))
+	for _, item := range read {
+		buffered <- item
+	}
+	close(buffered)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := make(map[string][]memgraph.Version)
+	for _, item := range read {
+		if _, ok := before[item.UUID]; !ok {
+			before[item.UUID] = s.mem.Snapshot(item.UUID)
+		}
+	}
+	summary, err := s.mem.PushItems(ctx, logger, opts, buffered)
+	if err != nil {
+		return summary, err
+	}
+	for uuid := range before {
+		if _, ok := summary.Versions[uuid]; !ok {
+			delete(before, uuid)
+		}
+	}
+	if err = s.persist(logger, before); err != nil {
+		return calculator.PushSummary{}, err
+	}
+	return summary, nil
+}
+
+func (s *Storage) LoadItems(ctx context.Context, logger *zap.Logger, uuid string, version int) ([]drawio.Item, error) {
+	return s.mem.LoadItems(ctx, logger, uuid, version)
+}
+
+func (s *Storage) ListDiagrams(ctx context.Context, logger *zap.Logger) ([]string, error) {
+	return s.mem.ListDiagrams(ctx, logger)
+}
+
+func (s *Storage) ListVersions(ctx context.Context, logger *zap.Logger, uuid string) ([]calculator.DiagramVersion, error) {
+	return s.mem.ListVersions(ctx, logger, uuid)
+}
+
+func (s *Storage) LoadElement(ctx context.Context, logger *zap.Logger, uuid string, version int, eid int) (*calculator.Element, error) {
+	return s.mem.LoadElement(ctx, logger, uuid, version, eid)
+}
+
+func (s *Storage) FindElements(ctx context.Context, logger *zap.Logger, q calculator.ElementQuery) ([]calculator.ElementMatch, error) {
+	return s.mem.FindElements(ctx, logger, q)
+}
+
+func (s *Storage) FindPaths(ctx context.Context, logger *zap.Logger, q calculator.PathQuery) ([][]drawio.Item, error) {
+	return s.mem.FindPaths(ctx, logger, q)
+}
+
+func (s *Storage) DeleteDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error {
+	return s.change(logger, uuid, func() error { return s.mem.DeleteDiagram(ctx, logger, uuid, version) })
+}
+
+func (s *Storage) RestoreDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error {
+	return s.change(logger, uuid, func() error { return s.mem.RestoreDiagram(ctx, logger, uuid, version) })
+}
+
+func (s *Storage) PurgeDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error {
+	return s.change(logger, uuid, func() error { return s.mem.PurgeDiagram(ctx, logger, uuid, version) })
+}
+
+func (s *Storage) ListTrash(ctx context.Context, logger *zap.Logger) ([]calculator.DiagramVersion, error) {
+	return s.mem.ListTrash(ctx, logger)
+}
+
+// change applies f to the diagram in memory and writes diagram file when it succeeds, the diagram is reset
+// when the file could not be written
+func (s *Storage) change(logger *zap.Logger, uuid string, f func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := map[string][]memgraph.Version{uuid: s.mem.Snapshot(uuid)}
+	if err := f(); err != nil {
+		return err
+	}
+	return s.persist(logger, before)
+}
+
+// persist writes files of the changed diagrams, before are their snapshots taken prior to the change.
+// When a file could not be written, every diagram is reset to its snapshot in memory and files written
+// already are written back, so memory does not keep changes the files miss.
+func (s *Storage) persist(logger *zap.Logger, before map[string][]memgraph.Version) error {
+	var written []string
+	for uuid := range before {
+		err := s.write(uuid)
+		if err == nil {
+			written = append(written, uuid)
+			continue
+		}
+		logger.Error("could not write diagram file, diagrams reset",
+			zap.String("uuid", uuid),
+			zap.Error(err),
+		)
+		for uuid, versions := range before {
+			if err := s.mem.ResetDiagram(uuid, versions); err != nil {
+				logger.Error("could not reset diagram",
+					zap.String("uuid", uuid),
+					zap.Error(err),
+				)
+			}
+		}
+		for _, uuid := range written {
+			if err := s.write(uuid); err != nil {
+				logger.Error("could not write diagram file back",
+					zap.String("uuid", uuid),
+					zap.Error(err),
+				)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// write replaces diagram file with a new one, so a crash never leaves a partially written diagram
+func (s *Storage) write(uuid string) error {
+	snapshot := s.mem.Snapshot(uuid)
+	if len(snapshot) == 0 {
+		// diagram reset to nothing
+		if err := os.Remove(s.file(uuid)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	doc := document{Version: fileVersion, UUID: uuid}
+	for _, stored := range snapshot {
+		v := version{
+			Version:       stored.Meta.Version,
+			Project:       stored.Meta.Project,
+			Source:        stored.Meta.Source,
+			SourceVersion: stored.Meta.SourceVersion,
+			Created:       stored.Meta.Created,
+			Deleted:       stored.Meta.Deleted,
+			Purged:        stored.Purged,
+			Items:         []record{},
+		}
+		for _, item := range stored.Items {
+			v.Items = append(v.Items, newRecord(item))
+		}
+		doc.Versions = append(doc.Versions, v)
+	}
+
+	tmp, err := os.CreateTemp(s.Path, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = json.NewEncoder(tmp).Encode(doc); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file(uuid))
+}
+
+// file names are encoded uuids, they never start with a dot like temporary files
+func (s *Storage) file(uuid string) string {
+	return filepath.Join(s.Path, base64.RawURLEncoding.EncodeToString([]byte(uuid))+fileExt)
+}
+
+func readDocument(file string) (*document, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var doc document
+	if err = json.NewDecoder(f).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Version != fileVersion {
+		return nil, fmt.Errorf("unsupported file version %d", doc.Version)
+	}
+	name := strings.TrimSuffix(filepath.Base(file), fileExt)
+	if base64.RawURLEncoding.EncodeToString([]byte(doc.UUID)) != name {
+		return nil, fmt.Errorf("diagram uuid %q does not match file name", doc.UUID)
+	}
+	return &doc, nil
+}
+
+func newRecord(item drawio.Item) record {
+	return record{
+		ID:       item.EID,
+		Value:    item.Value,
+		Class:    item.Class,
+		SubClass: item.SubClass,
+		Source:   item.SourceId,
+		Target:   item.TargetId,
+		ExitX:    item.ExitX,
+		ExitY:    item.ExitY,
+		EntryX:   item.EntryX,
+		EntryY:   item.EntryY,
+	}
+}
+
+func (r record) item(uuid string) drawio.Item {
+	return drawio.Item{
+		UUID:     uuid,
+		EID:      r.ID,
+		Value:    r.Value,
+		Class:    r.Class,
+		SubClass: r.SubClass,
+		SourceId: r.Source,
+		TargetId: r.Target,
+		ExitX:    r.ExitX,
+		ExitY:    r.ExitY,
+		EntryX:   r.EntryX,
+		EntryY:   r.EntryY,
+	}
+}
@@ -0,0 +1,169 @@
+package filegraph
+
+import (
+	"context"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func push(s *Storage, opts calculator.PushOptions, items []drawio.Item) (calculator.PushSummary, error) {
+	ch := make(chan drawio.Item, len(items))
+	for _, item := range items {
+		ch <- item
+	}
+	close(ch)
+	return s.PushItems(context.Background(), zap.NewNop(), opts, ch)
+}
+
+func TestStorage(t *testing.T) {
+	dir := t.TempDir()
+	logger := zap.NewNop()
+	s, err := NewStorage(logger, dir)
+	assert.NoError(t, err)
+
+	input := []drawio.Item{
+		{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 3, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "4k7"},
+		{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 6, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1"},
+		{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 7, Class: drawio.ItemClassLines, SubClass: "line",
+			SourceId: 3, TargetId: 6, ExitX: 1, ExitY: 0.5, EntryY: 0.5},
+		{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 9, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 42},
+		{UUID: "../escape", EID: 1, Class: drawio.ItemClassResistors},
+	}
+	summary, err := push(s, calculator.PushOptions{Project: "test", Source: "test/diagram.xml"}, input)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Nodes)
+	assert.Equal(t, 1, summary.Relations)
+	if assert.Len(t, summary.Failed, 2) {
+		// invalid uuids are refused before they get to file names
+		assert.Equal(t, "../escape", summary.Failed[0].UUID)
+		assert.ErrorIs(t, summary.Failed[1].Error, calculator.ErrNoRelationEndpoint)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Len(t, files, 1)
+
+	// second version without the wire
+	_, err = push(s, calculator.PushOptions{}, input[:2])
+	assert.NoError(t, err)
+
+	t.Run("diagrams are read back after restart", func(t *testing.T) {
+		s, err := NewStorage(logger, dir)
+		assert.NoError(t, err)
+		items, err := s.LoadItems(context.Background(), logger, "uweCVhkyVy6MirBnUyNJ", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, input[:3], items)
+
+		items, err = s.LoadItems(context.Background(), logger, "uweCVhkyVy6MirBnUyNJ", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, input[:2], items)
+
+		versions, err := s.ListVersions(context.Background(), logger, "uweCVhkyVy6MirBnUyNJ")
+		assert.NoError(t, err)
+		assert.Equal(t, "test/diagram.xml", versions[0].Source)
+		assert.False(t, versions[0].Created.IsZero())
+
+		_, err = s.LoadItems(context.Background(), logger, "../escape", 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("trash is read back after restart", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewStorage(logger, dir)
+		assert.NoError(t, err)
+		for range []int{1, 2, 3} {
+			_, err = push(s, calculator.PushOptions{}, input[:2])
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, s.DeleteDiagram(context.Background(), logger, "uweCVhkyVy6MirBnUyNJ", 0))
+		assert.NoError(t, s.RestoreDiagram(context.Background(), logger, "uweCVhkyVy6MirBnUyNJ", 1))
+		assert.NoError(t, s.PurgeDiagram(context.Background(), logger, "uweCVhkyVy6MirBnUyNJ", 3))
+
+		s, err = NewStorage(logger, dir)
+		assert.NoError(t, err)
+		versions, err := s.ListVersions(context.Background(), logger, "uweCVhkyVy6MirBnUyNJ")
+		assert.NoError(t, err)
+		assert.Len(t, versions, 1)
+		trash, err := s.ListTrash(context.Background(), logger)
+		assert.NoError(t, err)
+		assert.Len(t, trash, 1)
+		assert.Equal(t, 2, trash[0].Version)
+
+		summary, err := push(s, calculator.PushOptions{}, input[:2])
+		assert.NoError(t, err)
+		assert.Equal(t, 4, summary.Versions["uweCVhkyVy6MirBnUyNJ"])
+	})
+
+	t.Run("slow producer does not block other diagrams", func(t *testing.T) {
+		slow := make(chan drawio.Item)
+		done := make(chan error)
+		go func() {
+			_, err := s.PushItems(context.Background(), logger, calculator.PushOptions{}, slow)
+			done <- err
+		}()
+		slow <- drawio.Item{UUID: "slow", EID: 1, Class: drawio.ItemClassResistors}
+
+		pushed := make(chan error)
+		go func() {
+			_, err := push(s, calculator.PushOptions{}, []drawio.Item{{UUID: "fast", EID: 1, Class: drawio.ItemClassResistors}})
+			pushed <- err
+		}()
+		select {
+		case err := <-pushed:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("push is blocked by the slow producer")
+		}
+		close(slow)
+		assert.NoError(t, <-done)
+		items, err := s.LoadItems(context.Background(), logger, "slow", 0)
+		assert.NoError(t, err)
+		assert.Len(t, items, 1)
+	})
+
+	t.Run("read-only directory", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("directory permissions do not apply to root")
+		}
+		dir := t.TempDir()
+		s, err := NewStorage(logger, dir)
+		assert.NoError(t, err)
+		_, err = push(s, calculator.PushOptions{}, input[:2])
+		assert.NoError(t, err)
+		assert.NoError(t, os.Chmod(dir, 0o500))
+		defer os.Chmod(dir, 0o700)
+
+		_, err = push(s, calculator.PushOptions{}, input[:2])
+		assert.Error(t, err)
+		_, err = push(s, calculator.PushOptions{}, []drawio.Item{{UUID: "new", EID: 1, Class: drawio.ItemClassResistors}})
+		assert.Error(t, err)
+		assert.Error(t, s.DeleteDiagram(context.Background(), logger, "uweCVhkyVy6MirBnUyNJ", 1))
+
+		// memory keeps what the files have
+		versions, err := s.ListVersions(context.Background(), logger, "uweCVhkyVy6MirBnUyNJ")
+		assert.NoError(t, err)
+		assert.Len(t, versions, 1)
+		diagrams, err := s.ListDiagrams(context.Background(), logger)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"uweCVhkyVy6MirBnUyNJ"}, diagrams)
+		trash, err := s.ListTrash(context.Background(), logger)
+		assert.NoError(t, err)
+		assert.Empty(t, trash)
+
+		assert.NoError(t, os.Chmod(dir, 0o700))
+		summary, err := push(s, calculator.PushOptions{}, input[:2])
+		assert.NoError(t, err)
+		assert.Equal(t, 2, summary.Versions["uweCVhkyVy6MirBnUyNJ"])
+	})
+
+	t.Run("broken file", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"version": 2}`), 0o600))
+		_, err := NewStorage(logger, dir)
+		assert.ErrorContains(t, err, "unsupported file version")
+	})
+}
@@ -0,0 +1,650 @@
+// Package filestore is an object storage on a local directory for small deployments and CI.
+// The latest version of every file is kept under its path, so the directory is browsable as is,
+// all versions are kept under .versions/<path>/ named by version id. A deleted file keeps its
+// versions until it is purged, a deleted version is kept as <version>.trash.
+package filestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	versionsDir = ".versions"
+	tmpDir      = ".tmp"
+	metaExt     = ".json"
+	trashExt    = ".trash"
+)
+
+// metadata is kept for every version in <version>.json
+type metadata struct {
+	Uploader string                   `json:"uploader,omitempty"`
+	Checksum string                   `json:"sha256"`
+	Metadata *calculator.FileMetadata `json:"metadata,omitempty"`
+}
+
+type Storage struct {
+	Path string
+	// mu serializes writes, so version ids of a file grow
+	mu sync.Mutex
+}
+
+// NewStorage creates directory if needed
+func NewStorage(logger *zap.Logger, path string) (*Storage, error) {
+	for _, dir := range []string{path, filepath.Join(path, versionsDir), filepath.Join(path, tmpDir)} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("could not create object storage directory: %w", err)
+		}
+	}
+	logger.Info("filesystem object storage ready",
+		zap.String("path", path),
+	)
+	return &Storage{Path: path}, nil
+}
+
+func (s *Storage) ConfigDump(ctx context.Context, logger *zap.Logger) map[string]string {
+	return map[string]string{"path": s.Path}
+}
+
+func (s *Storage) UploadTextFile(ctx context.Context, logger *zap.Logger, r io.Reader, path string) error {
+	_, err := s.UploadFile(ctx, logger, r, path, calculator.UploadOptions{})
+	return err
+}
+
+// UploadFile writes a new version of the file, the file is replaced at once. Uploader, checksum and metadata
+// are kept next to the version in <version>.json. Content and metadata equal to the latest version are not
+// written again.
+func (s *Storage) UploadFile(ctx context.Context, logger *zap.Logger, r io.Reader, path string, opts calculator.UploadOptions) (*calculator.FileInfo, error) {
+	file, versions, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(s.Path, tmpDir), "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmp, hash), r); err != nil {
+		_ = tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if opts.Checksum != "" && !strings.EqualFold(opts.Checksum, checksum) {
+		return nil, fmt.Errorf("%s: %w", path, calculator.ErrChecksum)
+	}
+	fileMeta, err := opts.Describe(ctx, func() (io.ReadCloser, error) {
+		return os.Open(tmp.Name())
+	})
+	if err != nil {
+		return nil, err
+	}
+	meta, err := json.Marshal(metadata{Uploader: opts.Uploader, Checksum: checksum, Metadata: fileMeta})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// preconditions are checked under the lock, so concurrent uploads can not both pass them
+	current, err := s.StatFile(ctx, logger, path, "")
+	if errors.Is(err, calculator.ErrNotFound) {
+		current, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = opts.Check(current); err != nil {
+		return nil, err
+	}
+	if current != nil && current.Checksum == checksum && current.Metadata.Equal(fileMeta) {
+		logger.Info("file not changed, version kept",
+			zap.String("path", path),
+			zap.String("VersionID", current.Version),
+		)
+		return current, nil
+	}
+	if err = os.MkdirAll(versions, 0o750); err != nil {
+		return nil, err
+	}
+	version, err := nextVersion(versions)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.writeFile(filepath.Join(versions, version+metaExt), meta); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(versions, version)); err != nil {
+		return nil, err
+	}
+	if err = s.link(filepath.Join(versions, version), file); err != nil {
+		logger.Error("Failed to upload file",
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	logger.Info("file uploaded",
+		zap.String("path", path),
+		zap.String("VersionID", version),
+	)
+	return s.stat(path, versions, version)
+}
+
+// LoadFileByName loads latest version of the file for empty version, the given version otherwise
+func (s *Storage) LoadFileByName(ctx context.Context, logger *zap.Logger, path string, version string) (io.Reader, error) {
+	file, versions, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if version != "" {
+		if err = checkVersion(version); err != nil {
+			return nil, err
+		}
+		file = filepath.Join(versions, version)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		logger.Error("could not load file",
+			zap.String("path", path),
+			zap.String("version", version),
+			zap.Error(err),
+		)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// StatFile returns metadata of the file version, the latest one for empty version. Version ids are unique,
+// so they are entity tags as well.
+func (s *Storage) StatFile(ctx context.Context, logger *zap.Logger, path string, version string) (*calculator.FileInfo, error) {
+	file, versions, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if version == "" {
+		if _, err = os.Stat(file); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+		}
+		ids, err := versionIDs(versions)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+		}
+		version = ids[len(ids)-1]
+	} else if err = checkVersion(version); err != nil {
+		return nil, err
+	}
+
+	return s.stat(path, versions, version)
+}
+
+// stat reads metadata of the version, metadata file is missing for versions uploaded before it was kept
+func (s *Storage) stat(path string, versions string, version string) (*calculator.FileInfo, error) {
+	stat, err := os.Stat(filepath.Join(versions, version))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+		}
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	var meta metadata
+	if b, err := os.ReadFile(filepath.Join(versions, version+metaExt)); err == nil {
+		if err = json.Unmarshal(b, &meta); err != nil {
+			return nil, err
+		}
+	}
+	return &calculator.FileInfo{
+		Path:         path,
+		Version:      version,
+		Size:         stat.Size(),
+		ETag:         version,
+		LastModified: stat.ModTime(),
+		ContentType:  contentType,
+		Uploader:     meta.Uploader,
+		Checksum:     meta.Checksum,
+		Metadata:     meta.Metadata,
+	}, nil
+}
+
+func (s *Storage) IsVersioned(ctx context.Context) bool {
+	return true
+}
+
+// Ls lists files and directories right under path like minio does, directories end with a slash.
+// Files come with metadata of their latest versions. Empty path lists the root.
+func (s *Storage) Ls(ctx context.Context, path string, opts calculator.LsOptions) <-chan calculator.ObjectInfo {
+	rChan := make(chan calculator.ObjectInfo)
+	prefix := strings.Trim(path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	go func() {
+		defer close(rChan)
+		send := func(obj calculator.ObjectInfo) bool {
+			select {
+			case rChan <- obj:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		dir := s.Path
+		if prefix != "" {
+			var err error
+			if dir, _, err = s.resolve(prefix); err != nil {
+				send(calculator.ObjectInfo{Err: err})
+				return
+			}
+		}
+		// directory entries are sorted by name, the listing is sorted by path with trailing slashes
+		var names []string
+		err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && name == dir {
+					return fs.SkipDir
+				}
+				return err
+			}
+			if name == dir {
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".") {
+				if entry.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(s.Path, name)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			switch {
+			case entry.IsDir() && opts.Recursive:
+				return nil
+			case entry.IsDir():
+				names = append(names, rel+"/")
+				return fs.SkipDir
+			}
+			names = append(names, rel)
+			return nil
+		})
+		if err != nil {
+			send(calculator.ObjectInfo{Err: err})
+			return
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if name <= opts.StartAfter {
+				continue
+			}
+			obj := calculator.ObjectInfo{Path: name}
+			if !obj.IsDir() {
+				info, err := s.StatFile(ctx, zap.NewNop(), name, "")
+				if errors.Is(err, calculator.ErrNotFound) {
+					// deleted meanwhile
+					continue
+				}
+				if err != nil {
+					send(calculator.ObjectInfo{Err: err})
+					return
+				}
+				obj.Size = info.Size
+				obj.LastModified = &info.LastModified
+				obj.Metadata = info.Metadata
+			}
+			if !send(obj) {
+				return
+			}
+		}
+	}()
+	return rChan
+}
+
+// LsVersions lists versions of the file, the latest first
+func (s *Storage) LsVersions(ctx context.Context, path string, logger *zap.Logger) (<-chan string, error) {
+	file, versions, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(file); err != nil {
+		logger.Error("could not load file",
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		return nil, fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+	}
+	ids, err := versionIDs(versions)
+	if err != nil {
+		return nil, err
+	}
+
+	rChan := make(chan string, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		rChan <- ids[i]
+	}
+	close(rChan)
+	return rChan, nil
+}
+
+// DeleteFile removes the file, its versions are kept for RestoreFile
+func (s *Storage) DeleteFile(ctx context.Context, logger *zap.Logger, path string) error {
+	file, _, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = os.Remove(file); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+		}
+		return err
+	}
+	logger.Info("file deleted",
+		zap.String("path", path),
+	)
+	return nil
+}
+
+// RestoreFile brings back the latest version of deleted file
+func (s *Storage) RestoreFile(ctx context.Context, logger *zap.Logger, path string) error {
+	file, versions, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err = os.Stat(file); err == nil {
+		return fmt.Errorf("%s is not deleted: %w", path, calculator.ErrNotFound)
+	}
+	ids, err := versionIDs(versions)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+	}
+	if err = s.link(filepath.Join(versions, ids[len(ids)-1]), file); err != nil {
+		return err
+	}
+	logger.Info("file restored",
+		zap.String("path", path),
+	)
+	return nil
+}
+
+// PurgeFile removes the file with all its versions
+func (s *Storage) PurgeFile(ctx context.Context, logger *zap.Logger, path string) error {
+	file, versions, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, fileErr := os.Stat(file)
+	_, versionsErr := os.Stat(versions)
+	if os.IsNotExist(fileErr) && os.IsNotExist(versionsErr) {
+		return fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+	}
+	if err = os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = os.RemoveAll(versions); err != nil {
+		return err
+	}
+	logger.Info("file purged",
+		zap.String("path", path),
+	)
+	return nil
+}
+
+// DeleteVersion renames the version to <version>.trash. The file is linked to the newest version left
+// when the deleted one was the latest, or removed when no version is left. A deleted file stays deleted.
+func (s *Storage) DeleteVersion(ctx context.Context, logger *zap.Logger, path string, version string) error {
+	file, versions, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+	if err = checkVersion(version); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, err := versionIDs(versions)
+	if err != nil {
+		return err
+	}
+	i := sort.SearchStrings(ids, version)
+	if i == len(ids) || ids[i] != version {
+		return fmt.Errorf("%s version %s: %w", path, version, calculator.ErrNotFound)
+	}
+	name := filepath.Join(versions, version)
+	if err = os.Rename(name, name+trashExt); err != nil {
+		return err
+	}
+	if _, err = os.Stat(file); err == nil && i == len(ids)-1 {
+		if i == 0 {
+			err = os.Remove(file)
+		} else {
+			err = s.link(filepath.Join(versions, ids[i-1]), file)
+		}
+		if err != nil {
+			_ = os.Rename(name+trashExt, name)
+			return err
+		}
+	}
+	logger.Info("file version deleted",
+		zap.String("path", path),
+		zap.String("VersionID", version),
+	)
+	return nil
+}
+
+// RestoreVersion brings back the deleted version, the file is linked to it when it is the newest version.
+// A deleted file is brought back only when the version is the only one.
+func (s *Storage) RestoreVersion(ctx context.Context, logger *zap.Logger, path string, version string) error {
+	file, versions, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+	if err = checkVersion(version); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := filepath.Join(versions, version)
+	if err = os.Rename(name+trashExt, name); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s version %s is not deleted: %w", path, version, calculator.ErrNotFound)
+		}
+		return err
+	}
+	ids, err := versionIDs(versions)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(file)
+	if ids[len(ids)-1] == version && (err == nil || len(ids) == 1) {
+		if err = s.link(name, file); err != nil {
+			return err
+		}
+	}
+	logger.Info("file version restored",
+		zap.String("path", path),
+		zap.String("VersionID", version),
+	)
+	return nil
+}
+
+// PurgeVersion removes the deleted version with its metadata
+func (s *Storage) PurgeVersion(ctx context.Context, logger *zap.Logger, path string, version string) error {
+	_, versions, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+	if err = checkVersion(version); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := filepath.Join(versions, version)
+	if err = os.Remove(name + trashExt); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s version %s is not deleted: %w", path, version, calculator.ErrNotFound)
+		}
+		return err
+	}
+	if err = os.Remove(name + metaExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	logger.Info("file version purged",
+		zap.String("path", path),
+		zap.String("VersionID", version),
+	)
+	return nil
+}
+
+// resolve returns file of the latest version and directory of versions for path.
+// Path is relative to the storage root and may not leave it or reach service directories.
+func (s *Storage) resolve(path string) (file string, versions string, err error) {
+	clean := filepath.ToSlash(filepath.Clean("/" + path))[1:]
+	if clean == "" || clean != strings.Trim(path, "/") {
+		return "", "", fmt.Errorf("invalid path %q", path)
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", "", fmt.Errorf("invalid path %q", path)
+		}
+	}
+	return filepath.Join(s.Path, filepath.FromSlash(clean)), filepath.Join(s.Path, versionsDir, filepath.FromSlash(clean)), nil
+}
+
+// checkVersion rejects versions which are not plain names without dots, so they do not reach
+// outside of versions directory or metadata files
+func checkVersion(version string) error {
+	if version == "" || strings.ContainsAny(version, `/\.`) {
+		return fmt.Errorf("invalid version %q", version)
+	}
+	return nil
+}
+
+// writeFile writes data to the file at once
+func (s *Storage) writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Join(s.Path, tmpDir), "meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// link makes file the given version, the file is replaced at once
+func (s *Storage) link(version string, file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o750); err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.Path, tmpDir, "link-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err := os.Link(version, tmp); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, file)
+}
+
+// versionIDs returns ids of file versions, the oldest first
+func versionIDs(versions string) ([]string, error) {
+	entries, err := os.ReadDir(versions)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		// version ids have no dots, metadata files have
+		if !entry.IsDir() && !strings.Contains(entry.Name(), ".") {
+			ids = append(ids, entry.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// nextVersion returns id of a new version, ids are fixed width hex time, so they sort in order of uploads.
+// Ids of deleted versions are not reused.
+func nextVersion(versions string) (string, error) {
+	ids, err := versionIDs(versions)
+	if err != nil {
+		return "", err
+	}
+	trashed, err := filepath.Glob(filepath.Join(versions, "*"+trashExt))
+	if err != nil {
+		return "", err
+	}
+	for _, name := range trashed {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(name), trashExt))
+	}
+	sort.Strings(ids)
+	next := time.Now().UnixNano()
+	if len(ids) > 0 {
+		last, err := strconv.ParseInt(ids[len(ids)-1], 16, 64)
+		if err == nil && last >= next {
+			next = last + 1
+		}
+	}
+	return fmt.Sprintf("%016x", next), nil
+}
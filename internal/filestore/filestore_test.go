@@ -0,0 +1,288 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var _ calculator.ObjectStorage = &Storage{}
+
+func load(t *testing.T, s *Storage, path string, version string) string {
+	t.Helper()
+	r, err := s.LoadFileByName(context.Background(), zap.NewNop(), path, version)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer r.(io.Closer).Close()
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func collect(ch <-chan string) []string {
+	var names []string
+	for name := range ch {
+		names = append(names, name)
+	}
+	return names
+}
+
+func paths(ch <-chan calculator.ObjectInfo) []string {
+	var names []string
+	for obj := range ch {
+		names = append(names, obj.Path)
+	}
+	return names
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	dir := t.TempDir()
+	s, err := NewStorage(logger, dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, s.IsVersioned(ctx))
+
+	t.Run("versions", func(t *testing.T) {
+		assert.NoError(t, s.UploadTextFile(ctx, logger, strings.NewReader("first"), "test/diagram.xml"))
+		uploaded, err := s.UploadFile(ctx, logger, strings.NewReader("second"), "test/diagram.xml", calculator.UploadOptions{Uploader: "alice"})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "alice", uploaded.Uploader)
+		assert.Equal(t, "16367aacb67a4a017c8da8ab95682ccb390863780f7114dda0a0e0c55644c7c4", uploaded.Checksum)
+		assert.Equal(t, "second", load(t, s, "test/diagram.xml", ""))
+
+		versions, err := s.LsVersions(ctx, "test/diagram.xml", logger)
+		if !assert.NoError(t, err) {
+			return
+		}
+		ids := collect(versions)
+		if !assert.Len(t, ids, 2) {
+			return
+		}
+		assert.Greater(t, ids[0], ids[1])
+		assert.Equal(t, "second", load(t, s, "test/diagram.xml", ids[0]))
+		assert.Equal(t, "first", load(t, s, "test/diagram.xml", ids[1]))
+
+		// the directory is browsable as is
+		b, err := os.ReadFile(filepath.Join(dir, "test", "diagram.xml"))
+		assert.NoError(t, err)
+		assert.Equal(t, "second", string(b))
+
+		info, err := s.StatFile(ctx, logger, "test/diagram.xml", "")
+		if assert.NoError(t, err) {
+			assert.Equal(t, ids[0], info.Version)
+			assert.Equal(t, ids[0], info.ETag)
+			assert.Equal(t, *uploaded, *info)
+			assert.Equal(t, int64(len("second")), info.Size)
+			assert.Contains(t, info.ContentType, "xml")
+		}
+		info, err = s.StatFile(ctx, logger, "test/diagram.xml", ids[1])
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(len("first")), info.Size)
+		}
+		_, err = s.StatFile(ctx, logger, "test/diagram.xml", "0000000000000001")
+		assert.True(t, errors.Is(err, calculator.ErrNotFound))
+
+		// same content keeps the version
+		same, err := s.UploadFile(ctx, logger, strings.NewReader("second"), "test/diagram.xml", calculator.UploadOptions{Uploader: "bob"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, *uploaded, *same)
+		}
+		_, err = s.UploadFile(ctx, logger, strings.NewReader("third"), "test/diagram.xml", calculator.UploadOptions{Checksum: uploaded.Checksum})
+		assert.True(t, errors.Is(err, calculator.ErrChecksum))
+		assert.Equal(t, "second", load(t, s, "test/diagram.xml", ""))
+
+		_, err = s.LoadFileByName(ctx, logger, "test/diagram.xml", "0000000000000001")
+		assert.True(t, errors.Is(err, calculator.ErrNotFound))
+		_, err = s.LoadFileByName(ctx, logger, "test/diagram.xml", "../diagram.xml")
+		assert.Error(t, err)
+	})
+
+	t.Run("ls", func(t *testing.T) {
+		assert.NoError(t, s.UploadTextFile(ctx, logger, strings.NewReader("other"), "test/sub/other.xml"))
+		assert.NoError(t, s.UploadTextFile(ctx, logger, strings.NewReader("another"), "another/diagram.xml"))
+		assert.NoError(t, s.UploadTextFile(ctx, logger, strings.NewReader("text"), "test/sub.txt"))
+		ls := func(path string, opts calculator.LsOptions) []string {
+			return paths(s.Ls(ctx, path, opts))
+		}
+
+		assert.Equal(t, []string{"another/", "test/"}, ls("", calculator.LsOptions{}))
+		assert.Equal(t, []string{"test/diagram.xml", "test/sub.txt", "test/sub/"}, ls("test/", calculator.LsOptions{}))
+		assert.Equal(t, []string{"test/diagram.xml", "test/sub.txt", "test/sub/"}, ls("test", calculator.LsOptions{}))
+		assert.Empty(t, ls("missing/", calculator.LsOptions{}))
+		assert.Equal(t, []string{"test/diagram.xml", "test/sub.txt", "test/sub/other.xml"}, ls("test", calculator.LsOptions{Recursive: true}))
+		assert.Equal(t, []string{"another/diagram.xml", "test/diagram.xml", "test/sub.txt", "test/sub/other.xml"},
+			ls("", calculator.LsOptions{Recursive: true}))
+		assert.Equal(t, []string{"test/sub.txt", "test/sub/other.xml"}, ls("test", calculator.LsOptions{Recursive: true, StartAfter: "test/diagram.xml"}))
+
+		var objects []calculator.ObjectInfo
+		for obj := range s.Ls(ctx, "test", calculator.LsOptions{}) {
+			objects = append(objects, obj)
+		}
+		if assert.Len(t, objects, 3) {
+			assert.Equal(t, int64(len("second")), objects[0].Size)
+			assert.NotNil(t, objects[0].LastModified)
+			assert.True(t, objects[2].IsDir())
+			assert.Nil(t, objects[2].LastModified)
+		}
+
+		var errs []error
+		for obj := range s.Ls(ctx, "../", calculator.LsOptions{}) {
+			errs = append(errs, obj.Err)
+		}
+		if assert.Len(t, errs, 1) {
+			assert.Error(t, errs[0])
+		}
+
+		// listing stops with ctx
+		cancelled, cancel := context.WithCancel(ctx)
+		ch := s.Ls(cancelled, "test", calculator.LsOptions{})
+		<-ch
+		cancel()
+		for range ch {
+		}
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		inspected := 0
+		opts := calculator.UploadOptions{
+			Metadata: calculator.FileMetadata{Author: "alice", Tags: []string{"power"}},
+			Inspect: func(ctx context.Context, r io.Reader, meta *calculator.FileMetadata) error {
+				inspected++
+				b, err := io.ReadAll(r)
+				meta.DiagramUUID = string(b)
+				return err
+			},
+		}
+		info, err := s.UploadFile(ctx, logger, strings.NewReader("described"), "tagged/diagram.xml", opts)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 1, inspected)
+		want := &calculator.FileMetadata{Author: "alice", Tags: []string{"power"}, DiagramUUID: "described"}
+		assert.Equal(t, want, info.Metadata)
+
+		stat, err := s.StatFile(ctx, logger, "tagged/diagram.xml", "")
+		assert.NoError(t, err)
+		assert.Equal(t, want, stat.Metadata)
+		objects := make(map[string]*calculator.FileMetadata)
+		for obj := range s.Ls(ctx, "tagged", calculator.LsOptions{}) {
+			objects[obj.Path] = obj.Metadata
+		}
+		assert.Equal(t, map[string]*calculator.FileMetadata{"tagged/diagram.xml": want}, objects)
+
+		// same content with other metadata is a new version
+		same, err := s.UploadFile(ctx, logger, strings.NewReader("described"), "tagged/diagram.xml", opts)
+		assert.NoError(t, err)
+		assert.Equal(t, info.Version, same.Version)
+		opts.Metadata.Tags = []string{"power", "draft"}
+		retagged, err := s.UploadFile(ctx, logger, strings.NewReader("described"), "tagged/diagram.xml", opts)
+		assert.NoError(t, err)
+		assert.NotEqual(t, info.Version, retagged.Version)
+		assert.True(t, retagged.Metadata.HasTags("DRAFT", "power"))
+
+		opts.Inspect = func(ctx context.Context, r io.Reader, meta *calculator.FileMetadata) error {
+			return errors.New("rejected")
+		}
+		_, err = s.UploadFile(ctx, logger, strings.NewReader("rejected"), "tagged/diagram.xml", opts)
+		assert.EqualError(t, err, "rejected")
+		assert.Equal(t, "described", load(t, s, "tagged/diagram.xml", ""))
+	})
+
+	t.Run("invalid paths", func(t *testing.T) {
+		for _, path := range []string{"", "/", "../escape.xml", "test/../../escape.xml", ".versions/test/diagram.xml", "test//diagram.xml"} {
+			assert.Error(t, s.UploadTextFile(ctx, logger, strings.NewReader("x"), path), path)
+			_, err := s.LoadFileByName(ctx, logger, path, "")
+			assert.Error(t, err, path)
+		}
+		_, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape.xml"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("delete, restore and purge", func(t *testing.T) {
+		path := "test/sub/other.xml"
+		assert.NoError(t, s.DeleteFile(ctx, logger, path))
+		_, err := s.LoadFileByName(ctx, logger, path, "")
+		assert.True(t, errors.Is(err, calculator.ErrNotFound))
+		_, err = s.LsVersions(ctx, path, logger)
+		assert.True(t, errors.Is(err, calculator.ErrNotFound))
+		assert.True(t, errors.Is(s.DeleteFile(ctx, logger, path), calculator.ErrNotFound))
+
+		assert.NoError(t, s.RestoreFile(ctx, logger, path))
+		assert.Equal(t, "other", load(t, s, path, ""))
+		assert.True(t, errors.Is(s.RestoreFile(ctx, logger, path), calculator.ErrNotFound))
+
+		assert.NoError(t, s.DeleteFile(ctx, logger, path))
+		assert.NoError(t, s.PurgeFile(ctx, logger, path))
+		assert.True(t, errors.Is(s.RestoreFile(ctx, logger, path), calculator.ErrNotFound))
+		assert.True(t, errors.Is(s.PurgeFile(ctx, logger, path), calculator.ErrNotFound))
+		_, err = os.Stat(filepath.Join(dir, versionsDir, "test", "sub", "other.xml"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("delete, restore and purge version", func(t *testing.T) {
+		path := "test/versions.xml"
+		first, err := s.UploadFile(ctx, logger, strings.NewReader("first"), path, calculator.UploadOptions{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		second, err := s.UploadFile(ctx, logger, strings.NewReader("second"), path, calculator.UploadOptions{})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.NoError(t, s.DeleteVersion(ctx, logger, path, second.Version))
+		assert.Equal(t, "first", load(t, s, path, ""))
+		_, err = s.StatFile(ctx, logger, path, second.Version)
+		assert.True(t, errors.Is(err, calculator.ErrNotFound))
+		versions, err := s.LsVersions(ctx, path, logger)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{first.Version}, collect(versions))
+		assert.True(t, errors.Is(s.DeleteVersion(ctx, logger, path, second.Version), calculator.ErrNotFound))
+
+		// the file is gone with its only version and comes back with it
+		assert.NoError(t, s.DeleteVersion(ctx, logger, path, first.Version))
+		_, err = s.StatFile(ctx, logger, path, "")
+		assert.True(t, errors.Is(err, calculator.ErrNotFound))
+		assert.NoError(t, s.RestoreVersion(ctx, logger, path, first.Version))
+		assert.Equal(t, "first", load(t, s, path, ""))
+
+		// a new version does not reuse the id of the deleted one
+		third, err := s.UploadFile(ctx, logger, strings.NewReader("third"), path, calculator.UploadOptions{})
+		assert.NoError(t, err)
+		assert.Greater(t, third.Version, second.Version)
+		assert.NoError(t, s.RestoreVersion(ctx, logger, path, second.Version))
+		assert.Equal(t, "third", load(t, s, path, ""))
+		assert.True(t, errors.Is(s.RestoreVersion(ctx, logger, path, second.Version), calculator.ErrNotFound))
+
+		assert.True(t, errors.Is(s.PurgeVersion(ctx, logger, path, second.Version), calculator.ErrNotFound))
+		assert.NoError(t, s.DeleteVersion(ctx, logger, path, second.Version))
+		assert.NoError(t, s.PurgeVersion(ctx, logger, path, second.Version))
+		assert.True(t, errors.Is(s.RestoreVersion(ctx, logger, path, second.Version), calculator.ErrNotFound))
+		_, err = os.Stat(filepath.Join(dir, versionsDir, "test", "versions.xml", second.Version+metaExt))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		reopened, err := NewStorage(logger, dir)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "second", load(t, reopened, "test/diagram.xml", ""))
+		versions, err := reopened.LsVersions(ctx, "test/diagram.xml", logger)
+		assert.NoError(t, err)
+		assert.Len(t, collect(versions), 2)
+	})
+}
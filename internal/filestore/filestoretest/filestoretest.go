@@ -0,0 +1,26 @@
+// Package filestoretest provides filesystem object storage for tests of packages using object storage
+package filestoretest
+
+import (
+	"context"
+	"github.com/aemakeye/circuit_calculator/internal/filestore"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+// NewStorage creates object storage in a temporary directory of the test with files given by their
+// path and content
+func NewStorage(t testing.TB, files map[string]string) *filestore.Storage {
+	t.Helper()
+	storage, err := filestore.NewStorage(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range files {
+		if err = storage.UploadTextFile(context.Background(), zap.NewNop(), strings.NewReader(content), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return storage
+}
@@ -0,0 +1,127 @@
+package archive
+
+import (
+	"archive/zip"
+	"errors"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	archiveUrl = "/api/archive"
+	// DeadLineTimeOut is longer than handlers.DeadLineTimeOut, archives take every document of the project
+	DeadLineTimeOut = 5 * time.Minute
+	// DefaultMaxArchiveSize bounds the imported archive when Handler.MaxArchiveSize is not set
+	DefaultMaxArchiveSize = 1 << 30
+)
+
+type Handler struct {
+	Logger     *zap.Logger
+	Calculator *calculator.Calculator
+	// MaxArchiveSize is the maximum size of the imported archive in bytes, 0 means DefaultMaxArchiveSize
+	MaxArchiveSize int64
+	// MaxFileSize is the maximum uncompressed size of an archived document in bytes, 0 means no limit
+	MaxFileSize int64
+}
+
+func (h *Handler) Register(r chi.Router) {
+	r.Use(middleware.Timeout(DeadLineTimeOut))
+	r.Route(archiveUrl, func(r chi.Router) {
+		r.Get("/{project}", h.Export)
+		r.Post("/{project}", h.Import)
+	})
+}
+
+// Export downloads zip archive of the project. "history=true" adds every version of documents,
+// "netlists=true" adds netlists of diagrams.
+func (h *Handler) Export(w http.ResponseWriter, r *http.Request) {
+	project := chi.URLParam(r, "project")
+	opts := calculator.ArchiveOptions{
+		History:  r.URL.Query().Get("history") == "true",
+		Netlists: r.URL.Query().Get("netlists") == "true",
+	}
+
+	// the archive is streamed, headers are sent with the first entry
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": project + ".zip"}))
+	_, err := h.Calculator.ExportProject(r.Context(), w, project, opts)
+	if errors.Is(err, calculator.ErrNotFound) {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Disposition")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		// the response may be written partially, the client gets a broken archive
+		h.Logger.Error("could not export project",
+			zap.String("project", project),
+			zap.Error(err),
+		)
+	}
+}
+
+// Import recreates documents of the zip archive in the request body under the project and ingests them.
+// "overwrite=true" uploads documents existing in the project as their new versions, they are reported
+// as conflicts otherwise.
+func (h *Handler) Import(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	project := chi.URLParam(r, "project")
+
+	// zip is read from the end, the body is kept in a temporary file
+	tmp, err := os.CreateTemp("", "archive-*.zip")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, h.maxArchiveSize()))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		handlers.WriteJSON(h.Logger, w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+
+	report, err := h.Calculator.ImportProject(r.Context(), archive, calculator.ImportOptions{
+		Project:     project,
+		Overwrite:   r.URL.Query().Get("overwrite") == "true",
+		MaxFileSize: h.MaxFileSize,
+	})
+	if err != nil {
+		h.Logger.Error("could not import project",
+			zap.String("project", project),
+			zap.Error(err),
+		)
+		if report == nil {
+			handlers.WriteJSON(h.Logger, w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+			return
+		}
+		handlers.WriteJSON(h.Logger, w, http.StatusInternalServerError, report)
+		return
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, report)
+}
+
+func (h *Handler) maxArchiveSize() int64 {
+	if h.MaxArchiveSize > 0 {
+		return h.MaxArchiveSize
+	}
+	return DefaultMaxArchiveSize
+}
@@ -0,0 +1,226 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/filestore"
+	"github.com/aemakeye/circuit_calculator/internal/memgraph"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func diagram(value string) string {
+	return `<mxfile><diagram id="uweCVhkyVy6MirBnUyNJ" name="Page-1"><mxGraphModel><root>
+		<mxCell id="0"/><mxCell id="1" parent="0"/>
+		<mxCell id="3" value="` + value + `" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1">
+			<mxGeometry x="110" y="140" width="100" height="20" as="geometry"/>
+		</mxCell>
+		</root></mxGraphModel></diagram></mxfile>`
+}
+
+// environment is a calculator with its own storages served by the handler
+func environment(t *testing.T) (*calculator.Calculator, chi.Router) {
+	logger := zap.NewNop()
+	storage, err := filestore.NewStorage(logger, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &calculator.Calculator{
+		Logger:      logger,
+		Gstorage:    memgraph.NewStorage(),
+		TextStorage: storage,
+		DiagramSvc:  drawio.NewController(logger),
+	}
+	h := Handler{Logger: logger, Calculator: c, MaxFileSize: 1024}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+	return c, r
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	source, sr := environment(t)
+	for _, upload := range []struct{ path, content, uploader string }{
+		{"test/diagram.xml", diagram("10k"), "alice"},
+		{"test/diagram.xml", diagram("4k7"), "bob"},
+		{"test/sub/notes.txt", "not a diagram", "alice"},
+		{"other/diagram.xml", diagram("1k"), "alice"},
+	} {
+		_, err := source.TextStorage.UploadFile(ctx, logger, strings.NewReader(upload.content), upload.path,
+			calculator.UploadOptions{Uploader: upload.uploader})
+		assert.NoError(t, err)
+	}
+
+	export := func(url string) (*httptest.ResponseRecorder, *zip.Reader, *calculator.Manifest) {
+		w := httptest.NewRecorder()
+		sr.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != http.StatusOK {
+			return w, nil, nil
+		}
+		archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if !assert.NoError(t, err) {
+			return w, nil, nil
+		}
+		var manifest calculator.Manifest
+		for _, f := range archive.File {
+			if f.Name == calculator.ManifestName {
+				rc, _ := f.Open()
+				assert.NoError(t, json.NewDecoder(rc).Decode(&manifest))
+				_ = rc.Close()
+			}
+		}
+		return w, archive, &manifest
+	}
+	names := func(archive *zip.Reader) []string {
+		var names []string
+		for _, f := range archive.File {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	t.Run("export latest versions", func(t *testing.T) {
+		w, archive, manifest := export(archiveUrl + "/test")
+		if archive == nil {
+			t.Fatalf("no archive, status %d", w.Code)
+		}
+		assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+		assert.Equal(t, "attachment; filename=test.zip", w.Header().Get("Content-Disposition"))
+		assert.ElementsMatch(t, []string{"files/test/diagram.xml", "files/test/sub/notes.txt", calculator.ManifestName}, names(archive))
+		assert.Equal(t, "test", manifest.Project)
+		if assert.Len(t, manifest.Files, 2) {
+			assert.Equal(t, "test/diagram.xml", manifest.Files[0].Path)
+			assert.Len(t, manifest.Files[0].Versions, 1)
+			assert.Equal(t, "bob", manifest.Files[0].Versions[0].Uploader)
+		}
+	})
+
+	t.Run("export missing project", func(t *testing.T) {
+		w, _, _ := export(archiveUrl + "/missing")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Disposition"))
+	})
+
+	w, archive, manifest := export(archiveUrl + "/test?history=true&netlists=true")
+	if archive == nil {
+		t.Fatalf("no archive, status %d", w.Code)
+	}
+	body := w.Body.Bytes()
+	t.Run("export history and netlists", func(t *testing.T) {
+		assert.Len(t, names(archive), 7)
+		assert.Contains(t, names(archive), "netlists/test/diagram.xml.json")
+		if assert.Len(t, manifest.Files, 2) {
+			assert.Len(t, manifest.Files[0].Versions, 2)
+			assert.Equal(t, "netlists/test/diagram.xml.json", manifest.Files[0].Netlist)
+			assert.Empty(t, manifest.Files[1].Netlist)
+			assert.NotEmpty(t, manifest.Files[1].NetlistError)
+		}
+	})
+
+	target, tr := environment(t)
+	importArchive := func(url string, body []byte) (*httptest.ResponseRecorder, calculator.ImportReport) {
+		w := httptest.NewRecorder()
+		tr.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body)))
+		var report calculator.ImportReport
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+		}
+		return w, report
+	}
+
+	t.Run("import", func(t *testing.T) {
+		w, report := importArchive(archiveUrl+"/moved", body)
+		if !assert.Equal(t, http.StatusOK, w.Code) {
+			return
+		}
+		assert.Equal(t, "moved", report.Project)
+		if !assert.Len(t, report.Files, 2) {
+			return
+		}
+		assert.Equal(t, "moved/diagram.xml", report.Files[0].Path)
+		assert.Equal(t, calculator.ImportCreated, report.Files[0].Status)
+		assert.Equal(t, "uweCVhkyVy6MirBnUyNJ", report.Files[0].UUID)
+		assert.Equal(t, 1, report.Files[0].DiagramVersion)
+		assert.Equal(t, "moved/sub/notes.txt", report.Files[1].Path)
+		assert.Equal(t, calculator.ImportCreated, report.Files[1].Status)
+		assert.NotEmpty(t, report.Files[1].IngestError)
+
+		// history is recreated with original uploaders and checksums
+		ids, err := target.TextStorage.LsVersions(ctx, "moved/diagram.xml", logger)
+		assert.NoError(t, err)
+		var versions []*calculator.FileInfo
+		for id := range ids {
+			info, err := target.TextStorage.StatFile(ctx, logger, "moved/diagram.xml", id)
+			assert.NoError(t, err)
+			versions = append(versions, info)
+		}
+		if assert.Len(t, versions, 2) {
+			assert.Equal(t, "bob", versions[0].Uploader)
+			assert.Equal(t, "alice", versions[1].Uploader)
+			assert.Equal(t, manifest.Files[0].Versions[0].Checksum, versions[0].Checksum)
+		}
+
+		items, err := target.Gstorage.LoadItems(ctx, logger, "uweCVhkyVy6MirBnUyNJ", 0)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, "4k7", items[0].Value)
+		}
+	})
+
+	t.Run("import conflicts", func(t *testing.T) {
+		w, report := importArchive(archiveUrl+"/moved", body)
+		if !assert.Equal(t, http.StatusOK, w.Code) || !assert.Len(t, report.Files, 2) {
+			return
+		}
+		for _, file := range report.Files {
+			assert.Equal(t, calculator.ImportConflict, file.Status)
+			assert.NotNil(t, file.Current)
+		}
+
+		w, report = importArchive(archiveUrl+"/moved?overwrite=true", body)
+		if assert.Equal(t, http.StatusOK, w.Code) && assert.Len(t, report.Files, 2) {
+			assert.Equal(t, calculator.ImportCreated, report.Files[0].Status)
+		}
+	})
+
+	t.Run("bad archives", func(t *testing.T) {
+		w, _ := importArchive(archiveUrl+"/moved", []byte("not a zip"))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+		buf := new(bytes.Buffer)
+		zw := zip.NewWriter(buf)
+		entry, _ := zw.Create("files/test/diagram.xml")
+		_, _ = io.WriteString(entry, diagram("1k"))
+		_ = zw.Close()
+		w, _ = importArchive(archiveUrl+"/moved", buf.Bytes())
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+		buf.Reset()
+		zw = zip.NewWriter(buf)
+		entry, _ = zw.Create(calculator.ManifestName)
+		_, _ = io.WriteString(entry, `{"project": "test", "files": [
+			{"path": "test/../../escape.xml", "versions": [{"version": "1"}]},
+			{"path": "test/large.xml", "versions": [{"version": "1"}]}
+		]}`)
+		entry, _ = zw.Create("files/test/large.xml")
+		_, _ = io.WriteString(entry, strings.Repeat("x", 2048))
+		_ = zw.Close()
+		w, report := importArchive(archiveUrl+"/moved", buf.Bytes())
+		if assert.Equal(t, http.StatusOK, w.Code) && assert.Len(t, report.Files, 2) {
+			assert.Equal(t, calculator.ImportFailed, report.Files[0].Status)
+			assert.Equal(t, calculator.ImportFailed, report.Files[1].Status)
+			assert.Contains(t, report.Files[1].Error, "larger")
+		}
+	})
+}
@@ -2,18 +2,17 @@ package calculator
 
 import (
 	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"go.uber.org/zap"
 	"net/http"
-	"time"
 )
 
 const (
 	FormFileBody     = "uploadData"
 	uploadDiagramUrl = "/api/uploadDiagram"
 	uploadFileUrl    = "/api/uploadFile"
-	DeadLineTimeOut  = 10 * time.Second
 )
 
 type Handler struct {
@@ -22,7 +21,7 @@ type Handler struct {
 }
 
 func (h *Handler) Register(r chi.Router) {
-	r.Use(middleware.Timeout(DeadLineTimeOut))
+	r.Use(middleware.Timeout(handlers.DeadLineTimeOut))
 	r.Route(uploadDiagramUrl, func(r chi.Router) {
 		r.Post("/{project}", h.UploadDiagram)
 		r.Post("/{project}/", h.UploadDiagram)
@@ -0,0 +1,151 @@
+package diff
+
+import (
+	"bytes"
+	"errors"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/diff"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const (
+	diffUrl      = "/api/diff"
+	FormatJSON   = "json"
+	FormatDrawio = "drawio"
+)
+
+type Handler struct {
+	Logger     *zap.Logger
+	Calculator *calculator.Calculator
+}
+
+func (h *Handler) Register(r chi.Router) {
+	r.Use(middleware.Timeout(handlers.DeadLineTimeOut))
+	r.Route(diffUrl, func(r chi.Router) {
+		r.Get("/{format}/file/{project}/*", h.DiffFile)
+		r.Get("/{format}/graph/{uuid}", h.DiffGraph)
+	})
+}
+
+// DiffFile compares two versions of the stored diagram given by "from" and "to" query parameters,
+// "to" defaults to the latest version. Format is json or drawio, the latter is the "to" document
+// with changes highlighted.
+func (h *Handler) DiffFile(w http.ResponseWriter, r *http.Request) {
+	format := chi.URLParam(r, "format")
+	if format != FormatJSON && format != FormatDrawio {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	project := chi.URLParam(r, "project")
+	filename := chi.URLParam(r, "*")
+	from := r.URL.Query().Get("from")
+	if project == "" || filename == "" || from == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	path := project + "/" + filename
+
+	var docs [2][]byte
+	var circuits [2]*netlist.Netlist
+	for i, version := range []string{from, r.URL.Query().Get("to")} {
+		obj, err := h.Calculator.TextStorage.LoadFileByName(r.Context(), h.Logger, path, version)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		docs[i], err = io.ReadAll(obj)
+		if closer, ok := obj.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		uuid, items, err := h.Calculator.ParseItems(r.Context(), bytes.NewReader(docs[i]))
+		if err != nil {
+			h.Logger.Error("could not parse diagram",
+				zap.String("path", path),
+				zap.String("version", version),
+				zap.Error(err),
+			)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		circuits[i] = netlist.FromItems(uuid, items)
+	}
+	if circuits[0].UUID != circuits[1].UUID {
+		h.Logger.Error("versions are different diagrams",
+			zap.String("path", path),
+			zap.Strings("uuids", []string{circuits[0].UUID, circuits[1].UUID}),
+		)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	d := diff.Compare(circuits[0], circuits[1])
+	if format == FormatJSON {
+		handlers.WriteJSON(h.Logger, w, http.StatusOK, d)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err := diff.Annotate(buf, bytes.NewReader(docs[0]), bytes.NewReader(docs[1]), d); err != nil {
+		h.Logger.Error("could not annotate diagram",
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", diff.ContentTypeDrawio)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		h.Logger.Error("error writing response body",
+			zap.Error(err),
+		)
+	}
+}
+
+// DiffGraph compares two versions of the diagram stored in graph storage, "to" defaults to the latest version.
+// Graph storage keeps no layout, so only json format is available.
+func (h *Handler) DiffGraph(w http.ResponseWriter, r *http.Request) {
+	if chi.URLParam(r, "format") != FormatJSON {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	uuid := chi.URLParam(r, "uuid")
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil || from < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	to := 0
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil || to < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var circuits [2]*netlist.Netlist
+	for i, version := range []int{from, to} {
+		circuits[i], err = h.Calculator.LoadCircuit(r.Context(), uuid, version)
+		if errors.Is(err, calculator.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, diff.Compare(circuits[0], circuits[1]))
+}
@@ -0,0 +1,121 @@
+package diff
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/diff"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/filestore/filestoretest"
+	"github.com/aemakeye/circuit_calculator/internal/memgraph"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	v1 = `<mxfile><diagram id="uweCVhkyVy6MirBnUyNJ"><mxGraphModel><root>
+		<mxCell id="0"/><mxCell id="1" parent="0"/>
+		<mxCell id="3" value="10k" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1">
+			<mxGeometry x="110" y="140" width="100" height="20" as="geometry"/>
+		</mxCell>
+	</root></mxGraphModel></diagram></mxfile>`
+	v2 = `<mxfile><diagram id="uweCVhkyVy6MirBnUyNJ"><mxGraphModel><root>
+		<mxCell id="0"/><mxCell id="1" parent="0"/>
+		<mxCell id="3" value="22k" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1">
+			<mxGeometry x="300" y="140" width="100" height="20" as="geometry"/>
+		</mxCell>
+	</root></mxGraphModel></diagram></mxfile>`
+	other = `<mxfile><diagram id="another"><mxGraphModel><root></root></mxGraphModel></diagram></mxfile>`
+)
+
+func TestHandler(t *testing.T) {
+	logger := zap.NewNop()
+	graph := memgraph.NewStorage()
+	for _, value := range []string{"10k", "10k", "22k"} {
+		ch := make(chan drawio.Item, 1)
+		ch <- drawio.Item{UUID: "stored", EID: 2, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: value}
+		close(ch)
+		_, err := graph.PushItems(context.Background(), logger, calculator.PushOptions{}, ch)
+		assert.NoError(t, err)
+	}
+
+	// versions are uploaded in order, v2 is the latest one
+	storage := filestoretest.NewStorage(t, nil)
+	versions := make(map[string]string)
+	for _, version := range []struct{ name, content string }{{"v1", v1}, {"other", other}, {"v2", v2}} {
+		info, err := storage.UploadFile(context.Background(), logger, strings.NewReader(version.content), "test/diagram.xml", calculator.UploadOptions{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		versions[version.name] = info.Version
+	}
+
+	h := Handler{
+		Logger: logger,
+		Calculator: &calculator.Calculator{
+			Logger:      logger,
+			Gstorage:    graph,
+			TextStorage: storage,
+			DiagramSvc:  drawio.NewController(logger),
+		},
+	}
+	r := chi.NewRouter()
+	h.Register(r)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	t.Run("file versions as json", func(t *testing.T) {
+		w := get("/api/diff/json/file/test/diagram.xml?from=" + versions["v1"])
+		assert.Equal(t, http.StatusOK, w.Code)
+		var d diff.Diff
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&d))
+		// element moved and relabelled, only the value is a change
+		assert.Len(t, d.Values, 1)
+		assert.Empty(t, d.Added)
+		assert.Empty(t, d.Rewired)
+	})
+
+	t.Run("file versions as drawio", func(t *testing.T) {
+		w := get("/api/diff/drawio/file/test/diagram.xml?from=" + versions["v1"] + "&to=" + versions["v2"])
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, diff.ContentTypeDrawio, w.Header().Get("Content-Type"))
+		assert.True(t, strings.Contains(w.Body.String(), "strokeColor="))
+	})
+
+	t.Run("graph versions", func(t *testing.T) {
+		w := get("/api/diff/json/graph/stored?from=1&to=2")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var d diff.Diff
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&d))
+		assert.True(t, d.Empty())
+
+		w = get("/api/diff/json/graph/stored?from=1")
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&d))
+		assert.Equal(t, "22k", d.Values[0].ToLabel)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for url, code := range map[string]int{
+			"/api/diff/json/file/test/diagram.xml":                           http.StatusBadRequest,
+			"/api/diff/svg/file/test/diagram.xml?from=" + versions["v1"]:     http.StatusBadRequest,
+			"/api/diff/json/file/test/diagram.xml?from=v3":                   http.StatusNotFound,
+			"/api/diff/json/file/test/diagram.xml?from=" + versions["other"]: http.StatusUnprocessableEntity,
+			"/api/diff/drawio/graph/stored?from=1":                           http.StatusBadRequest,
+			"/api/diff/json/graph/stored?from=0":                             http.StatusBadRequest,
+			"/api/diff/json/graph/stored?from=1&to=latest":                   http.StatusBadRequest,
+			"/api/diff/json/graph/stored?from=1&to=4":                        http.StatusNotFound,
+			"/api/diff/json/graph/missing?from=1":                            http.StatusNotFound,
+		} {
+			assert.Equal(t, code, get(url).Code, url)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package export
+
+import (
+	"bytes"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/export"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+)
+
+const (
+	exportUrl = "/api/export"
+)
+
+type Handler struct {
+	Logger     *zap.Logger
+	Calculator *calculator.Calculator
+}
+
+func (h *Handler) Register(r chi.Router) {
+	r.Use(middleware.Timeout(handlers.DeadLineTimeOut))
+	r.Route(exportUrl, func(r chi.Router) {
+		r.Get("/{format}/file/{project}/*", h.ExportFile)
+		r.Get("/{format}/graph/{uuid}", h.ExportGraph)
+		r.Get("/{format}/graph/{uuid}/", h.ExportGraph)
+	})
+}
+
+// ExportFile exports graph of the stored diagram, optional "version" query parameter selects version of the diagram
+func (h *Handler) ExportFile(w http.ResponseWriter, r *http.Request) {
+	format := chi.URLParam(r, "format")
+	if _, ok := export.ContentType[format]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	project := chi.URLParam(r, "project")
+	filename := chi.URLParam(r, "*")
+	if project == "" || filename == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	path := project + "/" + filename
+
+	obj, err := h.Calculator.TextStorage.LoadFileByName(r.Context(), h.Logger, path, r.URL.Query().Get("version"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if closer, ok := obj.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	uuid, items, err := h.Calculator.ParseItems(r.Context(), obj)
+	if err != nil {
+		h.Logger.Error("could not parse diagram",
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	h.write(w, format, uuid, items)
+}
+
+// ExportGraph exports graph of the diagram stored in graph storage
+func (h *Handler) ExportGraph(w http.ResponseWriter, r *http.Request) {
+	format := chi.URLParam(r, "format")
+	if _, ok := export.ContentType[format]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	uuid := chi.URLParam(r, "uuid")
+
+	version, err := handlers.DiagramVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	items, err := h.Calculator.Gstorage.LoadItems(r.Context(), h.Logger, uuid, version)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(items) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	h.write(w, format, uuid, items)
+}
+
+func (h *Handler) write(w http.ResponseWriter, format string, uuid string, items []drawio.Item) {
+	var encode func(w io.Writer, uuid string, items []drawio.Item) error
+	switch format {
+	case export.FormatDot:
+		encode = export.Dot
+	case export.FormatGraphML:
+		encode = export.GraphML
+	}
+
+	buf := new(bytes.Buffer)
+	if err := encode(buf, uuid, items); err != nil {
+		h.Logger.Error("could not export diagram graph",
+			zap.String("uuid", uuid),
+			zap.String("format", format),
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="`+uuid+"."+format+`"`)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		h.Logger.Error("error writing response body",
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,93 @@
+package export
+
+import (
+	"context"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/filestore/filestoretest"
+	"github.com/aemakeye/circuit_calculator/internal/memgraph"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler_Export(t *testing.T) {
+	logger := zap.NewNop()
+	graph := memgraph.NewStorage()
+	stored := make(chan drawio.Item, 1)
+	stored <- drawio.Item{UUID: "stored", EID: 2, Class: drawio.ItemClassResistors, SubClass: "resistor_1"}
+	close(stored)
+	_, err := graph.PushItems(context.Background(), logger, calculator.PushOptions{}, stored)
+	assert.NoError(t, err)
+
+	h := Handler{
+		Logger: logger,
+		Calculator: &calculator.Calculator{
+			Logger:   logger,
+			Gstorage: graph,
+			TextStorage: filestoretest.NewStorage(t, map[string]string{
+				"test/diagram.xml": `
+					<mxfile host="65bd71144e">
+						<diagram id="uweCVhkyVy6MirBnUyNJ" name="Page-1">
+						<mxGraphModel>
+							<root>
+								<mxCell id="0"/>
+								<mxCell id="1" parent="0"/>
+								<mxCell id="3" value="" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1">
+									<mxGeometry x="110" y="140" width="100" height="20" as="geometry"/>
+								</mxCell>
+							</root>
+						</mxGraphModel>
+					</diagram>
+				</mxfile>`,
+				"test/broken.xml": `<mxfile></mxfile>`,
+			}),
+			DiagramSvc: drawio.NewController(logger),
+		},
+	}
+	r := chi.NewRouter()
+	h.Register(r)
+
+	tests := []struct {
+		name                string
+		url                 string
+		expectedCode        int
+		expectedType        string
+		expectedDisposition string
+		expectedBody        string
+	}{
+		{"dot from file", "/api/export/dot/file/test/diagram.xml", http.StatusOK,
+			"text/vnd.graphviz", `attachment; filename="uweCVhkyVy6MirBnUyNJ.dot"`, `3 [class="resistors"`},
+		{"graphml from file", "/api/export/graphml/file/test/diagram.xml", http.StatusOK,
+			"application/graphml+xml", `attachment; filename="uweCVhkyVy6MirBnUyNJ.graphml"`, `<node id="n3">`},
+		{"dot from graph", "/api/export/dot/graph/stored", http.StatusOK,
+			"text/vnd.graphviz", `attachment; filename="stored.dot"`, `2 [class="resistors"`},
+		{"unknown format", "/api/export/png/graph/stored", http.StatusBadRequest, "", "", ""},
+		{"missing file", "/api/export/dot/file/test/missing.xml", http.StatusNotFound, "", "", ""},
+		{"document without id", "/api/export/dot/file/test/broken.xml", http.StatusUnprocessableEntity, "", "", ""},
+		{"missing graph", "/api/export/dot/graph/missing", http.StatusNotFound, "", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, test.expectedCode, res.StatusCode)
+			if test.expectedCode != http.StatusOK {
+				return
+			}
+			assert.Equal(t, test.expectedType, res.Header.Get("Content-Type"))
+			assert.Equal(t, test.expectedDisposition, res.Header.Get("Content-Disposition"))
+			b, err := io.ReadAll(res.Body)
+			assert.NoError(t, err)
+			assert.Contains(t, string(b), test.expectedBody)
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+)
+
+const (
+	graphUrl       = "/api/graph/diagrams"
+	searchUrl      = "/api/graph/search"
+	trashUrl       = "/api/graph/trash"
+	consistencyUrl = "/api/graph/consistency"
+	// DefaultPathLength is the number of connections in a path when maxLength is not given
+	DefaultPathLength = 8
+	// DefaultLimit is the number of paths or search results returned when limit is not given
+	DefaultLimit = 100
+)
+
+// Handler gives read access to diagrams stored in graph storage
+type Handler struct {
+	Logger     *zap.Logger
+	Calculator *calculator.Calculator
+}
+
+// Element is a stored diagram element
+type Element struct {
+	ID       int    `json:"id"`
+	Class    string `json:"class"`
+	SubClass string `json:"subClass,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+// Connection is a stored wire between two elements
+type Connection struct {
+	ID     int `json:"id"`
+	Source int `json:"source"`
+	Target int `json:"target"`
+}
+
+// ElementResponse is an element with its connections and connected elements
+type ElementResponse struct {
+	Element
+	Connections []Connection `json:"connections"`
+	Neighbours  []Element    `json:"neighbours"`
+}
+
+// Match is an element found by search, with the diagram version it is in
+type Match struct {
+	UUID    string `json:"uuid"`
+	Version int    `json:"version"`
+	Project string `json:"project,omitempty"`
+	Element
+}
+
+// Path is a chain of elements from the first one to the last one, connections link adjacent elements
+type Path struct {
+	Elements    []Element    `json:"elements"`
+	Connections []Connection `json:"connections"`
+}
+
+// PathsResponse lists paths found in the diagram version, shorter paths first
+type PathsResponse struct {
+	UUID    string `json:"uuid"`
+	Version int    `json:"version,omitempty"`
+	Paths   []Path `json:"paths"`
+}
+
+// NetResponse is a circuit node with the elements connected to it
+type NetResponse struct {
+	UUID     string           `json:"uuid"`
+	Net      string           `json:"net"`
+	Pins     []netlist.PinRef `json:"pins"`
+	Wires    []int            `json:"wires"`
+	Elements []Element        `json:"elements"`
+}
+
+func (h *Handler) Register(r chi.Router) {
+	r.Use(middleware.Timeout(handlers.DeadLineTimeOut))
+	r.Get(searchUrl, h.Search)
+	r.Get(trashUrl, h.Trash)
+	r.Get(consistencyUrl, h.Consistency)
+	r.Route(graphUrl, func(r chi.Router) {
+		r.Get("/", h.List)
+		r.Get("/{uuid}", h.Circuit)
+		r.Delete("/{uuid}", h.Delete)
+		r.Post("/{uuid}/restore", h.Restore)
+		r.Get("/{uuid}/versions", h.Versions)
+		r.Get("/{uuid}/elements/{eid}", h.Element)
+		r.Get("/{uuid}/paths", h.Paths)
+		r.Get("/{uuid}/nets/{net}", h.Net)
+	})
+}
+
+// List returns uuids of stored diagrams
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	uuids, err := h.Calculator.Gstorage.ListDiagrams(r.Context(), h.Logger)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if uuids == nil {
+		uuids = []string{}
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, uuids)
+}
+
+// Versions returns stored versions of the diagram
+func (h *Handler) Versions(w http.ResponseWriter, r *http.Request) {
+	versions, err := h.Calculator.Gstorage.ListVersions(r.Context(), h.Logger, chi.URLParam(r, "uuid"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, versions)
+}
+
+// Circuit returns netlist of a stored diagram, optional "version" query parameter selects version of the diagram
+func (h *Handler) Circuit(w http.ResponseWriter, r *http.Request) {
+	version, err := handlers.DiagramVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n, err := h.Calculator.LoadCircuit(r.Context(), chi.URLParam(r, "uuid"), version)
+	if errors.Is(err, calculator.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, n)
+}
+
+// Element returns a single element with its neighbours
+func (h *Handler) Element(w http.ResponseWriter, r *http.Request) {
+	eid, err := strconv.Atoi(chi.URLParam(r, "eid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	version, err := handlers.DiagramVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	element, err := h.Calculator.Gstorage.LoadElement(r.Context(), h.Logger, chi.URLParam(r, "uuid"), version, eid)
+	if errors.Is(err, calculator.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := ElementResponse{
+		Element:     newElement(element.Item),
+		Connections: []Connection{},
+		Neighbours:  []Element{},
+	}
+	for _, item := range element.Relations {
+		resp.Connections = append(resp.Connections, Connection{ID: item.EID, Source: item.SourceId, Target: item.TargetId})
+	}
+	for _, item := range element.Neighbours {
+		resp.Neighbours = append(resp.Neighbours, newElement(item))
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, resp)
+}
+
+// Delete moves diagram version given by "version" query parameter to trash, the whole diagram
+// with its source documents is moved when version is not given. A single version is trashed
+// along with the version of its source document it was read from.
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	version, err := handlers.DiagramVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.writeStatus(w, h.Calculator.DeleteDiagram(r.Context(), chi.URLParam(r, "uuid"), version))
+}
+
+// Restore brings back trashed diagram version, or the whole diagram when version is not given
+func (h *Handler) Restore(w http.ResponseWriter, r *http.Request) {
+	version, err := handlers.DiagramVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.writeStatus(w, h.Calculator.RestoreDiagram(r.Context(), chi.URLParam(r, "uuid"), version))
+}
+
+// Trash returns trashed diagram versions, they are purged after the trash period
+func (h *Handler) Trash(w http.ResponseWriter, r *http.Request) {
+	versions, err := h.Calculator.Gstorage.ListTrash(r.Context(), h.Logger)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if versions == nil {
+		versions = []calculator.DiagramVersion{}
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, versions)
+}
+
+// Consistency reports diagrams which source document is missing and documents which are not in graph storage
+func (h *Handler) Consistency(w http.ResponseWriter, r *http.Request) {
+	report, err := h.Calculator.CheckConsistency(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, report)
+}
+
+// Search finds elements in the latest versions of stored diagrams. Query parameters project, class and subClass
+// match exactly, label matches a part of element label ignoring case, min and max bound element values like "1uF".
+// A bound without unit needs class to be given.
+func (h *Handler) Search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := calculator.ElementQuery{
+		Project:  query.Get("project"),
+		Class:    query.Get("class"),
+		SubClass: query.Get("subClass"),
+		Label:    query.Get("label"),
+	}
+	var err error
+	if q.Limit, err = intParam(r, "limit", DefaultLimit); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var bounds [2]*netlist.Value
+	for i, name := range []string{"min", "max"} {
+		s := query.Get(name)
+		if s == "" {
+			continue
+		}
+		v, err := netlist.ParseValue(s, netlist.ClassUnit[q.Class])
+		if err != nil || v.Unit == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bounds[i] = &v
+	}
+
+	matches, err := h.Calculator.FindComponents(r.Context(), q, bounds[0], bounds[1])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := []Match{}
+	for _, m := range matches {
+		resp = append(resp, Match{UUID: m.Item.UUID, Version: m.Version, Project: m.Project, Element: newElement(m.Item)})
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, resp)
+}
+
+// Paths returns simple paths between elements given by "from" and "to" query parameters,
+// "maxLength" limits the number of connections in a path
+func (h *Handler) Paths(w http.ResponseWriter, r *http.Request) {
+	q := calculator.PathQuery{UUID: chi.URLParam(r, "uuid")}
+	var err error
+	if q.From, err = strconv.Atoi(r.URL.Query().Get("from")); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if q.To, err = strconv.Atoi(r.URL.Query().Get("to")); err != nil || q.To == q.From {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if q.Version, err = handlers.DiagramVersion(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if q.MaxLength, err = intParam(r, "maxLength", DefaultPathLength); err != nil || q.MaxLength > calculator.MaxPathLength {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if q.Limit, err = intParam(r, "limit", DefaultLimit); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	paths, err := h.Calculator.Gstorage.FindPaths(r.Context(), h.Logger, q)
+	if errors.Is(err, calculator.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := PathsResponse{UUID: q.UUID, Version: q.Version, Paths: []Path{}}
+	for _, items := range paths {
+		path := Path{Elements: []Element{}, Connections: []Connection{}}
+		for _, item := range items {
+			if item.Class == drawio.ItemClassLines {
+				path.Connections = append(path.Connections, Connection{ID: item.EID, Source: item.SourceId, Target: item.TargetId})
+			} else {
+				path.Elements = append(path.Elements, newElement(item))
+			}
+		}
+		resp.Paths = append(resp.Paths, path)
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, resp)
+}
+
+// Net returns a node of the circuit, named as in the netlist of the diagram, with the elements connected to it
+func (h *Handler) Net(w http.ResponseWriter, r *http.Request) {
+	version, err := handlers.DiagramVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n, err := h.Calculator.LoadCircuit(r.Context(), chi.URLParam(r, "uuid"), version)
+	if errors.Is(err, calculator.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	name := chi.URLParam(r, "net")
+	for _, net := range n.Nets {
+		if net.Name != name {
+			continue
+		}
+		resp := NetResponse{UUID: n.UUID, Net: net.Name, Pins: net.Pins, Wires: net.Wires, Elements: []Element{}}
+		if resp.Wires == nil {
+			resp.Wires = []int{}
+		}
+		connected := make(map[int]bool)
+		for _, pin := range net.Pins {
+			connected[pin.Component] = true
+		}
+		for _, c := range n.Components {
+			if connected[c.ID] {
+				resp.Elements = append(resp.Elements, Element{ID: c.ID, Class: c.Class, SubClass: c.SubClass, Value: c.Label})
+			}
+		}
+		handlers.WriteJSON(h.Logger, w, http.StatusOK, resp)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// intParam reads positive integer query parameter, def is returned when it is not given
+func intParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return v, nil
+}
+
+func newElement(item drawio.Item) Element {
+	return Element{
+		ID:       item.EID,
+		Class:    item.Class,
+		SubClass: item.SubClass,
+		Value:    item.Value,
+	}
+}
+
+// writeStatus answers with no content, or with the status of err
+func (h *Handler) writeStatus(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, calculator.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,438 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/filestore/filestoretest"
+	"github.com/aemakeye/circuit_calculator/internal/memgraph"
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingDelete fails to delete any file
+type failingDelete struct {
+	calculator.ObjectStorage
+}
+
+func (f failingDelete) DeleteFile(ctx context.Context, logger *zap.Logger, path string) error {
+	return errors.New("storage is read only")
+}
+
+func TestHandler(t *testing.T) {
+	logger := zap.NewNop()
+	graph := memgraph.NewStorage()
+	items := []drawio.Item{
+		{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 3, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "10k"},
+		{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 4, Class: drawio.ItemClassInductors, SubClass: "inductor_3"},
+		{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 6, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1"},
+		{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 7, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 6, ExitX: 1, EntryX: 0},
+		{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 8, Class: drawio.ItemClassLines, SourceId: 6, TargetId: 4, ExitX: 1, EntryX: 1},
+		{UUID: "another", EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1"},
+	}
+	ch := make(chan drawio.Item, len(items))
+	for _, item := range items {
+		ch <- item
+	}
+	close(ch)
+	_, err := graph.PushItems(context.Background(), logger, calculator.PushOptions{}, ch)
+	assert.NoError(t, err)
+
+	h := Handler{
+		Logger:     logger,
+		Calculator: &calculator.Calculator{Logger: logger, Gstorage: graph},
+	}
+	r := chi.NewRouter()
+	h.Register(r)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	t.Run("list", func(t *testing.T) {
+		w := get("/api/graph/diagrams/")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `["another", "uweCVhkyVy6MirBnUyNJ"]`, w.Body.String())
+	})
+
+	t.Run("circuit", func(t *testing.T) {
+		w := get("/api/graph/diagrams/uweCVhkyVy6MirBnUyNJ")
+		assert.Equal(t, http.StatusOK, w.Code)
+		n, err := netlist.Decode(w.Body)
+		assert.NoError(t, err)
+		assert.Len(t, n.Components, 3)
+		assert.Len(t, n.Nets, 2)
+
+		assert.Equal(t, http.StatusNotFound, get("/api/graph/diagrams/missing").Code)
+	})
+
+	t.Run("element", func(t *testing.T) {
+		w := get("/api/graph/diagrams/uweCVhkyVy6MirBnUyNJ/elements/6")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp ElementResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, ElementResponse{
+			Element:     Element{ID: 6, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1"},
+			Connections: []Connection{{ID: 7, Source: 3, Target: 6}, {ID: 8, Source: 6, Target: 4}},
+			Neighbours: []Element{
+				{ID: 3, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "10k"},
+				{ID: 4, Class: drawio.ItemClassInductors, SubClass: "inductor_3"},
+			},
+		}, resp)
+
+		assert.Equal(t, http.StatusNotFound, get("/api/graph/diagrams/uweCVhkyVy6MirBnUyNJ/elements/42").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/api/graph/diagrams/uweCVhkyVy6MirBnUyNJ/elements/R1").Code)
+	})
+
+	t.Run("versions", func(t *testing.T) {
+		w := get("/api/graph/diagrams/another/versions")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var versions []calculator.DiagramVersion
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&versions))
+		assert.Len(t, versions, 1)
+		assert.Equal(t, 1, versions[0].Version)
+		assert.Equal(t, 1, versions[0].Elements)
+
+		assert.Equal(t, http.StatusNotFound, get("/api/graph/diagrams/missing/versions").Code)
+		assert.Equal(t, http.StatusOK, get("/api/graph/diagrams/another?version=1").Code)
+		assert.Equal(t, http.StatusNotFound, get("/api/graph/diagrams/another?version=2").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/api/graph/diagrams/another?version=0").Code)
+	})
+}
+
+func TestHandler_Queries(t *testing.T) {
+	logger := zap.NewNop()
+	graph := memgraph.NewStorage()
+	for project, items := range map[string][]drawio.Item{
+		"amp": {
+			{UUID: "amp", EID: 2, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R1 10k"},
+			{UUID: "amp", EID: 3, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "4.7µF"},
+			{UUID: "amp", EID: 4, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "100nF"},
+			{UUID: "amp", EID: 5, Class: drawio.ItemClassLines, SourceId: 2, TargetId: 3, ExitX: 1, EntryX: 0},
+			{UUID: "amp", EID: 6, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 4, ExitX: 1, EntryX: 0},
+		},
+		"filter": {
+			{UUID: "filter", EID: 2, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_2", Value: "22uF"},
+		},
+	} {
+		ch := make(chan drawio.Item, len(items))
+		for _, item := range items {
+			ch <- item
+		}
+		close(ch)
+		_, err := graph.PushItems(context.Background(), logger, calculator.PushOptions{Project: project}, ch)
+		assert.NoError(t, err)
+	}
+
+	h := Handler{
+		Logger:     logger,
+		Calculator: &calculator.Calculator{Logger: logger, Gstorage: graph},
+	}
+	r := chi.NewRouter()
+	h.Register(r)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	t.Run("search", func(t *testing.T) {
+		search := func(query string) []Match {
+			w := get("/api/graph/search?" + query)
+			assert.Equal(t, http.StatusOK, w.Code, query)
+			var matches []Match
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&matches))
+			return matches
+		}
+		assert.Equal(t, []Match{
+			{UUID: "amp", Version: 1, Project: "amp", Element: Element{ID: 3, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "4.7µF"}},
+			{UUID: "filter", Version: 1, Project: "filter", Element: Element{ID: 2, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_2", Value: "22uF"}},
+		}, search("class=capacitors&min=1u"))
+		assert.Len(t, search("project=amp&min=1uF"), 1)
+		assert.Len(t, search("min=1uF&limit=1"), 1)
+		assert.Len(t, search("class=capacitors&max=10uF"), 2)
+		assert.Equal(t, 2, search("label=r1")[0].ID)
+		assert.Empty(t, search("label=2N3904"))
+
+		for _, query := range []string{"min=1u", "class=capacitors&min=1kΩ", "min=big", "limit=0"} {
+			assert.Equal(t, http.StatusBadRequest, get("/api/graph/search?"+query).Code, query)
+		}
+	})
+
+	t.Run("paths", func(t *testing.T) {
+		w := get("/api/graph/diagrams/amp/paths?from=2&to=4")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp PathsResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, "amp", resp.UUID)
+		assert.Len(t, resp.Paths, 1)
+		assert.Equal(t, []Connection{{ID: 5, Source: 2, Target: 3}, {ID: 6, Source: 3, Target: 4}}, resp.Paths[0].Connections)
+		assert.Equal(t, []int{2, 3, 4}, []int{resp.Paths[0].Elements[0].ID, resp.Paths[0].Elements[1].ID, resp.Paths[0].Elements[2].ID})
+
+		w = get("/api/graph/diagrams/amp/paths?from=2&to=4&maxLength=1")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"uuid": "amp", "paths": []}`, w.Body.String())
+
+		for url, code := range map[string]int{
+			"/api/graph/diagrams/amp/paths?from=2&to=42":              http.StatusNotFound,
+			"/api/graph/diagrams/missing/paths?from=2&to=4":           http.StatusNotFound,
+			"/api/graph/diagrams/amp/paths?from=2":                    http.StatusBadRequest,
+			"/api/graph/diagrams/amp/paths?from=2&to=2":               http.StatusBadRequest,
+			"/api/graph/diagrams/amp/paths?from=2&to=4&maxLength=":    http.StatusOK,
+			"/api/graph/diagrams/amp/paths?from=2&to=4&maxLength=100": http.StatusBadRequest,
+		} {
+			assert.Equal(t, code, get(url).Code, url)
+		}
+	})
+
+	t.Run("net", func(t *testing.T) {
+		n, err := h.Calculator.LoadCircuit(context.Background(), "amp", 0)
+		assert.NoError(t, err)
+		var name string
+		for _, net := range n.Nets {
+			if len(net.Wires) == 1 && net.Wires[0] == 6 {
+				name = net.Name
+			}
+		}
+
+		w := get("/api/graph/diagrams/amp/nets/" + name)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp NetResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, []int{6}, resp.Wires)
+		assert.Equal(t, []Element{
+			{ID: 3, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "4.7µF"},
+			{ID: 4, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "100nF"},
+		}, resp.Elements)
+
+		assert.Equal(t, http.StatusNotFound, get("/api/graph/diagrams/amp/nets/N42").Code)
+		assert.Equal(t, http.StatusNotFound, get("/api/graph/diagrams/missing/nets/N1").Code)
+	})
+}
+
+func TestHandler_Trash(t *testing.T) {
+	logger := zap.NewNop()
+	graph := memgraph.NewStorage()
+	for _, push := range []struct {
+		uuid, source string
+	}{
+		{"amp", "test/amp.xml"},
+		{"amp", "test/amp.xml"},
+		{"filter", "test/filter.xml"},
+		{"copy", "test/filter.xml"},
+		{"imported", "netlist"},
+		{"orphan", "test/removed.xml"},
+	} {
+		ch := make(chan drawio.Item, 1)
+		ch <- drawio.Item{UUID: push.uuid, EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1"}
+		close(ch)
+		_, err := graph.PushItems(context.Background(), logger, calculator.PushOptions{Project: "test", Source: push.source}, ch)
+		assert.NoError(t, err)
+	}
+	files := filestoretest.NewStorage(t, map[string]string{
+		"test/amp.xml": "<mxfile/>", "test/filter.xml": "<mxfile/>", "test/new.xml": "<mxfile/>", "top.xml": "<mxfile/>",
+	})
+	uploaded := make(map[string]string)
+	for _, path := range []string{"test/amp.xml", "test/filter.xml"} {
+		info, err := files.StatFile(context.Background(), logger, path, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		uploaded[path] = info.Version
+	}
+	// exists tells whether the document is not deleted, deleted whether it is kept for restore
+	exists := func(path string) bool {
+		_, err := files.StatFile(context.Background(), logger, path, "")
+		return err == nil
+	}
+	deleted := func(path string) bool {
+		_, err := files.StatFile(context.Background(), logger, path, uploaded[path])
+		return err == nil && !exists(path)
+	}
+
+	h := Handler{
+		Logger:     logger,
+		Calculator: &calculator.Calculator{Logger: logger, Gstorage: graph, TextStorage: files},
+	}
+	r := chi.NewRouter()
+	h.Register(r)
+
+	do := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	t.Run("consistency", func(t *testing.T) {
+		w := do(http.MethodGet, "/api/graph/consistency")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var report calculator.Consistency
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+		assert.Len(t, report.Orphaned, 1)
+		assert.Equal(t, "orphan", report.Orphaned[0].UUID)
+		assert.Equal(t, []string{"test/new.xml", "top.xml"}, report.Unindexed)
+	})
+
+	t.Run("delete version", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/api/graph/diagrams/amp?version=2").Code)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/api/graph/diagrams/amp?version=2").Code)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/api/graph/diagrams/amp?version=2").Code)
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/graph/diagrams/amp").Code)
+		// document stays while the diagram has versions
+		assert.True(t, exists("test/amp.xml"))
+
+		assert.Equal(t, http.StatusNoContent, do(http.MethodPost, "/api/graph/diagrams/amp/restore?version=2").Code)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/api/graph/diagrams/amp/restore?version=2").Code)
+	})
+
+	t.Run("delete diagram", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/api/graph/diagrams/amp").Code)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/api/graph/diagrams/amp").Code)
+		assert.True(t, deleted("test/amp.xml"))
+
+		// document shared with another diagram is kept
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/api/graph/diagrams/copy").Code)
+		assert.True(t, exists("test/filter.xml"))
+
+		w := do(http.MethodGet, "/api/graph/trash")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var trash []calculator.DiagramVersion
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&trash))
+		assert.Len(t, trash, 3)
+		assert.NotNil(t, trash[0].Deleted)
+
+		assert.Equal(t, http.StatusNoContent, do(http.MethodPost, "/api/graph/diagrams/amp/restore").Code)
+		assert.True(t, exists("test/amp.xml"))
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/graph/diagrams/amp?version=1").Code)
+
+		assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/api/graph/diagrams/missing").Code)
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/api/graph/diagrams/amp?version=first").Code)
+	})
+
+	t.Run("failed document delete", func(t *testing.T) {
+		// amp version 1 is trashed by the user, version 2 is restored
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/api/graph/diagrams/amp?version=1").Code)
+		h.Calculator.TextStorage = failingDelete{files}
+		defer func() { h.Calculator.TextStorage = files }()
+
+		assert.Equal(t, http.StatusInternalServerError, do(http.MethodDelete, "/api/graph/diagrams/amp").Code)
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/graph/diagrams/amp?version=2").Code)
+		// only versions trashed by the failed call are restored
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/api/graph/diagrams/amp?version=1").Code)
+		assert.True(t, exists("test/amp.xml"))
+		assert.Equal(t, http.StatusNoContent, do(http.MethodPost, "/api/graph/diagrams/amp/restore?version=1").Code)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/api/graph/diagrams/amp").Code)
+
+		purged, err := h.Calculator.PurgeTrash(context.Background(), time.Now().Add(-time.Hour))
+		assert.NoError(t, err)
+		assert.Empty(t, purged)
+
+		purged, err = h.Calculator.PurgeTrash(context.Background(), time.Now().Add(time.Second))
+		assert.NoError(t, err)
+		assert.Len(t, purged, 3)
+		assert.False(t, deleted("test/amp.xml"))
+		assert.False(t, exists("test/amp.xml"))
+		// document of the remaining diagram is kept
+		assert.True(t, exists("test/filter.xml"))
+
+		assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/api/graph/diagrams/amp/restore").Code)
+		assert.JSONEq(t, `[]`, do(http.MethodGet, "/api/graph/trash").Body.String())
+	})
+}
+
+func TestHandler_TrashVersion(t *testing.T) {
+	logger := zap.NewNop()
+	diagram := func(value string) string {
+		return `<mxfile host="65bd71144e"><diagram id="amp" name="Page-1"><mxGraphModel><root>
+			<mxCell id="0"/><mxCell id="1" parent="0"/>
+			<mxCell id="2" value="` + value + `" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1">
+				<mxGeometry x="110" y="140" width="100" height="20" as="geometry"/>
+			</mxCell>
+		</root></mxGraphModel></diagram></mxfile>`
+	}
+	files := filestoretest.NewStorage(t, map[string]string{"test/amp.xml": diagram("10k")})
+	h := Handler{
+		Logger: logger,
+		Calculator: &calculator.Calculator{
+			Logger:      logger,
+			Gstorage:    memgraph.NewStorage(),
+			TextStorage: files,
+			DiagramSvc:  drawio.NewController(logger),
+		},
+	}
+	r := chi.NewRouter()
+	h.Register(r)
+	do := func(method, url string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w.Code
+	}
+	ctx := context.Background()
+	latest := func() string {
+		info, err := files.StatFile(ctx, logger, "test/amp.xml", "")
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		return info.Version
+	}
+
+	first := latest()
+	_, _, err := h.Calculator.IngestFile(ctx, "test/amp.xml", "")
+	assert.NoError(t, err)
+	// the same document version read again is shared by versions 1 and 2
+	_, _, err = h.Calculator.IngestFile(ctx, "test/amp.xml", first)
+	assert.NoError(t, err)
+	second, err := files.UploadFile(ctx, logger, strings.NewReader(diagram("22k")), "test/amp.xml", calculator.UploadOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, err = h.Calculator.IngestFile(ctx, "test/amp.xml", "")
+	assert.NoError(t, err)
+
+	versions, err := h.Calculator.Gstorage.ListVersions(ctx, logger, "amp")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{first, first, second.Version},
+		[]string{versions[0].SourceVersion, versions[1].SourceVersion, versions[2].SourceVersion})
+
+	t.Run("delete and restore", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/api/graph/diagrams/amp?version=3"))
+		_, err := files.StatFile(ctx, logger, "test/amp.xml", second.Version)
+		assert.ErrorIs(t, err, calculator.ErrNotFound)
+		assert.Equal(t, first, latest())
+
+		assert.Equal(t, http.StatusNoContent, do(http.MethodPost, "/api/graph/diagrams/amp/restore?version=3"))
+		assert.Equal(t, second.Version, latest())
+	})
+
+	t.Run("shared document version", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/api/graph/diagrams/amp?version=2"))
+		_, err := files.StatFile(ctx, logger, "test/amp.xml", first)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNoContent, do(http.MethodPost, "/api/graph/diagrams/amp/restore?version=2"))
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/api/graph/diagrams/amp?version=3"))
+		purged, err := h.Calculator.PurgeTrash(ctx, time.Now().Add(time.Second))
+		assert.NoError(t, err)
+		assert.Len(t, purged, 1)
+		assert.ErrorIs(t, files.RestoreVersion(ctx, logger, "test/amp.xml", second.Version), calculator.ErrNotFound)
+		assert.Equal(t, first, latest())
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/graph/diagrams/amp?version=2"))
+	})
+}
@@ -1,11 +1,62 @@
 package handlers
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"time"
 )
 
 type Handler interface {
 	Register(router chi.Router)
 }
 
+// DiagramVersion reads diagram version from "version" query parameter, 0 is the latest version
+func DiagramVersion(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("version")
+	if v == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid diagram version %q", v)
+	}
+	return version, nil
+}
+
+// UserHeader is set to the name of authenticated user by the proxy in front of the API
+const UserHeader = "X-Forwarded-User"
+
+// Uploader returns the name of the user making the request, empty when unknown
+func Uploader(r *http.Request) string {
+	return r.Header.Get(UserHeader)
+}
+
+// DeadLineTimeOut bounds API requests, handlers taking longer set their own timeout
+const DeadLineTimeOut = 10 * time.Second
+
+// WriteJSON writes v as the JSON response with the status code, encoding errors are logged and answered with 500
+func WriteJSON(logger *zap.Logger, w http.ResponseWriter, code int, v interface{}) {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		logger.Error("error in json encoding",
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logger.Error("error writing response body",
+			zap.Error(err),
+		)
+	}
+}
+
 // TODO: "github.com/go-chi/cors"
@@ -0,0 +1,159 @@
+package netlist
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+)
+
+const (
+	schemaUrl = "/api/netlist/schema"
+	exportUrl = "/api/netlist/export"
+	importUrl = "/api/netlist/import"
+)
+
+type Handler struct {
+	Logger     *zap.Logger
+	Calculator *calculator.Calculator
+}
+
+// ImportResponse reports uuid and stored version of imported netlist and ids of items failed to be stored
+type ImportResponse struct {
+	UUID    string   `json:"uuid"`
+	Version int      `json:"version,omitempty"`
+	Failed  []int    `json:"failed,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+func (h *Handler) Register(r chi.Router) {
+	r.Use(middleware.Timeout(handlers.DeadLineTimeOut))
+	r.Get(schemaUrl, h.Schema)
+	r.Route(exportUrl, func(r chi.Router) {
+		r.Get("/file/{project}/*", h.ExportFile)
+		r.Get("/graph/{uuid}", h.ExportGraph)
+		r.Get("/graph/{uuid}/", h.ExportGraph)
+	})
+	r.Post(importUrl, h.Import)
+}
+
+// Schema returns JSON Schema of the netlist document
+func (h *Handler) Schema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(netlist.Schema); err != nil {
+		h.Logger.Error("error writing response body",
+			zap.Error(err),
+		)
+	}
+}
+
+// ExportFile builds netlist of the stored diagram, optional "version" query parameter selects version of the diagram
+func (h *Handler) ExportFile(w http.ResponseWriter, r *http.Request) {
+	project := chi.URLParam(r, "project")
+	filename := chi.URLParam(r, "*")
+	if project == "" || filename == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	path := project + "/" + filename
+
+	obj, err := h.Calculator.TextStorage.LoadFileByName(r.Context(), h.Logger, path, r.URL.Query().Get("version"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if closer, ok := obj.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	uuid, items, err := h.Calculator.ParseItems(r.Context(), obj)
+	if err != nil {
+		h.Logger.Error("could not parse diagram",
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, netlist.FromItems(uuid, items))
+}
+
+// ExportGraph builds netlist of the diagram stored in graph storage
+func (h *Handler) ExportGraph(w http.ResponseWriter, r *http.Request) {
+	uuid := chi.URLParam(r, "uuid")
+
+	version, err := handlers.DiagramVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	n, err := h.Calculator.LoadCircuit(r.Context(), uuid, version)
+	if errors.Is(err, calculator.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, n)
+}
+
+// Import validates netlist document and stores it in graph storage. Netlists with sources or analyses
+// get 422, they are not stored with the diagram. Netlists with no item stored get 422 as well.
+func (h *Handler) Import(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	n, err := netlist.Decode(r.Body)
+	if err == nil {
+		err = n.Storable()
+	}
+	if err != nil {
+		h.Logger.Error("bad netlist",
+			zap.Error(err),
+		)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = json.NewEncoder(w).Encode(ImportResponse{Errors: []string{err.Error()}})
+		return
+	}
+
+	resp := ImportResponse{UUID: n.UUID}
+	opts := calculator.PushOptions{
+		Source:  "netlist",
+		Replace: r.URL.Query().Get("replace") == "true",
+	}
+	summary, err := h.Calculator.StoreItems(r.Context(), opts, netlist.ToItems(n))
+	if err != nil {
+		h.Logger.Error("netlist was not stored",
+			zap.String("uuid", n.UUID),
+			zap.Error(err),
+		)
+		resp.Errors = []string{err.Error()}
+		handlers.WriteJSON(h.Logger, w, http.StatusInternalServerError, resp)
+		return
+	}
+	for _, item := range summary.Failed {
+		resp.Failed = append(resp.Failed, item.EID)
+		resp.Errors = append(resp.Errors, item.Error.Error())
+	}
+	resp.Version = summary.Versions[n.UUID]
+	if resp.Version == 0 {
+		h.Logger.Error("no netlist item was stored",
+			zap.String("uuid", n.UUID),
+		)
+		handlers.WriteJSON(h.Logger, w, http.StatusUnprocessableEntity, resp)
+		return
+	}
+
+	handlers.WriteJSON(h.Logger, w, http.StatusCreated, resp)
+}
@@ -0,0 +1,180 @@
+package netlist
+
+import (
+	"encoding/json"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/filestore/filestoretest"
+	"github.com/aemakeye/circuit_calculator/internal/memgraph"
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	logger := zap.NewNop()
+	h := Handler{
+		Logger: logger,
+		Calculator: &calculator.Calculator{
+			Logger:   logger,
+			Gstorage: memgraph.NewStorage(),
+			TextStorage: filestoretest.NewStorage(t, map[string]string{
+				"test/diagram.xml": `
+					<mxfile host="65bd71144e">
+						<diagram id="uweCVhkyVy6MirBnUyNJ" name="Page-1">
+						<mxGraphModel>
+							<root>
+								<mxCell id="0"/>
+								<mxCell id="1" parent="0"/>
+								<mxCell id="3" value="10k" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1">
+									<mxGeometry x="110" y="140" width="100" height="20" as="geometry"/>
+								</mxCell>
+								<mxCell id="6" value="" style="shape=mxgraph.electrical.capacitors.capacitor_1;" vertex="1" parent="1">
+									<mxGeometry x="280" y="170" width="100" height="60" as="geometry"/>
+								</mxCell>
+								<mxCell id="7" value="" style="endArrow=none;html=1;exitX=1;exitY=0.5;entryX=0;entryY=0.5;" edge="1" parent="1" source="3" target="6">
+									<mxGeometry width="50" height="50" relative="1" as="geometry"/>
+								</mxCell>
+							</root>
+						</mxGraphModel>
+					</diagram>
+				</mxfile>`,
+			}),
+			DiagramSvc: drawio.NewController(logger),
+		},
+	}
+	r := chi.NewRouter()
+	h.Register(r)
+
+	t.Run("schema", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/netlist/schema", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, netlist.Schema, w.Body.Bytes())
+	})
+
+	t.Run("export stored file", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/netlist/export/file/test/diagram.xml", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		n, err := netlist.Decode(w.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "uweCVhkyVy6MirBnUyNJ", n.UUID)
+		assert.Len(t, n.Components, 2)
+		assert.Equal(t, []netlist.PinRef{{Component: 3, Pin: netlist.PinSecond}, {Component: 6, Pin: netlist.PinFirst}}, n.Nets[0].Pins)
+	})
+
+	t.Run("export missing file", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/netlist/export/file/test/missing.xml", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("import and export from graph", func(t *testing.T) {
+		doc := `{"version": "1", "uuid": "imported",
+			"components": [
+				{"id": 1, "class": "resistors", "subClass": "resistor_1", "value": {"magnitude": 100, "unit": "ohm"}, "pins": ["1", "2"]},
+				{"id": 2, "class": "capacitors", "subClass": "capacitor_1", "pins": ["1", "2"]}
+			],
+			"nets": [{"name": "in", "pins": [{"component": 1, "pin": "2"}, {"component": 2, "pin": "1"}]}]}`
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/netlist/import", strings.NewReader(doc)))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var resp ImportResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, ImportResponse{UUID: "imported", Version: 1}, resp)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/netlist/export/graph/imported", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		n, err := netlist.Decode(w.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "100ohm", n.Components[0].Label)
+		assert.Equal(t, []netlist.PinRef{{Component: 1, Pin: netlist.PinSecond}, {Component: 2, Pin: netlist.PinFirst}}, n.Nets[0].Pins)
+	})
+
+	t.Run("import and export round trip", func(t *testing.T) {
+		components := `[
+				{"id": 1, "class": "resistors", "subClass": "resistor_1", "label": "100ohm", "value": {"magnitude": 100, "unit": "ohm"}, "pins": ["1", "2"]},
+				{"id": 2, "class": "capacitors", "subClass": "capacitor_1", "label": "C1", "pins": ["1", "2"]},
+				{"id": 3, "class": "inductors", "subClass": "inductor_3", "label": "L1", "pins": ["1", "2"]}
+			]`
+		nets := `[
+				{"name": "N1", "pins": [{"component": 1, "pin": "2"}, {"component": 2, "pin": "1"}, {"component": 3, "pin": "1"}], "wires": [4, 5]},
+				{"name": "N2", "pins": [{"component": 2, "pin": "2"}, {"component": 3, "pin": "2"}], "wires": [6]}
+			]`
+		sources := `[{"component": 1, "kind": "voltage", "signal": "ac", "amplitude": {"magnitude": 5, "unit": "V"},
+				"frequency": {"magnitude": 50, "unit": "Hz"}}]`
+		analyses := `[{"type": "op"}, {"type": "ac", "start": {"magnitude": 1, "unit": "Hz"}, "stop": {"magnitude": 1000, "unit": "Hz"}, "points": 10}]`
+		doc := func(extra string) string {
+			return `{"version": "1", "uuid": "roundtrip", "components": ` + components + `, "nets": ` + nets + extra + `}`
+		}
+		importDoc := func(doc string) (int, ImportResponse) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/netlist/import", strings.NewReader(doc)))
+			var resp ImportResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			return w.Code, resp
+		}
+
+		// sources and analyses are not stored, the netlist is rejected instead of losing them
+		for _, extra := range []string{`, "sources": ` + sources, `, "analyses": ` + analyses,
+			`, "sources": ` + sources + `, "analyses": ` + analyses} {
+			code, resp := importDoc(doc(extra))
+			assert.Equal(t, http.StatusUnprocessableEntity, code)
+			assert.Contains(t, resp.Errors[0], "sources and analyses")
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/netlist/export/graph/roundtrip", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		code, resp := importDoc(doc(""))
+		assert.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, 1, resp.Version)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/netlist/export/graph/roundtrip", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		exported, err := netlist.Decode(w.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		imported, err := netlist.Decode(strings.NewReader(doc("")))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, imported, exported)
+	})
+
+	t.Run("import with no item stored", func(t *testing.T) {
+		doc := `{"version": "1", "uuid": "not a uuid",
+			"components": [{"id": 1, "class": "resistors", "subClass": "resistor_1", "pins": ["1", "2"]}], "nets": []}`
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/netlist/import", strings.NewReader(doc)))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		var resp ImportResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, []int{1}, resp.Failed)
+		assert.Zero(t, resp.Version)
+	})
+
+	t.Run("import invalid netlist", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/netlist/import", strings.NewReader(`{"version": "0"}`)))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		var resp ImportResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Contains(t, resp.Errors[0], "unsupported netlist version")
+	})
+
+	t.Run("export missing graph", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/netlist/export/graph/missing", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
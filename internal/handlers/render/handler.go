@@ -0,0 +1,95 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
+	"github.com/aemakeye/circuit_calculator/internal/render"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+)
+
+const (
+	svgUrl = "/api/render/svg"
+)
+
+type Handler struct {
+	Logger  *zap.Logger
+	Storage calculator.ObjectStorage
+}
+
+func (h *Handler) Register(r chi.Router) {
+	r.Use(middleware.Timeout(handlers.DeadLineTimeOut))
+	r.Route(svgUrl, func(r chi.Router) {
+		r.Get("/{project}/*", h.RenderSVG)
+		r.Post("/{project}/*", h.RenderSVG)
+	})
+}
+
+// RenderSVG renders stored diagram to svg. Optional "version" query parameter selects version of the diagram.
+// POST request body may carry JSON encoded render.Results to be drawn on top of the circuit.
+func (h *Handler) RenderSVG(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	project := chi.URLParam(r, "project")
+	filename := chi.URLParam(r, "*")
+	if project == "" || filename == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	path := project + "/" + filename
+
+	var res *render.Results
+	if r.Method == http.MethodPost {
+		res = &render.Results{}
+		if err := json.NewDecoder(r.Body).Decode(res); err != nil {
+			h.Logger.Error("bad results body",
+				zap.String("path", path),
+				zap.Error(err),
+			)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	obj, err := h.Storage.LoadFileByName(r.Context(), h.Logger, path, r.URL.Query().Get("version"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if closer, ok := obj.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	doc, err := drawio.ReadMxfile(obj)
+	if err != nil {
+		h.Logger.Error("could not parse diagram",
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err = render.SVG(buf, doc, res); err != nil {
+		h.Logger.Error("could not render diagram",
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		h.Logger.Error("error writing response body",
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,71 @@
+package render
+
+import (
+	"github.com/aemakeye/circuit_calculator/internal/filestore/filestoretest"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler_RenderSVG(t *testing.T) {
+	storage := filestoretest.NewStorage(t, map[string]string{
+		"test/diagram.xml": `
+			<mxfile host="65bd71144e">
+				<diagram id="uweCVhkyVy6MirBnUyNJ" name="Page-1">
+				<mxGraphModel>
+					<root>
+						<mxCell id="0"/>
+						<mxCell id="1" parent="0"/>
+						<mxCell id="3" value="" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1">
+							<mxGeometry x="110" y="140" width="100" height="20" as="geometry"/>
+						</mxCell>
+					</root>
+				</mxGraphModel>
+			</diagram>
+		</mxfile>`,
+		"test/broken.xml": `<mxfile><diagram>`,
+	})
+	h := Handler{
+		Logger:  zap.NewNop(),
+		Storage: storage,
+	}
+	r := chi.NewRouter()
+	h.Register(r)
+
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{"render", http.MethodGet, "/api/render/svg/test/diagram.xml", "", http.StatusOK, `<g id="cell-3">`},
+		{"render with results", http.MethodPost, "/api/render/svg/test/diagram.xml", `{"branchCurrents": {"3": 0.5}}`, http.StatusOK, "0.5 A"},
+		{"bad results", http.MethodPost, "/api/render/svg/test/diagram.xml", `{"branchCurrents": `, http.StatusBadRequest, ""},
+		{"missing diagram", http.MethodGet, "/api/render/svg/test/missing.xml", "", http.StatusNotFound, ""},
+		{"broken diagram", http.MethodGet, "/api/render/svg/test/broken.xml", "", http.StatusUnprocessableEntity, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, test.expectedCode, res.StatusCode)
+			if test.expectedCode == http.StatusOK {
+				assert.Equal(t, "image/svg+xml", res.Header.Get("Content-Type"))
+			}
+			b, err := io.ReadAll(res.Body)
+			assert.NoError(t, err)
+			assert.Contains(t, string(b), test.expectedBody)
+		})
+	}
+}
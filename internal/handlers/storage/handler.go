@@ -2,60 +2,138 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"go.uber.org/zap"
+	"io"
+	"mime"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	loadUrl         = "/api/ostorage/load"
-	listUrl         = "/api/ostorage/ls"
-	uploadUrl       = "/api/ostorage/upload"
-	FormFileBody    = "uploadData"
-	DeadLineTimeOut = 10 * time.Second
+	loadUrl      = "/api/ostorage/load"
+	listUrl      = "/api/ostorage/ls"
+	uploadUrl    = "/api/ostorage/upload"
+	versionsUrl  = "/api/ostorage/versions"
+	restoreUrl   = "/api/ostorage/restore"
+	FormFileBody = "uploadData"
+	// metadata form fields of the upload, they precede the file part. Tags are comma separated
+	// or given by repeated fields.
+	FormAuthor      = "author"
+	FormDescription = "description"
+	FormTags        = "tags"
+	// formValueLimit bounds metadata form fields
+	formValueLimit = 4 << 10
+	// ChecksumHeader is hex encoded SHA-256 of the uploaded file, the upload fails when the content differs
+	ChecksumHeader = "X-Checksum-Sha256"
+	// DefaultMaxUploadSize bounds the upload request when Handler.MaxUploadSize is not set
+	DefaultMaxUploadSize = 64 << 20
+	// DefaultLsLimit and MaxLsLimit are the default and the largest page sizes of the listing
+	DefaultLsLimit = 100
+	MaxLsLimit     = 1000
+)
+
+// listing orders
+const (
+	sortName  = "name"
+	sortMtime = "mtime"
 )
 
 type Handler struct {
 	Logger  *zap.Logger
 	Storage calculator.ObjectStorage
+	// Calculator restores versions and ingests them to graph storage, restore is not available when nil
+	Calculator *calculator.Calculator
+	// MaxUploadSize is the maximum size of the upload request in bytes, 0 means DefaultMaxUploadSize
+	MaxUploadSize int64
+	// PresignExpiry is the lifetime of presigned URLs, 0 means DefaultPresignExpiry
+	PresignExpiry time.Duration
+	// PresignSecret signs upload tokens of presigned URLs, a random one is generated when it is empty
+	PresignSecret []byte
+
+	secretOnce sync.Once
+	key        []byte
 }
 
+// LsResponse is a page of the listing, Next is the cursor of the following page, empty on the last page
 type LsResponse struct {
-	LsItems []string `json:"projects"`
+	LsItems []calculator.ObjectInfo `json:"projects"`
+	Next    string                  `json:"next,omitempty"`
+}
+
+// VersionsResponse lists versions of the file, the latest first
+type VersionsResponse struct {
+	Path     string                `json:"path"`
+	Versions []calculator.FileInfo `json:"versions"`
+}
+
+// PreconditionResponse reports the latest version of the file, when the upload is based on another version
+// or the file was to be created only. Current is null when the file does not exist.
+type PreconditionResponse struct {
+	Current *calculator.FileInfo `json:"current"`
+	Error   string               `json:"error"`
+}
+
+// ValidationResponse explains why the uploaded document is rejected by the validation level of the project
+type ValidationResponse struct {
+	Path  string `json:"path"`
+	Level string `json:"level"`
+	*calculator.ValidationError
+}
+
+// RestoreResponse reports the new latest version of the file and the diagram version it was ingested to.
+// IngestError is set when the restored document could not be stored in graph storage.
+type RestoreResponse struct {
+	File           *calculator.FileInfo `json:"file"`
+	UUID           string               `json:"uuid,omitempty"`
+	DiagramVersion int                  `json:"diagramVersion,omitempty"`
+	IngestError    string               `json:"ingestError,omitempty"`
 }
 
 func (h *Handler) Register(r chi.Router) {
-	r.Use(middleware.Timeout(DeadLineTimeOut))
 	r.Route(loadUrl, func(r chi.Router) {
-		r.Get("/{filename}", h.LoadFile)
-		r.Get("/{filename}/", h.LoadFile)
+		r.Get("/{project}/*", h.LoadFile)
 	})
 	r.Route(uploadUrl, func(r chi.Router) {
 		r.Post("/", h.UploadFile)
 		r.Post("/{project}", h.UploadFile)
 		r.Post("/{project}/", h.UploadFile)
 	})
-	r.Route(listUrl, func(r chi.Router) {
-		r.Get("/{project}/", h.ListProjectFiles)
-		r.Get("/{project}", h.ListProjectFiles)
-		r.Get("/", h.ListProjectFiles)
+	r.Post(completeUrl, h.Complete)
+	// loads, uploads and completed presigned uploads are bounded by timeouts of the server only
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(handlers.DeadLineTimeOut))
+		r.Route(listUrl, func(r chi.Router) {
+			r.Get("/{project}/", h.ListProjectFiles)
+			r.Get("/{project}", h.ListProjectFiles)
+			r.Get("/", h.ListProjectFiles)
+		})
+		r.Get(versionsUrl+"/{project}/*", h.ListVersions)
+		r.Post(restoreUrl+"/{project}/*", h.RestoreVersion)
+		r.Post(presignUrl+"/{project}/*", h.Presign)
 	})
-
 }
 
-// UploadFile upload file to storage
+// UploadFile upload file to storage. If-Match with a version or ETag uploads only over that version,
+// If-None-Match: * creates the file only. Requests larger than MaxUploadSize get 413.
+// Author, description and tags form fields are kept with the version, along with editor, diagram uuid
+// and numbers of components read from diagrams when Calculator is set. The content is validated by the policy
+// of the project then, rejected documents get 415 when their format is not accepted, 413 when they are
+// too large and 422 otherwise.
 func (h *Handler) UploadFile(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	err := r.ParseMultipartForm(10 << 20) // 10MB max
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	//w.Header().Set("Content-Type", "application/json")
 
 	project := chi.URLParam(r, "project")
 	// do not allow to write to root of the bucket.
@@ -63,67 +141,480 @@ func (h *Handler) UploadFile(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	file, mpfhandler, err := r.FormFile(FormFileBody)
-	if err != nil {
-		h.Logger.Error("failed to upload file",
-			zap.Error(err),
-		)
+	opts, ok := uploadOptions(r)
+	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	err = h.Storage.UploadTextFile(r.Context(), h.Logger, file, project+"/"+mpfhandler.Filename)
+	// the file part is streamed to the storage, it is not buffered in memory or temporary files
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxUploadSize())
+	mr, err := r.MultipartReader()
 	if err != nil {
-		h.Logger.Error("failed to upload file",
-			zap.Error(err),
-		)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	var author, description string
+	var tags []string
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			h.Logger.Error("failed to upload file",
+				zap.Error(err),
+			)
+			h.writeUploadError(w, err)
+			return
+		}
+		switch part.FormName() {
+		case FormAuthor, FormDescription, FormTags:
+			value, err := io.ReadAll(io.LimitReader(part, formValueLimit))
+			if err != nil {
+				h.writeUploadError(w, err)
+				return
+			}
+			switch part.FormName() {
+			case FormAuthor:
+				author = string(value)
+			case FormDescription:
+				description = string(value)
+			case FormTags:
+				tags = append(tags, strings.Split(string(value), ",")...)
+			}
+			continue
+		}
+		if part.FormName() != FormFileBody || part.FileName() == "" {
+			continue
+		}
+		if opts.Metadata, err = calculator.NewFileMetadata(author, description, tags); err != nil {
+			h.Logger.Error("bad upload metadata",
+				zap.Error(err),
+			)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		filePath := project + "/" + part.FileName()
+		if h.Calculator != nil {
+			opts.Inspect = h.Calculator.Inspector(filePath, h.maxUploadSize())
+		}
+
+		info, err := h.Storage.UploadFile(r.Context(), h.Logger, part, filePath, opts)
+		if h.writePrecondition(w, opts, err) || h.writeValidation(w, filePath, err) {
+			return
+		}
+		if err != nil {
+			h.Logger.Error("failed to upload file",
+				zap.Error(err),
+			)
+			h.writeUploadError(w, err)
+			return
+		}
+		handlers.WriteJSON(h.Logger, w, http.StatusCreated, info)
+		return
+	}
+}
+
+// writeUploadError writes 413 when the upload is larger than allowed, 400 otherwise
+func (h *Handler) writeUploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+}
 
-	w.WriteHeader(http.StatusCreated)
-	return
+func (h *Handler) maxUploadSize() int64 {
+	if h.MaxUploadSize > 0 {
+		return h.MaxUploadSize
+	}
+	return DefaultMaxUploadSize
 }
 
-// ListProjectFiles lists existing projects or project content
-// returns http.StatusNotFound in case project name does not exist in storage
+// ListProjectFiles lists existing projects or project content with size, time and metadata of files
+// a page at a time. Query parameters:
+//   - "recursive=true" lists every file under the project instead of its top level files and directories
+//   - "sort" is "name" (the default) or "mtime", "order" is "asc" (the default) or "desc"
+//   - "limit" is the page size, DefaultLsLimit by default and up to MaxLsLimit
+//   - "cursor" is "next" of the previous page, it is given with the same sort and order only
+//   - "tag" keeps files having all the tags only
+//
+// returns http.StatusNotFound in case project name does not exist in storage or nothing is tagged so
 func (h *Handler) ListProjectFiles(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
 	project := chi.URLParam(r, "project")
+	q, ok := lsQuery(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	var items LsResponse
-	for item := range h.Storage.Ls(r.Context(), project) {
-		items.LsItems = append(items.LsItems, item)
+	// name ordered pages are read from the storage from the cursor on, other orders need the whole listing
+	streamed := q.cursor.Sort == sortName && !q.cursor.Desc
+	opts := calculator.LsOptions{Recursive: q.recursive}
+	if streamed && q.after {
+		opts.StartAfter = q.cursor.Path
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	items := []calculator.ObjectInfo{}
+	for item := range h.Storage.Ls(ctx, project, opts) {
+		if item.Err != nil {
+			h.writeError(w, project, item.Err)
+			return
+		}
+		if len(q.tags) > 0 && !item.Metadata.HasTags(q.tags...) {
+			continue
+		}
+		items = append(items, item)
+		if streamed && len(items) > q.limit {
+			break
+		}
+	}
+	if !streamed {
+		sort.Slice(items, func(i, j int) bool {
+			return q.cursor.at(items[i]).before(q.cursor.at(items[j]))
+		})
+		if q.after {
+			i := sort.Search(len(items), func(i int) bool {
+				return q.cursor.before(q.cursor.at(items[i]))
+			})
+			items = items[i:]
+		}
 	}
 
-	if len(items.LsItems) == 0 {
-		w.WriteHeader(http.StatusNotFound)
+	resp := LsResponse{LsItems: items}
+	if len(items) > q.limit {
+		resp.LsItems = items[:q.limit]
+		resp.Next = q.cursor.at(items[q.limit-1]).encode()
+	}
+	if len(resp.LsItems) == 0 && !q.after {
+		handlers.WriteJSON(h.Logger, w, http.StatusNotFound, resp)
+		return
 	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, resp)
+}
 
-	buf := new(bytes.Buffer)
-	err := json.NewEncoder(buf).Encode(items)
+// listing is a parsed listing request, cursor keeps the order even when the first page is requested
+type listing struct {
+	recursive bool
+	limit     int
+	tags      []string
+	cursor    lsCursor
+	// after tells whether the listing continues from the cursor
+	after bool
+}
+
+// lsQuery reads query parameters of the listing request, false is returned for bad ones
+func lsQuery(r *http.Request) (listing, bool) {
+	query := r.URL.Query()
+	q := listing{
+		recursive: query.Get("recursive") == "true",
+		limit:     DefaultLsLimit,
+		tags:      query["tag"],
+		cursor:    lsCursor{Sort: sortName},
+	}
+	switch query.Get("sort") {
+	case "", sortName:
+	case sortMtime:
+		q.cursor.Sort = sortMtime
+	default:
+		return q, false
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.cursor.Desc = true
+	default:
+		return q, false
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > MaxLsLimit {
+			return q, false
+		}
+		q.limit = n
+	}
+	if token := query.Get("cursor"); token != "" {
+		cursor, err := decodeCursor(token)
+		if err != nil || cursor.Sort != q.cursor.Sort || cursor.Desc != q.cursor.Desc {
+			return q, false
+		}
+		q.cursor = cursor
+		q.after = true
+	}
+	return q, true
+}
+
+// lsCursor is the position in the listing ordered by Sort, the path and time of the last listed entry
+type lsCursor struct {
+	Sort string    `json:"s"`
+	Desc bool      `json:"d,omitempty"`
+	Path string    `json:"p"`
+	Time time.Time `json:"t,omitempty"`
+}
+
+// at returns the position of the entry in the listing of the same order, directories have zero time
+func (c lsCursor) at(item calculator.ObjectInfo) lsCursor {
+	at := lsCursor{Sort: c.Sort, Desc: c.Desc, Path: item.Path}
+	if item.LastModified != nil {
+		at.Time = *item.LastModified
+	}
+	return at
+}
+
+// before tells whether the position precedes the other one, entries of the same time are ordered by path
+func (c lsCursor) before(o lsCursor) bool {
+	a, b := c, o
+	if c.Desc {
+		a, b = o, c
+	}
+	if a.Sort == sortMtime && !a.Time.Equal(b.Time) {
+		return a.Time.Before(b.Time)
+	}
+	return a.Path < b.Path
+}
+
+func (c lsCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(token string) (lsCursor, error) {
+	var c lsCursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
 	if err != nil {
-		h.Logger.Error("error in json encoding of storage path listing",
-			zap.String("path", project),
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// LoadFile downloads the file stored under the project, "version" query parameter selects a version of it.
+// Range and conditional requests are served by http.ServeContent.
+func (h *Handler) LoadFile(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "*")
+	filePath, ok := storagePath(chi.URLParam(r, "project"), name)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	info, err := h.Storage.StatFile(r.Context(), h.Logger, filePath, r.URL.Query().Get("version"))
+	if err != nil {
+		if errors.Is(err, calculator.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h.Logger.Error("could not load file",
+			zap.String("path", filePath),
 			zap.Error(err),
 		)
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("error listing storage"))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(buf.Bytes()); err != nil {
-		h.Logger.Error("error writing response body",
+	// content is loaded by the resolved version, so it matches headers even if the file is uploaded meanwhile
+	reader, err := h.Storage.LoadFileByName(r.Context(), h.Logger, filePath, info.Version)
+	if err != nil {
+		if errors.Is(err, calculator.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	content, ok := reader.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(reader)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+
+	base := path.Base(name)
+	contentType := info.ContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		// documents are uploaded as octet-stream, ServeContent sniffs the type when nothing is found by extension
+		contentType = mime.TypeByExtension(path.Ext(base))
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": base}))
+	if info.ETag != "" {
+		w.Header().Set("ETag", `"`+info.ETag+`"`)
+	}
+	http.ServeContent(w, r, base, info.LastModified, content)
+}
+
+// ListVersions lists versions of the file with their metadata, the latest first
+func (h *Handler) ListVersions(w http.ResponseWriter, r *http.Request) {
+	filePath, ok := storagePath(chi.URLParam(r, "project"), chi.URLParam(r, "*"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ids, err := h.Storage.LsVersions(r.Context(), filePath, h.Logger)
+	if err != nil {
+		h.writeError(w, filePath, err)
+		return
+	}
+	resp := VersionsResponse{Path: filePath, Versions: []calculator.FileInfo{}}
+	for id := range ids {
+		info, err := h.Storage.StatFile(r.Context(), h.Logger, filePath, id)
+		if err != nil {
+			h.writeError(w, filePath, err)
+			return
+		}
+		resp.Versions = append(resp.Versions, *info)
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, resp)
+}
+
+// RestoreVersion copies the version given by "version" query parameter forward as the latest version of the file
+// and ingests it to graph storage. Failed ingestion is reported in the response, the file stays restored.
+func (h *Handler) RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	if h.Calculator == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	filePath, ok := storagePath(chi.URLParam(r, "project"), chi.URLParam(r, "*"))
+	version := r.URL.Query().Get("version")
+	if !ok || version == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// stat first, so a missing version is told from a failed upload
+	if _, err := h.Storage.StatFile(r.Context(), h.Logger, filePath, version); err != nil {
+		h.writeError(w, filePath, err)
+		return
+	}
+	opts, ok := uploadOptions(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	info, err := h.Calculator.RestoreFileVersion(r.Context(), filePath, version, opts)
+	if h.writePrecondition(w, opts, err) {
+		return
+	}
+	if err != nil {
+		h.writeError(w, filePath, err)
+		return
+	}
+
+	resp := RestoreResponse{File: info}
+	uuid, summary, err := h.Calculator.IngestFile(r.Context(), filePath, info.Version)
+	if err != nil {
+		h.Logger.Error("restored version was not ingested",
+			zap.String("path", filePath),
+			zap.String("version", info.Version),
 			zap.Error(err),
 		)
+		resp.IngestError = err.Error()
+	} else {
+		resp.UUID = uuid
+		resp.DiagramVersion = summary.Versions[uuid]
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusCreated, resp)
+}
+
+// writePrecondition writes the latest version of the file when err is PreconditionError, 409 when the file was
+// to be created only and 412 otherwise. It tells whether the response was written.
+func (h *Handler) writePrecondition(w http.ResponseWriter, opts calculator.UploadOptions, err error) bool {
+	var perr *calculator.PreconditionError
+	if !errors.As(err, &perr) {
+		return false
+	}
+	code := http.StatusPreconditionFailed
+	if opts.IfNoneMatch && perr.Current != nil {
+		code = http.StatusConflict
 	}
+	if perr.Current != nil && perr.Current.ETag != "" {
+		w.Header().Set("ETag", `"`+perr.Current.ETag+`"`)
+	}
+	handlers.WriteJSON(h.Logger, w, code, PreconditionResponse{Current: perr.Current, Error: err.Error()})
+	return true
+}
 
+// writeValidation writes the reason of rejecting the document when err is ValidationError.
+// It tells whether the response was written.
+func (h *Handler) writeValidation(w http.ResponseWriter, path string, err error) bool {
+	var verr *calculator.ValidationError
+	if !errors.As(err, &verr) {
+		return false
+	}
+	project, _, _ := strings.Cut(path, "/")
+	resp := ValidationResponse{Path: path, Level: h.Calculator.Validation.Policy(project).Level, ValidationError: verr}
+	h.Logger.Info("document rejected",
+		zap.String("path", path),
+		zap.String("reason", verr.Reason),
+		zap.String("detail", verr.Detail),
+	)
+	switch verr.Reason {
+	case calculator.ReasonUnsupported:
+		handlers.WriteJSON(h.Logger, w, http.StatusUnsupportedMediaType, resp)
+	case calculator.ReasonTooLarge:
+		handlers.WriteJSON(h.Logger, w, http.StatusRequestEntityTooLarge, resp)
+	default:
+		handlers.WriteJSON(h.Logger, w, http.StatusUnprocessableEntity, resp)
+	}
+	return true
 }
 
-func (h *Handler) LoadFile(w http.ResponseWriter, r *http.Request) {
+// writeError writes 404 for missing files and versions, 500 otherwise
+func (h *Handler) writeError(w http.ResponseWriter, path string, err error) {
+	if errors.Is(err, calculator.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	h.Logger.Error("storage request failed",
+		zap.String("path", path),
+		zap.Error(err),
+	)
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// uploadOptions reads uploader, checksum and conditional headers of the upload request. If-Match takes versions
+// or entity tags, If-None-Match takes "*" only. False is returned for other If-None-Match values.
+func uploadOptions(r *http.Request) (calculator.UploadOptions, bool) {
+	opts := calculator.UploadOptions{
+		Uploader: handlers.Uploader(r),
+		Checksum: r.Header.Get(ChecksumHeader),
+	}
+	for _, header := range r.Header.Values("If-Match") {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+			if tag != "" {
+				opts.IfMatch = append(opts.IfMatch, tag)
+			}
+		}
+	}
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if strings.TrimSpace(header) != "*" {
+			return opts, false
+		}
+		opts.IfNoneMatch = true
+	}
+	return opts, true
+}
 
+// storagePath joins project and file name into the object path, false is returned when either of them
+// is empty or the name has empty, "." or ".." segments
+func storagePath(project string, name string) (string, bool) {
+	if project == "" || name == "" {
+		return "", false
+	}
+	for _, part := range strings.Split(project+"/"+name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", false
+		}
+	}
+	return project + "/" + name, true
 }
@@ -3,8 +3,17 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
 	"github.com/aemakeye/circuit_calculator/internal/config"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/filestore"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
+	"github.com/aemakeye/circuit_calculator/internal/memgraph"
 	"github.com/go-chi/chi"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
@@ -12,8 +21,12 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandlers(t *testing.T) {
@@ -89,7 +102,7 @@ func TestHandlers(t *testing.T) {
 		defer res.Body.Close()
 
 		err = json.NewDecoder(res.Body).Decode(&jb)
-		t.Logf("%s", jb)
+		t.Logf("%v", jb)
 		assert.NoError(t, err)
 	})
 
@@ -176,3 +189,784 @@ func TestHandlers(t *testing.T) {
 
 	})
 }
+
+func TestHandler_LoadFile(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	storage, err := filestore.NewStorage(logger, t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, storage.UploadTextFile(ctx, logger, strings.NewReader("<mxfile>first</mxfile>"), "test/sub/diagram.xml"))
+	assert.NoError(t, storage.UploadTextFile(ctx, logger, strings.NewReader("<mxfile>second</mxfile>"), "test/sub/diagram.xml"))
+	versions, err := storage.LsVersions(ctx, "test/sub/diagram.xml", logger)
+	assert.NoError(t, err)
+	var ids []string
+	for id := range versions {
+		ids = append(ids, id)
+	}
+
+	h := Handler{Logger: logger, Storage: storage}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+	get := func(url string, header map[string]string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	t.Run("latest version", func(t *testing.T) {
+		res := get(loadUrl+"/test/sub/diagram.xml", nil)
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "<mxfile>second</mxfile>", string(b))
+		assert.Contains(t, res.Header.Get("Content-Type"), "xml")
+		assert.Equal(t, `attachment; filename=diagram.xml`, res.Header.Get("Content-Disposition"))
+		assert.Equal(t, `"`+ids[0]+`"`, res.Header.Get("ETag"))
+		assert.NotEmpty(t, res.Header.Get("Last-Modified"))
+		assert.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+	})
+
+	t.Run("version", func(t *testing.T) {
+		res := get(loadUrl+"/test/sub/diagram.xml?version="+ids[1], nil)
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "<mxfile>first</mxfile>", string(b))
+		assert.Equal(t, `"`+ids[1]+`"`, res.Header.Get("ETag"))
+	})
+
+	t.Run("range", func(t *testing.T) {
+		res := get(loadUrl+"/test/sub/diagram.xml", map[string]string{"Range": "bytes=8-13"})
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+		assert.Equal(t, "second", string(b))
+		assert.Equal(t, "bytes 8-13/23", res.Header.Get("Content-Range"))
+	})
+
+	t.Run("not modified", func(t *testing.T) {
+		res := get(loadUrl+"/test/sub/diagram.xml", map[string]string{"If-None-Match": `"` + ids[0] + `"`})
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for url, code := range map[string]int{
+			loadUrl + "/test/missing.xml":                              http.StatusNotFound,
+			loadUrl + "/test/sub/diagram.xml?version=0000000000000001": http.StatusNotFound,
+			loadUrl + "/missing/diagram.xml":                           http.StatusNotFound,
+			loadUrl + "/test/sub/../../escape.xml":                     http.StatusBadRequest,
+			loadUrl + "/test/":                                         http.StatusBadRequest,
+		} {
+			res := get(url, nil)
+			res.Body.Close()
+			assert.Equal(t, code, res.StatusCode, url)
+		}
+	})
+}
+
+func TestHandler_Versions(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	storage, err := filestore.NewStorage(logger, t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	graph := memgraph.NewStorage()
+	h := Handler{
+		Logger:  logger,
+		Storage: storage,
+		Calculator: &calculator.Calculator{
+			Logger:      logger,
+			Gstorage:    graph,
+			TextStorage: storage,
+			DiagramSvc:  drawio.NewController(logger),
+		},
+	}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+	do := func(method string, url string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, body)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	upload := func(content string, user string) {
+		bbuf := &bytes.Buffer{}
+		writer := multipart.NewWriter(bbuf)
+		fw, err := writer.CreateFormFile(FormFileBody, "diagram.xml")
+		assert.NoError(t, err)
+		_, _ = io.WriteString(fw, content)
+		_ = writer.Close()
+		w := do(http.MethodPost, uploadUrl+"/test", bbuf, map[string]string{
+			"Content-Type":      writer.FormDataContentType(),
+			handlers.UserHeader: user,
+		})
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	diagram := func(value string) string {
+		return `<mxfile><diagram id="uweCVhkyVy6MirBnUyNJ" name="Page-1"><mxGraphModel><root>
+			<mxCell id="0"/><mxCell id="1" parent="0"/>
+			<mxCell id="3" value="` + value + `" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1">
+				<mxGeometry x="110" y="140" width="100" height="20" as="geometry"/>
+			</mxCell>
+			</root></mxGraphModel></diagram></mxfile>`
+	}
+	upload(diagram("10k"), "alice")
+	upload(diagram("4k7"), "bob")
+
+	var versions VersionsResponse
+	t.Run("list", func(t *testing.T) {
+		w := do(http.MethodGet, versionsUrl+"/test/diagram.xml", nil, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&versions))
+		if !assert.Len(t, versions.Versions, 2) {
+			return
+		}
+		assert.Equal(t, "test/diagram.xml", versions.Path)
+		assert.Equal(t, "bob", versions.Versions[0].Uploader)
+		assert.Equal(t, "alice", versions.Versions[1].Uploader)
+		sum := sha256.Sum256([]byte(diagram("10k")))
+		assert.Equal(t, hex.EncodeToString(sum[:]), versions.Versions[1].Checksum)
+		assert.Equal(t, int64(len(diagram("10k"))), versions.Versions[1].Size)
+		assert.False(t, versions.Versions[1].LastModified.IsZero())
+
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, versionsUrl+"/test/missing.xml", nil, nil).Code)
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		if len(versions.Versions) != 2 {
+			t.Skip("no versions listed")
+		}
+		oldest := versions.Versions[1].Version
+		w := do(http.MethodPost, restoreUrl+"/test/diagram.xml?version="+oldest, nil, map[string]string{handlers.UserHeader: "carol"})
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var resp RestoreResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Empty(t, resp.IngestError)
+		assert.Equal(t, "uweCVhkyVy6MirBnUyNJ", resp.UUID)
+		assert.Equal(t, 1, resp.DiagramVersion)
+		if assert.NotNil(t, resp.File) {
+			assert.Equal(t, "carol", resp.File.Uploader)
+			assert.Equal(t, versions.Versions[1].Checksum, resp.File.Checksum)
+			assert.NotEqual(t, oldest, resp.File.Version)
+		}
+
+		// copied forward, history is kept
+		ids, err := storage.LsVersions(ctx, "test/diagram.xml", logger)
+		assert.NoError(t, err)
+		n := 0
+		for range ids {
+			n++
+		}
+		assert.Equal(t, 3, n)
+
+		items, err := graph.LoadItems(ctx, logger, "uweCVhkyVy6MirBnUyNJ", 0)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, "10k", items[0].Value)
+		}
+		diagrams, err := graph.ListVersions(ctx, logger, "uweCVhkyVy6MirBnUyNJ")
+		assert.NoError(t, err)
+		if assert.Len(t, diagrams, 1) {
+			assert.Equal(t, "test", diagrams[0].Project)
+			assert.Equal(t, "test/diagram.xml", diagrams[0].Source)
+		}
+	})
+
+	t.Run("restore errors", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, restoreUrl+"/test/diagram.xml", nil, nil).Code)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodPost, restoreUrl+"/test/diagram.xml?version=0000000000000001", nil, nil).Code)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodPost, restoreUrl+"/test/missing.xml?version=0000000000000001", nil, nil).Code)
+	})
+}
+
+func TestHandler_Preconditions(t *testing.T) {
+	logger := zap.NewNop()
+	storage, err := filestore.NewStorage(logger, t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := Handler{Logger: logger, Storage: storage}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+	upload := func(content string, header map[string]string) (*httptest.ResponseRecorder, PreconditionResponse) {
+		bbuf := &bytes.Buffer{}
+		writer := multipart.NewWriter(bbuf)
+		fw, err := writer.CreateFormFile(FormFileBody, "diagram.xml")
+		assert.NoError(t, err)
+		_, _ = io.WriteString(fw, content)
+		_ = writer.Close()
+		req := httptest.NewRequest(http.MethodPost, uploadUrl+"/test", bbuf)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp PreconditionResponse
+		if w.Code != http.StatusCreated && w.Code != http.StatusBadRequest {
+			assert.NoError(t, json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&resp))
+		}
+		return w, resp
+	}
+
+	w, resp := upload("first", map[string]string{"If-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Nil(t, resp.Current)
+
+	w, _ = upload("first", map[string]string{"If-None-Match": "*"})
+	if !assert.Equal(t, http.StatusCreated, w.Code) {
+		return
+	}
+	var first calculator.FileInfo
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&first))
+
+	w, resp = upload("again", map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	if assert.NotNil(t, resp.Current) {
+		assert.Equal(t, first.Version, resp.Current.Version)
+	}
+
+	w, _ = upload("second", map[string]string{"If-Match": `"` + first.ETag + `"`})
+	if !assert.Equal(t, http.StatusCreated, w.Code) {
+		return
+	}
+	var second calculator.FileInfo
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&second))
+
+	// somebody saved meanwhile, the editor offers a merge
+	w, resp = upload("stale", map[string]string{"If-Match": first.Version})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, `"`+second.ETag+`"`, w.Header().Get("ETag"))
+	if assert.NotNil(t, resp.Current) {
+		assert.Equal(t, second.Version, resp.Current.Version)
+	}
+
+	w, _ = upload("third", map[string]string{"If-None-Match": `"` + second.ETag + `"`})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, _ = upload("third", map[string]string{"If-Match": `"unknown", W/"` + second.Version + `"`})
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestHandler_Upload(t *testing.T) {
+	logger := zap.NewNop()
+	storage, err := filestore.NewStorage(logger, t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := Handler{Logger: logger, Storage: storage, MaxUploadSize: 1024}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+	upload := func(content string, header map[string]string) *httptest.ResponseRecorder {
+		bbuf := &bytes.Buffer{}
+		writer := multipart.NewWriter(bbuf)
+		assert.NoError(t, writer.WriteField("comment", "fields before the file are skipped"))
+		fw, err := writer.CreateFormFile(FormFileBody, "diagram.xml")
+		assert.NoError(t, err)
+		_, _ = io.WriteString(fw, content)
+		_ = writer.Close()
+		req := httptest.NewRequest(http.MethodPost, uploadUrl+"/test", bbuf)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	sum := sha256.Sum256([]byte("<mxfile/>"))
+	checksum := hex.EncodeToString(sum[:])
+
+	w := upload("<mxfile/>", map[string]string{ChecksumHeader: checksum})
+	if !assert.Equal(t, http.StatusCreated, w.Code) {
+		return
+	}
+	var first calculator.FileInfo
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&first))
+	assert.Equal(t, checksum, first.Checksum)
+	assert.Equal(t, "test/diagram.xml", first.Path)
+
+	// same content is not stored again
+	w = upload("<mxfile/>", nil)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var same calculator.FileInfo
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&same))
+	assert.Equal(t, first.Version, same.Version)
+
+	assert.Equal(t, http.StatusBadRequest, upload("<mxfile></mxfile>", map[string]string{ChecksumHeader: checksum}).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(strings.Repeat("x", 2048), nil).Code)
+
+	req := httptest.NewRequest(http.MethodPost, uploadUrl+"/test", strings.NewReader("--b--\r\n"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	versions, err := storage.LsVersions(context.Background(), "test/diagram.xml", logger)
+	assert.NoError(t, err)
+	n := 0
+	for range versions {
+		n++
+	}
+	assert.Equal(t, 1, n)
+}
+
+func TestHandler_Metadata(t *testing.T) {
+	logger := zap.NewNop()
+	storage, err := filestore.NewStorage(logger, t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := Handler{
+		Logger:  logger,
+		Storage: storage,
+		Calculator: &calculator.Calculator{
+			Logger:      logger,
+			Gstorage:    memgraph.NewStorage(),
+			TextStorage: storage,
+			DiagramSvc:  drawio.NewController(logger),
+		},
+	}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+	upload := func(name string, content string, fields map[string]string) (*httptest.ResponseRecorder, calculator.FileInfo) {
+		bbuf := &bytes.Buffer{}
+		writer := multipart.NewWriter(bbuf)
+		for k, v := range fields {
+			assert.NoError(t, writer.WriteField(k, v))
+		}
+		fw, err := writer.CreateFormFile(FormFileBody, name)
+		assert.NoError(t, err)
+		_, _ = io.WriteString(fw, content)
+		_ = writer.Close()
+		req := httptest.NewRequest(http.MethodPost, uploadUrl+"/test", bbuf)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var info calculator.FileInfo
+		if w.Code == http.StatusCreated {
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+		}
+		return w, info
+	}
+	list := func(url string) (int, []string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		var resp LsResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		var paths []string
+		for _, item := range resp.LsItems {
+			paths = append(paths, item.Path)
+		}
+		return w.Code, paths
+	}
+
+	w, info := upload("diagram.xml", `<mxfile host="app.diagrams.net"><diagram id="uweCVhkyVy6MirBnUyNJ"><mxGraphModel><root>
+		<mxCell id="0"/><mxCell id="1" parent="0"/>
+		<mxCell id="3" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1"/>
+		<mxCell id="4" style="shape=mxgraph.electrical.resistors.resistor_2;" vertex="1" parent="1"/>
+		<mxCell id="5" style="shape=mxgraph.electrical.capacitors.capacitor_1;" vertex="1" parent="1"/>
+		<mxCell id="6" style="endArrow=none;" edge="1" parent="1" source="3" target="5"/>
+		</root></mxGraphModel></diagram></mxfile>`,
+		map[string]string{FormAuthor: "alice", FormDescription: "power supply", FormTags: "power, draft,power"})
+	if !assert.Equal(t, http.StatusCreated, w.Code) {
+		return
+	}
+	assert.Equal(t, &calculator.FileMetadata{
+		Author:      "alice",
+		Description: "power supply",
+		Tags:        []string{"power", "draft"},
+		Editor:      "app.diagrams.net",
+		DiagramUUID: "uweCVhkyVy6MirBnUyNJ",
+		Components:  map[string]int{"resistors": 2, "capacitors": 1},
+	}, info.Metadata)
+
+	// documents other than diagrams keep metadata given by the uploader only
+	w, info = upload("notes.txt", "not a diagram", map[string]string{FormTags: "draft"})
+	if assert.Equal(t, http.StatusCreated, w.Code) {
+		assert.Equal(t, &calculator.FileMetadata{Tags: []string{"draft"}}, info.Metadata)
+	}
+	w, _ = upload("large.txt", "", map[string]string{FormDescription: strings.Repeat("x", calculator.MaxDescriptionLength+1)})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	code, paths := list(listUrl + "/test")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"test/diagram.xml", "test/notes.txt"}, paths)
+	_, paths = list(listUrl + "/test?tag=DRAFT")
+	assert.Equal(t, []string{"test/diagram.xml", "test/notes.txt"}, paths)
+	_, paths = list(listUrl + "/test?tag=draft&tag=power")
+	assert.Equal(t, []string{"test/diagram.xml"}, paths)
+	code, paths = list(listUrl + "/test?tag=missing")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Empty(t, paths)
+}
+
+func TestHandler_Validation(t *testing.T) {
+	logger := zap.NewNop()
+	storage, err := filestore.NewStorage(logger, t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := Handler{
+		Logger:  logger,
+		Storage: storage,
+		Calculator: &calculator.Calculator{
+			Logger:      logger,
+			Gstorage:    memgraph.NewStorage(),
+			TextStorage: storage,
+			DiagramSvc:  drawio.NewController(logger),
+			Validation: calculator.Validation{
+				Default:  calculator.ValidationPolicy{MaxSize: 512},
+				Projects: map[string]calculator.ValidationPolicy{"production": {Level: calculator.ValidationStrict}},
+			},
+		},
+	}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+	upload := func(project string, name string, content string) (*httptest.ResponseRecorder, ValidationResponse) {
+		bbuf := &bytes.Buffer{}
+		writer := multipart.NewWriter(bbuf)
+		fw, err := writer.CreateFormFile(FormFileBody, name)
+		assert.NoError(t, err)
+		_, _ = io.WriteString(fw, content)
+		_ = writer.Close()
+		req := httptest.NewRequest(http.MethodPost, uploadUrl+"/"+project, bbuf)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp ValidationResponse
+		if w.Code != http.StatusCreated {
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w, resp
+	}
+	diagram := `<mxfile host="app.diagrams.net"><diagram id="uweCVhkyVy6MirBnUyNJ"><mxGraphModel><root>
+		<mxCell id="0"/><mxCell id="1" parent="0"/>
+		<mxCell id="3" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1"/>
+		</root></mxGraphModel></diagram></mxfile>`
+
+	w, _ := upload("test", "notes.txt", "not a diagram")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w, _ = upload("production", "diagram.xml", diagram)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w, resp := upload("production", "notes.txt", "not a diagram")
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Equal(t, "production/notes.txt", resp.Path)
+	assert.Equal(t, calculator.ValidationStrict, resp.Level)
+	if assert.NotNil(t, resp.ValidationError) {
+		assert.Equal(t, calculator.ReasonUnsupported, resp.Reason)
+	}
+
+	w, resp = upload("test", "diagram.xml", "<mxfile>\n<diagram>\n</mxfile>")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, calculator.ValidationLenient, resp.Level)
+	if assert.NotNil(t, resp.ValidationError) {
+		assert.Equal(t, calculator.ReasonMalformed, resp.Reason)
+		assert.Equal(t, 3, resp.Line)
+	}
+
+	w, resp = upload("test", "entities.xml", `<!DOCTYPE mxfile [<!ENTITY x SYSTEM "file:///etc/passwd">]><mxfile>&x;</mxfile>`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	if assert.NotNil(t, resp.ValidationError) {
+		assert.Equal(t, calculator.ReasonDTD, resp.Reason)
+	}
+
+	w, _ = upload("test", "large.txt", strings.Repeat("x", 513))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// rejected documents are not stored
+	_, err = storage.StatFile(context.Background(), logger, "test/diagram.xml", "")
+	assert.ErrorIs(t, err, calculator.ErrNotFound)
+}
+
+func TestHandler_List(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	dir := t.TempDir()
+	storage, err := filestore.NewStorage(logger, dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := Handler{Logger: logger, Storage: storage}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+
+	// files are modified in reverse order of their names
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	names := []string{"a.xml", "b.xml", "c.xml", "d/e.xml", "f.xml"}
+	for i, name := range names {
+		assert.NoError(t, storage.UploadTextFile(ctx, logger, strings.NewReader(name), "test/"+name))
+		mtime := start.Add(time.Duration(len(names)-i) * time.Hour)
+		assert.NoError(t, os.Chtimes(filepath.Join(dir, "test", filepath.FromSlash(name)), mtime, mtime))
+	}
+
+	list := func(url string) (int, LsResponse) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		var resp LsResponse
+		if w.Code != http.StatusBadRequest {
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w.Code, resp
+	}
+	// all follows cursors and returns pages
+	all := func(url string) [][]string {
+		var pages [][]string
+		for cursor := ""; ; {
+			code, resp := list(url + "&cursor=" + cursor)
+			if !assert.Equal(t, http.StatusOK, code) {
+				return pages
+			}
+			var page []string
+			for _, item := range resp.LsItems {
+				page = append(page, item.Path)
+			}
+			pages = append(pages, page)
+			if resp.Next == "" {
+				return pages
+			}
+			cursor = resp.Next
+		}
+	}
+
+	code, resp := list(listUrl + "/test")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Next)
+	if assert.Len(t, resp.LsItems, 5) {
+		assert.Equal(t, "test/a.xml", resp.LsItems[0].Path)
+		assert.Equal(t, int64(len("a.xml")), resp.LsItems[0].Size)
+		assert.True(t, start.Add(5*time.Hour).Equal(*resp.LsItems[0].LastModified))
+		assert.Equal(t, "test/d/", resp.LsItems[3].Path)
+		assert.Nil(t, resp.LsItems[3].LastModified)
+	}
+
+	assert.Equal(t, [][]string{{"test/a.xml", "test/b.xml"}, {"test/c.xml", "test/d/"}, {"test/f.xml"}},
+		all(listUrl+"/test?limit=2"))
+	assert.Equal(t, [][]string{{"test/a.xml", "test/b.xml", "test/c.xml"}, {"test/d/e.xml", "test/f.xml"}},
+		all(listUrl+"/test?limit=3&recursive=true"))
+	assert.Equal(t, [][]string{{"test/f.xml", "test/d/e.xml"}, {"test/c.xml", "test/b.xml"}, {"test/a.xml"}},
+		all(listUrl+"/test?limit=2&recursive=true&sort=mtime"))
+	assert.Equal(t, [][]string{{"test/a.xml", "test/b.xml"}, {"test/c.xml", "test/d/e.xml"}, {"test/f.xml"}},
+		all(listUrl+"/test?limit=2&recursive=true&sort=mtime&order=desc"))
+	assert.Equal(t, [][]string{{"test/f.xml", "test/d/"}, {"test/c.xml", "test/b.xml"}, {"test/a.xml"}},
+		all(listUrl+"/test?limit=2&order=desc"))
+
+	_, resp = list(listUrl + "/test?limit=2")
+	code, _ = list(listUrl + "/test?limit=2&sort=mtime&cursor=" + resp.Next)
+	assert.Equal(t, http.StatusBadRequest, code)
+	for _, query := range []string{"limit=0", "limit=1001", "sort=size", "order=up", "cursor=bad"} {
+		code, _ = list(listUrl + "/test?" + query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+	code, _ = list(listUrl + "/missing")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// presigner keeps uploads of presigned URLs in memory, the editor puts them to staged
+type presigner struct {
+	*filestore.Storage
+	staged map[string]string
+	keys   int
+}
+
+func (p *presigner) PresignGet(ctx context.Context, logger *zap.Logger, path string, version string, expiry time.Duration) (*url.URL, error) {
+	return url.Parse("http://storage.test/" + path + "?versionId=" + version)
+}
+
+func (p *presigner) PresignPut(ctx context.Context, logger *zap.Logger, expiry time.Duration) (string, *url.URL, error) {
+	p.keys++
+	key := fmt.Sprintf(".uploads/%d", p.keys)
+	p.staged[key] = ""
+	u, err := url.Parse("http://storage.test/" + key)
+	return key, u, err
+}
+
+func (p *presigner) CommitUpload(ctx context.Context, logger *zap.Logger, key string, path string, opts calculator.UploadOptions) (*calculator.FileInfo, error) {
+	content, ok := p.staged[key]
+	if !ok || content == "" {
+		return nil, calculator.ErrNotFound
+	}
+	delete(p.staged, key)
+	return p.UploadFile(ctx, logger, strings.NewReader(content), path, opts)
+}
+
+func TestHandler_Presign(t *testing.T) {
+	logger := zap.NewNop()
+	fs, err := filestore.NewStorage(logger, t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	storage := &presigner{Storage: fs, staged: map[string]string{}}
+	h := Handler{
+		Logger:  logger,
+		Storage: storage,
+		Calculator: &calculator.Calculator{
+			Logger:      logger,
+			Gstorage:    memgraph.NewStorage(),
+			TextStorage: storage,
+			DiagramSvc:  drawio.NewController(logger),
+		},
+		MaxUploadSize: 1024,
+	}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+	presign := func(method string, path string, query string) (int, PresignResponse) {
+		req := httptest.NewRequest(http.MethodPost, presignUrl+"/"+path+"?method="+method+query, nil)
+		req.Header.Set(handlers.UserHeader, "alice")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp PresignResponse
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w.Code, resp
+	}
+	complete := func(req CompleteRequest) (*httptest.ResponseRecorder, RestoreResponse) {
+		b, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, completeUrl, bytes.NewReader(b)))
+		var resp RestoreResponse
+		if w.Code == http.StatusCreated {
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w, resp
+	}
+	diagram := `<mxfile host="app.diagrams.net"><diagram id="uweCVhkyVy6MirBnUyNJ"><mxGraphModel><root>
+		<mxCell id="0"/><mxCell id="1" parent="0"/>
+		<mxCell id="3" style="shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1"/>
+		</root></mxGraphModel></diagram></mxfile>`
+
+	code, _ := presign("GET", "test/diagram.xml", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = presign("DELETE", "test/diagram.xml", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// a new file is created by the upload
+	code, put := presign("PUT", "test/diagram.xml", "")
+	if !assert.Equal(t, http.StatusOK, code) {
+		return
+	}
+	assert.Equal(t, http.MethodPut, put.Method)
+	assert.Empty(t, put.Version)
+	assert.Equal(t, completeUrl, put.Complete)
+	assert.True(t, put.Expires.After(time.Now().Add(DefaultPresignExpiry-time.Minute)))
+	w, _ := complete(CompleteRequest{Token: put.Token})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	storage.staged[strings.TrimPrefix(put.URL, "http://storage.test/")] = diagram
+	w, created := complete(CompleteRequest{Token: put.Token, Tags: []string{"power"}})
+	if !assert.Equal(t, http.StatusCreated, w.Code) {
+		return
+	}
+	assert.Equal(t, "alice", created.File.Uploader)
+	assert.True(t, created.File.Metadata.HasTags("power"))
+	assert.Equal(t, "uweCVhkyVy6MirBnUyNJ", created.UUID)
+	assert.Empty(t, created.IngestError)
+	assert.Empty(t, storage.staged)
+
+	code, get := presign("GET", "test/diagram.xml", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, created.File.Version, get.Version)
+	assert.Empty(t, get.Token)
+	assert.Contains(t, get.URL, created.File.Version)
+
+	// uploads based on a stale version are rejected
+	_, first := presign("PUT", "test/diagram.xml", "")
+	_, second := presign("PUT", "test/diagram.xml", "")
+	assert.Equal(t, created.File.Version, first.Version)
+	storage.staged[strings.TrimPrefix(first.URL, "http://storage.test/")] = diagram + "\n"
+	storage.staged[strings.TrimPrefix(second.URL, "http://storage.test/")] = diagram + "\n\n"
+	w, _ = complete(CompleteRequest{Token: first.Token})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w, _ = complete(CompleteRequest{Token: second.Token})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	// documents are validated and bounded by MaxUploadSize
+	_, put = presign("PUT", "test/large.txt", "")
+	storage.staged[strings.TrimPrefix(put.URL, "http://storage.test/")] = strings.Repeat("x", 1025)
+	w, _ = complete(CompleteRequest{Token: put.Token})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	_, put = presign("PUT", "test/broken.xml", "")
+	storage.staged[strings.TrimPrefix(put.URL, "http://storage.test/")] = "<mxfile>"
+	w, _ = complete(CompleteRequest{Token: put.Token})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// tokens are signed
+	_, put = presign("PUT", "test/forged.txt", "")
+	storage.staged[strings.TrimPrefix(put.URL, "http://storage.test/")] = "text"
+	_, signature, _ := strings.Cut(put.Token, ".")
+	payload, _ := json.Marshal(uploadToken{Key: ".uploads/1", Path: "test/diagram.xml", Expires: time.Now().Add(time.Hour).Unix()})
+	forged := base64.RawURLEncoding.EncodeToString(payload) + "." + signature
+	for _, token := range []string{"", "bad", forged} {
+		w, _ = complete(CompleteRequest{Token: token})
+		assert.Equal(t, http.StatusForbidden, w.Code, token)
+	}
+	expired, err := h.signToken(uploadToken{Key: ".uploads/1", Path: "test/forged.txt", Expires: time.Now().Add(-time.Second).Unix()})
+	assert.NoError(t, err)
+	w, _ = complete(CompleteRequest{Token: expired})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// storages without presigned URLs
+	plain := Handler{Logger: logger, Storage: fs, Calculator: h.Calculator}
+	w = httptest.NewRecorder()
+	plain.Presign(w, httptest.NewRequest(http.MethodPost, presignUrl+"/test/diagram.xml?method=GET", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+// deadlineStorage records whether the storage was called with a deadline
+type deadlineStorage struct {
+	calculator.ObjectStorage
+	deadlines map[string]bool
+}
+
+func (s deadlineStorage) UploadFile(ctx context.Context, logger *zap.Logger, r io.Reader, path string, opts calculator.UploadOptions) (*calculator.FileInfo, error) {
+	_, s.deadlines["upload"] = ctx.Deadline()
+	return s.ObjectStorage.UploadFile(ctx, logger, r, path, opts)
+}
+
+func (s deadlineStorage) Ls(ctx context.Context, path string, opts calculator.LsOptions) <-chan calculator.ObjectInfo {
+	_, s.deadlines["ls"] = ctx.Deadline()
+	return s.ObjectStorage.Ls(ctx, path, opts)
+}
+
+func TestHandler_Deadlines(t *testing.T) {
+	logger := zap.NewNop()
+	files, err := filestore.NewStorage(logger, t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	storage := deadlineStorage{ObjectStorage: files, deadlines: map[string]bool{}}
+	h := Handler{Logger: logger, Storage: storage}
+	r := chi.NewRouter()
+	r.Group(h.Register)
+
+	bbuf := &bytes.Buffer{}
+	writer := multipart.NewWriter(bbuf)
+	fw, err := writer.CreateFormFile(FormFileBody, "diagram.xml")
+	assert.NoError(t, err)
+	_, _ = io.WriteString(fw, "<mxfile/>")
+	_ = writer.Close()
+	req := httptest.NewRequest(http.MethodPost, uploadUrl+"/test", bbuf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, listUrl+"/test", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// uploads are bounded by server timeouts only, other requests by handlers.DeadLineTimeOut
+	assert.Equal(t, map[string]bool{"upload": false, "ls": true}, storage.deadlines)
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/handlers"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	presignUrl  = "/api/ostorage/presign"
+	completeUrl = "/api/ostorage/complete"
+	// DefaultPresignExpiry is the lifetime of presigned URLs when Handler.PresignExpiry is not set
+	DefaultPresignExpiry = 15 * time.Minute
+	// completeGrace is added to the lifetime of upload tokens, the upload may take until the URL expires
+	completeGrace = 10 * time.Minute
+)
+
+// PresignResponse is a presigned URL of the file. Uploads are stored by posting Token to Complete,
+// Version is the version the upload is based on then, empty when the file is created.
+type PresignResponse struct {
+	Method   string    `json:"method"`
+	URL      string    `json:"url"`
+	Path     string    `json:"path"`
+	Version  string    `json:"version,omitempty"`
+	Expires  time.Time `json:"expires"`
+	Token    string    `json:"token,omitempty"`
+	Complete string    `json:"complete,omitempty"`
+}
+
+// CompleteRequest stores the upload of the token with metadata given by the uploader
+type CompleteRequest struct {
+	Token       string   `json:"token"`
+	Author      string   `json:"author,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// uploadToken is the signed payload of CompleteRequest.Token, it binds the staging key to the file and
+// the version the upload is based on
+type uploadToken struct {
+	Key      string `json:"key"`
+	Path     string `json:"path"`
+	Base     string `json:"base,omitempty"`
+	Uploader string `json:"uploader,omitempty"`
+	Expires  int64  `json:"exp"`
+}
+
+// Presign issues a presigned URL of the file for the editor, "method" query parameter is GET or PUT.
+// GET downloads the version given by "version" query parameter or the latest one. PUT uploads a new version
+// based on the given version or the latest one, the file is created when it does not exist. The upload
+// is stored by Complete, it gets 412 or 409 when the file was changed meanwhile. Storages not issuing
+// URLs get 501.
+func (h *Handler) Presign(w http.ResponseWriter, r *http.Request) {
+	presigner, ok := h.Storage.(calculator.Presigner)
+	if !ok || h.Calculator == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	filePath, ok := storagePath(chi.URLParam(r, "project"), chi.URLParam(r, "*"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	version := r.URL.Query().Get("version")
+	expiry := h.presignExpiry()
+	resp := PresignResponse{Path: filePath, Expires: time.Now().Add(expiry).UTC()}
+
+	switch strings.ToUpper(r.URL.Query().Get("method")) {
+	case http.MethodGet:
+		info, err := h.Storage.StatFile(r.Context(), h.Logger, filePath, version)
+		if err != nil {
+			h.writeError(w, filePath, err)
+			return
+		}
+		u, err := presigner.PresignGet(r.Context(), h.Logger, filePath, info.Version, expiry)
+		if err != nil {
+			h.writeError(w, filePath, err)
+			return
+		}
+		resp.Method, resp.URL, resp.Version = http.MethodGet, u.String(), info.Version
+	case http.MethodPut:
+		info, err := h.Storage.StatFile(r.Context(), h.Logger, filePath, version)
+		switch {
+		case errors.Is(err, calculator.ErrNotFound) && version == "":
+			// the file is created by the upload
+		case err != nil:
+			h.writeError(w, filePath, err)
+			return
+		default:
+			resp.Version = info.Version
+		}
+		key, u, err := presigner.PresignPut(r.Context(), h.Logger, expiry)
+		if err != nil {
+			h.writeError(w, filePath, err)
+			return
+		}
+		token, err := h.signToken(uploadToken{
+			Key:      key,
+			Path:     filePath,
+			Base:     resp.Version,
+			Uploader: handlers.Uploader(r),
+			Expires:  resp.Expires.Add(completeGrace).Unix(),
+		})
+		if err != nil {
+			h.writeError(w, filePath, err)
+			return
+		}
+		resp.Method, resp.URL, resp.Token, resp.Complete = http.MethodPut, u.String(), token, completeUrl
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusOK, resp)
+}
+
+// Complete stores the content uploaded by the presigned URL of the token as a new version of the file,
+// validates it by the policy of the project and ingests it to graph storage. Rejected uploads get the same
+// responses as UploadFile, expired or forged tokens get 403 and tokens with nothing uploaded get 404.
+// Failed ingestion is reported in the response, the file stays stored.
+func (h *Handler) Complete(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	presigner, ok := h.Storage.(calculator.Presigner)
+	if !ok || h.Calculator == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	var req CompleteRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, formValueLimit*4)).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token, err := h.verifyToken(req.Token)
+	if err != nil {
+		h.Logger.Info("upload token rejected",
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if uploader := handlers.Uploader(r); uploader != "" && uploader != token.Uploader {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	opts := calculator.UploadOptions{Uploader: token.Uploader}
+	if token.Base != "" {
+		opts.IfMatch = []string{token.Base}
+	} else {
+		opts.IfNoneMatch = true
+	}
+	if opts.Metadata, err = calculator.NewFileMetadata(req.Author, req.Description, req.Tags); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// the size of presigned uploads is not bounded by the storage, it is checked with the document
+	opts.Inspect = h.Calculator.Inspector(token.Path, h.maxUploadSize())
+
+	info, err := presigner.CommitUpload(r.Context(), h.Logger, token.Key, token.Path, opts)
+	if h.writePrecondition(w, opts, err) || h.writeValidation(w, token.Path, err) {
+		return
+	}
+	if err != nil {
+		h.writeError(w, token.Path, err)
+		return
+	}
+
+	resp := RestoreResponse{File: info}
+	uuid, summary, err := h.Calculator.IngestFile(r.Context(), token.Path, info.Version)
+	if err != nil {
+		h.Logger.Error("uploaded version was not ingested",
+			zap.String("path", token.Path),
+			zap.String("version", info.Version),
+			zap.Error(err),
+		)
+		resp.IngestError = err.Error()
+	} else {
+		resp.UUID = uuid
+		resp.DiagramVersion = summary.Versions[uuid]
+	}
+	handlers.WriteJSON(h.Logger, w, http.StatusCreated, resp)
+}
+
+func (h *Handler) presignExpiry() time.Duration {
+	if h.PresignExpiry > 0 {
+		return h.PresignExpiry
+	}
+	return DefaultPresignExpiry
+}
+
+// signToken encodes the token with its HMAC-SHA256 signature
+func (h *Handler) signToken(token uploadToken) (string, error) {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, h.secret())
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyToken decodes the token signed by signToken, an error is returned for forged and expired tokens
+func (h *Handler) verifyToken(s string) (uploadToken, error) {
+	var token uploadToken
+	encoded, signature, ok := strings.Cut(s, ".")
+	if !ok {
+		return token, errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return token, fmt.Errorf("malformed token: %w", err)
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return token, fmt.Errorf("malformed token: %w", err)
+	}
+	mac := hmac.New(sha256.New, h.secret())
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return token, errors.New("bad token signature")
+	}
+	if err = json.Unmarshal(payload, &token); err != nil {
+		return token, fmt.Errorf("malformed token: %w", err)
+	}
+	if time.Now().Unix() > token.Expires {
+		return token, errors.New("token expired")
+	}
+	return token, nil
+}
+
+// secret returns PresignSecret or a random key generated once, tokens are not valid after restart then
+func (h *Handler) secret() []byte {
+	h.secretOnce.Do(func() {
+		if len(h.PresignSecret) > 0 {
+			h.key = h.PresignSecret
+			return
+		}
+		h.key = make([]byte, 32)
+		if _, err := rand.Read(h.key); err != nil {
+			h.Logger.Fatal("could not generate presign secret",
+				zap.Error(err),
+			)
+		}
+	})
+	return h.key
+}
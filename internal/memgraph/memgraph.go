@@ -0,0 +1,570 @@
+// Package memgraph keeps diagrams in memory. It follows semantics of the neo4j controller
+// and is used for tests and for running the service without a database.
+package memgraph
+
+import (
+	"context"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Storage struct {
+	mu sync.RWMutex
+	// diagrams keeps versions of every diagram, version n is at n-1, purged versions are nil,
+	// so version numbers are never reused
+	diagrams map[string][]*diagram
+}
+
+// Version is a stored diagram version with its items, Purged versions have no items
+type Version struct {
+	Meta   calculator.DiagramVersion
+	Items  []drawio.Item
+	Purged bool
+}
+
+type diagram struct {
+	meta  calculator.DiagramVersion
+	nodes map[int]drawio.Item
+	// relations are keyed by wire id like in neo4j, parallel wires between the same elements are kept apart
+	relations map[int]drawio.Item
+}
+
+// edge is a relation seen from one of its elements
+type edge struct {
+	relation int
+	node     int
+}
+
+func NewStorage() *Storage {
+	return &Storage{diagrams: make(map[string][]*diagram)}
+}
+
+// PushItems reads items until the channel is closed and stores a version of every diagram at once,
+// nothing is stored when ctx is cancelled
+func (s *Storage) PushItems(ctx context.Context, logger *zap.Logger, opts calculator.PushOptions, items <-chan drawio.Item) (calculator.PushSummary, error) {
+	var summary calculator.PushSummary
+	var nodes, relations []drawio.Item
+
+OuterLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			return summary, ctx.Err()
+		case item, ok := <-items:
+			if !ok {
+				break OuterLoop
+			}
+			if err := validate(item); err != nil {
+				logger.Error("refusing to push item",
+					zap.Error(err),
+				)
+				item.Error = err
+				summary.Failed = append(summary.Failed, item)
+				continue
+			}
+			if item.Class == drawio.ItemClassLines {
+				relations = append(relations, item)
+			} else {
+				nodes = append(nodes, item)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return summary, err
+	}
+
+	// every diagram is built from the pushed items only, previous version is either kept or replaced
+	written := make(map[string]*diagram)
+	for _, item := range append(nodes, relations...) {
+		if _, ok := written[item.UUID]; !ok {
+			written[item.UUID] = newDiagram(calculator.DiagramVersion{
+				UUID:          item.UUID,
+				Project:       opts.Project,
+				Source:        opts.Source,
+				SourceVersion: opts.SourceVersion,
+				Created:       time.Now().UTC(),
+			})
+		}
+	}
+	for _, item := range nodes {
+		written[item.UUID].nodes[item.EID] = item
+		summary.Nodes++
+	}
+	for _, item := range relations {
+		if err := written[item.UUID].addRelation(item); err != nil {
+			item.Error = err
+			summary.Failed = append(summary.Failed, item)
+			continue
+		}
+		summary.Relations++
+	}
+
+	summary.Versions = make(map[string]int)
+	for uuid, d := range written {
+		summary.Versions[uuid] = s.put(d, opts.Replace)
+	}
+	logger.Info("diagram pushed",
+		zap.Int("nodes", summary.Nodes),
+		zap.Int("relations", summary.Relations),
+		zap.Any("versions", summary.Versions),
+	)
+	return summary, nil
+}
+
+// PutVersion stores diagram version as is, it is used to restore persisted versions.
+// Versions go in order, numbers skipped are taken as purged.
+func (s *Storage) PutVersion(v Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.diagrams[v.Meta.UUID]
+	if v.Meta.Version <= len(versions) {
+		return fmt.Errorf("diagram %s version %d is out of order", v.Meta.UUID, v.Meta.Version)
+	}
+	for len(versions) < v.Meta.Version-1 {
+		versions = append(versions, nil)
+	}
+	if v.Purged {
+		s.diagrams[v.Meta.UUID] = append(versions, nil)
+		return nil
+	}
+
+	d := newDiagram(v.Meta)
+	for _, item := range v.Items {
+		if item.Class != drawio.ItemClassLines {
+			d.nodes[item.EID] = item
+		}
+	}
+	for _, item := range v.Items {
+		if item.Class == drawio.ItemClassLines {
+			if err := d.addRelation(item); err != nil {
+				return err
+			}
+		}
+	}
+	s.diagrams[v.Meta.UUID] = append(versions, d)
+	return nil
+}
+
+// ResetDiagram replaces every version of the diagram with versions taken by Snapshot, the diagram is removed
+// when there are none. It undoes changes which could not be persisted.
+func (s *Storage) ResetDiagram(uuid string, versions []Version) error {
+	reset := NewStorage()
+	for _, v := range versions {
+		if err := reset.PutVersion(v); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(versions) == 0 {
+		delete(s.diagrams, uuid)
+		return nil
+	}
+	s.diagrams[uuid] = reset.diagrams[uuid]
+	return nil
+}
+
+// Snapshot returns every version of the diagram, trashed and purged ones included, to be persisted
+func (s *Storage) Snapshot(uuid string) []Version {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var versions []Version
+	for i, d := range s.diagrams[uuid] {
+		if d == nil {
+			versions = append(versions, Version{Meta: calculator.DiagramVersion{UUID: uuid, Version: i + 1}, Purged: true})
+			continue
+		}
+		versions = append(versions, Version{Meta: d.meta, Items: d.items()})
+	}
+	return versions
+}
+
+// LoadItems returns nodes and then relations of the diagram, both ordered by id
+func (s *Storage) LoadItems(ctx context.Context, logger *zap.Logger, uuid string, version int) ([]drawio.Item, error) {
+	if err := calculator.ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d := s.version(uuid, version)
+	if d == nil {
+		return nil, nil
+	}
+	return d.items(), nil
+}
+
+func (s *Storage) ListDiagrams(ctx context.Context, logger *zap.Logger) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	uuids := make([]string, 0, len(s.diagrams))
+	for uuid := range s.diagrams {
+		if s.version(uuid, 0) != nil {
+			uuids = append(uuids, uuid)
+		}
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
+
+func (s *Storage) ListVersions(ctx context.Context, logger *zap.Logger, uuid string) ([]calculator.DiagramVersion, error) {
+	if err := calculator.ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var versions []calculator.DiagramVersion
+	for _, d := range s.diagrams[uuid] {
+		if d != nil && d.meta.Deleted == nil {
+			versions = append(versions, d.summary())
+		}
+	}
+	return versions, nil
+}
+
+// LoadElement returns element with its relations and neighbours ordered by id
+func (s *Storage) LoadElement(ctx context.Context, logger *zap.Logger, uuid string, version int, eid int) (*calculator.Element, error) {
+	if err := calculator.ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d := s.version(uuid, version)
+	if d == nil {
+		return nil, calculator.ErrNotFound
+	}
+	item, ok := d.nodes[eid]
+	if !ok {
+		return nil, calculator.ErrNotFound
+	}
+	element := &calculator.Element{Item: item}
+	for _, e := range d.edges()[eid] {
+		relation := d.relations[e.relation]
+		relation.SubClass = "line"
+		element.Relations = append(element.Relations, relation)
+		element.Neighbours = append(element.Neighbours, d.nodes[e.node])
+	}
+	sort.Slice(element.Relations, func(i, j int) bool { return element.Relations[i].EID < element.Relations[j].EID })
+	sort.Slice(element.Neighbours, func(i, j int) bool { return element.Neighbours[i].EID < element.Neighbours[j].EID })
+	return element, nil
+}
+
+// FindElements searches nodes of the latest version of every diagram
+func (s *Storage) FindElements(ctx context.Context, logger *zap.Logger, q calculator.ElementQuery) ([]calculator.ElementMatch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	uuids := make([]string, 0, len(s.diagrams))
+	for uuid := range s.diagrams {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	label := strings.ToLower(q.Label)
+	var matches []calculator.ElementMatch
+	for _, uuid := range uuids {
+		d := s.version(uuid, 0)
+		if d == nil || q.Project != "" && d.meta.Project != q.Project {
+			continue
+		}
+		var found []calculator.ElementMatch
+		for _, item := range d.nodes {
+			if q.Class != "" && item.Class != q.Class ||
+				q.SubClass != "" && item.SubClass != q.SubClass ||
+				!strings.Contains(strings.ToLower(item.Value), label) {
+				continue
+			}
+			found = append(found, calculator.ElementMatch{Item: item, Version: d.meta.Version, Project: d.meta.Project})
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i].Item.EID < found[j].Item.EID })
+		matches = append(matches, found...)
+		if q.Limit > 0 && len(matches) >= q.Limit {
+			return matches[:q.Limit], nil
+		}
+	}
+	return matches, nil
+}
+
+// FindPaths walks the diagram depth first visiting neighbours in order of their ids,
+// paths of the same length keep that order
+func (s *Storage) FindPaths(ctx context.Context, logger *zap.Logger, q calculator.PathQuery) ([][]drawio.Item, error) {
+	if err := calculator.ValidateUUID(q.UUID); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d := s.version(q.UUID, q.Version)
+	if d == nil {
+		return nil, calculator.ErrNotFound
+	}
+	if _, ok := d.nodes[q.From]; !ok {
+		return nil, calculator.ErrNotFound
+	}
+	if _, ok := d.nodes[q.To]; !ok {
+		return nil, calculator.ErrNotFound
+	}
+
+	// parallel wires make paths of their own, like relationships of neo4j paths do
+	adjacent := d.edges()
+	var paths [][]drawio.Item
+	path := []drawio.Item{d.nodes[q.From]}
+	visited := map[int]bool{q.From: true}
+	var walk func(eid int)
+	walk = func(eid int) {
+		if eid == q.To && len(path) > 1 {
+			paths = append(paths, append([]drawio.Item{}, path...))
+			return
+		}
+		if len(path)/2 >= q.MaxLength {
+			return
+		}
+		for _, next := range adjacent[eid] {
+			if visited[next.node] {
+				continue
+			}
+			relation := d.relations[next.relation]
+			relation.SubClass = "line"
+			visited[next.node] = true
+			path = append(path, relation, d.nodes[next.node])
+			walk(next.node)
+			path = path[:len(path)-2]
+			visited[next.node] = false
+		}
+	}
+	walk(q.From)
+
+	sort.SliceStable(paths, func(i, j int) bool { return len(paths[i]) < len(paths[j]) })
+	if q.Limit > 0 && len(paths) > q.Limit {
+		paths = paths[:q.Limit]
+	}
+	return paths, nil
+}
+
+// DeleteDiagram moves the diagram version, or all its versions for 0, to trash
+func (s *Storage) DeleteDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error {
+	now := time.Now().UTC()
+	return s.trash(ctx, uuid, version, func(d *diagram) bool {
+		if d.meta.Deleted != nil {
+			return false
+		}
+		d.meta.Deleted = &now
+		return true
+	})
+}
+
+// RestoreDiagram brings back the trashed version, or all trashed versions for 0
+func (s *Storage) RestoreDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error {
+	return s.trash(ctx, uuid, version, func(d *diagram) bool {
+		if d.meta.Deleted == nil {
+			return false
+		}
+		d.meta.Deleted = nil
+		return true
+	})
+}
+
+// PurgeDiagram removes the trashed version, or all trashed versions for 0, for good
+func (s *Storage) PurgeDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error {
+	return s.trash(ctx, uuid, version, func(d *diagram) bool {
+		if d.meta.Deleted == nil {
+			return false
+		}
+		d.nodes, d.relations = nil, nil
+		return true
+	})
+}
+
+// ListTrash returns trashed versions ordered by diagram uuid and version
+func (s *Storage) ListTrash(ctx context.Context, logger *zap.Logger) ([]calculator.DiagramVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var versions []calculator.DiagramVersion
+	for _, diagrams := range s.diagrams {
+		for _, d := range diagrams {
+			if d != nil && d.meta.Deleted != nil {
+				versions = append(versions, d.summary())
+			}
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].UUID != versions[j].UUID {
+			return versions[i].UUID < versions[j].UUID
+		}
+		return versions[i].Version < versions[j].Version
+	})
+	return versions, nil
+}
+
+// trash applies change to the diagram version or to all versions for 0, versions are purged when change
+// leaves them with no nodes. ErrNotFound is returned when change applies to nothing.
+func (s *Storage) trash(ctx context.Context, uuid string, version int, change func(d *diagram) bool) error {
+	if err := calculator.ValidateUUID(uuid); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.diagrams[uuid]
+	changed := 0
+	for i, d := range versions {
+		if d == nil || version != 0 && version != i+1 || !change(d) {
+			continue
+		}
+		if d.nodes == nil {
+			versions[i] = nil
+		}
+		changed++
+	}
+	if changed == 0 {
+		return calculator.ErrNotFound
+	}
+	return nil
+}
+
+// put stores d as a new version or instead of the latest one and returns its number, must be called with mu locked.
+// Trashed or purged latest version is never replaced.
+func (s *Storage) put(d *diagram, replace bool) int {
+	versions := s.diagrams[d.meta.UUID]
+	if replace && len(versions) > 0 && versions[len(versions)-1] != nil && versions[len(versions)-1].meta.Deleted == nil {
+		d.meta.Version = len(versions)
+		d.meta.Created = versions[len(versions)-1].meta.Created
+		versions[len(versions)-1] = d
+		return d.meta.Version
+	}
+	d.meta.Version = len(versions) + 1
+	s.diagrams[d.meta.UUID] = append(versions, d)
+	return d.meta.Version
+}
+
+// version returns diagram version or the latest one for 0, trashed versions are not returned,
+// must be called with mu locked
+func (s *Storage) version(uuid string, version int) *diagram {
+	versions := s.diagrams[uuid]
+	if version == 0 {
+		for i := len(versions) - 1; i >= 0; i-- {
+			if versions[i] != nil && versions[i].meta.Deleted == nil {
+				return versions[i]
+			}
+		}
+		return nil
+	}
+	if version < 1 || version > len(versions) {
+		return nil
+	}
+	if d := versions[version-1]; d != nil && d.meta.Deleted == nil {
+		return d
+	}
+	return nil
+}
+
+func newDiagram(meta calculator.DiagramVersion) *diagram {
+	return &diagram{
+		meta:      meta,
+		nodes:     make(map[int]drawio.Item),
+		relations: make(map[int]drawio.Item),
+	}
+}
+
+// items returns nodes and then relations, both ordered by id
+func (d *diagram) items() []drawio.Item {
+	var nodes, relations []drawio.Item
+	for _, item := range d.nodes {
+		nodes = append(nodes, item)
+	}
+	for _, item := range d.relations {
+		item.SubClass = "line"
+		relations = append(relations, item)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].EID < nodes[j].EID })
+	sort.Slice(relations, func(i, j int) bool { return relations[i].EID < relations[j].EID })
+	return append(nodes, relations...)
+}
+
+// summary is the version meta with number of elements
+func (d *diagram) summary() calculator.DiagramVersion {
+	meta := d.meta
+	meta.Elements = len(d.nodes) + len(d.relations)
+	return meta
+}
+
+// edges returns relations of every element ordered by neighbour id and then by relation id,
+// relations are not directed
+func (d *diagram) edges() map[int][]edge {
+	adjacent := make(map[int][]edge)
+	for id, relation := range d.relations {
+		adjacent[relation.SourceId] = append(adjacent[relation.SourceId], edge{relation: id, node: relation.TargetId})
+		if relation.SourceId != relation.TargetId {
+			adjacent[relation.TargetId] = append(adjacent[relation.TargetId], edge{relation: id, node: relation.SourceId})
+		}
+	}
+	for _, edges := range adjacent {
+		sort.Slice(edges, func(i, j int) bool {
+			if edges[i].node != edges[j].node {
+				return edges[i].node < edges[j].node
+			}
+			return edges[i].relation < edges[j].relation
+		})
+	}
+	return adjacent
+}
+
+func (d *diagram) addRelation(item drawio.Item) error {
+	_, source := d.nodes[item.SourceId]
+	_, target := d.nodes[item.TargetId]
+	if !source || !target {
+		return calculator.ErrNoRelationEndpoint
+	}
+	d.relations[item.EID] = item
+	return nil
+}
+
+func validate(item drawio.Item) error {
+	if err := calculator.ValidateUUID(item.UUID); err != nil {
+		return err
+	}
+	if _, ok := drawio.ItemAvailableClass[item.Class]; !ok {
+		return fmt.Errorf("item class %s is not supported", item.Class)
+	}
+	return nil
+}
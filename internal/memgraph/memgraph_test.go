@@ -0,0 +1,325 @@
+package memgraph
+
+import (
+	"context"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/aemakeye/circuit_calculator/internal/netlist"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func push(s *Storage, ctx context.Context, opts calculator.PushOptions, items []drawio.Item) (calculator.PushSummary, error) {
+	ch := make(chan drawio.Item, len(items))
+	for _, item := range items {
+		ch <- item
+	}
+	close(ch)
+	return s.PushItems(ctx, zap.NewNop(), opts, ch)
+}
+
+func TestStorage(t *testing.T) {
+	s := NewStorage()
+	ctx := context.Background()
+	input := []drawio.Item{
+		{UUID: "d1", EID: 7, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 6, ExitX: 1, EntryX: 0},
+		{UUID: "d1", EID: 3, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R1"},
+		{UUID: "d1", EID: 6, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1"},
+		{UUID: "d1", EID: 9, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 42},
+		{UUID: "d1", EID: 10, Class: drawio.ItemClassLines, SourceId: 6, TargetId: 3, ExitX: 0.5},
+		{UUID: "d1", EID: 11, Class: "signal_sources"},
+		{UUID: "", EID: 12, Class: drawio.ItemClassResistors},
+		{UUID: "d1'}) //", EID: 13, Class: drawio.ItemClassResistors},
+	}
+
+	summary, err := push(s, ctx, calculator.PushOptions{Project: "test", Source: "test/d1.xml"}, input)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Nodes)
+	assert.Equal(t, 2, summary.Relations)
+	assert.Equal(t, map[string]int{"d1": 1}, summary.Versions)
+	assert.Len(t, summary.Failed, 4)
+	assert.ErrorIs(t, summary.Failed[3].Error, calculator.ErrNoRelationEndpoint)
+	// uuids are validated like in neo4j
+	_, err = s.LoadItems(ctx, zap.NewNop(), "d1'}) //", 0)
+	assert.Error(t, err)
+
+	items, err := s.LoadItems(ctx, zap.NewNop(), "d1", 0)
+	assert.NoError(t, err)
+	assert.Len(t, items, 4)
+	// parallel wires between the same elements are kept apart, every one with its own direction
+	assert.Equal(t, 7, items[2].EID)
+	assert.Equal(t, []int{3, 6}, []int{items[2].SourceId, items[2].TargetId})
+	assert.Equal(t, 10, items[3].EID)
+	assert.Equal(t, []int{6, 3}, []int{items[3].SourceId, items[3].TargetId})
+	assert.Equal(t, float32(0.5), items[3].ExitX)
+
+	edited := []drawio.Item{
+		{UUID: "d1", EID: 3, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R2"},
+		{UUID: "d1", EID: 4, Class: drawio.ItemClassInductors, SubClass: "inductor_3"},
+		{UUID: "d1", EID: 8, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 4},
+	}
+
+	t.Run("new version", func(t *testing.T) {
+		summary, err := push(s, ctx, calculator.PushOptions{}, edited)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"d1": 2}, summary.Versions)
+
+		items, err := s.LoadItems(ctx, zap.NewNop(), "d1", 0)
+		assert.NoError(t, err)
+		assert.Len(t, items, 3)
+		assert.Equal(t, "R2", items[0].Value)
+
+		// previous version is kept as is
+		items, err = s.LoadItems(ctx, zap.NewNop(), "d1", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "R1", items[0].Value)
+		assert.Equal(t, 6, items[1].EID)
+
+		items, err = s.LoadItems(ctx, zap.NewNop(), "d1", 3)
+		assert.NoError(t, err)
+		assert.Empty(t, items)
+	})
+
+	t.Run("replace current version", func(t *testing.T) {
+		summary, err := push(s, ctx, calculator.PushOptions{Replace: true}, edited[:2])
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"d1": 2}, summary.Versions)
+
+		// wire removed from the document is removed from the version
+		items, err := s.LoadItems(ctx, zap.NewNop(), "d1", 2)
+		assert.NoError(t, err)
+		assert.Len(t, items, 2)
+
+		versions, err := s.ListVersions(ctx, zap.NewNop(), "d1")
+		assert.NoError(t, err)
+		assert.Len(t, versions, 2)
+		assert.Equal(t, "test/d1.xml", versions[0].Source)
+		assert.Equal(t, 4, versions[0].Elements)
+		assert.Equal(t, 2, versions[1].Elements)
+	})
+
+	t.Run("diagrams are isolated", func(t *testing.T) {
+		summary, err := push(s, ctx, calculator.PushOptions{}, []drawio.Item{
+			{UUID: "d2", EID: 1, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 6},
+		})
+		assert.NoError(t, err)
+		assert.ErrorIs(t, summary.Failed[0].Error, calculator.ErrNoRelationEndpoint)
+
+		items, err := s.LoadItems(ctx, zap.NewNop(), "missing", 0)
+		assert.NoError(t, err)
+		assert.Empty(t, items)
+	})
+
+	t.Run("list diagrams", func(t *testing.T) {
+		uuids, err := s.ListDiagrams(ctx, zap.NewNop())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"d1", "d2"}, uuids)
+	})
+
+	t.Run("element with neighbours", func(t *testing.T) {
+		element, err := s.LoadElement(ctx, zap.NewNop(), "d1", 1, 6)
+		assert.NoError(t, err)
+		assert.Equal(t, "capacitor_1", element.Item.SubClass)
+		assert.Len(t, element.Relations, 2)
+		assert.Equal(t, []int{3, 3}, []int{element.Neighbours[0].EID, element.Neighbours[1].EID})
+
+		_, err = s.LoadElement(ctx, zap.NewNop(), "d1", 0, 6)
+		assert.ErrorIs(t, err, calculator.ErrNotFound)
+		_, err = s.LoadElement(ctx, zap.NewNop(), "d1", 1, 7)
+		assert.ErrorIs(t, err, calculator.ErrNotFound)
+		_, err = s.LoadElement(ctx, zap.NewNop(), "missing", 0, 3)
+		assert.ErrorIs(t, err, calculator.ErrNotFound)
+	})
+
+	t.Run("restore version", func(t *testing.T) {
+		assert.NoError(t, s.PutVersion(Version{Meta: calculator.DiagramVersion{UUID: "d3", Version: 1}, Items: edited}))
+		assert.Error(t, s.PutVersion(Version{Meta: calculator.DiagramVersion{UUID: "d3", Version: 1}, Items: edited}))
+		items, err := s.LoadItems(ctx, zap.NewNop(), "d3", 1)
+		assert.NoError(t, err)
+		assert.Len(t, items, 3)
+
+		// skipped versions are purged
+		assert.NoError(t, s.PutVersion(Version{Meta: calculator.DiagramVersion{UUID: "d3", Version: 3}, Items: edited}))
+		snapshot := s.Snapshot("d3")
+		assert.Len(t, snapshot, 3)
+		assert.True(t, snapshot[1].Purged)
+		assert.Len(t, snapshot[2].Items, 3)
+	})
+
+	t.Run("cancelled push stores nothing", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := s.PushItems(cctx, zap.NewNop(), calculator.PushOptions{}, make(chan drawio.Item))
+		assert.ErrorIs(t, err, context.Canceled)
+
+		items, err := s.LoadItems(ctx, zap.NewNop(), "d4", 0)
+		assert.NoError(t, err)
+		assert.Empty(t, items)
+	})
+}
+
+func TestStorage_Queries(t *testing.T) {
+	s := NewStorage()
+	ctx := context.Background()
+	_, err := push(s, ctx, calculator.PushOptions{Project: "amp"}, []drawio.Item{
+		{UUID: "d1", EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R1 10k"},
+		{UUID: "d1", EID: 2, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "r2 22k"},
+		{UUID: "d1", EID: 3, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "4.7uF"},
+		{UUID: "d1", EID: 4, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "100nF"},
+		{UUID: "d1", EID: 10, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 2},
+		{UUID: "d1", EID: 11, Class: drawio.ItemClassLines, SourceId: 2, TargetId: 3},
+		{UUID: "d1", EID: 12, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 1},
+		{UUID: "d1", EID: 13, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 4},
+	})
+	assert.NoError(t, err)
+	_, err = push(s, ctx, calculator.PushOptions{Project: "filter"}, []drawio.Item{
+		{UUID: "d2", EID: 5, Class: drawio.ItemClassResistors, SubClass: "resistor_2", Value: "R1"},
+	})
+	assert.NoError(t, err)
+
+	t.Run("find elements", func(t *testing.T) {
+		ids := func(q calculator.ElementQuery) []string {
+			matches, err := s.FindElements(ctx, zap.NewNop(), q)
+			assert.NoError(t, err)
+			var found []string
+			for _, m := range matches {
+				assert.Equal(t, 1, m.Version)
+				found = append(found, m.Item.UUID+":"+m.Item.Value)
+			}
+			return found
+		}
+		assert.Equal(t, []string{"d1:R1 10k", "d1:r2 22k", "d2:R1"}, ids(calculator.ElementQuery{Class: drawio.ItemClassResistors}))
+		assert.Equal(t, []string{"d1:R1 10k", "d1:r2 22k"}, ids(calculator.ElementQuery{Project: "amp", Label: "R"}))
+		assert.Equal(t, []string{"d2:R1"}, ids(calculator.ElementQuery{SubClass: "resistor_2"}))
+		assert.Equal(t, []string{"d1:4.7uF"}, ids(calculator.ElementQuery{Limit: 1, Class: drawio.ItemClassCapacitors}))
+		assert.Empty(t, ids(calculator.ElementQuery{Project: "missing"}))
+	})
+
+	t.Run("find paths", func(t *testing.T) {
+		paths, err := s.FindPaths(ctx, zap.NewNop(), calculator.PathQuery{UUID: "d1", From: 1, To: 3, MaxLength: 4})
+		assert.NoError(t, err)
+		assert.Len(t, paths, 2)
+		var ids [][]int
+		for _, path := range paths {
+			var p []int
+			for _, item := range path {
+				p = append(p, item.EID)
+			}
+			ids = append(ids, p)
+		}
+		assert.Equal(t, [][]int{{1, 12, 3}, {1, 10, 2, 11, 3}}, ids)
+		assert.Equal(t, "line", paths[0][1].SubClass)
+
+		paths, err = s.FindPaths(ctx, zap.NewNop(), calculator.PathQuery{UUID: "d1", From: 4, To: 2, MaxLength: 1})
+		assert.NoError(t, err)
+		assert.Len(t, paths, 0)
+		paths, err = s.FindPaths(ctx, zap.NewNop(), calculator.PathQuery{UUID: "d1", From: 4, To: 2, MaxLength: 3})
+		assert.NoError(t, err)
+		assert.Len(t, paths, 2)
+		paths, err = s.FindPaths(ctx, zap.NewNop(), calculator.PathQuery{UUID: "d1", From: 4, To: 2, MaxLength: 3, Limit: 1})
+		assert.NoError(t, err)
+		assert.Len(t, paths, 1)
+		assert.Len(t, paths[0], 5)
+
+		_, err = s.FindPaths(ctx, zap.NewNop(), calculator.PathQuery{UUID: "d1", From: 1, To: 5, MaxLength: 4})
+		assert.ErrorIs(t, err, calculator.ErrNotFound)
+		_, err = s.FindPaths(ctx, zap.NewNop(), calculator.PathQuery{UUID: "d1", Version: 2, From: 1, To: 3, MaxLength: 4})
+		assert.ErrorIs(t, err, calculator.ErrNotFound)
+	})
+}
+
+func TestStorage_ParallelWires(t *testing.T) {
+	s := NewStorage()
+	ctx := context.Background()
+	// R1 and R2 in parallel, both wires connect the same elements
+	summary, err := push(s, ctx, calculator.PushOptions{}, []drawio.Item{
+		{UUID: "d1", EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R1"},
+		{UUID: "d1", EID: 2, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R2"},
+		{UUID: "d1", EID: 3, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 2, ExitX: 0, EntryX: 0},
+		{UUID: "d1", EID: 4, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 2, ExitX: 1, EntryX: 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Relations)
+
+	items, err := s.LoadItems(ctx, zap.NewNop(), "d1", 0)
+	assert.NoError(t, err)
+	assert.Len(t, items, 4)
+	assert.Len(t, netlist.FromItems("d1", items).Nets, 2)
+
+	paths, err := s.FindPaths(ctx, zap.NewNop(), calculator.PathQuery{UUID: "d1", From: 1, To: 2, MaxLength: 2})
+	assert.NoError(t, err)
+	if assert.Len(t, paths, 2) {
+		assert.Equal(t, 3, paths[0][1].EID)
+		assert.Equal(t, 4, paths[1][1].EID)
+	}
+}
+
+func TestStorage_Trash(t *testing.T) {
+	s := NewStorage()
+	ctx := context.Background()
+	logger := zap.NewNop()
+	for _, value := range []string{"R1", "R2", "R3"} {
+		_, err := push(s, ctx, calculator.PushOptions{Source: "test/d1.xml"}, []drawio.Item{
+			{UUID: "d1", EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: value},
+		})
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, s.DeleteDiagram(ctx, logger, "d1", 3))
+	assert.ErrorIs(t, s.DeleteDiagram(ctx, logger, "d1", 3), calculator.ErrNotFound)
+
+	// latest version is the last one not in trash
+	items, err := s.LoadItems(ctx, logger, "d1", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "R2", items[0].Value)
+	items, err = s.LoadItems(ctx, logger, "d1", 3)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+	versions, err := s.ListVersions(ctx, logger, "d1")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	t.Run("trashed version is not replaced", func(t *testing.T) {
+		summary, err := push(s, ctx, calculator.PushOptions{Replace: true}, []drawio.Item{
+			{UUID: "d1", EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R4"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"d1": 4}, summary.Versions)
+	})
+
+	t.Run("whole diagram", func(t *testing.T) {
+		assert.NoError(t, s.DeleteDiagram(ctx, logger, "d1", 0))
+		uuids, err := s.ListDiagrams(ctx, logger)
+		assert.NoError(t, err)
+		assert.Empty(t, uuids)
+
+		trash, err := s.ListTrash(ctx, logger)
+		assert.NoError(t, err)
+		assert.Len(t, trash, 4)
+		assert.NotNil(t, trash[0].Deleted)
+		assert.Equal(t, 1, trash[0].Elements)
+
+		assert.NoError(t, s.RestoreDiagram(ctx, logger, "d1", 2))
+		items, err := s.LoadItems(ctx, logger, "d1", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "R2", items[0].Value)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		assert.ErrorIs(t, s.PurgeDiagram(ctx, logger, "d1", 2), calculator.ErrNotFound)
+		assert.NoError(t, s.PurgeDiagram(ctx, logger, "d1", 0))
+		assert.ErrorIs(t, s.RestoreDiagram(ctx, logger, "d1", 4), calculator.ErrNotFound)
+		trash, err := s.ListTrash(ctx, logger)
+		assert.NoError(t, err)
+		assert.Empty(t, trash)
+
+		// numbers of purged versions are not reused
+		summary, err := push(s, ctx, calculator.PushOptions{}, []drawio.Item{
+			{UUID: "d1", EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R5"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"d1": 5}, summary.Versions)
+		assert.Len(t, s.Snapshot("d1"), 5)
+	})
+}
@@ -1,29 +1,105 @@
 package minio
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/tags"
 	"go.uber.org/zap"
 	"io"
-	"io/ioutil"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// user metadata keys of uploaded objects, free text values are query escaped to fit into headers
+const (
+	metaUploader    = "Uploader"
+	metaChecksum    = "Sha256"
+	metaAuthor      = "Author"
+	metaDescription = "Description"
+	metaTags        = "Tags"
+	metaEditor      = "Editor"
+	metaDiagram     = "Diagram"
+	metaComponents  = "Components"
+)
+
+const (
+	// uploadsPrefix keeps staging objects of uploads in progress, it is hidden from listings
+	uploadsPrefix = ".uploads/"
+	// uploadPartSize bounds memory taken by an upload, the size of uploaded content is not known in advance
+	uploadPartSize = 16 << 20
+	// maxCopySize is the largest object copied by a single request, larger ones are copied by parts
+	maxCopySize = 5 << 30
+)
+
+// trashTag marks deleted versions, its value tells what DeleteVersion did to the latest version of the file
+const (
+	trashTag = "Trashed"
+	// trashKept is the value of versions which were not the latest one
+	trashKept = "kept"
+	// trashDeleted is the value of the only version left, a delete marker was put over it.
+	// Other values are ids of versions copied over the deleted one.
+	trashDeleted = "deleted"
+)
+
 var once sync.Once
 var instance *minioStorage
 
+// commits serializes commits of a path, minioStorage is passed by value so the locks are kept here
+var commits = &keyLocks{locks: make(map[string]*keyLock)}
+
+// keyLocks is a mutex per key, locks are dropped when nobody holds or waits for them
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the key and returns the function unlocking it
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	k, ok := l.locks[key]
+	if !ok {
+		k = &keyLock{}
+		l.locks[key] = k
+	}
+	k.refs++
+	l.mu.Unlock()
+
+	k.Lock()
+	return func() {
+		k.Unlock()
+		l.mu.Lock()
+		if k.refs--; k.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
 type minioStorage struct {
 	Url      string
 	user     string
 	password string
 	ssl      bool
 	Client   *minio.Client
-	Logger   *zap.Logger
-	Bucket   *minio.BucketInfo
+	// Public signs URLs for the endpoint clients connect to, Client is used when it is nil
+	Public *minio.Client
+	Logger *zap.Logger
+	Bucket *minio.BucketInfo
 }
 
 func NewMinioStorage(logger *zap.Logger, url string, bucket string, user string, password string, ssl bool) (*minioStorage, error) {
@@ -78,30 +154,50 @@ func NewMinioStorage(logger *zap.Logger, url string, bucket string, user string,
 	return instance, err
 }
 
+// SetPublicEndpoint makes presigned URLs point to the host, e.g. the ingress of the server. URLs are signed
+// offline, the region has to be given, us-east-1 is used when it is empty.
+func (m *minioStorage) SetPublicEndpoint(host string, secure bool, region string) error {
+	if region == "" {
+		region = "us-east-1"
+	}
+	public, err := minio.New(host, &minio.Options{
+		Creds:  credentials.NewStaticV4(m.user, m.password, ""),
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return err
+	}
+	m.Public = public
+	return nil
+}
+
 func (m minioStorage) UploadTextFile(ctx context.Context, logger *zap.Logger, r io.Reader, path string) (err error) {
-	//TODO: check if already exists and raise alert
+	_, err = m.UploadFile(ctx, logger, r, path, calculator.UploadOptions{})
+	return err
+}
+
+// UploadFile streams the content to a staging object in parts of uploadPartSize, computing its checksum
+// on the fly, and copies it to the path on the server side with uploader, checksum and metadata in user metadata.
+// Content and metadata equal to the latest version do not make a new version, the latest one is returned then.
+func (m minioStorage) UploadFile(ctx context.Context, logger *zap.Logger, r io.Reader, path string, opts calculator.UploadOptions) (*calculator.FileInfo, error) {
 	logger.Info("Diagram upload started",
 		zap.String("bucket", m.Bucket.Name),
 		zap.String("name", path),
 	)
 
-	body, err := ioutil.ReadAll(r)
+	staging, err := stagingKey()
 	if err != nil {
-		logger.Error("filed to read from reader",
-			zap.Error(err),
-		)
-		return err
+		return nil, err
 	}
-
-	rn := bytes.NewReader(body)
-
-	info, err := m.Client.PutObject(
+	hash := sha256.New()
+	staged, err := m.Client.PutObject(
 		ctx,
 		m.Bucket.Name,
-		path,
-		rn,
-		int64(len(body)),
-		minio.PutObjectOptions{ContentType: "application/octet-stream"},
+		staging,
+		io.TeeReader(r, hash),
+		-1,
+		minio.PutObjectOptions{ContentType: "application/octet-stream", PartSize: uploadPartSize},
 	)
 	if err != nil {
 		logger.Error("Failed to upload file",
@@ -109,24 +205,175 @@ func (m minioStorage) UploadTextFile(ctx context.Context, logger *zap.Logger, r
 			zap.String("path", path),
 			zap.Error(err),
 		)
-		return err
+		return nil, err
+	}
+	defer m.removeStaging(logger, staging, staged.VersionID)
+
+	return m.commit(ctx, logger, staging, staged.VersionID, staged.Size, hex.EncodeToString(hash.Sum(nil)), path, opts)
+}
+
+// PresignGet returns URL downloading the version of the file, the version has to be given
+func (m minioStorage) PresignGet(ctx context.Context, logger *zap.Logger, path string, version string, expiry time.Duration) (*url.URL, error) {
+	if version == "" {
+		return nil, fmt.Errorf("no version of %s to presign", path)
+	}
+	u, err := m.presignClient().PresignedGetObject(ctx, m.Bucket.Name, path, expiry, url.Values{"versionId": {version}})
+	if err != nil {
+		logger.Error("could not presign download",
+			zap.String("path", path),
+			zap.String("version", version),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return u, nil
+}
+
+// PresignPut returns URL uploading to a new staging key under uploadsPrefix. Staging objects which are never
+// committed are left to lifecycle rules of the bucket.
+func (m minioStorage) PresignPut(ctx context.Context, logger *zap.Logger, expiry time.Duration) (string, *url.URL, error) {
+	staging, err := stagingKey()
+	if err != nil {
+		return "", nil, err
+	}
+	u, err := m.presignClient().PresignedPutObject(ctx, m.Bucket.Name, staging, expiry)
+	if err != nil {
+		logger.Error("could not presign upload",
+			zap.Error(err),
+		)
+		return "", nil, err
+	}
+	return staging, u, nil
+}
+
+// CommitUpload reads the staging object for its checksum and copies it to the path like UploadFile does,
+// the staging object is removed
+func (m minioStorage) CommitUpload(ctx context.Context, logger *zap.Logger, key string, path string, opts calculator.UploadOptions) (*calculator.FileInfo, error) {
+	if !strings.HasPrefix(key, uploadsPrefix) {
+		return nil, fmt.Errorf("invalid staging key %q", key)
+	}
+	staged, err := m.Client.StatObject(ctx, m.Bucket.Name, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, notFound(err, key)
+	}
+	defer m.removeStaging(logger, key, staged.VersionID)
+
+	obj, err := m.Client.GetObject(ctx, m.Bucket.Name, key, minio.GetObjectOptions{VersionID: staged.VersionID})
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, obj)
+	_ = obj.Close()
+	if err != nil {
+		return nil, err
+	}
+	return m.commit(ctx, logger, key, staged.VersionID, staged.Size, hex.EncodeToString(hash.Sum(nil)), path, opts)
+}
+
+// commit copies the staging object version to the path unless it is rejected by opts
+func (m minioStorage) commit(ctx context.Context, logger *zap.Logger, staging string, stagedVersion string, size int64,
+	checksum string, path string, opts calculator.UploadOptions) (*calculator.FileInfo, error) {
+	if opts.Checksum != "" && !strings.EqualFold(opts.Checksum, checksum) {
+		return nil, fmt.Errorf("%s: %w", path, calculator.ErrChecksum)
+	}
+	fileMeta, err := opts.Describe(ctx, func() (io.ReadCloser, error) {
+		return m.Client.GetObject(ctx, m.Bucket.Name, staging, minio.GetObjectOptions{VersionID: stagedVersion})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the bucket has no conditional writes, the latest version is checked right before the copy while
+	// commits of the path are serialized. Other instances sharing the bucket may still commit in between.
+	defer commits.lock(path)()
+	current, err := m.StatFile(ctx, logger, path, "")
+	if errors.Is(err, calculator.ErrNotFound) {
+		current, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = opts.Check(current); err != nil {
+		return nil, err
+	}
+	if current != nil && current.Checksum == checksum && current.Metadata.Equal(fileMeta) {
+		logger.Info("file not changed, version kept",
+			zap.String("path", path),
+			zap.String("VersionID", current.Version),
+		)
+		return current, nil
+	}
+
+	meta := map[string]string{
+		"Content-Type": "application/octet-stream",
+		metaChecksum:   checksum,
+	}
+	if opts.Uploader != "" {
+		meta[metaUploader] = opts.Uploader
+	}
+	encodeMetadata(fileMeta, meta)
+	dst := minio.CopyDestOptions{Bucket: m.Bucket.Name, Object: path, UserMetadata: meta, ReplaceMetadata: true}
+	src := minio.CopySrcOptions{Bucket: m.Bucket.Name, Object: staging, VersionID: stagedVersion}
+	var info minio.UploadInfo
+	if size <= maxCopySize {
+		info, err = m.Client.CopyObject(ctx, dst, src)
 	} else {
-		logger.Info("file uploaded",
-			zap.String("bucket", info.Bucket),
-			zap.String("key", info.Key),
-			zap.String("VersionID", info.VersionID),
+		info, err = m.Client.ComposeObject(ctx, dst, src)
+	}
+	if err != nil {
+		logger.Error("Failed to upload file",
+			zap.String("bucket", m.Bucket.Name),
+			zap.String("path", path),
+			zap.Error(err),
 		)
+		return nil, err
 	}
-	return nil
+	logger.Info("file uploaded",
+		zap.String("bucket", info.Bucket),
+		zap.String("key", info.Key),
+		zap.String("VersionID", info.VersionID),
+	)
+	return &calculator.FileInfo{
+		Path:         path,
+		Version:      info.VersionID,
+		Size:         size,
+		ETag:         strings.Trim(info.ETag, `"`),
+		LastModified: info.LastModified,
+		ContentType:  "application/octet-stream",
+		Uploader:     opts.Uploader,
+		Checksum:     checksum,
+		Metadata:     fileMeta,
+	}, nil
+}
+
+// removeStaging removes the staging object for good, not hiding it by a delete marker
+func (m minioStorage) removeStaging(logger *zap.Logger, staging string, version string) {
+	err := m.Client.RemoveObject(context.Background(), m.Bucket.Name, staging, minio.RemoveObjectOptions{VersionID: version})
+	if err != nil {
+		logger.Error("could not remove staging object",
+			zap.String("path", staging),
+			zap.Error(err),
+		)
+	}
+}
+
+// presignClient returns the client of the public endpoint, URLs are signed for the host clients connect to
+func (m minioStorage) presignClient() *minio.Client {
+	if m.Public != nil {
+		return m.Public
+	}
+	return m.Client
 }
 
 // LoadDiagramByName loads latest version of file from minio in case version is empty string,
 // in case version is not empty - tries loading provided version
 func (m minioStorage) LoadFileByName(ctx context.Context, logger *zap.Logger, path string, version string) (io.Reader, error) {
-	_, err := m.Client.StatObject(ctx, m.Bucket.Name, path, minio.StatObjectOptions{})
+	_, err := m.statVersion(ctx, path, version)
 	if err != nil {
 		logger.Error("could not load file",
 			zap.String("path", path),
+			zap.String("version", version),
 			zap.Error(err),
 		)
 		return nil, err
@@ -157,42 +404,87 @@ func (m minioStorage) LoadFileByName(ctx context.Context, logger *zap.Logger, pa
 	return objReader, nil
 }
 
+// StatFile returns metadata of the file version, the latest one for empty version
+func (m minioStorage) StatFile(ctx context.Context, logger *zap.Logger, path string, version string) (*calculator.FileInfo, error) {
+	info, err := m.statVersion(ctx, path, version)
+	if err != nil {
+		logger.Error("could not stat file",
+			zap.String("path", path),
+			zap.String("version", version),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return &calculator.FileInfo{
+		Path:         path,
+		Version:      info.VersionID,
+		Size:         info.Size,
+		ETag:         strings.Trim(info.ETag, `"`),
+		LastModified: info.LastModified,
+		ContentType:  info.ContentType,
+		Uploader:     userMetadata(info.UserMetadata, metaUploader),
+		Checksum:     userMetadata(info.UserMetadata, metaChecksum),
+		Metadata:     decodeMetadata(info.UserMetadata),
+	}, nil
+}
+
 func (m minioStorage) IsVersioned(ctx context.Context) bool {
 	return true
 }
 
-// Ls performes list of files actually,  calculator.Diagram has only the name attribute set.
-func (m minioStorage) Ls(ctx context.Context, path string) <-chan string {
-	if !strings.HasSuffix(path, "/") {
+// Ls performes list of files actually, files come with metadata of their latest versions.
+// Empty path lists the root of the bucket.
+func (m minioStorage) Ls(ctx context.Context, path string, opts calculator.LsOptions) <-chan calculator.ObjectInfo {
+	if path != "" && !strings.HasSuffix(path, "/") {
 		path = path + "/"
 	}
-	rChan := make(chan string)
+	rChan := make(chan calculator.ObjectInfo)
 	chanObjInfo := m.Client.ListObjects(ctx, m.Bucket.Name, minio.ListObjectsOptions{
 		WithVersions: false,
-		WithMetadata: false,
+		// user metadata in listings is a minio extension, other servers list keys only
+		WithMetadata: true,
 		Prefix:       path,
-		Recursive:    false,
+		Recursive:    opts.Recursive,
 		MaxKeys:      0,
-		StartAfter:   "",
+		StartAfter:   opts.StartAfter,
 		UseV1:        false,
 	})
 
 	go func() {
+		defer close(rChan)
 		for obj := range chanObjInfo {
+			entry := calculator.ObjectInfo{Path: obj.Key, Err: obj.Err}
 			if obj.Err != nil {
-				m.Logger.Error("skipping bad object")
+				m.Logger.Error("could not list objects",
+					zap.String("path", path),
+					zap.Error(obj.Err),
+				)
+			} else if strings.HasPrefix(obj.Key, uploadsPrefix) {
+				continue
+			} else if !entry.IsDir() {
+				lastModified := obj.LastModified
+				entry.Size = obj.Size
+				entry.LastModified = &lastModified
+				entry.Metadata = decodeMetadata(obj.UserMetadata)
 			}
 			m.Logger.Debug("New item in list",
 				zap.String("diagram name", obj.Key),
 			)
-			rChan <- obj.Key
+			select {
+			case rChan <- entry:
+			case <-ctx.Done():
+				return
+			}
+			if obj.Err != nil {
+				return
+			}
 		}
-		close(rChan)
 	}()
 	return rChan
 }
 
-// LsVersions shows varsions of provided object, stored in minio object storage.
+// LsVersions lists versions of provided object stored in minio object storage, the latest first.
+// Delete markers and deleted versions are skipped.
 func (m minioStorage) LsVersions(ctx context.Context, path string, logger *zap.Logger) (<-chan string, error) {
 	_, err := m.Client.StatObject(ctx, m.Bucket.Name, path, minio.StatObjectOptions{})
 	if err != nil {
@@ -200,34 +492,32 @@ func (m minioStorage) LsVersions(ctx context.Context, path string, logger *zap.L
 			zap.String("path", path),
 			zap.Error(err),
 		)
-		return nil, err
+		return nil, notFound(err, path)
 	}
 
-	rChan := make(chan string)
-	chanObjInfo := m.Client.ListObjects(ctx, m.Bucket.Name, minio.ListObjectsOptions{
-		WithVersions: true,
-		WithMetadata: false,
-		Prefix:       path,
-		Recursive:    false,
-		MaxKeys:      0,
-		StartAfter:   "",
-		UseV1:        false,
-	})
-
-	go func() {
-		for obj := range chanObjInfo {
-			if obj.Err != nil {
-				m.Logger.Error("skipping bad object")
-			}
-			m.Logger.Debug("diagram version found",
-				zap.String("diagram name", path),
-				zap.String("version", obj.VersionID),
-			)
-			rChan <- obj.VersionID
+	versions, err := m.versions(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	rChan := make(chan string, len(versions))
+	for _, obj := range versions {
+		if obj.IsDeleteMarker {
+			continue
 		}
-		close(rChan)
-	}()
-
+		_, trashed, err := m.trashed(ctx, path, obj.VersionID)
+		if err != nil {
+			return nil, err
+		}
+		if trashed {
+			continue
+		}
+		logger.Debug("diagram version found",
+			zap.String("diagram name", path),
+			zap.String("version", obj.VersionID),
+		)
+		rChan <- obj.VersionID
+	}
+	close(rChan)
 	return rChan, nil
 }
 
@@ -237,6 +527,389 @@ func (m minioStorage) ConfigDump(ctx context.Context, logger *zap.Logger) map[st
 	return cfg
 }
 
+// DeleteFile removes the latest version of the file. The bucket is versioned, so a delete marker is put
+// on top of the file versions and the file is restored by removing the marker.
 func (m minioStorage) DeleteFile(ctx context.Context, logger *zap.Logger, path string) error {
-	panic("not implemented")
+	if _, err := m.Client.StatObject(ctx, m.Bucket.Name, path, minio.StatObjectOptions{}); err != nil {
+		logger.Error("could not delete file",
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		return notFound(err, path)
+	}
+	if err := m.Client.RemoveObject(ctx, m.Bucket.Name, path, minio.RemoveObjectOptions{}); err != nil {
+		logger.Error("could not delete file",
+			zap.String("bucket", m.Bucket.Name),
+			zap.String("path", path),
+			zap.Error(err),
+		)
+		return err
+	}
+	logger.Info("file deleted",
+		zap.String("path", path),
+	)
+	return nil
+}
+
+// RestoreFile removes delete marker which is the latest version of the file
+func (m minioStorage) RestoreFile(ctx context.Context, logger *zap.Logger, path string) error {
+	versions, err := m.versions(ctx, path)
+	if err != nil {
+		return err
+	}
+	for _, obj := range versions {
+		if !obj.IsLatest {
+			continue
+		}
+		if !obj.IsDeleteMarker {
+			break
+		}
+		if err = m.Client.RemoveObject(ctx, m.Bucket.Name, path, minio.RemoveObjectOptions{VersionID: obj.VersionID}); err != nil {
+			logger.Error("could not restore file",
+				zap.String("path", path),
+				zap.Error(err),
+			)
+			return err
+		}
+		logger.Info("file restored",
+			zap.String("path", path),
+		)
+		return nil
+	}
+	return fmt.Errorf("%s is not deleted: %w", path, calculator.ErrNotFound)
+}
+
+// PurgeFile removes every version of the file and its delete markers
+func (m minioStorage) PurgeFile(ctx context.Context, logger *zap.Logger, path string) error {
+	versions, err := m.versions(ctx, path)
+	if err != nil {
+		return err
+	}
+	for _, obj := range versions {
+		if err = m.Client.RemoveObject(ctx, m.Bucket.Name, path, minio.RemoveObjectOptions{VersionID: obj.VersionID}); err != nil {
+			logger.Error("could not purge file",
+				zap.String("path", path),
+				zap.String("version", obj.VersionID),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+	logger.Info("file purged",
+		zap.String("path", path),
+		zap.Int("versions", len(versions)),
+	)
+	return nil
+}
+
+// DeleteVersion tags the version as deleted. The newest version left is copied over the latest one when it is
+// deleted, a delete marker is put when there is none, the tag tells which one was put for RestoreVersion.
+func (m minioStorage) DeleteVersion(ctx context.Context, logger *zap.Logger, path string, version string) error {
+	defer commits.lock(path)()
+	if _, err := m.statVersion(ctx, path, version); err != nil {
+		logger.Error("could not delete file version",
+			zap.String("path", path),
+			zap.String("version", version),
+			zap.Error(err),
+		)
+		return err
+	}
+	versions, err := m.versions(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	replaced := trashKept
+	for _, obj := range versions {
+		if obj.IsLatest && obj.VersionID == version {
+			if replaced, err = m.replaceLatest(ctx, path, version, versions); err != nil {
+				logger.Error("could not replace the latest file version",
+					zap.String("path", path),
+					zap.String("version", version),
+					zap.Error(err),
+				)
+				return err
+			}
+		}
+	}
+	t, err := tags.MapToObjectTags(map[string]string{trashTag: replaced})
+	if err != nil {
+		return err
+	}
+	err = m.Client.PutObjectTagging(ctx, m.Bucket.Name, path, t, minio.PutObjectTaggingOptions{VersionID: version})
+	if err != nil {
+		logger.Error("could not delete file version",
+			zap.String("path", path),
+			zap.String("version", version),
+			zap.Error(err),
+		)
+		return err
+	}
+	logger.Info("file version deleted",
+		zap.String("path", path),
+		zap.String("VersionID", version),
+	)
+	return nil
+}
+
+// replaceLatest copies the newest version left over the latest one, or puts a delete marker when there is none.
+// Id of the copy or trashDeleted is returned.
+func (m minioStorage) replaceLatest(ctx context.Context, path string, latest string, versions []minio.ObjectInfo) (string, error) {
+	for _, obj := range versions {
+		if obj.IsDeleteMarker || obj.VersionID == latest {
+			continue
+		}
+		_, trashed, err := m.trashed(ctx, path, obj.VersionID)
+		if err != nil {
+			return "", err
+		}
+		if !trashed {
+			return m.copyVersion(ctx, path, obj.VersionID, obj.Size)
+		}
+	}
+	if err := m.Client.RemoveObject(ctx, m.Bucket.Name, path, minio.RemoveObjectOptions{}); err != nil {
+		return "", err
+	}
+	return trashDeleted, nil
+}
+
+// RestoreVersion removes the deleted tag of the version. The version is copied over the latest one when DeleteVersion
+// put the latest version and nothing was uploaded since, the delete marker put by DeleteVersion is removed.
+func (m minioStorage) RestoreVersion(ctx context.Context, logger *zap.Logger, path string, version string) error {
+	defer commits.lock(path)()
+	replaced, trashed, err := m.trashed(ctx, path, version)
+	if err != nil {
+		return err
+	}
+	if !trashed {
+		return fmt.Errorf("%s version %s is not deleted: %w", path, version, calculator.ErrNotFound)
+	}
+	err = m.Client.RemoveObjectTagging(ctx, m.Bucket.Name, path, minio.RemoveObjectTaggingOptions{VersionID: version})
+	if err != nil {
+		logger.Error("could not restore file version",
+			zap.String("path", path),
+			zap.String("version", version),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	if replaced != trashKept {
+		versions, err := m.versions(ctx, path)
+		if err != nil {
+			return err
+		}
+		for _, obj := range versions {
+			if !obj.IsLatest {
+				continue
+			}
+			switch {
+			case replaced == trashDeleted && obj.IsDeleteMarker:
+				err = m.Client.RemoveObject(ctx, m.Bucket.Name, path, minio.RemoveObjectOptions{VersionID: obj.VersionID})
+			case replaced == obj.VersionID:
+				// the copy is kept, another diagram version may have been read from it
+				var info minio.ObjectInfo
+				if info, err = m.Client.StatObject(ctx, m.Bucket.Name, path, minio.StatObjectOptions{VersionID: version}); err == nil {
+					_, err = m.copyVersion(ctx, path, version, info.Size)
+				}
+			}
+			break
+		}
+		if err != nil {
+			logger.Error("could not make restored file version the latest one",
+				zap.String("path", path),
+				zap.String("version", version),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+	logger.Info("file version restored",
+		zap.String("path", path),
+		zap.String("VersionID", version),
+	)
+	return nil
+}
+
+// PurgeVersion removes the deleted version for good
+func (m minioStorage) PurgeVersion(ctx context.Context, logger *zap.Logger, path string, version string) error {
+	_, trashed, err := m.trashed(ctx, path, version)
+	if err != nil {
+		return err
+	}
+	if !trashed {
+		return fmt.Errorf("%s version %s is not deleted: %w", path, version, calculator.ErrNotFound)
+	}
+	if err = m.Client.RemoveObject(ctx, m.Bucket.Name, path, minio.RemoveObjectOptions{VersionID: version}); err != nil {
+		logger.Error("could not purge file version",
+			zap.String("path", path),
+			zap.String("version", version),
+			zap.Error(err),
+		)
+		return err
+	}
+	logger.Info("file version purged",
+		zap.String("path", path),
+		zap.String("VersionID", version),
+	)
+	return nil
+}
+
+// copyVersion copies the version with its metadata over the latest version of the file and returns id of the copy
+func (m minioStorage) copyVersion(ctx context.Context, path string, version string, size int64) (string, error) {
+	dst := minio.CopyDestOptions{Bucket: m.Bucket.Name, Object: path}
+	src := minio.CopySrcOptions{Bucket: m.Bucket.Name, Object: path, VersionID: version}
+	var info minio.UploadInfo
+	var err error
+	if size <= maxCopySize {
+		info, err = m.Client.CopyObject(ctx, dst, src)
+	} else {
+		info, err = m.Client.ComposeObject(ctx, dst, src)
+	}
+	return info.VersionID, err
+}
+
+// statVersion stats the file version, the latest one for empty version. Deleted versions are not found.
+func (m minioStorage) statVersion(ctx context.Context, path string, version string) (minio.ObjectInfo, error) {
+	info, err := m.Client.StatObject(ctx, m.Bucket.Name, path, minio.StatObjectOptions{VersionID: version})
+	if err != nil {
+		return info, notFound(err, path)
+	}
+	if info.UserTagCount == 0 {
+		return info, nil
+	}
+	_, trashed, err := m.trashed(ctx, path, info.VersionID)
+	if err != nil {
+		return info, err
+	}
+	if trashed {
+		return info, fmt.Errorf("%s version %s: %w", path, info.VersionID, calculator.ErrNotFound)
+	}
+	return info, nil
+}
+
+// trashed returns the trash tag of the version, ok tells whether the version is deleted
+func (m minioStorage) trashed(ctx context.Context, path string, version string) (replaced string, ok bool, err error) {
+	t, err := m.Client.GetObjectTagging(ctx, m.Bucket.Name, path, minio.GetObjectTaggingOptions{VersionID: version})
+	if err != nil {
+		return "", false, notFound(err, path)
+	}
+	replaced, ok = t.ToMap()[trashTag]
+	return replaced, ok, nil
+}
+
+// versions lists versions and delete markers of the file, ErrNotFound is returned when there are none
+func (m minioStorage) versions(ctx context.Context, path string) ([]minio.ObjectInfo, error) {
+	var versions []minio.ObjectInfo
+	for obj := range m.Client.ListObjects(ctx, m.Bucket.Name, minio.ListObjectsOptions{
+		WithVersions: true,
+		Prefix:       path,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		// prefix matches longer names too
+		if obj.Key == path {
+			versions = append(versions, obj)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+	}
+	return versions, nil
+}
+
+// notFound wraps ErrNotFound into errors of missing file or version
+func notFound(err error, path string) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchVersion":
+		return fmt.Errorf("%s: %w", path, calculator.ErrNotFound)
+	}
+	return err
+}
+
+// userMetadata looks the key up ignoring case, servers differ in case of returned metadata keys
+// and listings keep their X-Amz-Meta- prefix
+func userMetadata(meta minio.StringMap, key string) string {
+	for k, v := range meta {
+		if strings.EqualFold(k, key) || strings.EqualFold(k, "X-Amz-Meta-"+key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// encodeMetadata puts the document metadata to user metadata of the object
+func encodeMetadata(meta *calculator.FileMetadata, into map[string]string) {
+	if meta == nil {
+		return
+	}
+	var tags []string
+	for _, tag := range meta.Tags {
+		tags = append(tags, url.QueryEscape(tag))
+	}
+	components := make(url.Values)
+	for class, n := range meta.Components {
+		components.Set(class, strconv.Itoa(n))
+	}
+	for key, value := range map[string]string{
+		metaAuthor:      url.QueryEscape(meta.Author),
+		metaDescription: url.QueryEscape(meta.Description),
+		metaTags:        strings.Join(tags, ","),
+		metaEditor:      url.QueryEscape(meta.Editor),
+		metaDiagram:     url.QueryEscape(meta.DiagramUUID),
+		metaComponents:  components.Encode(),
+	} {
+		if value != "" {
+			into[key] = value
+		}
+	}
+}
+
+// decodeMetadata reads the document metadata from user metadata of the object, nil is returned when there is none
+func decodeMetadata(from minio.StringMap) *calculator.FileMetadata {
+	unescape := func(key string) string {
+		value, err := url.QueryUnescape(userMetadata(from, key))
+		if err != nil {
+			return ""
+		}
+		return value
+	}
+	meta := &calculator.FileMetadata{
+		Author:      unescape(metaAuthor),
+		Description: unescape(metaDescription),
+		Editor:      unescape(metaEditor),
+		DiagramUUID: unescape(metaDiagram),
+	}
+	if tags := userMetadata(from, metaTags); tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag, err := url.QueryUnescape(tag); err == nil && tag != "" {
+				meta.Tags = append(meta.Tags, tag)
+			}
+		}
+	}
+	components, _ := url.ParseQuery(userMetadata(from, metaComponents))
+	for class := range components {
+		n, err := strconv.Atoi(components.Get(class))
+		if err != nil {
+			continue
+		}
+		if meta.Components == nil {
+			meta.Components = make(map[string]int)
+		}
+		meta.Components[class] = n
+	}
+	if meta.IsZero() {
+		return nil
+	}
+	return meta
+}
+
+// stagingKey returns a random key under uploadsPrefix
+func stagingKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return uploadsPrefix + hex.EncodeToString(b), nil
 }
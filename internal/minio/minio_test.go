@@ -5,12 +5,16 @@ package minio
 import (
 	"bytes"
 	"context"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
 	"github.com/minio/minio-go/v7"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"io/ioutil"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewMinioStorage(t *testing.T) {
@@ -108,11 +112,11 @@ func TestNewMinioStorage(t *testing.T) {
 			t.Logf("ETAG: %s", info.ETag)
 		}
 
-		infoChan := m.Ls(context.Background(), "test/")
+		infoChan := m.Ls(context.Background(), "test/", calculator.LsOptions{})
 
 		for obj_name := range infoChan {
-			assert.NotEmpty(t, obj_name)
-			t.Logf("obj info: %s", obj_name)
+			assert.NotEmpty(t, obj_name.Path)
+			t.Logf("obj info: %s", obj_name.Path)
 		}
 
 	})
@@ -161,11 +165,120 @@ func TestNewMinioStorage(t *testing.T) {
 			assert.NoError(t, err)
 		}
 		t.Logf("test data uploaded")
-		infoChan := m.Ls(context.Background(), "/test/")
+		infoChan := m.Ls(context.Background(), "/test/", calculator.LsOptions{})
 
 		for obj_name := range infoChan {
-			assert.NotEmpty(t, obj_name)
-			t.Logf("obj info: %s", obj_name)
+			assert.NotEmpty(t, obj_name.Path)
+			t.Logf("obj info: %s", obj_name.Path)
 		}
 	})
+	t.Run("delete, restore and purge", func(t *testing.T) {
+		path := "test/test-delete.xml"
+		assert.NoError(t, m.UploadTextFile(context.Background(), zap.NewNop(), bytes.NewReader(diagram), path))
+
+		assert.NoError(t, m.DeleteFile(context.Background(), zap.NewNop(), path))
+		_, err := m.LoadFileByName(context.Background(), zap.NewNop(), path, "")
+		assert.Error(t, err)
+		assert.ErrorIs(t, m.DeleteFile(context.Background(), zap.NewNop(), path), calculator.ErrNotFound)
+
+		assert.NoError(t, m.RestoreFile(context.Background(), zap.NewNop(), path))
+		_, err = m.LoadFileByName(context.Background(), zap.NewNop(), path, "")
+		assert.NoError(t, err)
+		assert.ErrorIs(t, m.RestoreFile(context.Background(), zap.NewNop(), path), calculator.ErrNotFound)
+
+		assert.NoError(t, m.PurgeFile(context.Background(), zap.NewNop(), path))
+		assert.ErrorIs(t, m.RestoreFile(context.Background(), zap.NewNop(), path), calculator.ErrNotFound)
+	})
+}
+
+func TestMetadata(t *testing.T) {
+	meta := &calculator.FileMetadata{
+		Author:      "Zoë Smith",
+		Description: "power supply, rev. 2\nfor the bench",
+		Tags:        []string{"power", "a,b"},
+		Editor:      "app.diagrams.net",
+		DiagramUUID: "uweCVhkyVy6MirBnUyNJ",
+		Components:  map[string]int{"resistors": 2, "capacitors": 1},
+	}
+	encoded := map[string]string{}
+	encodeMetadata(meta, encoded)
+	for _, v := range encoded {
+		assert.NotContains(t, v, "\n")
+	}
+
+	// listings return keys with prefix
+	listed := minio.StringMap{}
+	for k, v := range encoded {
+		listed["X-Amz-Meta-"+k] = v
+	}
+	assert.Equal(t, meta, decodeMetadata(listed))
+	assert.Nil(t, decodeMetadata(minio.StringMap{"X-Amz-Meta-Sha256": "00"}))
+}
+
+func TestPresign(t *testing.T) {
+	m := &minioStorage{user: "calculator", password: "c@1cu1@t0r", Bucket: &minio.BucketInfo{Name: "calculator"}}
+	if !assert.NoError(t, m.SetPublicEndpoint("minio.local.net", false, "")) {
+		return
+	}
+	ctx := context.Background()
+	logger := zap.NewNop()
+
+	// URLs are signed offline for the public endpoint
+	u, err := m.PresignGet(ctx, logger, "test/diagram.xml", "v1", time.Minute)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "minio.local.net", u.Host)
+		assert.Equal(t, "/calculator/test/diagram.xml", u.Path)
+		assert.Equal(t, "v1", u.Query().Get("versionId"))
+		assert.Equal(t, "60", u.Query().Get("X-Amz-Expires"))
+	}
+	_, err = m.PresignGet(ctx, logger, "test/diagram.xml", "", time.Minute)
+	assert.Error(t, err)
+
+	key, u, err := m.PresignPut(ctx, logger, time.Minute)
+	if assert.NoError(t, err) {
+		assert.True(t, strings.HasPrefix(key, uploadsPrefix))
+		assert.Equal(t, "/calculator/"+key, u.Path)
+	}
+	_, err = m.CommitUpload(ctx, logger, "test/diagram.xml", "test/other.xml", calculator.UploadOptions{})
+	assert.Error(t, err)
+}
+
+func TestKeyLocks(t *testing.T) {
+	l := &keyLocks{locks: make(map[string]*keyLock)}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	held := map[string]int{}
+	for i := 0; i < 50; i++ {
+		key := "test/" + strconv.Itoa(i%3) + ".xml"
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := l.lock(key)
+			defer unlock()
+			mu.Lock()
+			held[key]++
+			assert.Equal(t, 1, held[key], "key is committed concurrently")
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			held[key]--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, l.locks)
+
+	// other keys are not blocked
+	unlock := l.lock("test/a.xml")
+	done := make(chan struct{})
+	go func() {
+		l.lock("test/b.xml")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("other key is blocked")
+	}
+	unlock()
 }
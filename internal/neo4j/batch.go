@@ -0,0 +1,233 @@
+package neo4j
+
+import (
+	"context"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
+	"go.uber.org/zap"
+)
+
+const defaultBatchSize = 500
+
+// mergeNodesQuery merges elements by diagram uuid, version and element id and updates their properties,
+// so editing a label does not create a second element. Diagram node of the version must exist.
+const mergeNodesQuery = "UNWIND $rows AS row " +
+	"MATCH (d:Diagram {" + schemaKey + ": row.diagram}) " +
+	"MERGE (item:Element {" + schemaKey + ": row.key}) " +
+	"ON CREATE SET item." + schemaUUID + " = row.uuid, item." + schemaVersion + " = row.version, item." + schemaID + " = row.eid " +
+	"SET item." + schemaValue + " = row.value, item." + schemaClass + " = row.class, item." + schemaSubClass + " = row.subclass " +
+	"MERGE (d)-[:contains]->(item) " +
+	"RETURN count(item)"
+
+// mergeRelationsQuery merges wires by their element id, parallel wires between the same elements are kept apart.
+// Ids of created relations are returned, rows with missing source or target element are dropped by MATCH.
+const mergeRelationsQuery = "UNWIND $rows AS row " +
+	"MATCH " +
+	"(source:Element {" + schemaUUID + ": row.uuid, " + schemaVersion + ": row.version, " + schemaID + ": row.source}), " +
+	"(target:Element {" + schemaUUID + ": row.uuid, " + schemaVersion + ": row.version, " + schemaID + ": row.target}) " +
+	"MERGE (source)-[r:connected {" + schemaID + ": row.eid}]->(target) " +
+	"SET r." + schemaExitX + " = row.exitX, r." + schemaExitY + " = row.exitY, " +
+	"r." + schemaEntryX + " = row.entryX, r." + schemaEntryY + " = row.entryY " +
+	"RETURN row.uuid, row.eid"
+
+// ErrNoRelationEndpoint is set to relation items whose source or target element is not in the diagram
+var ErrNoRelationEndpoint = calculator.ErrNoRelationEndpoint
+
+// diagramWriter stores a version of every diagram found in nodes and relations,
+// it returns version numbers by diagram uuid and relations with missing endpoints
+type diagramWriter func(ctx context.Context, logger *zap.Logger, opts calculator.PushOptions,
+	nodes []drawio.Item, relations []drawio.Item) (versions map[string]int, missing []drawio.Item, err error)
+
+// written is the result of the diagram write transaction
+type written struct {
+	versions map[string]int
+	// created are uuid:eid of created relations
+	created map[string]struct{}
+}
+
+// batches splits rows to chunks of size rows at most, size < 1 means a single chunk
+func batches(rows []map[string]interface{}, size int) [][]map[string]interface{} {
+	if size < 1 || len(rows) <= size {
+		return [][]map[string]interface{}{rows}
+	}
+	var chunks [][]map[string]interface{}
+	for len(rows) > size {
+		chunks = append(chunks, rows[:size])
+		rows = rows[size:]
+	}
+	return append(chunks, rows)
+}
+
+// byDiagram groups items by diagram uuid keeping their order
+func byDiagram(items []drawio.Item) (uuids []string, groups map[string][]drawio.Item) {
+	groups = make(map[string][]drawio.Item)
+	for _, item := range items {
+		if _, ok := groups[item.UUID]; !ok {
+			uuids = append(uuids, item.UUID)
+		}
+		groups[item.UUID] = append(groups[item.UUID], item)
+	}
+	return uuids, groups
+}
+
+// writeDiagram writes every diagram as a new version, or over the latest one when opts.Replace is set,
+// with UNWIND batches in a single write transaction. Any database error rolls back the whole transaction,
+// ctx is checked between statements. Batches run one after another: a transaction is not safe for concurrent
+// use, and batches written by concurrent transactions would leave a partial version behind on error or cancel. Relations not created because of a missing endpoint
+// are not a database error, they are returned to be reported per item.
+func (c *Controller) writeDiagram(ctx context.Context, logger *zap.Logger, opts calculator.PushOptions,
+	nodes []drawio.Item, relations []drawio.Item) (versions map[string]int, missing []drawio.Item, err error) {
+	batchSize := c.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultBatchSize
+	}
+
+	uuids, groups := byDiagram(append(append([]drawio.Item{}, nodes...), relations...))
+
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer func() {
+		err := session.Close()
+		if err != nil {
+			logger.Error("Failed to close neo4j session")
+		} else {
+			logger.Debug("Closing neo4j Session")
+		}
+	}()
+
+	// exec runs statement which result is not needed
+	exec := func(tx neo4j.Transaction, query string, params map[string]interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r, err := tx.Run(query, params)
+		if err != nil {
+			return err
+		}
+		_, err = r.Consume()
+		return err
+	}
+
+	result, err := session.WriteTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			w := written{
+				versions: make(map[string]int),
+				created:  make(map[string]struct{}),
+			}
+			for _, uuid := range uuids {
+				version, err := nextVersion(tx, uuid, opts.Replace)
+				if err != nil {
+					return nil, err
+				}
+				w.versions[uuid] = version
+
+				var nodeRows, relationRows []map[string]interface{}
+				eids := []string{}
+				for _, item := range groups[uuid] {
+					if item.Class == drawio.ItemClassLines {
+						relationRows = append(relationRows, relationParams(item, version))
+					} else {
+						nodeRows = append(nodeRows, nodeParams(item, version))
+						eids = append(eids, eid(item.EID))
+					}
+				}
+
+				params := diagramParams(uuid, version, opts, eids)
+				statements := []string{mergeDiagramQuery}
+				if opts.Replace {
+					statements = append(statements, deleteStaleNodesQuery, deleteRelationsQuery)
+				}
+				for _, query := range statements {
+					if err = exec(tx, query, params); err != nil {
+						return nil, err
+					}
+				}
+
+				for _, rows := range batches(nodeRows, batchSize) {
+					if len(rows) == 0 {
+						continue
+					}
+					if err = exec(tx, mergeNodesQuery, map[string]interface{}{"rows": rows}); err != nil {
+						return nil, err
+					}
+				}
+
+				for _, rows := range batches(relationRows, batchSize) {
+					if len(rows) == 0 {
+						continue
+					}
+					if err = ctx.Err(); err != nil {
+						return nil, err
+					}
+					r, err := tx.Run(mergeRelationsQuery, map[string]interface{}{"rows": rows})
+					if err != nil {
+						return nil, err
+					}
+					for r.Next() {
+						v := r.Record().Values
+						w.created[propString(v[0])+":"+propString(v[1])] = struct{}{}
+					}
+					if err = r.Err(); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return w, nil
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := result.(written)
+	for _, item := range relations {
+		if _, ok := w.created[item.UUID+":"+eid(item.EID)]; !ok {
+			missing = append(missing, item)
+		}
+	}
+	return w.versions, missing, nil
+}
+
+// diagramParams are parameters of the Diagram node queries, eids are the pushed elements
+func diagramParams(uuid string, version int, opts calculator.PushOptions, eids []string) map[string]interface{} {
+	return map[string]interface{}{
+		"uuid":          uuid,
+		"version":       int64(version),
+		"key":           diagramKey(uuid, version),
+		"project":       opts.Project,
+		"source":        opts.Source,
+		"sourceVersion": opts.SourceVersion,
+		"eids":          eids,
+	}
+}
+
+// nextVersion locks the diagram until tx ends and returns number of the version to write, the latest one
+// is replaced only if it exists and is not in trash
+func nextVersion(tx neo4j.Transaction, uuid string, replace bool) (int, error) {
+	r, err := tx.Run(lastVersionQuery, map[string]interface{}{"uuid": uuid})
+	if err != nil {
+		return 0, err
+	}
+	record, err := r.Single()
+	if err != nil {
+		return 0, err
+	}
+	last := propInt(record.Values[0])
+	if live, _ := record.Values[1].(bool); replace && live {
+		return last, nil
+	}
+	return last + 1, nil
+}
+
+// liveVersion resolves version of the diagram with liveVersionQuery, 0 is returned when there is no such version
+func liveVersion(tx neo4j.Transaction, uuid string, version int) (int, error) {
+	r, err := tx.Run(liveVersionQuery, map[string]interface{}{"uuid": uuid, "version": int64(version)})
+	if err != nil {
+		return 0, err
+	}
+	record, err := r.Single()
+	if err != nil {
+		return 0, err
+	}
+	return propInt(record.Values[0]), nil
+}
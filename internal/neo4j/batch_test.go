@@ -0,0 +1,139 @@
+package neo4j
+
+import (
+	"context"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatches(t *testing.T) {
+	rows := make([]map[string]interface{}, 7)
+	for i := range rows {
+		rows[i] = nodeParams(drawio.Item{UUID: "uweCVhkyVy6MirBnUyNJ", EID: i}, 1)
+	}
+
+	tests := []struct {
+		size     int
+		expected []int
+	}{
+		{0, []int{7}},
+		{3, []int{3, 3, 1}},
+		{7, []int{7}},
+		{500, []int{7}},
+	}
+	for _, test := range tests {
+		var sizes []int
+		for _, chunk := range batches(rows, test.size) {
+			sizes = append(sizes, len(chunk))
+		}
+		assert.Equal(t, test.expected, sizes)
+	}
+	assert.Equal(t, "6", batches(rows, 3)[2][0]["eid"])
+}
+
+func TestBatchQueries(t *testing.T) {
+	for q, params := range map[string]map[string]interface{}{
+		mergeNodesQuery:     nodeParams(drawio.Item{}, 1),
+		mergeRelationsQuery: relationParams(drawio.Item{}, 1),
+	} {
+		assert.True(t, strings.HasPrefix(q, "UNWIND $rows AS row "))
+		for _, field := range strings.Fields(strings.NewReplacer(",", " ", "}", " ", ")", " ").Replace(q)) {
+			if strings.HasPrefix(field, "row.") {
+				assert.Contains(t, params, strings.TrimPrefix(field, "row."))
+			}
+		}
+		for _, label := range hostileLabels {
+			assert.NotContains(t, q, label)
+		}
+	}
+}
+
+func TestPushItems_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// nothing is sent and channel is never closed, PushItems must return without touching the driver
+	c := &Controller{}
+	summary, err := c.PushItems(ctx, zap.NewNop(), calculator.PushOptions{}, make(chan drawio.Item))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Zero(t, summary.Nodes)
+}
+
+// fakeWriter keeps elements in memory and reports relations like mergeRelationsQuery does
+type fakeWriter struct {
+	nodes     map[string]struct{}
+	relations int
+	versions  map[string]int
+}
+
+func (f *fakeWriter) write(ctx context.Context, logger *zap.Logger, opts calculator.PushOptions,
+	nodes []drawio.Item, relations []drawio.Item) (map[string]int, []drawio.Item, error) {
+	versions := make(map[string]int)
+	for _, item := range append(append([]drawio.Item{}, nodes...), relations...) {
+		if _, ok := versions[item.UUID]; !ok {
+			if !opts.Replace || f.versions[item.UUID] == 0 {
+				f.versions[item.UUID]++
+			}
+			versions[item.UUID] = f.versions[item.UUID]
+		}
+	}
+	for _, item := range nodes {
+		f.nodes[item.UUID+":"+eid(item.EID)] = struct{}{}
+	}
+	var missing []drawio.Item
+	for _, item := range relations {
+		_, source := f.nodes[item.UUID+":"+eid(item.SourceId)]
+		_, target := f.nodes[item.UUID+":"+eid(item.TargetId)]
+		if !source || !target {
+			missing = append(missing, item)
+			continue
+		}
+		f.relations++
+	}
+	return versions, missing, ctx.Err()
+}
+
+func TestPushItems_ThousandsOfWires(t *testing.T) {
+	const elements = 5000
+	fake := &fakeWriter{nodes: map[string]struct{}{}, versions: map[string]int{}}
+	c := &Controller{write: fake.write}
+
+	// wires go first, nothing can be written until the last element is read
+	ichan := make(chan drawio.Item)
+	go func() {
+		defer close(ichan)
+		for i := 1; i < elements; i++ {
+			ichan <- drawio.Item{UUID: "test-thousands-of-wires", EID: elements + i, Class: drawio.ItemClassLines,
+				SourceId: i, TargetId: i + 1}
+		}
+		ichan <- drawio.Item{UUID: "test-thousands-of-wires", EID: 2 * elements, Class: drawio.ItemClassLines,
+			SourceId: 1, TargetId: 3 * elements}
+		for i := 1; i <= elements; i++ {
+			ichan <- drawio.Item{UUID: "test-thousands-of-wires", EID: i, Class: drawio.ItemClassResistors}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		summary, err := c.PushItems(context.Background(), zap.NewNop(), calculator.PushOptions{}, ichan)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"test-thousands-of-wires": 1}, summary.Versions)
+		assert.Equal(t, elements, summary.Nodes)
+		assert.Equal(t, elements-1, summary.Relations)
+		assert.Len(t, summary.Failed, 1)
+		assert.ErrorIs(t, summary.Failed[0].Error, ErrNoRelationEndpoint)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("PushItems is stuck")
+	}
+	assert.Equal(t, elements-1, fake.relations)
+}
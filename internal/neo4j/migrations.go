@@ -0,0 +1,182 @@
+package neo4j
+
+import (
+	"context"
+	"fmt"
+	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
+	"go.uber.org/zap"
+)
+
+// Migration is a schema change of the graph. Statements run one by one, each in its own transaction,
+// as neo4j does not mix schema and data changes in a transaction. Every statement must be idempotent,
+// so a migration interrupted half way is safely run again.
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// Migrations are applied in order, applied versions are kept as Migration nodes
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "link elements stored before versioning to diagram version 1",
+		Statements: []string{
+			"MATCH (e:Element) WHERE e." + schemaVersion + " IS NULL SET e." + schemaVersion + " = 1",
+			"MATCH (e:Element) WHERE NOT (:Diagram)-[:contains]->(e) " +
+				"MERGE (d:Diagram {" + schemaUUID + ": e." + schemaUUID + ", " + schemaVersion + ": e." + schemaVersion + "}) " +
+				"ON CREATE SET d." + schemaCreated + " = datetime() " +
+				"MERGE (d)-[:contains]->(e)",
+		},
+	},
+	{
+		Version:     2,
+		Description: "remove duplicate diagrams and elements, set their keys",
+		Statements: []string{
+			"MATCH (d:Diagram) WITH d." + schemaUUID + " AS uuid, d." + schemaVersion + " AS version, collect(d) AS nodes " +
+				"WHERE size(nodes) > 1 UNWIND tail(nodes) AS duplicate DETACH DELETE duplicate",
+			"MATCH (e:Element) WHERE NOT (:Diagram)-[:contains]->(e) " +
+				"MATCH (d:Diagram {" + schemaUUID + ": e." + schemaUUID + ", " + schemaVersion + ": e." + schemaVersion + "}) " +
+				"MERGE (d)-[:contains]->(e)",
+			"MATCH (e:Element) WITH e." + schemaUUID + " AS uuid, e." + schemaVersion + " AS version, e." + schemaID + " AS eid, " +
+				"collect(e) AS nodes WHERE size(nodes) > 1 UNWIND tail(nodes) AS duplicate DETACH DELETE duplicate",
+			"MATCH (d:Diagram) SET d." + schemaKey + " = " + diagramKeyExpr("d"),
+			"MATCH (e:Element) SET e." + schemaKey + " = " + elementKeyExpr("e"),
+		},
+	},
+	{
+		Version:     3,
+		Description: "uniqueness constraints and indexes",
+		Statements: []string{
+			"CREATE CONSTRAINT diagram_key IF NOT EXISTS FOR (d:Diagram) REQUIRE d." + schemaKey + " IS UNIQUE",
+			"CREATE CONSTRAINT element_key IF NOT EXISTS FOR (e:Element) REQUIRE e." + schemaKey + " IS UNIQUE",
+			"CREATE CONSTRAINT migration_version IF NOT EXISTS FOR (m:Migration) REQUIRE m." + schemaVersion + " IS UNIQUE",
+			"CREATE INDEX diagram_uuid IF NOT EXISTS FOR (d:Diagram) ON (d." + schemaUUID + ", d." + schemaVersion + ")",
+			"CREATE INDEX element_uuid IF NOT EXISTS FOR (e:Element) ON (e." + schemaUUID + ", e." + schemaVersion + ", e." + schemaID + ")",
+		},
+	},
+	{
+		Version:     4,
+		Description: "diagram locks serializing pushes of the same diagram",
+		Statements: []string{
+			"CREATE CONSTRAINT diagram_lock_uuid IF NOT EXISTS FOR (l:DiagramLock) REQUIRE l." + schemaUUID + " IS UNIQUE",
+		},
+	},
+}
+
+const schemaVersionQuery = "MATCH (m:Migration) RETURN max(m." + schemaVersion + ")"
+
+const recordMigrationQuery = "MERGE (m:Migration {" + schemaVersion + ": $version}) " +
+	"SET m.description = $description, m.applied = datetime()"
+
+// diagramKeyExpr and elementKeyExpr build keys in cypher the same way diagramKey and elementKey do
+func diagramKeyExpr(n string) string {
+	return n + "." + schemaUUID + " + ':' + toString(" + n + "." + schemaVersion + ")"
+}
+
+func elementKeyExpr(n string) string {
+	return diagramKeyExpr(n) + " + ':' + toString(" + n + "." + schemaID + ")"
+}
+
+// SchemaVersion returns version of the last applied migration, 0 for an empty database
+func (c *Controller) SchemaVersion(ctx context.Context, logger *zap.Logger) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer func() {
+		err := session.Close()
+		if err != nil {
+			logger.Error("Failed to close neo4j session")
+		} else {
+			logger.Debug("Closing neo4j Session")
+		}
+	}()
+
+	result, err := session.ReadTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			r, err := tx.Run(schemaVersionQuery, nil)
+			if err != nil {
+				return nil, err
+			}
+			record, err := r.Single()
+			if err != nil {
+				return nil, err
+			}
+			return propInt(record.Values[0]), nil
+		},
+	)
+	if err != nil {
+		logger.Error("could not read schema version",
+			zap.Error(err),
+		)
+		return 0, err
+	}
+	return result.(int), nil
+}
+
+// Migrate applies Migrations newer than the schema version of the database and returns applied ones.
+// A failed migration stops Migrate, migrations before it stay applied.
+func (c *Controller) Migrate(ctx context.Context, logger *zap.Logger) ([]Migration, error) {
+	current, err := c.SchemaVersion(ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer func() {
+		err := session.Close()
+		if err != nil {
+			logger.Error("Failed to close neo4j session")
+		} else {
+			logger.Debug("Closing neo4j Session")
+		}
+	}()
+
+	exec := func(query string, params map[string]interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := session.WriteTransaction(
+			func(tx neo4j.Transaction) (interface{}, error) {
+				r, err := tx.Run(query, params)
+				if err != nil {
+					return nil, err
+				}
+				return r.Consume()
+			},
+		)
+		return err
+	}
+
+	var applied []Migration
+	for _, m := range Migrations {
+		if m.Version <= current {
+			continue
+		}
+		logger.Info("applying graph schema migration",
+			zap.Int("version", m.Version),
+			zap.String("description", m.Description),
+		)
+		for _, statement := range m.Statements {
+			if err = exec(statement, nil); err != nil {
+				logger.Error("graph schema migration failed",
+					zap.Int("version", m.Version),
+					zap.String("statement", statement),
+					zap.Error(err),
+				)
+				return applied, fmt.Errorf("migration %d: %w", m.Version, err)
+			}
+		}
+		params := map[string]interface{}{"version": int64(m.Version), "description": m.Description}
+		if err = exec(recordMigrationQuery, params); err != nil {
+			return applied, fmt.Errorf("migration %d: %w", m.Version, err)
+		}
+		applied = append(applied, m)
+	}
+	logger.Info("graph schema is up to date",
+		zap.Int("from", current),
+		zap.Int("applied", len(applied)),
+	)
+	return applied, nil
+}
@@ -0,0 +1,41 @@
+package neo4j
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	for i, m := range Migrations {
+		assert.Equal(t, i+1, m.Version, "migrations are numbered in order from 1")
+		assert.NotEmpty(t, m.Description)
+		assert.NotEmpty(t, m.Statements)
+		for _, statement := range m.Statements {
+			if strings.HasPrefix(statement, "CREATE ") {
+				assert.Contains(t, statement, "IF NOT EXISTS")
+			}
+			assert.NotContains(t, statement, "$")
+		}
+	}
+	assert.Equal(t, "d.uuid + ':' + toString(d.version)", diagramKeyExpr("d"))
+	assert.Equal(t, "uweCVhkyVy6MirBnUyNJ:2:7", elementKey("uweCVhkyVy6MirBnUyNJ", 2, 7))
+}
+
+func TestController_Migrate(t *testing.T) {
+	requireNeo4j(t)
+	logger := zap.NewNop()
+
+	_, err := ctrlr.Migrate(context.Background(), logger)
+	assert.NoError(t, err)
+	version, err := ctrlr.SchemaVersion(context.Background(), logger)
+	assert.NoError(t, err)
+	assert.Equal(t, Migrations[len(Migrations)-1].Version, version)
+
+	// applied migrations are not run again
+	applied, err := ctrlr.Migrate(context.Background(), logger)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+}
@@ -1,28 +1,47 @@
 package neo4j
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
 	"github.com/aemakeye/circuit_calculator/internal/drawio"
 	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
 	"github.com/neo4j/neo4j-go-driver/v4/neo4j/dbtype"
 	"go.uber.org/zap"
+	"sort"
+	"strconv"
 	"sync"
-	"text/template"
+	"time"
 )
 
 const (
-	relationQueueSize = 100
-	schemaUUID        = "uuid"
-	schemaID          = "eid"
-	schemaValue       = "Value"
-	schemaClass       = "Class"
-	schemaSubClass    = "SubClass"
+	schemaUUID          = "uuid"
+	schemaID            = "eid"
+	schemaValue         = "Value"
+	schemaClass         = "Class"
+	schemaSubClass      = "SubClass"
+	schemaExitX         = "exitX"
+	schemaExitY         = "exitY"
+	schemaEntryX        = "entryX"
+	schemaEntryY        = "entryY"
+	schemaVersion       = "version"
+	schemaProject       = "project"
+	schemaSource        = "source"
+	schemaSourceVersion = "sourceVersion"
+	schemaCreated       = "created"
+	schemaKey           = "key"
+	schemaDeleted       = "deleted"
+	schemaPurged        = "purged"
+	schemaLock          = "_lock"
 )
 
 type Controller struct {
-	Logger   *zap.Logger
-	Driver   neo4j.Driver
+	Logger *zap.Logger
+	Driver neo4j.Driver
+	// BatchSize is the number of rows written by a single UNWIND statement, diagram is always written in one transaction
+	BatchSize int
+	// write stores collected diagram, writeDiagram when nil
+	write    diagramWriter
 	user     string
 	password string
 	url      string
@@ -57,9 +76,96 @@ func NewController(logger *zap.Logger, url string, user string, password string)
 	return instance, nil
 }
 
-func (c *Controller) PushNodes(logger *zap.Logger, chitem <-chan drawio.Item, pr chan drawio.Item, noMoreNodes chan struct{}) {
-	driver := c.Driver
-	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+// PushItems reads items until the channel is closed and writes every diagram as a version described by opts
+// in a single transaction,
+// Nodes first, and then Relations, in batches of BatchSize rows. Relations are kept in memory until all
+// nodes are read, so their number is not limited. Relations with missing source or target
+// are reported in summary with ErrNoRelationEndpoint. A database error or cancelled ctx rolls back
+// the transaction and is returned.
+func (c *Controller) PushItems(ctx context.Context, logger *zap.Logger, opts calculator.PushOptions, items <-chan drawio.Item) (calculator.PushSummary, error) {
+	var summary calculator.PushSummary
+	var nodes, relations []drawio.Item
+
+OuterLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("diagram push cancelled before write",
+				zap.Error(ctx.Err()),
+			)
+			return summary, ctx.Err()
+		case item, ok := <-items:
+			if !ok {
+				break OuterLoop
+			}
+			node, err := IsNode(&item)
+			if err == nil {
+				err = ValidateUUID(item.UUID)
+			}
+			if err != nil {
+				logger.Error("refusing to push item",
+					zap.Error(err),
+				)
+				item.Error = err
+				summary.Failed = append(summary.Failed, item)
+				continue
+			}
+			if node {
+				nodes = append(nodes, item)
+			} else {
+				relations = append(relations, item)
+			}
+			logger.Debug("item parsed",
+				zap.String("uuid", item.UUID),
+				zap.Int("id", item.EID),
+			)
+		}
+	}
+
+	write := c.write
+	if write == nil {
+		write = c.writeDiagram
+	}
+	versions, missing, err := write(ctx, logger, opts, nodes, relations)
+	if err != nil {
+		logger.Error("diagram transaction rolled back",
+			zap.Int("nodes", len(nodes)),
+			zap.Int("relations", len(relations)),
+			zap.Error(err),
+		)
+		return summary, err
+	}
+
+	for _, item := range missing {
+		logger.Error("error while creating relation between elements",
+			zap.String("uuid", item.UUID),
+			zap.Int("source id", item.SourceId),
+			zap.Int("target id", item.TargetId),
+			zap.Error(ErrNoRelationEndpoint),
+		)
+		item.Error = ErrNoRelationEndpoint
+		summary.Failed = append(summary.Failed, item)
+	}
+	summary.Nodes = len(nodes)
+	summary.Relations = len(relations) - len(missing)
+	summary.Versions = versions
+	logger.Info("diagram pushed",
+		zap.Int("nodes", summary.Nodes),
+		zap.Int("relations", summary.Relations),
+		zap.Any("versions", summary.Versions),
+	)
+	return summary, nil
+}
+
+// LoadItems reads elements and connections of the diagram version back from the database, 0 is the latest version
+func (c *Controller) LoadItems(ctx context.Context, logger *zap.Logger, uuid string, version int) ([]drawio.Item, error) {
+	if err := ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
 	defer func() {
 		err := session.Close()
 		if err != nil {
@@ -69,60 +175,137 @@ func (c *Controller) PushNodes(logger *zap.Logger, chitem <-chan drawio.Item, pr
 		}
 	}()
 
-	for {
-		select {
-		case item, ok := <-chitem:
-			if ok {
-				cypherq := "MERGE (item:Element {" +
-					schemaUUID + ": '" + item.UUID + "', " +
-					schemaID + ": '" + fmt.Sprintf("%d", item.EID) + "', " +
-					schemaValue + ": '" + item.Value + "', " +
-					schemaClass + ": '" + item.Class + "', " +
-					schemaSubClass + ": '" + item.SubClass + "'" +
-					"}) " +
-					"RETURN COALESCE(item.uuid,\"\")+':'+COALESCE(item.id,\"\")"
-
-				tresult, err := session.WriteTransaction(
-					func(tx neo4j.Transaction) (interface{}, error) {
-						result, e := tx.Run(
-							cypherq, map[string]interface{}{},
-						)
-						if e != nil {
-							return nil, e
-						}
-						if result.Next() {
-							return result.Record().Values[0], nil
-						}
-						return nil, nil
-					},
-				)
+	result, err := session.ReadTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			var items []drawio.Item
+			params, err := versionParams(tx, uuid, version)
+			if err != nil {
+				return nil, err
+			}
+			nodes, err := tx.Run(loadNodesQuery, params)
+			if err != nil {
+				return nil, err
+			}
+			for nodes.Next() {
+				v := nodes.Record().Values
+				items = append(items, nodeItem(uuid, v[0:4]))
+			}
+			if err = nodes.Err(); err != nil {
+				return nil, err
+			}
 
-				if err != nil {
-					logger.Error("error on transaction",
-						zap.Error(err),
-					)
-					item.Error = err
-					pr <- item
-					continue
-				}
-				logger.Info("Node in DB",
-					zap.String("uuid:id", tresult.(string)),
-				)
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+			rels, err := tx.Run(loadRelationsQuery, params)
+			if err != nil {
+				return nil, err
+			}
+			for rels.Next() {
+				v := rels.Record().Values
+				items = append(items, relationItem(uuid, v[0], v[1], v[2].(dbtype.Relationship)))
+			}
+			return items, rels.Err()
+		},
+	)
+	if err != nil {
+		logger.Error("could not load diagram items",
+			zap.String("uuid", uuid),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	return result.([]drawio.Item), nil
+}
 
-				pr <- item
+// ListDiagrams returns uuids of diagrams with at least one element
+func (c *Controller) ListDiagrams(ctx context.Context, logger *zap.Logger) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer func() {
+		err := session.Close()
+		if err != nil {
+			logger.Error("Failed to close neo4j session")
+		} else {
+			logger.Debug("Closing neo4j Session")
+		}
+	}()
+
+	result, err := session.ReadTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			uuids := []string{}
+			rows, err := tx.Run(listDiagramsQuery, nil)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				uuids = append(uuids, propString(rows.Record().Values[0]))
 			}
-		case <-noMoreNodes:
-			logger.Info("parsed all nodes")
-			return
+			return uuids, rows.Err()
+		},
+	)
+	if err != nil {
+		logger.Error("could not list diagrams",
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return result.([]string), nil
+}
 
-		default:
+// ListVersions returns versions of the diagram with number of elements and relations in each one
+func (c *Controller) ListVersions(ctx context.Context, logger *zap.Logger, uuid string) ([]calculator.DiagramVersion, error) {
+	if err := ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer func() {
+		err := session.Close()
+		if err != nil {
+			logger.Error("Failed to close neo4j session")
+		} else {
+			logger.Debug("Closing neo4j Session")
 		}
+	}()
+
+	result, err := session.ReadTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			var versions []calculator.DiagramVersion
+			rows, err := tx.Run(listVersionsQuery, map[string]interface{}{"uuid": uuid})
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				versions = append(versions, versionItem(uuid, rows.Record().Values))
+			}
+			return versions, rows.Err()
+		},
+	)
+	if err != nil {
+		logger.Error("could not list diagram versions",
+			zap.String("uuid", uuid),
+			zap.Error(err),
+		)
+		return nil, err
 	}
+	return result.([]calculator.DiagramVersion), nil
 }
 
-func (c *Controller) PushRelations(logger *zap.Logger, chitem <-chan drawio.Item, pr chan drawio.Item, noMoreRels chan struct{}) {
-	driver := c.Driver
-	session := driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+// LoadElement reads a single element of the diagram version with its relations and neighbours
+func (c *Controller) LoadElement(ctx context.Context, logger *zap.Logger, uuid string, version int, id int) (*calculator.Element, error) {
+	if err := ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
 	defer func() {
 		err := session.Close()
 		if err != nil {
@@ -132,156 +315,361 @@ func (c *Controller) PushRelations(logger *zap.Logger, chitem <-chan drawio.Item
 		}
 	}()
 
-	var tbuf []byte
-	twrbuf := bytes.NewBuffer(tbuf)
-	//TODO: return (specific) error if no source or target for relation/edge
-	//https://neo4j.com/docs/cypher-manual/current/clauses/merge/#merge-merge-on-a-relationship
-	for {
-		select {
-		case item, ok := <-chitem:
-			if ok {
-				twrbuf.Reset()
-				cypherqTemplate := template.New("pushRelation")
-				cypherqTemplate, err := cypherqTemplate.Parse(`MATCH
-		(source:Element {` + schemaUUID + `: '{{.UUID}}', ` + schemaID + `: '{{.SourceId}}' }),
-		(target:Element {` + schemaUUID + `: '{{.UUID}}', ` + schemaID + `: '{{.TargetId}}' })
-		MERGE (source) - [r:connected] - (target)
-		RETURN r
-		`)
-				err = cypherqTemplate.Execute(twrbuf, item)
-				if err != nil {
-					logger.Error("failed to render cypher query template",
-						zap.Error(err),
-					)
-					continue
+	result, err := session.ReadTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			var element *calculator.Element
+			params, err := versionParams(tx, uuid, version)
+			if err != nil {
+				return nil, err
+			}
+			params["eid"] = eid(id)
+			rows, err := tx.Run(loadElementQuery, params)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				v := rows.Record().Values
+				if element == nil {
+					element = &calculator.Element{Item: nodeItem(uuid, v[0:4])}
 				}
-				tresult, err := session.WriteTransaction(
-					func(tx neo4j.Transaction) (interface{}, error) {
-						result, e := tx.Run(
-							twrbuf.String(), map[string]interface{}{},
-						)
-						if e != nil {
-							return nil, e
-						}
-						//in case relation created, dbtype.Relationship is returned.
-						//let us convert it to drawio.Item ant return
-						if result.Next() {
-							r := result.Record().Values[0]
-							return drawio.Item{
-								UUID:     item.UUID,
-								EID:      int(r.(dbtype.Relationship).Id),
-								Value:    "",
-								Class:    drawio.ItemClassLines,
-								SubClass: "",
-								SourceId: int(r.(dbtype.Relationship).StartId),
-								TargetId: int(r.(dbtype.Relationship).EndId),
-								ExitX:    0,
-								ExitY:    0,
-								EntryX:   0,
-								EntryY:   0,
-								Props:    r.(dbtype.Relationship).Props,
-							}, nil
-						}
-						logger.Error("neo4j transaction failed, empty return value for relation ",
-							zap.Ints("SourceID, TargetID", []int{item.SourceId, item.TargetId}),
-						)
-						return nil, fmt.Errorf("neo4j transaction failed, empty return value for relation")
-					},
-				)
-				if err != nil {
-					logger.Error("error while creating relation between elements",
-						zap.String("uuid", item.UUID),
-						zap.Int("source id", item.SourceId),
-						zap.Int("target id", item.TargetId),
-						zap.Error(err),
-					)
-					item.Error = err
-					pr <- item
+				r, ok := v[6].(dbtype.Relationship)
+				if !ok {
 					continue
 				}
-				logger.Info("relation pushed",
-					zap.Ints("Source id: %d, Target id: %d",
-						[]int{tresult.(drawio.Item).SourceId, tresult.(drawio.Item).TargetId}),
-				)
-				pr <- item
+				element.Relations = append(element.Relations, relationItem(uuid, v[4], v[5], r))
+				element.Neighbours = append(element.Neighbours, nodeItem(uuid, v[7:11]))
 			}
-		case <-noMoreRels:
-			return
-
-		default:
-
+			if err = rows.Err(); err != nil {
+				return nil, err
+			}
+			if element == nil {
+				return nil, calculator.ErrNotFound
+			}
+			return element, nil
+		},
+	)
+	if err != nil {
+		if err != calculator.ErrNotFound {
+			logger.Error("could not load element",
+				zap.String("uuid", uuid),
+				zap.Int("id", id),
+				zap.Error(err),
+			)
 		}
+		return nil, err
 	}
+	element := result.(*calculator.Element)
+	sort.Slice(element.Relations, func(i, j int) bool { return element.Relations[i].EID < element.Relations[j].EID })
+	sort.Slice(element.Neighbours, func(i, j int) bool { return element.Neighbours[i].EID < element.Neighbours[j].EID })
+	return element, nil
 }
 
-// PushItems reads data from channel, pushes Nodes first, and then Relations
-func (c *Controller) PushItems(logger *zap.Logger, items <-chan drawio.Item, pr chan drawio.Item, noMoreItems chan struct{}) {
-	defer close(pr)
-	relChanQueue := make(chan drawio.Item, relationQueueSize)
-	relChanQueueItems := 0
-	relChan := make(chan drawio.Item)
-	nodeChan := make(chan drawio.Item)
-	noMoreNodes := make(chan struct{})
-	noMoreRels := make(chan struct{})
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		c.PushNodes(logger, nodeChan, pr, noMoreNodes)
-		wg.Done()
+// FindElements searches elements of the latest version of every diagram
+func (c *Controller) FindElements(ctx context.Context, logger *zap.Logger, q calculator.ElementQuery) ([]calculator.ElementMatch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer func() {
+		err := session.Close()
+		if err != nil {
+			logger.Error("Failed to close neo4j session")
+		} else {
+			logger.Debug("Closing neo4j Session")
+		}
 	}()
 
-	go func() {
-		c.PushRelations(logger, relChan, pr, noMoreRels)
-		wg.Done()
+	query := findElementsQuery
+	if q.Limit > 0 {
+		query += " LIMIT $limit"
+	}
+	result, err := session.ReadTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			var matches []calculator.ElementMatch
+			rows, err := tx.Run(query, elementQueryParams(q))
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				v := rows.Record().Values
+				matches = append(matches, calculator.ElementMatch{
+					Item:    nodeItem(propString(v[0]), v[3:7]),
+					Version: propInt(v[1]),
+					Project: propString(v[2]),
+				})
+			}
+			return matches, rows.Err()
+		},
+	)
+	if err != nil {
+		logger.Error("could not find elements",
+			zap.Any("query", q),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return result.([]calculator.ElementMatch), nil
+}
+
+// FindPaths returns simple paths between two elements of the diagram version, shorter paths first
+func (c *Controller) FindPaths(ctx context.Context, logger *zap.Logger, q calculator.PathQuery) ([][]drawio.Item, error) {
+	if err := ValidateUUID(q.UUID); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer func() {
+		err := session.Close()
+		if err != nil {
+			logger.Error("Failed to close neo4j session")
+		} else {
+			logger.Debug("Closing neo4j Session")
+		}
 	}()
 
-OuterLoop:
-	for {
-		select {
-		case item, ok := <-items:
-			if ok {
-				node, err := IsNode(&item)
-				if err != nil {
-					logger.Error("error",
-						zap.Error(err),
-					)
-					continue
-				}
-				if node {
-					nodeChan <- item
-					logger.Debug("Pushing node",
-						zap.String("uuid", item.UUID),
-						zap.Int("id", item.EID),
-					)
-				} else {
-					relChanQueue <- item
-					relChanQueueItems++
-					logger.Debug("Sending relation to wait queue",
-						zap.String("uuid", item.UUID),
-						zap.Int("id", item.EID),
-					)
+	query := findPathsQuery(pathLength(q.MaxLength))
+	if q.Limit > 0 {
+		query += " LIMIT $limit"
+	}
+	result, err := session.ReadTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			params, err := versionParams(tx, q.UUID, q.Version)
+			if err != nil {
+				return nil, err
+			}
+			params["from"] = eid(q.From)
+			params["to"] = eid(q.To)
+			params["limit"] = int64(q.Limit)
+
+			r, err := tx.Run(countEndpointsQuery, params)
+			if err != nil {
+				return nil, err
+			}
+			record, err := r.Single()
+			if err != nil {
+				return nil, err
+			}
+			if found := propInt(record.Values[0]); found == 0 || found == 1 && q.From != q.To {
+				return nil, calculator.ErrNotFound
+			}
+
+			var paths [][]drawio.Item
+			rows, err := tx.Run(query, params)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				v := rows.Record().Values
+				nodes, _ := v[0].([]interface{})
+				rels, _ := v[1].([]interface{})
+				var path []drawio.Item
+				for i, n := range nodes {
+					if i > 0 {
+						rel, _ := rels[i-1].([]interface{})
+						r, _ := rel[2].(dbtype.Relationship)
+						path = append(path, relationItem(q.UUID, rel[0], rel[1], r))
+					}
+					node, _ := n.([]interface{})
+					path = append(path, nodeItem(q.UUID, node))
 				}
-				logger.Debug("item parsed",
-					zap.String("uuid", item.UUID),
-					zap.Int("id", item.EID),
-				)
+				paths = append(paths, path)
 			}
-		case <-noMoreItems:
-			noMoreNodes <- struct{}{}
-			break OuterLoop
+			return paths, rows.Err()
+		},
+	)
+	if err != nil {
+		if err != calculator.ErrNotFound {
+			logger.Error("could not find paths",
+				zap.String("uuid", q.UUID),
+				zap.Int("from", q.From),
+				zap.Int("to", q.To),
+				zap.Error(err),
+			)
+		}
+		return nil, err
+	}
+	return result.([][]drawio.Item), nil
+}
 
-		default:
+// DeleteDiagram moves the diagram version, or all its versions for 0, to trash
+func (c *Controller) DeleteDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error {
+	return c.trash(ctx, logger, deleteDiagramQuery, uuid, version)
+}
+
+// RestoreDiagram brings back the trashed version, or all trashed versions for 0
+func (c *Controller) RestoreDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error {
+	return c.trash(ctx, logger, restoreDiagramQuery, uuid, version)
+}
+
+// PurgeDiagram removes elements of the trashed version, or all trashed versions for 0, for good
+func (c *Controller) PurgeDiagram(ctx context.Context, logger *zap.Logger, uuid string, version int) error {
+	return c.trash(ctx, logger, purgeDiagramQuery, uuid, version)
+}
+
+// trash runs one of trash queries, ErrNotFound is returned when the query changed no version
+func (c *Controller) trash(ctx context.Context, logger *zap.Logger, query string, uuid string, version int) error {
+	if err := ValidateUUID(uuid); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer func() {
+		err := session.Close()
+		if err != nil {
+			logger.Error("Failed to close neo4j session")
+		} else {
+			logger.Debug("Closing neo4j Session")
+		}
+	}()
+
+	result, err := session.WriteTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			r, err := tx.Run(query, map[string]interface{}{"uuid": uuid, "version": int64(version)})
+			if err != nil {
+				return nil, err
+			}
+			record, err := r.Single()
+			if err != nil {
+				return nil, err
+			}
+			return propInt(record.Values[0]), nil
+		},
+	)
+	if err != nil {
+		logger.Error("could not change diagram trash state",
+			zap.String("uuid", uuid),
+			zap.Int("version", version),
+			zap.Error(err),
+		)
+		return err
+	}
+	if result.(int) == 0 {
+		return calculator.ErrNotFound
+	}
+	return nil
+}
+
+// ListTrash returns trashed versions of all diagrams
+func (c *Controller) ListTrash(ctx context.Context, logger *zap.Logger) ([]calculator.DiagramVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := c.Driver.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer func() {
+		err := session.Close()
+		if err != nil {
+			logger.Error("Failed to close neo4j session")
+		} else {
+			logger.Debug("Closing neo4j Session")
 		}
+	}()
+
+	result, err := session.ReadTransaction(
+		func(tx neo4j.Transaction) (interface{}, error) {
+			var versions []calculator.DiagramVersion
+			rows, err := tx.Run(listTrashQuery, nil)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				v := rows.Record().Values
+				version := versionItem(propString(v[6]), v)
+				deleted := propTime(v[7])
+				version.Deleted = &deleted
+				versions = append(versions, version)
+			}
+			return versions, rows.Err()
+		},
+	)
+	if err != nil {
+		logger.Error("could not list trash",
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return result.([]calculator.DiagramVersion), nil
+}
+
+// versionParams returns query parameters of the diagram version, 0 is resolved to the latest version.
+// Trashed or missing version is resolved to 0, which matches no elements.
+func versionParams(tx neo4j.Transaction, uuid string, version int) (map[string]interface{}, error) {
+	version, err := liveVersion(tx, uuid, version)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"uuid": uuid, "version": int64(version)}, nil
+}
+
+// nodeItem converts eid, Value, Class and SubClass columns to item
+func nodeItem(uuid string, v []interface{}) drawio.Item {
+	return drawio.Item{
+		UUID:     uuid,
+		EID:      propInt(v[0]),
+		Value:    propString(v[1]),
+		Class:    propString(v[2]),
+		SubClass: propString(v[3]),
+	}
+}
+
+// versionItem converts version, project, source, source version, created and elements columns to version
+func versionItem(uuid string, v []interface{}) calculator.DiagramVersion {
+	return calculator.DiagramVersion{
+		UUID:          uuid,
+		Version:       propInt(v[0]),
+		Project:       propString(v[1]),
+		Source:        propString(v[2]),
+		SourceVersion: propString(v[3]),
+		Created:       propTime(v[4]),
+		Elements:      propInt(v[5]),
+	}
+}
+
+func relationItem(uuid string, source interface{}, target interface{}, r dbtype.Relationship) drawio.Item {
+	return drawio.Item{
+		UUID:     uuid,
+		EID:      propInt(r.Props[schemaID]),
+		Class:    drawio.ItemClassLines,
+		SubClass: "line",
+		SourceId: propInt(source),
+		TargetId: propInt(target),
+		ExitX:    propFloat(r.Props[schemaExitX]),
+		ExitY:    propFloat(r.Props[schemaExitY]),
+		EntryX:   propFloat(r.Props[schemaEntryX]),
+		EntryY:   propFloat(r.Props[schemaEntryY]),
+		Props:    r.Props,
 	}
+}
 
-	for i := 0; i < relChanQueueItems; i++ {
-		iq := <-relChanQueue
-		relChan <- iq
+func propString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// propInt reads element id, ids are stored as strings
+func propInt(v interface{}) int {
+	switch i := v.(type) {
+	case int64:
+		return int(i)
+	case string:
+		n, _ := strconv.Atoi(i)
+		return n
 	}
-	noMoreRels <- struct{}{}
-	wg.Wait()
-	return
+	return 0
+}
+
+// propTime reads neo4j datetime, zero time is returned for anything else
+func propTime(v interface{}) time.Time {
+	t, _ := v.(time.Time)
+	return t.UTC()
+}
+
+func propFloat(v interface{}) float32 {
+	f, _ := v.(float64)
+	return float32(f)
 }
 
 func IsNode(item *drawio.Item) (bool, error) {
@@ -1,14 +1,14 @@
 package neo4j
 
 import (
+	"context"
 	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
 	"github.com/aemakeye/circuit_calculator/internal/drawio"
 	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"math/rand"
-	_ "net/http/pprof"
-	"sync"
 	"testing"
 	"time"
 )
@@ -21,7 +21,15 @@ const (
 
 var ctrlr, _ = NewController(zap.NewNop(), url, user, password)
 
+// requireNeo4j skips tests which need a live bolt server, memgraph covers the same semantics without it
+func requireNeo4j(tb testing.TB) {
+	if ctrlr == nil || ctrlr.Driver == nil || ctrlr.Driver.VerifyConnectivity() != nil {
+		tb.Skipf("neo4j is not available on %s", url)
+	}
+}
+
 func TestNeo4jBasic(t *testing.T) {
+	requireNeo4j(t)
 
 	tests := []struct {
 		name    string
@@ -78,144 +86,19 @@ func TestNeo4jBasic(t *testing.T) {
 
 }
 
-func TestNeo4jController_PushNode(t *testing.T) {
-
-	var input []drawio.Item
-	for i := 1; i < 9; i++ {
-		input = append(input, drawio.Item{
-			UUID:     "eopifrnv-dlfkvn-dklfv",
-			EID:      i,
-			Class:    "resistors",
-			SubClass: "resistor_1",
-		})
-	}
-
-	logger := zap.NewNop()
-	ichan := make(chan drawio.Item)
-	rchan := make(chan drawio.Item)
-
-	t.Run("push node, expected 8", func(t *testing.T) {
-		pushedNodesCount := 0
-		noMoreNodes := make(chan struct{})
-		var wg sync.WaitGroup
-		wg.Add(1)
-
-		go func() {
-			ctrlr.PushNodes(logger, ichan, rchan, noMoreNodes)
-			wg.Done()
-		}()
-
-		for _, v := range input {
-			ichan <- v
-			r, ok := <-rchan
-			if ok {
-				pushedNodesCount++
-			}
-			t.Logf("result id %d", r.EID)
-
-			//time.Sleep(1 * time.Second)
-		}
-		noMoreNodes <- struct{}{}
-
-		wg.Wait()
-		assert.Equal(t, len(input), pushedNodesCount)
-	})
-}
-
-func TestController_PushRelation(t *testing.T) {
-	logger := zap.NewNop()
-	var nodeInput, rinput []drawio.Item
-	for i := 1; i < 9; i++ {
-		nodeInput = append(nodeInput, drawio.Item{
-			UUID:     "eopifrnv-dlfkvn-dklfv",
-			EID:      i,
-			Class:    drawio.ItemClassResistors,
-			SubClass: "resistor_1",
-		})
-	}
-
-	for i := 0; i < 8; i++ {
-		rinput = append(rinput, drawio.Item{
-			UUID:     "eopifrnv-dlfkvn-dklfv",
-			EID:      0,
-			Value:    "",
-			Class:    drawio.ItemClassLines,
-			SubClass: "",
-			SourceId: i,
-			TargetId: i + 1,
-			ExitX:    0,
-			ExitY:    0,
-			EntryX:   0,
-			EntryY:   0,
-		})
-	}
-
-	ichan := make(chan drawio.Item)
-	relchan := make(chan drawio.Item)
-	reschan := make(chan drawio.Item)
-	reschan2 := make(chan drawio.Item)
-
-	tests := []struct {
-		Name          string
-		ExpectedError error
-		Relations     []drawio.Item
-		Reschan       chan drawio.Item
-	}{
-		{
-			"missing node for relation",
-			fmt.Errorf("neo4j transaction failed, empty return value for relation"),
-			[]drawio.Item{rinput[0]},
-			reschan,
-		},
-		{
-			"all good",
-			nil,
-			rinput[1:],
-			reschan2,
-		},
-	}
-
-	go ctrlr.PushNodes(logger, ichan, reschan, nil)
-
-	for _, item := range nodeInput {
-		t.Logf("pushing node id: %d", item.EID)
+// pushItems sends items to PushItems through a closed channel
+func pushItems(ctx context.Context, opts calculator.PushOptions, items []drawio.Item) (calculator.PushSummary, error) {
+	ichan := make(chan drawio.Item, len(items))
+	for _, item := range items {
 		ichan <- item
-		res := <-reschan
-		assert.NoError(t, res.Error)
-	}
-
-	for _, test := range tests {
-		t.Run(test.Name, func(t *testing.T) {
-			noMoreRels := make(chan struct{})
-			var wg sync.WaitGroup
-			wg.Add(1)
-
-			go func() {
-				ctrlr.PushRelations(logger, relchan, reschan, noMoreRels)
-				wg.Done()
-			}()
-
-			for _, item := range test.Relations {
-				t.Logf("pushing relation with source %d and dest %d", item.SourceId, item.TargetId)
-				relchan <- item
-				res := <-reschan
-				if test.ExpectedError != nil {
-					t.Logf("entered error branch")
-					assert.EqualError(t, res.Error, test.ExpectedError.Error())
-				} else {
-					assert.NoError(t, res.Error)
-				}
-			}
-			noMoreRels <- struct{}{}
-			wg.Wait()
-
-		})
 	}
+	close(ichan)
+	return ctrlr.PushItems(ctx, zap.NewNop(), opts, ichan)
 }
 
 func TestController_PushItems(t *testing.T) {
+	requireNeo4j(t)
 
-	logger := zap.NewNop()
 	var input []drawio.Item
 	for i := 1; i < 100; i++ {
 		input = append(input, drawio.Item{
@@ -229,7 +112,7 @@ func TestController_PushItems(t *testing.T) {
 	for i := 70; i < 90; i++ {
 		input = append(input, drawio.Item{
 			UUID:     "test-push-items",
-			EID:      0,
+			EID:      100 + i,
 			Value:    "",
 			Class:    drawio.ItemClassLines,
 			SubClass: "",
@@ -242,9 +125,6 @@ func TestController_PushItems(t *testing.T) {
 		})
 	}
 
-	ichan := make(chan drawio.Item)
-	reschan := make(chan drawio.Item, 100)
-
 	rand.Seed(time.Now().UnixNano())
 	perm := rand.Perm(len(input))
 	permInput := make([]drawio.Item, len(input))
@@ -252,109 +132,311 @@ func TestController_PushItems(t *testing.T) {
 		permInput[v] = input[i]
 	}
 
-	tests := []struct {
-		Name          string
-		ExpectedError error
-		items         []drawio.Item
-		Reschan       chan drawio.Item
-	}{
-		{
-			"all good",
-			nil,
-			permInput,
-			reschan,
-		},
+	t.Run("all good", func(t *testing.T) {
+		summary, err := pushItems(context.Background(), calculator.PushOptions{}, permInput)
+		assert.NoError(t, err)
+		assert.Empty(t, summary.Failed)
+		assert.Equal(t, 99, summary.Nodes)
+		assert.Equal(t, 20, summary.Relations)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := pushItems(ctx, calculator.PushOptions{}, permInput)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestController_LoadItems(t *testing.T) {
+	requireNeo4j(t)
+	logger := zap.NewNop()
+	input := []drawio.Item{
+		{UUID: "test-load-items", EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R1"},
+		{UUID: "test-load-items", EID: 2, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "C1"},
+		{UUID: "test-load-items", EID: 3, Class: drawio.ItemClassLines, SubClass: "line",
+			SourceId: 1, TargetId: 2, ExitX: 1, ExitY: 0.5, EntryX: 0, EntryY: 0.5},
 	}
 
-	for _, test := range tests {
-		t.Run(test.Name, func(t *testing.T) {
-			var wg sync.WaitGroup
-			noMoreItems := make(chan struct{})
-			wg.Add(1)
-
-			go func() {
-				ctrlr.PushItems(logger, ichan, reschan, noMoreItems)
-				wg.Done()
-			}()
+	summary, err := pushItems(context.Background(), calculator.PushOptions{}, input)
+	assert.NoError(t, err)
+	assert.Empty(t, summary.Failed)
+
+	items, err := ctrlr.LoadItems(context.Background(), logger, "test-load-items", 0)
+	assert.NoError(t, err)
+	assert.Len(t, items, len(input))
+	for _, item := range items {
+		if item.Class == drawio.ItemClassLines {
+			assert.Equal(t, 3, item.EID)
+			assert.ElementsMatch(t, []int{1, 2}, []int{item.SourceId, item.TargetId})
+		}
+	}
+
+	t.Run("list diagrams", func(t *testing.T) {
+		uuids, err := ctrlr.ListDiagrams(context.Background(), logger)
+		assert.NoError(t, err)
+		assert.Contains(t, uuids, "test-load-items")
+	})
 
-			for _, item := range test.items {
-				ichan <- item
-				t.Logf("pushing item of type %s", item.Class)
+	t.Run("element with neighbours", func(t *testing.T) {
+		element, err := ctrlr.LoadElement(context.Background(), logger, "test-load-items", 0, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, "C1", element.Item.Value)
+		assert.Equal(t, 3, element.Relations[0].EID)
+		assert.Equal(t, "R1", element.Neighbours[0].Value)
 
-			}
+		_, err = ctrlr.LoadElement(context.Background(), logger, "test-load-items", 0, 42)
+		assert.ErrorIs(t, err, calculator.ErrNotFound)
+	})
+}
 
-			noMoreItems <- struct{}{}
-			for res := range reschan {
-				if test.ExpectedError != nil {
-					t.Logf("entered error branch")
-					assert.EqualError(t, res.Error, test.ExpectedError.Error())
-				} else {
-					assert.NoError(t, res.Error)
-				}
+func TestController_PushItems_ParallelWires(t *testing.T) {
+	requireNeo4j(t)
+	uuid := fmt.Sprintf("test-parallel-%d", time.Now().UnixNano())
+	input := []drawio.Item{
+		{UUID: uuid, EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R1"},
+		{UUID: uuid, EID: 2, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R2"},
+		{UUID: uuid, EID: 3, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 2, ExitX: 0, EntryX: 0},
+		{UUID: uuid, EID: 4, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 2, ExitX: 1, EntryX: 1},
+	}
+	summary, err := pushItems(context.Background(), calculator.PushOptions{}, input)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Relations)
+
+	items, err := ctrlr.LoadItems(context.Background(), zap.NewNop(), uuid, 0)
+	assert.NoError(t, err)
+	var wires []int
+	for _, item := range items {
+		if item.Class == drawio.ItemClassLines {
+			wires = append(wires, item.EID)
+		}
+	}
+	assert.ElementsMatch(t, []int{3, 4}, wires)
+}
 
-			}
+func TestController_PushItems_HostileLabels(t *testing.T) {
+	requireNeo4j(t)
+	logger := zap.NewNop()
+	var input []drawio.Item
+	for i, label := range hostileLabels {
+		input = append(input, drawio.Item{
+			UUID:     "test-hostile-labels",
+			EID:      i + 1,
+			Value:    label,
+			Class:    drawio.ItemClassResistors,
+			SubClass: "resistor_1",
 		})
 	}
+	input = append(input, drawio.Item{UUID: "a'}) DETACH DELETE n //", EID: 1, Class: drawio.ItemClassResistors})
+
+	summary, err := pushItems(context.Background(), calculator.PushOptions{}, input)
+	assert.NoError(t, err)
+	assert.Len(t, summary.Failed, 1)
+	assert.Error(t, summary.Failed[0].Error)
+	assert.Equal(t, len(hostileLabels), summary.Nodes)
+
+	items, err := ctrlr.LoadItems(context.Background(), logger, "test-hostile-labels", 0)
+	assert.NoError(t, err)
+	var labels []string
+	for _, item := range items {
+		labels = append(labels, item.Value)
+	}
+	assert.ElementsMatch(t, hostileLabels, labels)
+}
 
+// benchmarkItems is a ladder of resistors, every element is wired to the next one
+func benchmarkItems(uuid string, n int) []drawio.Item {
+	var items []drawio.Item
+	for i := 1; i <= n; i++ {
+		items = append(items, drawio.Item{UUID: uuid, EID: i, Class: drawio.ItemClassResistors, SubClass: "resistor_1"})
+	}
+	for i := 1; i < n; i++ {
+		items = append(items, drawio.Item{UUID: uuid, EID: n + i, Class: drawio.ItemClassLines, SubClass: "line",
+			SourceId: i, TargetId: i + 1, ExitX: 1, ExitY: 0.5, EntryX: 0, EntryY: 0.5})
+	}
+	return items
 }
 
-func Test_channels(t *testing.T) {
-
-	queue := make(chan int, 10)
-	done := make(chan struct{}, 1)
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func(d chan struct{}) {
-		defer wg.Done()
-	OuterLoop:
-		for {
-			select {
-			case val, ok := <-queue:
-				if ok {
-					t.Logf("val %d", val)
-
-				} else {
-					t.Logf("channel is closed")
-				}
-			case _, dok := <-d:
-				if dok {
-					break OuterLoop
-				}
-			default:
-
-			}
+// BenchmarkPushBatched writes the same diagram with UNWIND batches in a single transaction
+func BenchmarkPushBatched(b *testing.B) {
+	requireNeo4j(b)
+	items := benchmarkItems("bench-batched", 1000)
+	for n := 0; n < b.N; n++ {
+		summary, err := pushItems(context.Background(), calculator.PushOptions{}, items)
+		if err != nil {
+			b.Fatal(err)
 		}
-		t.Logf("bye goroutine")
-		return
-	}(done)
+		if len(summary.Failed) > 0 {
+			b.Fatal(summary.Failed[0].Error)
+		}
+	}
+}
 
-	for i := 0; i < 10; i++ {
+func TestController_PushItems_MissingEndpoint(t *testing.T) {
+	requireNeo4j(t)
+	input := []drawio.Item{
+		{UUID: "test-missing-endpoint", EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1"},
+		{UUID: "test-missing-endpoint", EID: 2, Class: drawio.ItemClassResistors, SubClass: "resistor_1"},
+		{UUID: "test-missing-endpoint", EID: 3, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 2},
+		{UUID: "test-missing-endpoint", EID: 4, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 42},
+	}
+	summary, err := pushItems(context.Background(), calculator.PushOptions{}, input)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, summary.Relations)
+	assert.Len(t, summary.Failed, 1)
+	assert.Equal(t, 4, summary.Failed[0].EID)
+	assert.ErrorIs(t, summary.Failed[0].Error, ErrNoRelationEndpoint)
+}
 
-		if i == 4 {
-			done <- struct{}{}
-			//close(queue)
-			break
-		}
+func TestController_PushItems_Versions(t *testing.T) {
+	requireNeo4j(t)
+	logger := zap.NewNop()
+	uuid := fmt.Sprintf("test-versions-%d", time.Now().UnixNano())
+	input := []drawio.Item{
+		{UUID: uuid, EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R1"},
+		{UUID: uuid, EID: 2, Class: drawio.ItemClassResistors, SubClass: "resistor_1"},
+		{UUID: uuid, EID: 3, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 2},
+	}
+	summary, err := pushItems(context.Background(), calculator.PushOptions{Project: "test", Source: "test/v.xml"}, input)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{uuid: 1}, summary.Versions)
 
-		t.Logf("pushing item")
-		queue <- i
-		//time.Sleep(1 * time.Nanosecond)
+	edited := []drawio.Item{
+		{UUID: uuid, EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R2"},
 	}
+	summary, err = pushItems(context.Background(), calculator.PushOptions{}, edited)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{uuid: 2}, summary.Versions)
+
+	items, err := ctrlr.LoadItems(context.Background(), logger, uuid, 1)
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	items, err = ctrlr.LoadItems(context.Background(), logger, uuid, 0)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "R2", items[0].Value)
+
+	t.Run("replace removes stale elements", func(t *testing.T) {
+		summary, err := pushItems(context.Background(), calculator.PushOptions{Replace: true}, input[:2])
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{uuid: 2}, summary.Versions)
+
+		items, err := ctrlr.LoadItems(context.Background(), logger, uuid, 2)
+		assert.NoError(t, err)
+		assert.Len(t, items, 2)
+	})
 
-	wg.Wait()
-	//close(queue)
+	t.Run("replace keeps parallel wires", func(t *testing.T) {
+		parallel := append(append([]drawio.Item{}, input...),
+			drawio.Item{UUID: uuid, EID: 4, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 2, ExitX: 1, EntryX: 1})
+		summary, err := pushItems(context.Background(), calculator.PushOptions{Replace: true}, parallel)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, summary.Relations)
+
+		items, err := ctrlr.LoadItems(context.Background(), logger, uuid, 2)
+		assert.NoError(t, err)
+		assert.Len(t, items, 4)
+
+		// restore the version listed below
+		_, err = pushItems(context.Background(), calculator.PushOptions{Replace: true}, input[:2])
+		assert.NoError(t, err)
+	})
+
+	t.Run("list versions", func(t *testing.T) {
+		versions, err := ctrlr.ListVersions(context.Background(), logger, uuid)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 2)
+		assert.Equal(t, "test/v.xml", versions[0].Source)
+		assert.Equal(t, 3, versions[0].Elements)
+		assert.Equal(t, 2, versions[1].Elements)
+		assert.False(t, versions[0].Created.IsZero())
+	})
 }
 
-func TestBuffhan(t *testing.T) {
-	bch := make(chan int, 100)
-	for i := 1; i < 10; i++ {
-		bch <- i
+func TestController_FindElements(t *testing.T) {
+	requireNeo4j(t)
+	logger := zap.NewNop()
+	uuid := fmt.Sprintf("test-find-%d", time.Now().UnixNano())
+	input := []drawio.Item{
+		{UUID: uuid, EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R1 10k"},
+		{UUID: uuid, EID: 2, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "4.7uF"},
+		{UUID: uuid, EID: 3, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "100nF"},
+		{UUID: uuid, EID: 4, Class: drawio.ItemClassLines, SourceId: 1, TargetId: 2},
+		{UUID: uuid, EID: 5, Class: drawio.ItemClassLines, SourceId: 2, TargetId: 3},
+		{UUID: uuid, EID: 6, Class: drawio.ItemClassLines, SourceId: 3, TargetId: 1},
 	}
+	_, err := pushItems(context.Background(), calculator.PushOptions{Project: uuid}, input)
+	assert.NoError(t, err)
+
+	matches, err := ctrlr.FindElements(context.Background(), logger, calculator.ElementQuery{Project: uuid, Class: drawio.ItemClassCapacitors})
+	assert.NoError(t, err)
+	assert.Len(t, matches, 2)
+	assert.Equal(t, 2, matches[0].Item.EID)
+	assert.Equal(t, 1, matches[0].Version)
+
+	matches, err = ctrlr.FindElements(context.Background(), logger, calculator.ElementQuery{Project: uuid, Label: "r1", Limit: 1})
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+	assert.Equal(t, "R1 10k", matches[0].Item.Value)
+
+	t.Run("paths", func(t *testing.T) {
+		paths, err := ctrlr.FindPaths(context.Background(), logger, calculator.PathQuery{UUID: uuid, From: 1, To: 3, MaxLength: 4})
+		assert.NoError(t, err)
+		assert.Len(t, paths, 2)
+		assert.Len(t, paths[0], 3)
+		assert.Equal(t, 6, paths[0][1].EID)
+		assert.Len(t, paths[1], 5)
+
+		_, err = ctrlr.FindPaths(context.Background(), logger, calculator.PathQuery{UUID: uuid, From: 1, To: 42, MaxLength: 4})
+		assert.ErrorIs(t, err, calculator.ErrNotFound)
+	})
+}
 
-	t.Run("read not full buff", func(t *testing.T) {
-		for b := range bch {
-			t.Logf("got v=%d", b)
+func TestController_Trash(t *testing.T) {
+	requireNeo4j(t)
+	logger := zap.NewNop()
+	uuid := fmt.Sprintf("test-trash-%d", time.Now().UnixNano())
+	for _, value := range []string{"R1", "R2"} {
+		_, err := pushItems(context.Background(), calculator.PushOptions{}, []drawio.Item{
+			{UUID: uuid, EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: value},
+		})
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, ctrlr.DeleteDiagram(context.Background(), logger, uuid, 2))
+	assert.ErrorIs(t, ctrlr.DeleteDiagram(context.Background(), logger, uuid, 2), calculator.ErrNotFound)
+	items, err := ctrlr.LoadItems(context.Background(), logger, uuid, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "R1", items[0].Value)
+	items, err = ctrlr.LoadItems(context.Background(), logger, uuid, 2)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+
+	trash, err := ctrlr.ListTrash(context.Background(), logger)
+	assert.NoError(t, err)
+	var found bool
+	for _, v := range trash {
+		if v.UUID == uuid {
+			found = true
+			assert.Equal(t, 2, v.Version)
+			assert.NotNil(t, v.Deleted)
 		}
+	}
+	assert.True(t, found)
+
+	assert.NoError(t, ctrlr.RestoreDiagram(context.Background(), logger, uuid, 0))
+	assert.NoError(t, ctrlr.DeleteDiagram(context.Background(), logger, uuid, 0))
+	uuids, err := ctrlr.ListDiagrams(context.Background(), logger)
+	assert.NoError(t, err)
+	assert.NotContains(t, uuids, uuid)
+
+	assert.NoError(t, ctrlr.PurgeDiagram(context.Background(), logger, uuid, 0))
+	assert.ErrorIs(t, ctrlr.RestoreDiagram(context.Background(), logger, uuid, 0), calculator.ErrNotFound)
+
+	// numbers of purged versions are not reused
+	summary, err := pushItems(context.Background(), calculator.PushOptions{Replace: true}, []drawio.Item{
+		{UUID: uuid, EID: 1, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "R3"},
 	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{uuid: 3}, summary.Versions)
 }
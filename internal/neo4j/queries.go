@@ -0,0 +1,181 @@
+package neo4j
+
+import (
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"strconv"
+)
+
+// All graph queries are static text, every value coming from a diagram is passed as a query parameter.
+
+// Every upload is a Diagram node with its version number, elements of the version are linked to it with contains
+// and keep the version number too, so versions of the same diagram are stored side by side.
+// Diagrams and elements are merged by their key, which is unique by a constraint, see Migrations.
+// Trashed versions have deleted time set on the Diagram node, purged ones keep the node without elements,
+// so version numbers are not reused.
+
+// liveVersionQuery returns the version when it is not trashed, or the latest version not in trash for 0,
+// null when there is none
+const liveVersionQuery = "MATCH (d:Diagram {" + schemaUUID + ": $uuid}) " +
+	"WHERE d." + schemaDeleted + " IS NULL AND ($version = 0 OR d." + schemaVersion + " = $version) " +
+	"RETURN max(d." + schemaVersion + ")"
+
+// lastVersionQuery locks the diagram and returns its largest version number, trashed ones included, and whether
+// it is live. The lock is a DiagramLock node unique by uuid, a new diagram has no Diagram node to lock yet.
+// The write lock taken by SET is held until the transaction ends, so concurrent pushes of the diagram read
+// the last version one after another.
+const lastVersionQuery = "MERGE (l:DiagramLock {" + schemaUUID + ": $uuid}) SET l." + schemaLock + " = true " +
+	"WITH l OPTIONAL MATCH (d:Diagram {" + schemaUUID + ": $uuid}) " +
+	"WITH d ORDER BY d." + schemaVersion + " DESC LIMIT 1 " +
+	"RETURN d." + schemaVersion + ", d IS NOT NULL AND d." + schemaDeleted + " IS NULL"
+
+const mergeDiagramQuery = "MERGE (d:Diagram {" + schemaKey + ": $key}) " +
+	"ON CREATE SET d." + schemaUUID + " = $uuid, d." + schemaVersion + " = $version, d." + schemaCreated + " = datetime() " +
+	"SET d." + schemaProject + " = $project, d." + schemaSource + " = $source, d." + schemaSourceVersion + " = $sourceVersion"
+
+// deleteStaleNodesQuery removes elements of the version which are not in the pushed document
+const deleteStaleNodesQuery = "MATCH (d:Diagram {" + schemaUUID + ": $uuid, " + schemaVersion + ": $version})-[:contains]->(e:Element) " +
+	"WHERE NOT e." + schemaID + " IN $eids DETACH DELETE e"
+
+// deleteRelationsQuery removes all relations of the version, they are created again from the pushed document
+const deleteRelationsQuery = "MATCH (s:Element {" + schemaUUID + ": $uuid, " + schemaVersion + ": $version})-[r:connected]->() DELETE r"
+
+const loadNodesQuery = "MATCH (e:Element {" + schemaUUID + ": $uuid, " + schemaVersion + ": $version}) " +
+	"RETURN e." + schemaID + ", e." + schemaValue + ", e." + schemaClass + ", e." + schemaSubClass
+
+const loadRelationsQuery = "MATCH (s:Element {" + schemaUUID + ": $uuid, " + schemaVersion + ": $version})-[r:connected]->" +
+	"(t:Element {" + schemaUUID + ": $uuid, " + schemaVersion + ": $version}) " +
+	"RETURN s." + schemaID + ", t." + schemaID + ", r"
+
+const listDiagramsQuery = "MATCH (d:Diagram) WHERE d." + schemaDeleted + " IS NULL RETURN DISTINCT d." + schemaUUID + " AS uuid ORDER BY uuid"
+
+// listVersionsQuery counts elements and relations of every version not in trash
+const listVersionsQuery = "MATCH (d:Diagram {" + schemaUUID + ": $uuid}) WHERE d." + schemaDeleted + " IS NULL " +
+	"OPTIONAL MATCH (d)-[:contains]->(e:Element) " +
+	"OPTIONAL MATCH (e)-[r:connected]->() " +
+	"RETURN d." + schemaVersion + ", d." + schemaProject + ", d." + schemaSource + ", d." + schemaSourceVersion + ", d." + schemaCreated + ", " +
+	"count(DISTINCT e) + count(DISTINCT r) " +
+	"ORDER BY d." + schemaVersion
+
+// listTrashQuery is listVersionsQuery for trashed versions of all diagrams
+const listTrashQuery = "MATCH (d:Diagram) WHERE d." + schemaDeleted + " IS NOT NULL AND d." + schemaPurged + " IS NULL " +
+	"OPTIONAL MATCH (d)-[:contains]->(e:Element) " +
+	"OPTIONAL MATCH (e)-[r:connected]->() " +
+	"RETURN d." + schemaVersion + ", d." + schemaProject + ", d." + schemaSource + ", d." + schemaSourceVersion + ", d." + schemaCreated + ", " +
+	"count(DISTINCT e) + count(DISTINCT r), d." + schemaUUID + ", d." + schemaDeleted + " " +
+	"ORDER BY d." + schemaUUID + ", d." + schemaVersion
+
+// deleteDiagramQuery moves the version, or all versions for 0, to trash and returns the number of moved versions
+const deleteDiagramQuery = "MATCH (d:Diagram {" + schemaUUID + ": $uuid}) " +
+	"WHERE d." + schemaDeleted + " IS NULL AND ($version = 0 OR d." + schemaVersion + " = $version) " +
+	"SET d." + schemaDeleted + " = datetime() RETURN count(d)"
+
+// restoreDiagramQuery brings back the trashed version, or all trashed versions for 0
+const restoreDiagramQuery = "MATCH (d:Diagram {" + schemaUUID + ": $uuid}) " +
+	"WHERE d." + schemaDeleted + " IS NOT NULL AND d." + schemaPurged + " IS NULL " +
+	"AND ($version = 0 OR d." + schemaVersion + " = $version) " +
+	"REMOVE d." + schemaDeleted + " RETURN count(d)"
+
+// purgeDiagramQuery removes elements of the trashed version, or all trashed versions for 0,
+// the Diagram node is kept to hold the version number
+const purgeDiagramQuery = "MATCH (d:Diagram {" + schemaUUID + ": $uuid}) " +
+	"WHERE d." + schemaDeleted + " IS NOT NULL AND d." + schemaPurged + " IS NULL " +
+	"AND ($version = 0 OR d." + schemaVersion + " = $version) " +
+	"OPTIONAL MATCH (d)-[:contains]->(e:Element) DETACH DELETE e " +
+	"WITH DISTINCT d SET d." + schemaPurged + " = true RETURN count(d)"
+
+// loadElementQuery returns a row per relation of the element, relation and neighbour are null for a lonely element
+const loadElementQuery = "MATCH (e:Element {" + schemaUUID + ": $uuid, " + schemaVersion + ": $version, " + schemaID + ": $eid}) " +
+	"OPTIONAL MATCH (e)-[r:connected]-(n:Element) " +
+	"RETURN e." + schemaID + ", e." + schemaValue + ", e." + schemaClass + ", e." + schemaSubClass + ", " +
+	"startNode(r)." + schemaID + ", endNode(r)." + schemaID + ", r, " +
+	"n." + schemaID + ", n." + schemaValue + ", n." + schemaClass + ", n." + schemaSubClass
+
+// findElementsQuery searches elements of the latest version of every diagram, empty parameters match anything
+const findElementsQuery = "MATCH (v:Diagram) WHERE v." + schemaDeleted + " IS NULL WITH v." + schemaUUID + " AS uuid, max(v." + schemaVersion + ") AS version " +
+	"MATCH (d:Diagram {" + schemaUUID + ": uuid, " + schemaVersion + ": version})-[:contains]->(e:Element) " +
+	"WHERE ($project = '' OR d." + schemaProject + " = $project) " +
+	"AND ($class = '' OR e." + schemaClass + " = $class) " +
+	"AND ($subclass = '' OR e." + schemaSubClass + " = $subclass) " +
+	"AND toLower(coalesce(e." + schemaValue + ", '')) CONTAINS toLower($label) " +
+	"RETURN d." + schemaUUID + ", d." + schemaVersion + ", d." + schemaProject + ", " +
+	"e." + schemaID + ", e." + schemaValue + ", e." + schemaClass + ", e." + schemaSubClass + " " +
+	"ORDER BY d." + schemaUUID + ", toInteger(e." + schemaID + ")"
+
+// countEndpointsQuery tells whether both ends of a path are in the diagram version
+const countEndpointsQuery = "MATCH (e:Element {" + schemaUUID + ": $uuid, " + schemaVersion + ": $version}) " +
+	"WHERE e." + schemaID + " IN [$from, $to] RETURN count(e)"
+
+// findPathsQuery returns simple paths as lists of elements and relations. Length of a variable length
+// relation can not be a query parameter, so it is put into the text, it is an integer up to calculator.MaxPathLength.
+func findPathsQuery(maxLength int) string {
+	return "MATCH " +
+		"(a:Element {" + schemaUUID + ": $uuid, " + schemaVersion + ": $version, " + schemaID + ": $from}), " +
+		"(b:Element {" + schemaUUID + ": $uuid, " + schemaVersion + ": $version, " + schemaID + ": $to}) " +
+		"MATCH p = (a)-[:connected*1.." + strconv.Itoa(maxLength) + "]-(b) " +
+		"WHERE all(n IN nodes(p) WHERE single(m IN nodes(p) WHERE m = n)) " +
+		"RETURN [n IN nodes(p) | [n." + schemaID + ", n." + schemaValue + ", n." + schemaClass + ", n." + schemaSubClass + "]], " +
+		"[r IN relationships(p) | [startNode(r)." + schemaID + ", endNode(r)." + schemaID + ", r]] " +
+		"ORDER BY length(p)"
+}
+
+// ValidateUUID checks diagram id before it gets to the database
+var ValidateUUID = calculator.ValidateUUID
+
+// element ids are stored as strings
+func eid(id int) string {
+	return strconv.Itoa(id)
+}
+
+func diagramKey(uuid string, version int) string {
+	return uuid + ":" + strconv.Itoa(version)
+}
+
+func elementKey(uuid string, version int, id int) string {
+	return diagramKey(uuid, version) + ":" + eid(id)
+}
+
+func nodeParams(item drawio.Item, version int) map[string]interface{} {
+	return map[string]interface{}{
+		"uuid":     item.UUID,
+		"version":  int64(version),
+		"diagram":  diagramKey(item.UUID, version),
+		"key":      elementKey(item.UUID, version, item.EID),
+		"eid":      eid(item.EID),
+		"value":    item.Value,
+		"class":    item.Class,
+		"subclass": item.SubClass,
+	}
+}
+
+func relationParams(item drawio.Item, version int) map[string]interface{} {
+	return map[string]interface{}{
+		"uuid":    item.UUID,
+		"version": int64(version),
+		"eid":     eid(item.EID),
+		"source":  eid(item.SourceId),
+		"target":  eid(item.TargetId),
+		"exitX":   float64(item.ExitX),
+		"exitY":   float64(item.ExitY),
+		"entryX":  float64(item.EntryX),
+		"entryY":  float64(item.EntryY),
+	}
+}
+
+func elementQueryParams(q calculator.ElementQuery) map[string]interface{} {
+	return map[string]interface{}{
+		"project":  q.Project,
+		"class":    q.Class,
+		"subclass": q.SubClass,
+		"label":    q.Label,
+		"limit":    int64(q.Limit),
+	}
+}
+
+// pathLength bounds path length to calculator.MaxPathLength, anything below 1 is taken as the maximum
+func pathLength(maxLength int) int {
+	if maxLength < 1 || maxLength > calculator.MaxPathLength {
+		return calculator.MaxPathLength
+	}
+	return maxLength
+}
@@ -0,0 +1,145 @@
+package neo4j
+
+import (
+	"github.com/aemakeye/circuit_calculator/internal/calculator"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+var hostileLabels = []string{
+	`R1 "10k"`,
+	`it's`,
+	`back\slash\`,
+	`'}) DETACH DELETE item //`,
+	`"}) MATCH (n) DETACH DELETE n RETURN 1 //`,
+	"{{.UUID}}",
+	"line\nbreak",
+}
+
+func TestQueries_HostileLabels(t *testing.T) {
+	for _, label := range hostileLabels {
+		t.Run(label, func(t *testing.T) {
+			item := drawio.Item{
+				UUID:     "uweCVhkyVy6MirBnUyNJ",
+				EID:      3,
+				Value:    label,
+				Class:    label,
+				SubClass: label,
+			}
+			params := nodeParams(item, 2)
+			assert.Equal(t, label, params["value"])
+			assert.Equal(t, label, params["class"])
+			assert.Equal(t, label, params["subclass"])
+			assert.Equal(t, "3", params["eid"])
+			assert.Equal(t, int64(2), params["version"])
+
+			for _, q := range []string{mergeNodesQuery, mergeRelationsQuery, loadNodesQuery, loadRelationsQuery} {
+				assert.NotContains(t, q, label)
+				assert.NotContains(t, q, "'"+"}")
+			}
+		})
+	}
+
+	t.Run("relation params", func(t *testing.T) {
+		params := relationParams(drawio.Item{
+			UUID: "uweCVhkyVy6MirBnUyNJ", EID: 7, SourceId: 3, TargetId: 6,
+			ExitX: 0.5, ExitY: 1, EntryX: 0, EntryY: 0.25,
+		}, 1)
+		assert.Equal(t, map[string]interface{}{
+			"uuid":    "uweCVhkyVy6MirBnUyNJ",
+			"version": int64(1),
+			"eid":     "7",
+			"source":  "3",
+			"target":  "6",
+			"exitX":   0.5,
+			"exitY":   1.0,
+			"entryX":  0.0,
+			"entryY":  0.25,
+		}, params)
+	})
+
+	t.Run("queries reference only declared parameters", func(t *testing.T) {
+		for q, params := range map[string]map[string]interface{}{
+			mergeDiagramQuery:                   diagramParams("", 1, calculator.PushOptions{}, nil),
+			deleteStaleNodesQuery:               diagramParams("", 1, calculator.PushOptions{}, nil),
+			deleteRelationsQuery:                diagramParams("", 1, calculator.PushOptions{}, nil),
+			loadNodesQuery:                      {"uuid": "", "version": int64(1)},
+			loadRelationsQuery:                  {"uuid": "", "version": int64(1)},
+			listVersionsQuery:                   {"uuid": ""},
+			liveVersionQuery:                    {"uuid": "", "version": int64(1)},
+			lastVersionQuery:                    {"uuid": ""},
+			listTrashQuery:                      {},
+			deleteDiagramQuery:                  {"uuid": "", "version": int64(1)},
+			restoreDiagramQuery:                 {"uuid": "", "version": int64(1)},
+			purgeDiagramQuery:                   {"uuid": "", "version": int64(1)},
+			loadElementQuery:                    {"uuid": "", "version": int64(1), "eid": ""},
+			findElementsQuery + " LIMIT $limit": elementQueryParams(calculator.ElementQuery{}),
+			countEndpointsQuery:                 {"uuid": "", "version": int64(1), "from": "", "to": ""},
+			findPathsQuery(3) + " LIMIT $limit": {"uuid": "", "version": int64(1), "from": "", "to": "", "limit": int64(1)},
+		} {
+			for _, field := range strings.Fields(strings.NewReplacer(",", " ", "}", " ", ")", " ", "[", " ", "]", " ").Replace(q)) {
+				if strings.HasPrefix(field, "$") {
+					assert.Contains(t, params, strings.TrimPrefix(field, "$"))
+				}
+			}
+		}
+	})
+}
+
+func TestQueries_PathLength(t *testing.T) {
+	assert.Contains(t, findPathsQuery(pathLength(4)), "[:connected*1..4]")
+	for _, maxLength := range []int{0, -1, calculator.MaxPathLength + 1} {
+		assert.Equal(t, calculator.MaxPathLength, pathLength(maxLength))
+	}
+}
+
+func TestValidateUUID(t *testing.T) {
+	tests := []struct {
+		uuid  string
+		valid bool
+	}{
+		{"uweCVhkyVy6MirBnUyNJ", true},
+		{"eopifrnv-dlfkvn-dklfv", true},
+		{"QjKBXMU_Vo2TtaLlkMbm", true},
+		{"", false},
+		{"a'}) DETACH DELETE n //", false},
+		{`back\slash`, false},
+		{"with space", false},
+		{strings.Repeat("a", 65), false},
+	}
+	for _, test := range tests {
+		t.Run(test.uuid, func(t *testing.T) {
+			err := ValidateUUID(test.uuid)
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestQueries_ParallelWires(t *testing.T) {
+	// wires are merged by their id, not by their endpoints, so parallel wires are kept apart
+	assert.Contains(t, mergeRelationsQuery, "MERGE (source)-[r:connected {"+schemaID+": row.eid}]->(target)")
+	assert.NotContains(t, mergeRelationsQuery, "SET r."+schemaID)
+}
+
+func TestQueries_LastVersionLocksDiagram(t *testing.T) {
+	// the lock is taken before the last version is read, so concurrent pushes do not get the same version
+	lock := strings.Index(lastVersionQuery, "SET l."+schemaLock+" = true")
+	read := strings.Index(lastVersionQuery, "MATCH (d:Diagram")
+	assert.True(t, lock >= 0 && read > lock, lastVersionQuery)
+	assert.Contains(t, lastVersionQuery, "MERGE (l:DiagramLock {"+schemaUUID+": $uuid})")
+
+	// concurrent MERGEs of a new lock node would create duplicates without the constraint
+	var constrained bool
+	for _, m := range Migrations {
+		for _, statement := range m.Statements {
+			constrained = constrained || strings.Contains(statement, "FOR (l:DiagramLock) REQUIRE l."+schemaUUID+" IS UNIQUE")
+		}
+	}
+	assert.True(t, constrained)
+}
@@ -0,0 +1,360 @@
+package netlist
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// SchemaVersion is the version of the netlist document format, documents of other versions are rejected
+const SchemaVersion = "1"
+
+const (
+	UnitOhm     = "ohm"
+	UnitFarad   = "F"
+	UnitHenry   = "H"
+	UnitVolt    = "V"
+	UnitAmpere  = "A"
+	UnitHertz   = "Hz"
+	UnitSecond  = "s"
+	UnitDegrees = "deg"
+
+	SourceVoltage = "voltage"
+	SourceCurrent = "current"
+	SignalDC      = "dc"
+	SignalAC      = "ac"
+
+	AnalysisOP   = "op"
+	AnalysisAC   = "ac"
+	AnalysisTran = "tran"
+
+	PinFirst  = "1"
+	PinSecond = "2"
+)
+
+// ClassUnit is the unit of the value for every supported component class
+var ClassUnit = map[string]string{
+	drawio.ItemClassResistors:  UnitOhm,
+	drawio.ItemClassCapacitors: UnitFarad,
+	drawio.ItemClassInductors:  UnitHenry,
+}
+
+// Netlist is the interchange document between frontend, calculator and storages
+type Netlist struct {
+	Version    string      `json:"version"`
+	UUID       string      `json:"uuid"`
+	Components []Component `json:"components"`
+	Nets       []Net       `json:"nets"`
+	Sources    []Source    `json:"sources,omitempty"`
+	Analyses   []Analysis  `json:"analyses,omitempty"`
+}
+
+// Component is an element of the circuit, ID is mxCell id of the element in diagram
+type Component struct {
+	ID       int      `json:"id"`
+	Class    string   `json:"class"`
+	SubClass string   `json:"subClass"`
+	Label    string   `json:"label,omitempty"`
+	Value    *Value   `json:"value,omitempty"`
+	Pins     []string `json:"pins"`
+}
+
+// Net is a set of component pins connected together. Wires are mxCell ids of lines forming the net.
+type Net struct {
+	Name  string   `json:"name"`
+	Pins  []PinRef `json:"pins"`
+	Wires []int    `json:"wires,omitempty"`
+}
+
+type PinRef struct {
+	Component int    `json:"component"`
+	Pin       string `json:"pin"`
+}
+
+type Value struct {
+	Magnitude float64 `json:"magnitude"`
+	Unit      string  `json:"unit"`
+}
+
+// Source defines signal of a source component
+type Source struct {
+	Component int    `json:"component"`
+	Kind      string `json:"kind"`
+	Signal    string `json:"signal"`
+	Amplitude Value  `json:"amplitude"`
+	Frequency *Value `json:"frequency,omitempty"`
+	Phase     *Value `json:"phase,omitempty"`
+}
+
+// Analysis is a directive for the calculator, Start/Stop/Step are used by ac and tran analyses
+type Analysis struct {
+	Type   string `json:"type"`
+	Start  *Value `json:"start,omitempty"`
+	Stop   *Value `json:"stop,omitempty"`
+	Step   *Value `json:"step,omitempty"`
+	Points int    `json:"points,omitempty"`
+}
+
+// Decode reads netlist document, fields unknown to the schema are rejected
+func Decode(r io.Reader) (*Netlist, error) {
+	n := &Netlist{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(n); err != nil {
+		return nil, fmt.Errorf("can not decode netlist: %w", err)
+	}
+	if err := n.Validate(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Validate checks document is consistent: known version, unique components, nets and sources
+// referencing existing pins
+func (n *Netlist) Validate() error {
+	if n.Version != SchemaVersion {
+		return fmt.Errorf("unsupported netlist version %q", n.Version)
+	}
+	if n.UUID == "" {
+		return fmt.Errorf("netlist uuid is empty")
+	}
+
+	pins := make(map[int]map[string]struct{})
+	for _, c := range n.Components {
+		if _, ok := pins[c.ID]; ok {
+			return fmt.Errorf("duplicate component id %d", c.ID)
+		}
+		if _, ok := drawio.ItemAvailableClass[c.Class]; !ok || c.Class == drawio.ItemClassLines {
+			return fmt.Errorf("component %d: class %q is not supported", c.ID, c.Class)
+		}
+		if c.Value != nil && c.Value.Unit != ClassUnit[c.Class] {
+			return fmt.Errorf("component %d: unit %q does not match class %s", c.ID, c.Value.Unit, c.Class)
+		}
+		pins[c.ID] = make(map[string]struct{})
+		for _, p := range c.Pins {
+			pins[c.ID][p] = struct{}{}
+		}
+	}
+
+	netNames := make(map[string]struct{})
+	connected := make(map[PinRef]string)
+	for _, net := range n.Nets {
+		if _, ok := netNames[net.Name]; ok || net.Name == "" {
+			return fmt.Errorf("net name %q is empty or duplicate", net.Name)
+		}
+		netNames[net.Name] = struct{}{}
+		for _, ref := range net.Pins {
+			if _, ok := pins[ref.Component][ref.Pin]; !ok {
+				return fmt.Errorf("net %s: component %d has no pin %q", net.Name, ref.Component, ref.Pin)
+			}
+			if other, ok := connected[ref]; ok {
+				return fmt.Errorf("pin %d:%s is in both %s and %s nets", ref.Component, ref.Pin, other, net.Name)
+			}
+			connected[ref] = net.Name
+		}
+	}
+
+	for _, s := range n.Sources {
+		if _, ok := pins[s.Component]; !ok {
+			return fmt.Errorf("source references unknown component %d", s.Component)
+		}
+		if s.Kind != SourceVoltage && s.Kind != SourceCurrent {
+			return fmt.Errorf("source %d: unknown kind %q", s.Component, s.Kind)
+		}
+		if s.Signal != SignalDC && s.Signal != SignalAC {
+			return fmt.Errorf("source %d: unknown signal %q", s.Component, s.Signal)
+		}
+	}
+
+	for _, a := range n.Analyses {
+		switch a.Type {
+		case AnalysisOP:
+		case AnalysisAC:
+			if a.Start == nil || a.Stop == nil || a.Points <= 0 {
+				return fmt.Errorf("ac analysis requires start, stop and points")
+			}
+		case AnalysisTran:
+			if a.Step == nil || a.Stop == nil {
+				return fmt.Errorf("tran analysis requires step and stop")
+			}
+		default:
+			return fmt.Errorf("unknown analysis %q", a.Type)
+		}
+	}
+	return nil
+}
+
+// FromItems builds netlist of diagram items, elements of unsupported classes are skipped.
+// Lines are merged into nets, every line end is attached to the component pin closest to the line exit/entry point.
+func FromItems(uuid string, items []drawio.Item) *Netlist {
+	n := &Netlist{Version: SchemaVersion, UUID: uuid, Components: []Component{}, Nets: []Net{}}
+	components := make(map[int]struct{})
+	for _, item := range items {
+		if _, ok := ClassUnit[item.Class]; !ok {
+			continue
+		}
+		c := Component{
+			ID:       item.EID,
+			Class:    item.Class,
+			SubClass: item.SubClass,
+			Label:    item.Value,
+			Pins:     []string{PinFirst, PinSecond},
+		}
+		if v, err := ParseValue(item.Value, ClassUnit[item.Class]); err == nil {
+			c.Value = &v
+		}
+		n.Components = append(n.Components, c)
+		components[item.EID] = struct{}{}
+	}
+	sort.Slice(n.Components, func(i, j int) bool { return n.Components[i].ID < n.Components[j].ID })
+
+	// union-find over pins, every line joins pins of its both ends
+	parent := make(map[PinRef]PinRef)
+	var find func(p PinRef) PinRef
+	find = func(p PinRef) PinRef {
+		if parent[p] != p {
+			parent[p] = find(parent[p])
+		}
+		return parent[p]
+	}
+	add := func(p PinRef) {
+		if _, ok := parent[p]; !ok {
+			parent[p] = p
+		}
+	}
+	wires := make(map[PinRef][]int)
+	for _, item := range items {
+		if item.Class != drawio.ItemClassLines {
+			continue
+		}
+		var ends []PinRef
+		if _, ok := components[item.SourceId]; ok {
+			ends = append(ends, PinRef{Component: item.SourceId, Pin: pinAt(item.ExitX)})
+		}
+		if _, ok := components[item.TargetId]; ok {
+			ends = append(ends, PinRef{Component: item.TargetId, Pin: pinAt(item.EntryX)})
+		}
+		if len(ends) == 0 {
+			continue
+		}
+		for _, e := range ends {
+			add(e)
+		}
+		if len(ends) == 2 {
+			parent[find(ends[0])] = find(ends[1])
+		}
+		wires[ends[0]] = append(wires[ends[0]], item.EID)
+	}
+
+	groups := make(map[PinRef][]PinRef)
+	for p := range parent {
+		root := find(p)
+		groups[root] = append(groups[root], p)
+	}
+	for _, pins := range groups {
+		sort.Slice(pins, func(i, j int) bool { return lessPin(pins[i], pins[j]) })
+		net := Net{Pins: pins}
+		for _, p := range pins {
+			net.Wires = append(net.Wires, wires[p]...)
+		}
+		sort.Ints(net.Wires)
+		n.Nets = append(n.Nets, net)
+	}
+	sort.Slice(n.Nets, func(i, j int) bool { return lessPin(n.Nets[i].Pins[0], n.Nets[j].Pins[0]) })
+	for i := range n.Nets {
+		n.Nets[i].Name = "N" + strconv.Itoa(i+1)
+	}
+	return n
+}
+
+// Storable returns an error when the netlist has sources or analyses, they have no diagram items
+// and ToItems would drop them
+func (n *Netlist) Storable() error {
+	if len(n.Sources) > 0 || len(n.Analyses) > 0 {
+		return fmt.Errorf("sources and analyses can not be stored with the diagram, %d sources and %d analyses given",
+			len(n.Sources), len(n.Analyses))
+	}
+	return nil
+}
+
+// ToItems converts netlist to diagram items, sources and analyses are not converted. Every net becomes a star of lines from its first pin,
+// line ids are taken from net wires and allocated above the largest used id when wires run out.
+func ToItems(n *Netlist) []drawio.Item {
+	var items []drawio.Item
+	nextID := 0
+	for _, c := range n.Components {
+		value := c.Label
+		if value == "" && c.Value != nil {
+			value = FormatValue(*c.Value)
+		}
+		items = append(items, drawio.Item{
+			UUID:     n.UUID,
+			EID:      c.ID,
+			Value:    value,
+			Class:    c.Class,
+			SubClass: c.SubClass,
+		})
+		if c.ID >= nextID {
+			nextID = c.ID + 1
+		}
+	}
+	for _, net := range n.Nets {
+		for _, w := range net.Wires {
+			if w >= nextID {
+				nextID = w + 1
+			}
+		}
+	}
+
+	for _, net := range n.Nets {
+		wires := net.Wires
+		for i := 1; i < len(net.Pins); i++ {
+			eid := nextID
+			if len(wires) > 0 {
+				eid, wires = wires[0], wires[1:]
+			} else {
+				nextID++
+			}
+			src, dst := net.Pins[0], net.Pins[i]
+			items = append(items, drawio.Item{
+				UUID:     n.UUID,
+				EID:      eid,
+				Class:    drawio.ItemClassLines,
+				SubClass: "line",
+				SourceId: src.Component,
+				TargetId: dst.Component,
+				ExitX:    pinX(src.Pin),
+				ExitY:    0.5,
+				EntryX:   pinX(dst.Pin),
+				EntryY:   0.5,
+			})
+		}
+	}
+	return items
+}
+
+// pinAt maps relative x coordinate of the line end to the pin of two-terminal component,
+// symbols are drawn horizontally with the first pin on the left
+func pinAt(x float32) string {
+	if x < 0.5 {
+		return PinFirst
+	}
+	return PinSecond
+}
+
+func pinX(pin string) float32 {
+	if pin == PinFirst {
+		return 0
+	}
+	return 1
+}
+
+func lessPin(a, b PinRef) bool {
+	if a.Component != b.Component {
+		return a.Component < b.Component
+	}
+	return a.Pin < b.Pin
+}
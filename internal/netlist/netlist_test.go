@@ -0,0 +1,198 @@
+package netlist
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// R3 right pin and C6 left pin are wired twice, L4 is connected to the C6 right pin, line 9 is dangling
+var items = []drawio.Item{
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 3, Class: drawio.ItemClassResistors, SubClass: "resistor_1", Value: "4k7"},
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 4, Class: drawio.ItemClassInductors, SubClass: "inductor_3", Value: "L1"},
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 6, Class: drawio.ItemClassCapacitors, SubClass: "capacitor_1", Value: "10 uF"},
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 7, Class: drawio.ItemClassLines, SubClass: "line",
+		SourceId: 3, TargetId: 6, ExitX: 0.993, ExitY: 0.505, EntryX: 0.004, EntryY: 0.507},
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 8, Class: drawio.ItemClassLines, SubClass: "line",
+		SourceId: 6, TargetId: 4, ExitX: 0.998, ExitY: 0.507, EntryX: 1.002, EntryY: 1.052},
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 9, Class: drawio.ItemClassLines, SubClass: "line",
+		SourceId: 4, ExitX: -0.002, ExitY: 1.028},
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 10, Class: drawio.ItemClassLines, SubClass: "line",
+		SourceId: 3, TargetId: 6, ExitX: 0.95, ExitY: 0.545, EntryX: 0.015, EntryY: 0.513},
+	{UUID: "uweCVhkyVy6MirBnUyNJ", EID: 11, Class: "signal_sources", SubClass: "source"},
+}
+
+func TestFromItems(t *testing.T) {
+	n := FromItems("uweCVhkyVy6MirBnUyNJ", items)
+	assert.NoError(t, n.Validate())
+
+	assert.Len(t, n.Components, 3)
+	assert.Equal(t, &Value{Magnitude: 4700, Unit: UnitOhm}, n.Components[0].Value)
+	assert.Nil(t, n.Components[1].Value)
+	assert.Equal(t, "L1", n.Components[1].Label)
+	assert.InDelta(t, 10e-6, n.Components[2].Value.Magnitude, 1e-12)
+
+	assert.Equal(t, []Net{
+		{Name: "N1", Pins: []PinRef{{3, PinSecond}, {6, PinFirst}}, Wires: []int{7, 10}},
+		{Name: "N2", Pins: []PinRef{{4, PinFirst}}, Wires: []int{9}},
+		{Name: "N3", Pins: []PinRef{{4, PinSecond}, {6, PinSecond}}, Wires: []int{8}},
+	}, n.Nets)
+}
+
+func TestToItems(t *testing.T) {
+	n := FromItems("uweCVhkyVy6MirBnUyNJ", items)
+	n.Nets = append(n.Nets, Net{Name: "N4", Pins: []PinRef{{3, PinFirst}, {4, PinFirst}, {6, PinFirst}}})
+	n.Nets[1].Pins = nil
+
+	out := ToItems(n)
+	var lines []drawio.Item
+	for _, item := range out {
+		if item.Class == drawio.ItemClassLines {
+			lines = append(lines, item)
+		}
+	}
+	// N1 keeps its first wire id, N4 gets new ids above the largest one
+	assert.Equal(t, []int{7, 8, 11, 12}, []int{lines[0].EID, lines[1].EID, lines[2].EID, lines[3].EID})
+	assert.Equal(t, float32(1), lines[0].ExitX)
+	assert.Equal(t, float32(0), lines[0].EntryX)
+
+	t.Run("roundtrip", func(t *testing.T) {
+		n := FromItems("uweCVhkyVy6MirBnUyNJ", items)
+		back := FromItems(n.UUID, ToItems(n))
+		assert.Equal(t, n.Components, back.Components)
+		// a single line is enough for two pins and dangling line has no pin to connect to
+		assert.Equal(t, []Net{
+			{Name: "N1", Pins: n.Nets[0].Pins, Wires: []int{7}},
+			{Name: "N2", Pins: n.Nets[2].Pins, Wires: []int{8}},
+		}, back.Nets)
+	})
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name          string
+		doc           string
+		expectedError string
+	}{
+		{
+			"valid",
+			`{"version": "1", "uuid": "d1",
+			  "components": [
+			    {"id": 1, "class": "resistors", "subClass": "resistor_1", "value": {"magnitude": 100, "unit": "ohm"}, "pins": ["1", "2"]},
+			    {"id": 2, "class": "capacitors", "subClass": "capacitor_1", "pins": ["1", "2"]}
+			  ],
+			  "nets": [{"name": "in", "pins": [{"component": 1, "pin": "2"}, {"component": 2, "pin": "1"}]}],
+			  "sources": [{"component": 1, "kind": "voltage", "signal": "ac",
+			    "amplitude": {"magnitude": 5, "unit": "V"}, "frequency": {"magnitude": 50, "unit": "Hz"}}],
+			  "analyses": [{"type": "op"}, {"type": "ac", "start": {"magnitude": 1, "unit": "Hz"}, "stop": {"magnitude": 1000, "unit": "Hz"}, "points": 10}]
+			}`,
+			"",
+		},
+		{"unknown field", `{"version": "1", "uuid": "d1", "components": [], "nets": [], "layout": {}}`, "unknown field"},
+		{"wrong version", `{"version": "2", "uuid": "d1", "components": [], "nets": []}`, "unsupported netlist version"},
+		{"no uuid", `{"version": "1", "components": [], "nets": []}`, "uuid is empty"},
+		{
+			"duplicate component",
+			`{"version": "1", "uuid": "d1", "nets": [], "components": [
+			    {"id": 1, "class": "resistors", "subClass": "resistor_1", "pins": []},
+			    {"id": 1, "class": "resistors", "subClass": "resistor_1", "pins": []}]}`,
+			"duplicate component id 1",
+		},
+		{
+			"unit does not match class",
+			`{"version": "1", "uuid": "d1", "nets": [], "components": [
+			    {"id": 1, "class": "resistors", "subClass": "resistor_1", "value": {"magnitude": 1, "unit": "F"}, "pins": []}]}`,
+			"does not match class",
+		},
+		{
+			"net references missing pin",
+			`{"version": "1", "uuid": "d1",
+			  "components": [{"id": 1, "class": "resistors", "subClass": "resistor_1", "pins": ["1", "2"]}],
+			  "nets": [{"name": "n", "pins": [{"component": 1, "pin": "3"}]}]}`,
+			`component 1 has no pin "3"`,
+		},
+		{
+			"pin in two nets",
+			`{"version": "1", "uuid": "d1",
+			  "components": [{"id": 1, "class": "resistors", "subClass": "resistor_1", "pins": ["1", "2"]}],
+			  "nets": [{"name": "a", "pins": [{"component": 1, "pin": "1"}]}, {"name": "b", "pins": [{"component": 1, "pin": "1"}]}]}`,
+			"is in both a and b nets",
+		},
+		{
+			"tran without step",
+			`{"version": "1", "uuid": "d1", "components": [], "nets": [], "analyses": [{"type": "tran"}]}`,
+			"tran analysis requires step and stop",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, err := Decode(strings.NewReader(test.doc))
+			if test.expectedError == "" {
+				assert.NoError(t, err)
+				assert.NotNil(t, n)
+			} else {
+				assert.ErrorContains(t, err, test.expectedError)
+			}
+		})
+	}
+
+	t.Run("exported netlist decodes back", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		assert.NoError(t, json.NewEncoder(buf).Encode(FromItems("uweCVhkyVy6MirBnUyNJ", items)))
+		_, err := Decode(buf)
+		assert.NoError(t, err)
+	})
+}
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		in            string
+		unit          string
+		expected      Value
+		expectedError bool
+	}{
+		{"100", UnitOhm, Value{100, UnitOhm}, false},
+		{"10k", UnitOhm, Value{10e3, UnitOhm}, false},
+		{"4k7", UnitOhm, Value{4.7e3, UnitOhm}, false},
+		{"2.2 Mohm", UnitOhm, Value{2.2e6, UnitOhm}, false},
+		{"1meg", UnitOhm, Value{1e6, UnitOhm}, false},
+		{"330Ω", UnitOhm, Value{330, UnitOhm}, false},
+		{"47R", UnitOhm, Value{47, UnitOhm}, false},
+		{"1µF", UnitFarad, Value{1e-6, UnitFarad}, false},
+		{"100nF", UnitFarad, Value{100e-9, UnitFarad}, false},
+		{"1e-3 H", UnitHenry, Value{1e-3, UnitHenry}, false},
+		{"5m", UnitHenry, Value{5e-3, UnitHenry}, false},
+		{"10 H", UnitFarad, Value{}, true},
+		{"2N3904", "", Value{}, true},
+		{"R1", UnitOhm, Value{}, true},
+		{"", UnitOhm, Value{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			v, err := ParseValue(test.in, test.unit)
+			if test.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected.Unit, v.Unit)
+			assert.InDelta(t, test.expected.Magnitude, v.Magnitude, test.expected.Magnitude*1e-9)
+		})
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	assert.Equal(t, "4.7kohm", FormatValue(Value{4700, UnitOhm}))
+	assert.Equal(t, "100nF", FormatValue(Value{100e-9, UnitFarad}))
+	assert.Equal(t, "1H", FormatValue(Value{1, UnitHenry}))
+	assert.Equal(t, "0V", FormatValue(Value{0, UnitVolt}))
+}
+
+func TestSchema(t *testing.T) {
+	var v map[string]interface{}
+	assert.NoError(t, json.Unmarshal(Schema, &v))
+	assert.Equal(t, SchemaVersion, v["properties"].(map[string]interface{})["version"].(map[string]interface{})["const"])
+}
@@ -0,0 +1,10 @@
+package netlist
+
+import (
+	_ "embed"
+)
+
+// Schema is JSON Schema of the netlist document of SchemaVersion
+//
+//go:embed schema/netlist.v1.json
+var Schema []byte
@@ -0,0 +1,125 @@
+package netlist
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var siPrefix = map[string]float64{
+	"f":   1e-15,
+	"p":   1e-12,
+	"n":   1e-9,
+	"u":   1e-6,
+	"µ":   1e-6,
+	"μ":   1e-6,
+	"m":   1e-3,
+	"k":   1e3,
+	"K":   1e3,
+	"M":   1e6,
+	"meg": 1e6,
+	"G":   1e9,
+	"T":   1e12,
+}
+
+// unitAlias are spellings of units found in diagram labels
+var unitAlias = map[string]string{
+	"ohm":  UnitOhm,
+	"Ohm":  UnitOhm,
+	"ohms": UnitOhm,
+	"Ω":    UnitOhm,
+	"R":    UnitOhm,
+	"F":    UnitFarad,
+	"H":    UnitHenry,
+	"V":    UnitVolt,
+	"A":    UnitAmpere,
+	"Hz":   UnitHertz,
+	"s":    UnitSecond,
+	"deg":  UnitDegrees,
+	"°":    UnitDegrees,
+}
+
+var formatPrefix = []struct {
+	prefix string
+	scale  float64
+}{
+	{"T", 1e12}, {"G", 1e9}, {"M", 1e6}, {"k", 1e3}, {"", 1}, {"m", 1e-3}, {"u", 1e-6}, {"n", 1e-9}, {"p", 1e-12}, {"f", 1e-15},
+}
+
+// ParseValue parses value with optional SI prefix and unit, i.e. "10k", "4.7 uF", "1µF", "100Ω" or "4k7".
+// Unit defaults to unit argument and should match it when written.
+func ParseValue(s string, unit string) (Value, error) {
+	in := strings.TrimSpace(s)
+	if in == "" {
+		return Value{}, fmt.Errorf("empty value")
+	}
+
+	// number part
+	i := 0
+	for i < len(in) && (in[i] >= '0' && in[i] <= '9' || in[i] == '.' || in[i] == '-' || in[i] == '+' ||
+		(in[i] == 'e' || in[i] == 'E') && i > 0 && i+1 < len(in) && (in[i+1] >= '0' && in[i+1] <= '9' || in[i+1] == '-')) {
+		i++
+	}
+	if i == 0 {
+		return Value{}, fmt.Errorf("value %q does not start with a number", s)
+	}
+	number := in[:i]
+	rest := strings.TrimSpace(in[i:])
+
+	// prefix, unless the rest is a unit on its own. "meg" goes first not to be taken for milli
+	scale := 1.0
+	if _, isUnit := unitAlias[rest]; !isUnit {
+		for _, p := range []string{"meg", "f", "p", "n", "u", "µ", "μ", "m", "k", "K", "M", "G", "T"} {
+			if !strings.HasPrefix(rest, p) {
+				continue
+			}
+			scale = siPrefix[p]
+			rest = rest[len(p):]
+			// RKM notation: 4k7 is 4.7k
+			digits := rest
+			if j := strings.IndexFunc(rest, func(r rune) bool { return !unicode.IsDigit(r) }); j >= 0 {
+				digits = rest[:j]
+			}
+			if digits != "" && !strings.Contains(number, ".") {
+				number = number + "." + digits
+				rest = rest[len(digits):]
+			}
+			break
+		}
+	}
+
+	magnitude, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return Value{}, fmt.Errorf("bad number in value %q: %w", s, err)
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest != "" {
+		u, ok := unitAlias[rest]
+		if !ok {
+			return Value{}, fmt.Errorf("unknown unit %q in value %q", rest, s)
+		}
+		if unit != "" && u != unit {
+			return Value{}, fmt.Errorf("unit %q does not match expected %q", u, unit)
+		}
+		unit = u
+	}
+
+	return Value{Magnitude: magnitude * scale, Unit: unit}, nil
+}
+
+// FormatValue writes value with SI prefix, i.e. 4700 ohm as "4.7kohm"
+func FormatValue(v Value) string {
+	abs := math.Abs(v.Magnitude)
+	if abs == 0 {
+		return "0" + v.Unit
+	}
+	for _, p := range formatPrefix {
+		if abs >= p.scale*0.9999999 {
+			return strconv.FormatFloat(v.Magnitude/p.scale, 'g', 6, 64) + p.prefix + v.Unit
+		}
+	}
+	return strconv.FormatFloat(v.Magnitude, 'g', 6, 64) + v.Unit
+}
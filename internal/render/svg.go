@@ -0,0 +1,303 @@
+package render
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	canvasMargin   = 20.0
+	strokeColor    = "#000000"
+	resultColor    = "#1a5fb4"
+	fontSize       = 12
+	resistorZigzag = 6
+	inductorLoops  = 4
+)
+
+// Results keeps computed values to be shown on top of the circuit.
+// NodeVoltages are keyed by mxCell id of a wire, BranchCurrents are keyed by mxCell id of a component.
+type Results struct {
+	NodeVoltages   map[int]float64 `json:"nodeVoltages"`
+	BranchCurrents map[int]float64 `json:"branchCurrents"`
+}
+
+type point struct {
+	x, y float64
+}
+
+type bbox struct {
+	minX, minY, maxX, maxY float64
+}
+
+func (b *bbox) add(p point) {
+	b.minX = math.Min(b.minX, p.x)
+	b.minY = math.Min(b.minY, p.y)
+	b.maxX = math.Max(b.maxX, p.x)
+	b.maxY = math.Max(b.maxY, p.y)
+}
+
+// SVG renders drawio document to a standalone svg image, res is optional
+func SVG(w io.Writer, doc *drawio.Mxfile, res *Results) error {
+	cells := doc.Diagram.MxGraphModel.Root.MxCells
+	vertices := make(map[int]*drawio.MxCell)
+	for i := range cells {
+		if _, ok := cells[i].Attr("shape"); ok {
+			vertices[cells[i].Id] = &cells[i]
+		}
+	}
+
+	box := bbox{minX: math.MaxFloat64, minY: math.MaxFloat64, maxX: -math.MaxFloat64, maxY: -math.MaxFloat64}
+	wires := make(map[int][]point)
+	for i := range cells {
+		cell := &cells[i]
+		if !cell.HasStyle() {
+			continue
+		}
+		if _, ok := cell.Attr("endArrow"); ok {
+			path := wirePath(cell, vertices)
+			if len(path) < 2 {
+				continue
+			}
+			for _, p := range path {
+				box.add(p)
+			}
+			wires[cell.Id] = path
+			continue
+		}
+		g := cell.Geometry
+		box.add(point{g.X, g.Y})
+		box.add(point{g.X + g.Width, g.Y + g.Height})
+	}
+	if box.minX > box.maxX {
+		box = bbox{}
+	}
+
+	bw := bufio.NewWriter(w)
+	width := box.maxX - box.minX + 2*canvasMargin
+	height := box.maxY - box.minY + 2*canvasMargin
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="%s %s %s %s">`+"\n",
+		num(width), num(height), num(box.minX-canvasMargin), num(box.minY-canvasMargin), num(width), num(height))
+	fmt.Fprintf(bw, `<rect x="%s" y="%s" width="%s" height="%s" fill="#ffffff"/>`+"\n",
+		num(box.minX-canvasMargin), num(box.minY-canvasMargin), num(width), num(height))
+	fmt.Fprintf(bw, `<g fill="none" stroke="%s" stroke-width="1.5" stroke-linecap="round">`+"\n", strokeColor)
+
+	for i := range cells {
+		cell := &cells[i]
+		if path, ok := wires[cell.Id]; ok {
+			writeWire(bw, cell, path)
+			continue
+		}
+		if _, ok := vertices[cell.Id]; ok {
+			writeComponent(bw, cell)
+		}
+	}
+	fmt.Fprint(bw, "</g>\n")
+
+	if res != nil {
+		writeResults(bw, res, wires, vertices)
+	}
+	fmt.Fprint(bw, "</svg>\n")
+
+	return bw.Flush()
+}
+
+// wirePath builds polyline of the edge: terminal on source, waypoints and terminal on target.
+// Loose ends of the line are taken from sourcePoint/targetPoint of the geometry.
+func wirePath(cell *drawio.MxCell, vertices map[int]*drawio.MxCell) []point {
+	var path []point
+	if p, ok := terminal(cell, vertices, cell.Source, "exitX", "exitY", "sourcePoint"); ok {
+		path = append(path, p)
+	}
+	for _, wp := range cell.Geometry.Waypoints {
+		path = append(path, point{wp.X, wp.Y})
+	}
+	if p, ok := terminal(cell, vertices, cell.Target, "entryX", "entryY", "targetPoint"); ok {
+		path = append(path, p)
+	}
+	return path
+}
+
+func terminal(cell *drawio.MxCell, vertices map[int]*drawio.MxCell, id int, ax, ay, as string) (point, bool) {
+	if v, ok := vertices[id]; ok {
+		g := v.Geometry
+		fx, fy := 0.5, 0.5
+		if x, ok := cell.Attr(ax); ok {
+			fx, _ = strconv.ParseFloat(x, 64)
+		}
+		if y, ok := cell.Attr(ay); ok {
+			fy, _ = strconv.ParseFloat(y, 64)
+		}
+		return point{g.X + fx*g.Width, g.Y + fy*g.Height}, true
+	}
+	if p, ok := cell.Geometry.Point(as); ok {
+		return point{p.X, p.Y}, true
+	}
+	return point{}, false
+}
+
+func writeWire(w io.Writer, cell *drawio.MxCell, path []point) {
+	pts := make([]string, 0, len(path))
+	for _, p := range path {
+		pts = append(pts, num(p.x)+","+num(p.y))
+	}
+	fmt.Fprintf(w, `<polyline id="cell-%d" points="%s"/>`+"\n", cell.Id, strings.Join(pts, " "))
+}
+
+// writeComponent draws symbol of the component horizontally inside its geometry
+// and rotates it according to rotation and direction style attributes.
+func writeComponent(w io.Writer, cell *drawio.MxCell) {
+	g := cell.Geometry
+	cx, cy := g.X+g.Width/2, g.Y+g.Height/2
+	fmt.Fprintf(w, `<g id="cell-%d"`, cell.Id)
+	if angle := rotation(cell); angle != 0 {
+		fmt.Fprintf(w, ` transform="rotate(%s %s %s)"`, num(angle), num(cx), num(cy))
+	}
+	fmt.Fprint(w, ">\n")
+
+	shape, _ := cell.Attr("shape")
+	switch shapeClass(shape) {
+	case drawio.ItemClassResistors:
+		writeResistor(w, g)
+	case drawio.ItemClassCapacitors:
+		writeCapacitor(w, g)
+	case drawio.ItemClassInductors:
+		writeInductor(w, g)
+	default:
+		fmt.Fprintf(w, `<rect x="%s" y="%s" width="%s" height="%s"/>`+"\n",
+			num(g.X), num(g.Y), num(g.Width), num(g.Height))
+	}
+	fmt.Fprint(w, "</g>\n")
+
+	if cell.Value != "" {
+		fmt.Fprintf(w, `<text x="%s" y="%s" font-size="%d" text-anchor="middle" fill="%s" stroke="none">%s</text>`+"\n",
+			num(cx), num(g.Y+g.Height+fontSize+2), fontSize, strokeColor, escape(cell.Value))
+	}
+}
+
+func writeResistor(w io.Writer, g drawio.MxGeometry) {
+	cy := g.Y + g.Height/2
+	x0, x1 := g.X+g.Width*0.25, g.X+g.Width*0.75
+	step := (x1 - x0) / resistorZigzag
+	pts := []string{num(g.X) + "," + num(cy), num(x0) + "," + num(cy)}
+	for i := 0; i < resistorZigzag; i++ {
+		dy := g.Height / 2
+		if i%2 == 1 {
+			dy = -dy
+		}
+		pts = append(pts, num(x0+step*(float64(i)+0.5))+","+num(cy-dy))
+	}
+	pts = append(pts, num(x1)+","+num(cy), num(g.X+g.Width)+","+num(cy))
+	fmt.Fprintf(w, `<polyline points="%s"/>`+"\n", strings.Join(pts, " "))
+}
+
+func writeCapacitor(w io.Writer, g drawio.MxGeometry) {
+	cy := g.Y + g.Height/2
+	x0, x1 := g.X+g.Width*0.45, g.X+g.Width*0.55
+	fmt.Fprintf(w, `<line x1="%s" y1="%s" x2="%s" y2="%s"/>`+"\n", num(g.X), num(cy), num(x0), num(cy))
+	fmt.Fprintf(w, `<line x1="%s" y1="%s" x2="%s" y2="%s"/>`+"\n", num(x0), num(g.Y), num(x0), num(g.Y+g.Height))
+	fmt.Fprintf(w, `<line x1="%s" y1="%s" x2="%s" y2="%s"/>`+"\n", num(x1), num(g.Y), num(x1), num(g.Y+g.Height))
+	fmt.Fprintf(w, `<line x1="%s" y1="%s" x2="%s" y2="%s"/>`+"\n", num(x1), num(cy), num(g.X+g.Width), num(cy))
+}
+
+func writeInductor(w io.Writer, g drawio.MxGeometry) {
+	cy := g.Y + g.Height/2
+	x0, x1 := g.X+g.Width*0.2, g.X+g.Width*0.8
+	r := (x1 - x0) / inductorLoops / 2
+	d := []string{"M" + num(g.X) + " " + num(cy), "L" + num(x0) + " " + num(cy)}
+	for i := 0; i < inductorLoops; i++ {
+		d = append(d, "A"+num(r)+" "+num(r)+" 0 0 1 "+num(x0+2*r*float64(i+1))+" "+num(cy))
+	}
+	d = append(d, "L"+num(g.X+g.Width)+" "+num(cy))
+	fmt.Fprintf(w, `<path d="%s"/>`+"\n", strings.Join(d, " "))
+}
+
+func writeResults(w io.Writer, res *Results, wires map[int][]point, vertices map[int]*drawio.MxCell) {
+	fmt.Fprintf(w, `<g font-size="%d" fill="%s">`+"\n", fontSize, resultColor)
+	for _, id := range sortedKeys(res.NodeVoltages) {
+		path, ok := wires[id]
+		if !ok {
+			continue
+		}
+		p := midpoint(path)
+		fmt.Fprintf(w, `<text x="%s" y="%s">%s V</text>`+"\n", num(p.x+3), num(p.y-3), num(res.NodeVoltages[id]))
+	}
+	for _, id := range sortedKeys(res.BranchCurrents) {
+		v, ok := vertices[id]
+		if !ok {
+			continue
+		}
+		g := v.Geometry
+		fmt.Fprintf(w, `<text x="%s" y="%s" text-anchor="middle">%s A</text>`+"\n",
+			num(g.X+g.Width/2), num(g.Y-4), num(res.BranchCurrents[id]))
+	}
+	fmt.Fprint(w, "</g>\n")
+}
+
+// midpoint returns the point in the middle of the polyline length
+func midpoint(path []point) point {
+	var total float64
+	for i := 1; i < len(path); i++ {
+		total += math.Hypot(path[i].x-path[i-1].x, path[i].y-path[i-1].y)
+	}
+	half := total / 2
+	for i := 1; i < len(path); i++ {
+		seg := math.Hypot(path[i].x-path[i-1].x, path[i].y-path[i-1].y)
+		if seg >= half && seg > 0 {
+			k := half / seg
+			return point{path[i-1].x + (path[i].x-path[i-1].x)*k, path[i-1].y + (path[i].y-path[i-1].y)*k}
+		}
+		half -= seg
+	}
+	return path[0]
+}
+
+func rotation(cell *drawio.MxCell) float64 {
+	var angle float64
+	if r, ok := cell.Attr("rotation"); ok {
+		angle, _ = strconv.ParseFloat(r, 64)
+	}
+	switch d, _ := cell.Attr("direction"); d {
+	case "south":
+		angle += 90
+	case "west":
+		angle += 180
+	case "north":
+		angle += 270
+	}
+	return math.Mod(angle, 360)
+}
+
+// shapeClass returns class part of the shape name, i.e. resistors for mxgraph.electrical.resistors.resistor_1
+func shapeClass(shape string) string {
+	parts := strings.Split(shape, ".")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+func sortedKeys(m map[int]float64) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func num(f float64) string {
+	return strconv.FormatFloat(f, 'g', 6, 64)
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package render
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/aemakeye/circuit_calculator/internal/drawio"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+var diagram = []byte(`
+		<mxfile host="65bd71144e">
+        <diagram id="uweCVhkyVy6MirBnUyNJ" name="Page-1">
+        <mxGraphModel dx="354" dy="159" grid="1" gridSize="10" guides="1" tooltips="1" connect="0" arrows="1" fold="1" page="1" pageScale="1" pageWidth="827" pageHeight="1169" math="0" shadow="0">
+            <root>
+                <mxCell id="0"/>
+                <mxCell id="1" parent="0"/>
+                <mxCell id="3" value="R1 &lt;10k&gt;" style="pointerEvents=1;verticalLabelPosition=bottom;shadow=0;dashed=0;align=center;html=1;verticalAlign=top;shape=mxgraph.electrical.resistors.resistor_1;" vertex="1" parent="1">
+                    <mxGeometry x="110" y="140" width="100" height="20" as="geometry"/>
+                </mxCell>
+                <mxCell id="4" value="" style="pointerEvents=1;verticalLabelPosition=bottom;shadow=0;dashed=0;align=center;html=1;verticalAlign=top;shape=mxgraph.electrical.inductors.inductor_3;direction=south;" vertex="1" parent="1">
+                    <mxGeometry x="260" y="120" width="100" height="10" as="geometry"/>
+                </mxCell>
+                <mxCell id="6" value="" style="pointerEvents=1;verticalLabelPosition=bottom;shadow=0;dashed=0;align=center;html=1;verticalAlign=top;shape=mxgraph.electrical.capacitors.capacitor_1;" vertex="1" parent="1">
+                    <mxGeometry x="280" y="170" width="100" height="60" as="geometry"/>
+                </mxCell>
+                <mxCell id="8" value="" style="endArrow=none;html=1;entryX=1;entryY=0.5;entryDx=0;entryDy=0;entryPerimeter=0;exitX=1;exitY=0.5;exitDx=0;exitDy=0;exitPerimeter=0;edgeStyle=elbowEdgeStyle;" edge="1" parent="1" source="6" target="4">
+                    <mxGeometry width="50" height="50" relative="1" as="geometry">
+                        <mxPoint x="240" y="180" as="sourcePoint"/>
+                        <mxPoint x="290" y="130" as="targetPoint"/>
+                        <Array as="points">
+                            <mxPoint x="420" y="150"/>
+                            <mxPoint x="390" y="170"/>
+                        </Array>
+                    </mxGeometry>
+                </mxCell>
+                <mxCell id="9" value="" style="endArrow=none;html=1;exitX=0;exitY=0.5;exitDx=0;exitDy=0;exitPerimeter=0;" edge="1" parent="1" source="3">
+                    <mxGeometry width="50" height="50" relative="1" as="geometry">
+                        <mxPoint x="210" y="125" as="sourcePoint"/>
+                        <mxPoint x="60" y="150" as="targetPoint"/>
+                    </mxGeometry>
+                </mxCell>
+            </root>
+        </mxGraphModel>
+    </diagram>
+</mxfile>
+`)
+
+func TestSVG(t *testing.T) {
+	doc, err := drawio.ReadMxfile(bytes.NewReader(diagram))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		results  *Results
+		expected []string
+		missing  []string
+	}{
+		{
+			"components and wires",
+			nil,
+			[]string{
+				`<g id="cell-3">`,
+				`<g id="cell-4" transform="rotate(90 310 125)">`,
+				`<g id="cell-6">`,
+				// capacitor right pin, both waypoints and inductor right pin
+				`<polyline id="cell-8" points="380,200 420,150 390,170 360,125"/>`,
+				// resistor left pin and loose end of the line
+				`<polyline id="cell-9" points="110,150 60,150"/>`,
+				`R1 &lt;10k&gt;`,
+			},
+			[]string{" V</text>", " A</text>"},
+		},
+		{
+			"results overlay",
+			&Results{
+				NodeVoltages:   map[int]float64{9: 5, 100: 1},
+				BranchCurrents: map[int]float64{3: 0.0005},
+			},
+			[]string{
+				`<text x="88" y="147">5 V</text>`,
+				`<text x="160" y="136" text-anchor="middle">0.0005 A</text>`,
+			},
+			[]string{"1 V</text>"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			err := SVG(buf, doc, test.results)
+			assert.NoError(t, err)
+
+			out := buf.String()
+			for _, e := range test.expected {
+				assert.Contains(t, out, e)
+			}
+			for _, m := range test.missing {
+				assert.NotContains(t, out, m)
+			}
+
+			// output should be well-formed standalone document
+			var v struct{}
+			assert.NoError(t, xml.Unmarshal(buf.Bytes(), &v))
+			assert.True(t, strings.HasPrefix(out, `<svg xmlns="http://www.w3.org/2000/svg"`))
+		})
+	}
+
+	t.Run("empty diagram", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		err := SVG(buf, &drawio.Mxfile{}, nil)
+		assert.NoError(t, err)
+		assert.Contains(t, buf.String(), `viewBox="-20 -20 40 40"`)
+	})
+}
@@ -1,15 +0,0 @@
-package storage
-
-type Item struct {
-	UUID     string
-	ID       int
-	Value    string
-	Class    string
-	SubClass string
-	SourceId int
-	TargetId int
-	ExitX    float32
-	ExitY    float32
-	EntryX   float32
-	EntryY   float32
-}